@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"gopherpost/internal/auth"
+	"gopherpost/internal/config"
+	"gopherpost/internal/dkim"
+)
+
+// arcSealing reports whether any listener or route asks for ARC sealing.
+func arcSealing(listeners []config.Listener, routing config.Routing) bool {
+	for _, l := range listeners {
+		if l.ARCSeal {
+			return true
+		}
+	}
+	for _, route := range routing.Routes {
+		if route.ARCSeal {
+			return true
+		}
+	}
+	return false
+}
+
+// sealsFor reports whether mail to rcpt accepted on listener l is ARC sealed.
+// Only mail that leaves the server is sealed, when the listener or the route of
+// the recipient asks for it.
+func (s *server) sealsFor(l *config.Listener, rcpt string) bool {
+	if s.signer == nil || s.isLocal(rcpt) {
+		return false
+	}
+	return l.ARCSeal || (s.routes != nil && s.routes.ARCSeal(rcpt))
+}
+
+// arcSeal adds an ARC set to message. results are the Authentication-Results of
+// inbound mail; relayed mail records how the client authenticated instead.
+func (s *server) arcSeal(message []byte, identity *auth.Identity, results []string) ([]byte, error) {
+	if len(results) == 0 {
+		results = []string{"none"}
+		if identity != nil {
+			results = []string{"auth=pass smtp.auth=" + identity.Username}
+		}
+	}
+	var resolver dkim.Resolver = net.DefaultResolver
+	if s.resolver != nil {
+		resolver = s.resolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+	return s.signer.Seal(ctx, resolver, message, s.hostname, strings.Join(results, ";\r\n\t"))
+}
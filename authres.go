@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"gopherpost/internal/auth"
+	"gopherpost/internal/dkim"
+	"gopherpost/internal/dmarc"
+	"gopherpost/internal/spf"
+)
+
+// authTimeout bounds the DNS lookups of verifying one message.
+const authTimeout = 10 * time.Second
+
+// isInbound reports whether mail from the session is inbound, and so has its
+// sender authenticated: the client may not relay.
+func (s *server) isInbound(identity *auth.Identity, ip net.IP) bool {
+	return ip != nil && !s.mayRelay(identity, ip)
+}
+
+// addAuthenticationResults verifies an inbound message and prepends the header
+// fields that record the outcome: Received-SPF when SPF was checked, and one
+// Authentication-Results field listing every method that ran. Results already
+// in the message that claim to come from this host are removed. The results are
+// also returned for ARC sealing.
+func (s *server) addAuthenticationResults(message []byte, verdict *spf.Verdict) ([]byte, []string) {
+	var results []string
+	var head bytes.Buffer
+	if verdict != nil {
+		head.WriteString(s.spf.ReceivedSPF(*verdict))
+		results = append(results, verdict.AuthResult())
+	}
+	if s.resolver != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+		defer cancel()
+		results = append(results, s.verifyMessage(ctx, message, verdict)...)
+	}
+	if len(results) == 0 {
+		return message, nil
+	}
+	fmt.Fprintf(&head, "Authentication-Results: %s;\r\n\t%s\r\n", s.hostname, strings.Join(results, ";\r\n\t"))
+	return append(head.Bytes(), withoutForgedResults(message, s.hostname)...), results
+}
+
+// verifyMessage returns the dkim, arc and dmarc results for message.
+func (s *server) verifyMessage(ctx context.Context, message []byte, verdict *spf.Verdict) []string {
+	var results []string
+	var passed []string
+	signatures, err := dkim.Verify(ctx, s.resolver, message)
+	switch {
+	case err != nil:
+		results = append(results, "dkim=permerror "+comment(err.Error()))
+	case len(signatures) == 0:
+		results = append(results, "dkim=none")
+	}
+	for _, r := range signatures {
+		result := fmt.Sprintf("dkim=%s", r.Status)
+		if r.Reason != "" {
+			result += " " + comment(r.Reason)
+		}
+		if r.Domain != "" {
+			result += fmt.Sprintf(" header.d=%s header.s=%s header.b=%s", r.Domain, r.Selector, r.HeaderB)
+		}
+		results = append(results, result)
+		if r.Status == dkim.StatusPass {
+			passed = append(passed, r.Domain)
+		}
+	}
+
+	switch arc := dkim.VerifyARC(ctx, s.resolver, message); arc.Status {
+	case dkim.StatusPass:
+		results = append(results, fmt.Sprintf("arc=pass (i=%d) header.d=%s", arc.Instance, arc.Domain))
+	case dkim.StatusFail:
+		results = append(results, "arc=fail "+comment(arc.Reason))
+	default:
+		results = append(results, "arc=none")
+	}
+
+	if !s.dmarc {
+		return results
+	}
+	from, err := dmarc.FromDomain(message)
+	if err != nil {
+		return append(results, "dmarc=permerror "+comment(err.Error()))
+	}
+	id := dmarc.Identifiers{From: from, DKIM: passed}
+	if verdict != nil && verdict.Result == spf.Pass {
+		id.SPF = verdict.Domain
+	}
+	r := dmarc.Evaluate(ctx, s.resolver, id)
+	switch {
+	case r.Policy != "":
+		results = append(results, fmt.Sprintf("dmarc=%s (p=%s dis=none) header.from=%s", r.Status, r.Policy, from))
+	case r.Reason != "":
+		results = append(results, fmt.Sprintf("dmarc=%s %s header.from=%s", r.Status, comment(r.Reason), from))
+	default:
+		results = append(results, fmt.Sprintf("dmarc=%s header.from=%s", r.Status, from))
+	}
+	return results
+}
+
+// comment formats reason as a header comment.
+func comment(reason string) string {
+	return "(" + strings.NewReplacer("(", "", ")", "", "\r", "", "\n", " ").Replace(reason) + ")"
+}
+
+// withoutForgedResults drops the Authentication-Results fields in the header of
+// message whose authserv-id is authservID. Only a sender trying to fake our
+// verdict would add them (RFC 8601 section 5).
+func withoutForgedResults(message []byte, authservID string) []byte {
+	var out []byte
+	dropping := false
+	rest := message
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return append(out, rest...)
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			dropping = false
+			if name, value, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(string(bytes.TrimSpace(name)), "Authentication-Results") {
+				id, _, _ := bytes.Cut(value, []byte(";"))
+				dropping = strings.EqualFold(string(bytes.TrimSpace(id)), authservID)
+			}
+		}
+		if !dropping {
+			out = append(out, line...)
+		}
+		rest = rest[end:]
+	}
+	return out
+}
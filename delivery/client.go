@@ -2,78 +2,268 @@ package delivery
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/smtp"
+	"net/textproto"
 	"time"
 
-    "gopherpost/internal/config"
+	audit "gopherpost/internal/audit"
+	"gopherpost/internal/config"
 )
 
 var smtpPort = "25"
 
-// Deliver attempts SMTP delivery to a given host with raw message data.
-func Deliver(host string, from string, to string, data []byte) error {
-	addr := net.JoinHostPort(host, smtpPort)
+const transactionTimeout = 2 * time.Minute
+
+// Transaction is one message for one or more recipients, sent with a single
+// MAIL FROM and one RCPT TO per recipient.
+type Transaction struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// Result holds the outcome for each recipient of a Transaction, indexed like
+// Transaction.To. A nil entry means the recipient was accepted.
+type Result []error
+
+// Client is an open SMTP connection to one MX host. It can carry several
+// transactions in a row until Close is called.
+type Client struct {
+	host string
+	conn net.Conn
+	smtp *smtp.Client
+}
+
+// Dial connects to host, greets it and upgrades to TLS as sec requires: when TLS is
+// required and the server does not offer STARTTLS, or the handshake fails, the
+// connection is abandoned rather than used in the clear. Failures are returned as
+// *Error identifying the stage and any SMTP reply.
+func Dial(host string, sec Security) (*Client, error) {
+	conn, err := dialTCP(host, net.JoinHostPort(host, smtpPort))
+	if err != nil {
+		return nil, err
+	}
+	return handshake(host, conn, sec)
+}
+
+// DialRelay connects to a smarthost, secures the session as its TLS mode requires
+// and authenticates when credentials are configured. The relay's certificate is
+// always verified.
+func DialRelay(r *config.Relay) (*Client, error) {
+	conn, err := dialTCP(r.Host, r.Addr())
+	if err != nil {
+		return nil, err
+	}
+	sec := Security{Source: "relay"}
+	switch r.TLSMode {
+	case config.TLSModeImplicit:
+		tlsConn := tls.Client(conn, sec.tlsConfig(r.Host))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, newError(StageStartTLS, r.Host, err)
+		}
+		conn = tlsConn
+		sec.Disabled = true
+	case config.TLSModeNone:
+		sec.Disabled = true
+	default:
+		sec.Required = true
+	}
+	c, err := handshake(r.Host, conn, sec)
+	if err != nil {
+		return nil, err
+	}
+	if r.Username != "" {
+		if err := c.smtp.Auth(smtp.PlainAuth("", r.Username, r.Password, r.Host)); err != nil {
+			c.abort()
+			return nil, newError(StageAuth, r.Host, err)
+		}
+	}
+	return c, nil
+}
+
+func dialTCP(host, addr string) (net.Conn, error) {
 	dialer := &net.Dialer{Timeout: 30 * time.Second}
 	conn, err := dialer.Dial("tcp", addr)
 	if err != nil {
-		return fmt.Errorf("dial: %w", err)
+		return nil, newError(StageDial, host, err)
 	}
-	defer conn.Close()
-
-	if err := conn.SetDeadline(time.Now().Add(2 * time.Minute)); err != nil {
-		return fmt.Errorf("set deadline: %w", err)
+	if err := conn.SetDeadline(time.Now().Add(transactionTimeout)); err != nil {
+		conn.Close()
+		return nil, newError(StageDial, host, fmt.Errorf("set deadline: %w", err))
 	}
+	return conn, nil
+}
 
+// handshake reads the greeting on conn, sends EHLO and applies sec.
+func handshake(host string, conn net.Conn, sec Security) (*Client, error) {
 	client, err := smtp.NewClient(conn, host)
 	if err != nil {
-		return fmt.Errorf("new client: %w", err)
+		conn.Close()
+		return nil, newError(StageHelo, host, fmt.Errorf("greeting: %w", err))
 	}
-	defer client.Close()
+	c := &Client{host: host, conn: conn, smtp: client}
 
 	heloName := config.Hostname()
 	if err := client.Hello(heloName); err != nil {
-		return fmt.Errorf("helo: %w", err)
+		c.abort()
+		return nil, newError(StageHelo, host, err)
 	}
 
-	if ok, _ := client.Extension("STARTTLS"); ok {
-		tlsConf := &tls.Config{
-			ServerName:               host,
-			MinVersion:               tls.VersionTLS12,
-			PreferServerCipherSuites: true,
+	ok, _ := client.Extension("STARTTLS")
+	if !ok && sec.Required {
+		err := fmt.Errorf("%w: %s policy requires STARTTLS but the server does not offer it", ErrTLSPolicy, sec.Source)
+		if !sec.Testing {
+			c.abort()
+			audit.Log("delivery %s", err)
+			return nil, newError(StageStartTLS, host, err)
 		}
-		if err := client.StartTLS(tlsConf); err != nil {
-			return fmt.Errorf("starttls: %w", err)
+		audit.Log("delivery %s testing: %s: %v", sec.Source, host, err)
+	}
+	if ok && !sec.Disabled {
+		if err := client.StartTLS(sec.tlsConfig(host)); err != nil {
+			c.abort()
+			if sec.Required {
+				err = fmt.Errorf("%w: %s policy: %w", ErrTLSPolicy, sec.Source, err)
+				audit.Log("delivery %s: %v", host, err)
+			}
+			return nil, newError(StageStartTLS, host, err)
 		}
 		if err := client.Text.PrintfLine("EHLO %s", heloName); err != nil {
-			return fmt.Errorf("post-starttls ehlo write: %w", err)
+			c.abort()
+			return nil, newError(StageHelo, host, fmt.Errorf("post-starttls ehlo write: %w", err))
 		}
 		if _, _, err := client.Text.ReadResponse(250); err != nil {
-			return fmt.Errorf("post-starttls ehlo: %w", err)
+			c.abort()
+			return nil, newError(StageHelo, host, err)
 		}
 	}
+	return c, nil
+}
 
-	if err := client.Mail(from); err != nil {
-		return fmt.Errorf("mail from: %w", err)
+// Send runs one mail transaction. Rejections of the sender or individual
+// recipients are reported in the Result and leave the connection usable. A non-nil
+// error means the connection broke and must be closed; the Result is then nil
+// when the outcome for the recipients is unknown.
+func (c *Client) Send(tx Transaction) (Result, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(transactionTimeout)); err != nil {
+		return nil, newError(StageMail, c.host, fmt.Errorf("set deadline: %w", err))
 	}
-	if err := client.Rcpt(to); err != nil {
-		return fmt.Errorf("rcpt to: %w", err)
+	res := make(Result, len(tx.To))
+
+	if err := c.smtp.Mail(tx.From); err != nil {
+		if !isReply(err) {
+			return nil, newError(StageMail, c.host, err)
+		}
+		failed := newError(StageMail, c.host, err)
+		for i := range res {
+			res[i] = failed
+		}
+		return res, c.reset()
 	}
-	w, err := client.Data()
+
+	accepted := 0
+	for i, rcpt := range tx.To {
+		if err := c.smtp.Rcpt(rcpt); err != nil {
+			if !isReply(err) {
+				return nil, newError(StageRcpt, c.host, err)
+			}
+			res[i] = newError(StageRcpt, c.host, err)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return res, c.reset()
+	}
+
+	w, err := c.smtp.Data()
 	if err != nil {
-		return fmt.Errorf("data start: %w", err)
+		if !isReply(err) {
+			return nil, newError(StageData, c.host, err)
+		}
+		return failAccepted(res, newError(StageData, c.host, err)), c.reset()
 	}
-	if _, err := w.Write(data); err != nil {
-		return fmt.Errorf("data write: %w", err)
+	if _, err := w.Write(tx.Data); err != nil {
+		return nil, newError(StageData, c.host, err)
 	}
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("data close: %w", err)
+		if !isReply(err) {
+			return nil, newError(StageData, c.host, err)
+		}
+		return failAccepted(res, newError(StageData, c.host, err)), nil
 	}
+	return res, nil
+}
 
-	if err := client.Quit(); err != nil {
-		return fmt.Errorf("quit: %w", err)
+// Close ends the session with QUIT and closes the connection.
+func (c *Client) Close() error {
+	_ = c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := c.smtp.Quit(); err != nil {
+		c.abort()
+		return err
 	}
+	return nil
+}
 
+func (c *Client) abort() {
+	_ = c.smtp.Close()
+}
+
+// reset clears a transaction the server rejected so the next one can start.
+func (c *Client) reset() error {
+	if err := c.smtp.Reset(); err != nil {
+		return newError(StageMail, c.host, fmt.Errorf("rset: %w", err))
+	}
 	return nil
 }
+
+// failAccepted records err for every recipient the server had accepted.
+func failAccepted(res Result, err error) Result {
+	for i := range res {
+		if res[i] == nil {
+			res[i] = err
+		}
+	}
+	return res
+}
+
+// isReply reports whether err is an SMTP reply from the server, as opposed to a
+// connection or protocol failure.
+func isReply(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply)
+}
+
+// Deliver attempts SMTP delivery of one message to a single recipient via host,
+// applying the policy table entry for the recipient's domain, if any. Failures are
+// returned as *Error identifying the stage and any SMTP reply.
+func Deliver(host string, from string, to string, data []byte) error {
+	domain, err := ExtractDomain(to)
+	if err != nil {
+		return err
+	}
+	sec, _, err := localSecurity(domain)
+	if err != nil {
+		return newError(StagePolicy, host, err)
+	}
+	client, err := Dial(host, sec)
+	if err != nil {
+		return err
+	}
+	res, err := client.Send(Transaction{From: from, To: []string{to}, Data: data})
+	if err != nil {
+		client.abort()
+		if res != nil {
+			return res[0]
+		}
+		return err
+	}
+	// The message was accepted once DATA completed; a failed QUIT must not cause
+	// a retry and therefore a duplicate.
+	_ = client.Close()
+	return res[0]
+}
@@ -2,6 +2,7 @@ package delivery
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -9,11 +10,11 @@ import (
 	"testing"
 	"time"
 
-    "gopherpost/internal/config"
+	"gopherpost/internal/config"
 )
 
 func TestDeliverSuccess(t *testing.T) {
-    t.Setenv("SMTP_HOSTNAME", "gopherpost.test")
+	t.Setenv("SMTP_HOSTNAME", "gopherpost.test")
 	expectedHello := config.Hostname()
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -99,8 +100,133 @@ func TestDeliverDialError(t *testing.T) {
 	defer func() { smtpPort = oldPort }()
 
 	err := Deliver("127.0.0.1", "sender@example.com", "rcpt@example.com", []byte("Body"))
-	if err == nil {
-		t.Fatalf("expected dial error")
+	var derr *Error
+	if !errors.As(err, &derr) || derr.Stage != StageDial || derr.Permanent() {
+		t.Fatalf("expected transient dial error, got %v", err)
+	}
+}
+
+func TestDeliverRecipientRejected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+
+	oldPort := smtpPort
+	smtpPort = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	defer func() { smtpPort = oldPort }()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		replies := []string{"220 test ESMTP", "250 OK", "250 OK", "550 5.1.1 No such user", "221 Bye"}
+		fmt.Fprintf(conn, "%s\r\n", replies[0])
+		for _, reply := range replies[1:] {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "%s\r\n", reply)
+		}
+	}()
+
+	err = Deliver("127.0.0.1", "sender@example.com", "rcpt@example.com", []byte("Body"))
+	var derr *Error
+	if !errors.As(err, &derr) {
+		t.Fatalf("expected *Error, got %T: %v", err, err)
+	}
+	if derr.Stage != StageRcpt || derr.Code != 550 || derr.EnhancedCode != "5.1.1" || derr.Host != "127.0.0.1" {
+		t.Fatalf("unexpected error %+v", derr)
+	}
+	if !derr.Permanent() {
+		t.Fatalf("expected 550 to be permanent")
+	}
+}
+
+func TestClientReusesConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+
+	oldPort := smtpPort
+	smtpPort = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	defer func() { smtpPort = oldPort }()
+
+	commands := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		var seen []string
+		fmt.Fprint(conn, "220 test ESMTP\r\n")
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				commands <- seen
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			seen = append(seen, line)
+			switch {
+			case line == "RCPT TO:<missing@example.com>":
+				fmt.Fprint(conn, "550 5.1.1 No such user\r\n")
+			case line == "DATA":
+				fmt.Fprint(conn, "354 Go ahead\r\n")
+				for {
+					body, err := br.ReadString('\n')
+					if err != nil || body == ".\r\n" {
+						break
+					}
+				}
+				fmt.Fprint(conn, "250 OK\r\n")
+			case line == "QUIT":
+				fmt.Fprint(conn, "221 Bye\r\n")
+				commands <- seen
+				return
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+
+	client, err := Dial("127.0.0.1", Security{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	res, err := client.Send(Transaction{From: "a@example.org", To: []string{"one@example.com", "missing@example.com"}, Data: []byte("first")})
+	if err != nil {
+		t.Fatalf("first Send: %v", err)
+	}
+	if res[0] != nil || !IsPermanent(res[1]) {
+		t.Fatalf("expected partial rejection, got %v", res)
+	}
+	res, err = client.Send(Transaction{From: "b@example.org", To: []string{"two@example.com"}, Data: []byte("second")})
+	if err != nil || res[0] != nil {
+		t.Fatalf("second Send: %v %v", res, err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	var mails int
+	for _, cmd := range <-commands {
+		if strings.HasPrefix(cmd, "MAIL FROM:") {
+			mails++
+		}
+	}
+	if mails != 2 {
+		t.Fatalf("expected two transactions on one connection, got %d", mails)
 	}
 }
 
@@ -118,3 +244,75 @@ func expectCommand(t *testing.T, br *bufio.Reader, allowed ...string) {
 	}
 	t.Fatalf("unexpected command %q", line)
 }
+
+func TestDialRelayAuthRequiresTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 relay ESMTP\r\n")
+		expectCommand(t, br, "EHLO "+config.Hostname())
+		fmt.Fprint(conn, "250-relay\r\n250 AUTH PLAIN\r\n")
+		// The client must hang up rather than send credentials in the clear.
+		if line, err := br.ReadString('\n'); err == nil {
+			t.Errorf("unexpected command %q", line)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	relay := &config.Relay{Host: host, Port: port, TLSMode: config.TLSModeStartTLS, Username: "mailer", Password: "secret"}
+	_, err = DialRelay(relay)
+	var derr *Error
+	if !errors.As(err, &derr) || derr.Stage != StageStartTLS || !errors.Is(err, ErrTLSPolicy) {
+		t.Fatalf("expected the relay to be refused without STARTTLS, got %v", err)
+	}
+	<-done
+}
+
+func TestDialRelayPlaintext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 relay ESMTP\r\n")
+		expectCommand(t, br, "EHLO "+config.Hostname())
+		fmt.Fprint(conn, "250-relay\r\n250 STARTTLS\r\n")
+		// TLS mode none never upgrades, even when offered.
+		expectCommand(t, br, "QUIT")
+		fmt.Fprint(conn, "221 Bye\r\n")
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	client, err := DialRelay(&config.Relay{Host: host, Port: port, TLSMode: config.TLSModeNone})
+	if err != nil {
+		t.Fatalf("DialRelay: %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	<-done
+}
@@ -3,35 +3,176 @@ package delivery
 import (
 	"fmt"
 
-    audit "gopherpost/internal/audit"
+	audit "gopherpost/internal/audit"
+	"gopherpost/internal/config"
+	"gopherpost/internal/tlspolicy"
 )
 
-var deliverFunc = Deliver
+// sender is the part of *Client used by DeliverTransactions.
+type sender interface {
+	Send(tx Transaction) (Result, error)
+	Close() error
+}
+
+var dialFunc = func(host string, sec Security) (sender, error) {
+	c, err := Dial(host, sec)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var relayDialFunc = func(r *config.Relay) (sender, error) {
+	c, err := DialRelay(r)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
 // DeliverMessage resolves the domain and attempts SMTP delivery to one of the MX hosts.
+// It is DeliverTransactions for a single message and recipient.
 func DeliverMessage(from, to string, data []byte) error {
 	domain, err := ExtractDomain(to)
 	if err != nil {
 		return err
 	}
+	results := DeliverTransactions(domain, []Transaction{{From: from, To: []string{to}, Data: data}})
+	return results[0][0]
+}
+
+// DeliverTransactions delivers txs, whose recipients all belong to domain, reusing
+// one connection per MX host for as many transactions as it will carry. Hosts are
+// tried in preference order: a host that cannot be reached, or whose connection
+// breaks mid-transaction, hands the remaining transactions to the next host, while
+// SMTP replies to MAIL, RCPT, and DATA are final for the recipients they concern.
+// A permanent (5xx) failure to set up a session stops at once. Hosts that the
+// domain's TLS policy (DANE or MTA-STS) rules out, or that cannot meet it, are
+// skipped, so such messages are deferred rather than sent in the clear. A
+// policy table entry for domain replaces DANE and MTA-STS. The
+// result for each transaction holds one entry per recipient, nil when it was
+// accepted.
+func DeliverTransactions(domain string, txs []Transaction) []Result {
+	results := make([]Result, len(txs))
 	mxRecords, err := ResolveMX(domain)
-	if err != nil {
+	switch {
+	case err != nil:
 		audit.Log("delivery mx lookup failed for %s: %v", domain, err)
-		return fmt.Errorf("MX lookup failed for %s: %w", domain, err)
-	}
-	if len(mxRecords) == 0 {
+		return fillPending(results, txs, fmt.Errorf("MX lookup failed for %s: %w", domain, err))
+	case len(mxRecords) == 0:
 		audit.Log("delivery no MX records for %s", domain)
-		return fmt.Errorf("MX lookup failed for %s: no MX records", domain)
+		return fillPending(results, txs, fmt.Errorf("MX lookup failed for %s: no MX records", domain))
+	}
+
+	local, overridden, err := localSecurity(domain)
+	if err != nil {
+		audit.Log("delivery tls policy for %s unavailable: %v", domain, err)
+		return fillPending(results, txs, newError(StagePolicy, domain, err))
+	}
+	var sts *tlspolicy.STSPolicy
+	if !overridden {
+		sts = domainPolicy(domain)
 	}
 	var lastErr error
 	for _, mx := range mxRecords {
-		err = deliverFunc(mx.Host, from, to, data)
-		if err == nil {
-			audit.Log("delivery succeeded to %s via %s", to, mx.Host)
-			return nil
+		if pending(results) == 0 {
+			break
+		}
+		sec := local
+		if !overridden {
+			if sec, err = securityFor(mx.Host, sts); err != nil {
+				audit.Log("delivery to %s skips %s: %v", domain, mx.Host, err)
+				lastErr = err
+				continue
+			}
+		}
+		client, err := dialFunc(mx.Host, sec)
+		if err != nil {
+			audit.Log("delivery connection to %s via %s failed: %v", domain, mx.Host, err)
+			lastErr = err
+			if IsPermanent(err) {
+				break
+			}
+			continue
+		}
+		if err := sendAll(client, mx.Host, domain, txs, results); err != nil {
+			lastErr = err
+		}
+		_ = client.Close()
+	}
+	return fillPending(results, txs, fmt.Errorf("delivery failed: %w", lastErr))
+}
+
+// DeliverRelay hands txs, whose recipients all belong to domain, to a smarthost
+// over one connection. There is no fallback: when the relay cannot be reached the
+// transactions are deferred.
+func DeliverRelay(relay *config.Relay, domain string, txs []Transaction) []Result {
+	results := make([]Result, len(txs))
+	client, err := relayDialFunc(relay)
+	if err != nil {
+		audit.Log("delivery connection to %s via relay %s failed: %v", domain, relay.Addr(), err)
+		return fillPending(results, txs, fmt.Errorf("delivery failed: %w", err))
+	}
+	err = sendAll(client, relay.Host, domain, txs, results)
+	_ = client.Close()
+	if err != nil {
+		return fillPending(results, txs, fmt.Errorf("delivery failed: %w", err))
+	}
+	return results
+}
+
+// sendAll sends the transactions that have no result yet over client, stopping
+// when the connection breaks.
+func sendAll(client sender, host, domain string, txs []Transaction, results []Result) error {
+	for i, tx := range txs {
+		if results[i] != nil {
+			continue
+		}
+		res, err := client.Send(tx)
+		if res != nil {
+			results[i] = res
+			logResult(host, tx, res)
+		}
+		if err != nil {
+			audit.Log("delivery connection to %s via %s broke: %v", domain, host, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func logResult(host string, tx Transaction, res Result) {
+	for i, rcpt := range tx.To {
+		if res[i] == nil {
+			audit.Log("delivery succeeded to %s via %s", rcpt, host)
+		} else {
+			audit.Log("delivery to %s via %s failed: %v", rcpt, host, res[i])
+		}
+	}
+}
+
+// pending counts the transactions that have no result yet.
+func pending(results []Result) int {
+	n := 0
+	for _, res := range results {
+		if res == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// fillPending records err for every recipient of transactions without a result.
+func fillPending(results []Result, txs []Transaction, err error) []Result {
+	for i, tx := range txs {
+		if results[i] != nil {
+			continue
+		}
+		res := make(Result, len(tx.To))
+		for j := range res {
+			res[j] = err
 		}
-		audit.Log("delivery attempt to %s via %s failed: %v", to, mx.Host, err)
-		lastErr = err
+		results[i] = res
 	}
-	return fmt.Errorf("delivery failed: %w", lastErr)
+	return results
 }
@@ -3,16 +3,57 @@ package delivery
 import (
 	"errors"
 	"net"
+	"net/textproto"
 	"testing"
+
+	"gopherpost/internal/config"
 )
 
-func TestDeliverMessageNoMX(t *testing.T) {
+// fakeSender replays scripted outcomes in place of a real SMTP connection.
+type fakeSender struct {
+	host   string
+	send   func(host string, tx Transaction) (Result, error)
+	closed bool
+}
+
+func (f *fakeSender) Send(tx Transaction) (Result, error) { return f.send(f.host, tx) }
+func (f *fakeSender) Close() error                        { f.closed = true; return nil }
+
+// stubDelivery replaces MX lookup and dialing for the duration of a test.
+func stubDelivery(t *testing.T, hosts []string, dial func(host string) error, send func(host string, tx Transaction) (Result, error)) *[]string {
+	t.Helper()
+	t.Setenv("SMTP_TLS_MTA_STS", "false")
+	t.Setenv("SMTP_TLS_DANE", "false")
 	originalLookup := mxLookup
-	originalDeliver := deliverFunc
-	defer func() {
+	originalDial := dialFunc
+	t.Cleanup(func() {
 		mxLookup = originalLookup
-		deliverFunc = originalDeliver
-	}()
+		dialFunc = originalDial
+	})
+
+	mxLookup = func(domain string) ([]*net.MX, error) {
+		var records []*net.MX
+		for i, host := range hosts {
+			records = append(records, &net.MX{Host: host, Pref: uint16(10 * (i + 1))})
+		}
+		return records, nil
+	}
+	var dialed []string
+	dialFunc = func(host string, sec Security) (sender, error) {
+		dialed = append(dialed, host)
+		if dial != nil {
+			if err := dial(host); err != nil {
+				return nil, err
+			}
+		}
+		return &fakeSender{host: host, send: send}, nil
+	}
+	return &dialed
+}
+
+func TestDeliverMessageNoMX(t *testing.T) {
+	originalLookup := mxLookup
+	defer func() { mxLookup = originalLookup }()
 
 	mxLookup = func(domain string) ([]*net.MX, error) {
 		return nil, nil
@@ -25,68 +66,154 @@ func TestDeliverMessageNoMX(t *testing.T) {
 }
 
 func TestDeliverMessageSuccess(t *testing.T) {
-	originalLookup := mxLookup
-	originalDeliver := deliverFunc
-	defer func() {
-		mxLookup = originalLookup
-		deliverFunc = originalDeliver
-	}()
-
-	mxLookup = func(domain string) ([]*net.MX, error) {
-		return []*net.MX{
-			{Host: "mx1.example.com", Pref: 10},
-		}, nil
-	}
-
 	var delivered bool
-	deliverFunc = func(host, from, to string, data []byte) error {
+	stubDelivery(t, []string{"mx1.example.com"}, nil, func(host string, tx Transaction) (Result, error) {
 		if host != "mx1.example.com" {
 			t.Fatalf("unexpected host %s", host)
 		}
-		if from != "sender@example.com" || to != "rcpt@example.com" {
-			t.Fatalf("unexpected envelope %s -> %s", from, to)
+		if tx.From != "sender@example.com" || len(tx.To) != 1 || tx.To[0] != "rcpt@example.com" {
+			t.Fatalf("unexpected envelope %s -> %v", tx.From, tx.To)
 		}
-		if string(data) != "payload" {
-			t.Fatalf("unexpected payload %q", string(data))
+		if string(tx.Data) != "payload" {
+			t.Fatalf("unexpected payload %q", string(tx.Data))
 		}
 		delivered = true
-		return nil
-	}
+		return make(Result, 1), nil
+	})
 
 	if err := DeliverMessage("sender@example.com", "rcpt@example.com", []byte("payload")); err != nil {
 		t.Fatalf("DeliverMessage error: %v", err)
 	}
 	if !delivered {
-		t.Fatalf("expected deliverFunc to be invoked")
+		t.Fatalf("expected the transaction to be sent")
 	}
 }
 
 func TestDeliverMessageFailure(t *testing.T) {
-	originalLookup := mxLookup
-	originalDeliver := deliverFunc
-	defer func() {
-		mxLookup = originalLookup
-		deliverFunc = originalDeliver
-	}()
+	dialed := stubDelivery(t, []string{"mx1.example.com", "mx2.example.com"}, func(host string) error {
+		return newError(StageDial, host, errors.New("smtp error"))
+	}, nil)
 
-	mxLookup = func(domain string) ([]*net.MX, error) {
-		return []*net.MX{
-			{Host: "mx1.example.com", Pref: 10},
-			{Host: "mx2.example.com", Pref: 20},
-		}, nil
+	err := DeliverMessage("sender@example.com", "rcpt@example.com", []byte("payload"))
+	if err == nil {
+		t.Fatalf("expected error")
 	}
-
-	attempts := 0
-	deliverFunc = func(host, from, to string, data []byte) error {
-		attempts++
-		return errors.New("smtp error")
+	if len(*dialed) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(*dialed))
 	}
+}
+
+func TestDeliverMessageStopsOnPermanentFailure(t *testing.T) {
+	dialed := stubDelivery(t, []string{"mx1.example.com", "mx2.example.com", "mx3.example.com"}, func(host string) error {
+		if host == "mx1.example.com" {
+			return newError(StageDial, host, errors.New("connection refused"))
+		}
+		return newError(StageHelo, host, &textproto.Error{Code: 554, Msg: "5.7.1 Go away"})
+	}, nil)
 
 	err := DeliverMessage("sender@example.com", "rcpt@example.com", []byte("payload"))
-	if err == nil {
-		t.Fatalf("expected error")
+	if len(*dialed) != 2 {
+		t.Fatalf("expected to stop after the 5xx from mx2, tried %v", *dialed)
+	}
+	var derr *Error
+	if !errors.As(err, &derr) {
+		t.Fatalf("expected *Error, got %T: %v", err, err)
+	}
+	if derr.Host != "mx2.example.com" || derr.Stage != StageHelo || !derr.Permanent() {
+		t.Fatalf("unexpected error %+v", derr)
+	}
+}
+
+func TestDeliverTransactionsReusesConnection(t *testing.T) {
+	var sent []Transaction
+	dialed := stubDelivery(t, []string{"mx1.example.com"}, nil, func(host string, tx Transaction) (Result, error) {
+		sent = append(sent, tx)
+		res := make(Result, len(tx.To))
+		for i, rcpt := range tx.To {
+			if rcpt == "missing@example.com" {
+				res[i] = newError(StageRcpt, host, &textproto.Error{Code: 550, Msg: "5.1.1 No such user"})
+			}
+		}
+		return res, nil
+	})
+
+	results := DeliverTransactions("example.com", []Transaction{
+		{From: "a@example.org", To: []string{"one@example.com", "missing@example.com"}, Data: []byte("first")},
+		{From: "b@example.org", To: []string{"two@example.com"}, Data: []byte("second")},
+	})
+	if len(*dialed) != 1 || len(sent) != 2 {
+		t.Fatalf("expected both transactions over one connection, dialed %v sent %d", *dialed, len(sent))
+	}
+	if results[0][0] != nil || results[1][0] != nil {
+		t.Fatalf("expected accepted recipients to succeed: %v", results)
+	}
+	if !IsPermanent(results[0][1]) {
+		t.Fatalf("expected only the rejected recipient to fail, got %v", results[0][1])
+	}
+}
+
+func TestDeliverTransactionsMovesOnWhenConnectionBreaks(t *testing.T) {
+	dialed := stubDelivery(t, []string{"mx1.example.com", "mx2.example.com"}, nil, func(host string, tx Transaction) (Result, error) {
+		if host == "mx1.example.com" && string(tx.Data) == "second" {
+			return nil, newError(StageData, host, errors.New("connection reset"))
+		}
+		return make(Result, len(tx.To)), nil
+	})
+
+	results := DeliverTransactions("example.com", []Transaction{
+		{From: "a@example.org", To: []string{"one@example.com"}, Data: []byte("first")},
+		{From: "a@example.org", To: []string{"two@example.com"}, Data: []byte("second")},
+	})
+	if len(*dialed) != 2 {
+		t.Fatalf("expected the broken transaction to move to mx2, dialed %v", *dialed)
+	}
+	for i, res := range results {
+		if res[0] != nil {
+			t.Fatalf("transaction %d failed: %v", i, res[0])
+		}
+	}
+}
+
+func TestDeliverRelay(t *testing.T) {
+	originalRelayDial := relayDialFunc
+	t.Cleanup(func() { relayDialFunc = originalRelayDial })
+	var relayed []string
+	relayDialFunc = func(r *config.Relay) (sender, error) {
+		return &fakeSender{host: r.Host, send: func(host string, tx Transaction) (Result, error) {
+			relayed = append(relayed, tx.To...)
+			return make(Result, len(tx.To)), nil
+		}}, nil
+	}
+	dialed := stubDelivery(t, []string{"mx.example.com"}, nil, nil)
+
+	relay := &config.Relay{Name: "esp", Host: "smtp.esp.example", Port: "465", TLSMode: config.TLSModeImplicit}
+	results := DeliverRelay(relay, "example.com", []Transaction{
+		{From: "a@example.org", To: []string{"one@example.com", "two@example.com"}, Data: []byte("x")},
+		{From: "b@example.org", To: []string{"three@example.com"}, Data: []byte("y")},
+	})
+	if results[0][0] != nil || results[0][1] != nil || results[1][0] != nil || len(relayed) != 3 {
+		t.Fatalf("expected delivery through the relay, relayed %v: %v", relayed, results)
+	}
+	if len(*dialed) != 0 {
+		t.Fatalf("expected no MX delivery, dialed %v", *dialed)
+	}
+}
+
+func TestDeliverRelayUnavailable(t *testing.T) {
+	originalRelayDial := relayDialFunc
+	t.Cleanup(func() { relayDialFunc = originalRelayDial })
+	relayDialFunc = func(r *config.Relay) (sender, error) {
+		return nil, newError(StageDial, r.Host, errors.New("connection refused"))
+	}
+	dialed := stubDelivery(t, []string{"mx.example.com"}, nil, nil)
+
+	relay := &config.Relay{Host: "relay.example", Port: "587"}
+	results := DeliverRelay(relay, "example.com", []Transaction{{From: "a@example.org", To: []string{"one@example.com"}, Data: []byte("x")}})
+	var derr *Error
+	if !errors.As(results[0][0], &derr) || derr.Host != "relay.example" || IsPermanent(results[0][0]) {
+		t.Fatalf("expected a temporary relay error, got %v", results[0][0])
 	}
-	if attempts != 2 {
-		t.Fatalf("expected 2 attempts, got %d", attempts)
+	if len(*dialed) != 0 {
+		t.Fatalf("expected no fallback to MX, dialed %v", *dialed)
 	}
 }
@@ -0,0 +1,76 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Stage names the step of an SMTP transaction at which delivery failed.
+type Stage string
+
+const (
+	StagePolicy   Stage = "policy"
+	StageDial     Stage = "dial"
+	StageHelo     Stage = "helo"
+	StageStartTLS Stage = "starttls"
+	StageAuth     Stage = "auth"
+	StageMail     Stage = "mail"
+	StageRcpt     Stage = "rcpt"
+	StageData     Stage = "data"
+)
+
+// Error describes a failed delivery attempt to one MX host. Code and
+// EnhancedCode are set when the remote server replied with an error; they are
+// zero for connection and protocol failures.
+type Error struct {
+	Stage        Stage
+	Host         string
+	Code         int
+	EnhancedCode string
+	Message      string
+	Err          error
+}
+
+var enhancedCodePattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// newError wraps err from stage against host, extracting the SMTP reply when err
+// carries one.
+func newError(stage Stage, host string, err error) *Error {
+	e := &Error{Stage: stage, Host: host, Err: err}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		e.Code = reply.Code
+		e.Message = strings.Join(strings.Fields(reply.Msg), " ")
+		e.EnhancedCode = enhancedCodePattern.FindString(e.Message)
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("%s %s: %d %s", e.Stage, e.Host, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Stage, e.Host, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Permanent reports whether the remote server rejected the message with a 5xx
+// reply, in which case retrying cannot succeed.
+func (e *Error) Permanent() bool {
+	return e.Code >= 500 && e.Code < 600
+}
+
+// IsPermanent reports whether err is a permanent failure that retrying cannot fix,
+// i.e. the remote server rejected the message with a 5xx reply.
+func IsPermanent(err error) bool {
+	var derr *Error
+	if errors.As(err, &derr) {
+		return derr.Permanent()
+	}
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500 && reply.Code < 600
+}
@@ -0,0 +1,42 @@
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+)
+
+func TestNewError(t *testing.T) {
+	err := newError(StageRcpt, "mx.example.com", &textproto.Error{Code: 550, Msg: "5.1.1 No such\nuser"})
+	if err.Code != 550 || err.EnhancedCode != "5.1.1" || err.Message != "5.1.1 No such user" {
+		t.Fatalf("unexpected reply fields %+v", err)
+	}
+	if got := err.Error(); got != "rcpt mx.example.com: 550 5.1.1 No such user" {
+		t.Fatalf("unexpected message %q", got)
+	}
+
+	dial := newError(StageDial, "mx.example.com", errors.New("connection refused"))
+	if dial.Code != 0 || dial.Permanent() {
+		t.Fatalf("expected connection failure to be transient: %+v", dial)
+	}
+	if got := dial.Error(); got != "dial mx.example.com: connection refused" {
+		t.Fatalf("unexpected message %q", got)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	rejected := fmt.Errorf("delivery failed: %w", newError(StageData, "mx.example.com", &textproto.Error{Code: 554, Msg: "5.7.1 Rejected"}))
+	if !IsPermanent(rejected) {
+		t.Fatalf("expected wrapped 554 to be permanent")
+	}
+	if IsPermanent(newError(StageRcpt, "mx.example.com", &textproto.Error{Code: 451, Msg: "4.3.0 Try again"})) {
+		t.Fatalf("expected 451 to be transient")
+	}
+	if !IsPermanent(&textproto.Error{Code: 550, Msg: "No"}) {
+		t.Fatalf("expected bare 550 reply to be permanent")
+	}
+	if IsPermanent(errors.New("dial: connection refused")) {
+		t.Fatalf("expected network error to be transient")
+	}
+}
@@ -0,0 +1,177 @@
+package delivery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	audit "gopherpost/internal/audit"
+	"gopherpost/internal/config"
+	"gopherpost/internal/tlspolicy"
+)
+
+const (
+	policyLookupTimeout = 30 * time.Second
+	// tlsaLookupTimeout bounds the TLSA lookup made for every MX host, well
+	// below the SMTP dial, since a slow resolver otherwise delays each attempt.
+	tlsaLookupTimeout = 5 * time.Second
+)
+
+var (
+	// policyResolver answers the TXT and TLSA queries for MTA-STS and DANE.
+	policyResolver tlspolicy.Resolver = tlspolicy.NewDNSResolver()
+	stsPolicies                       = tlspolicy.NewSTSCache(policyResolver)
+	// policyTable holds the local per-domain overrides, if configured.
+	policyTable *tlspolicy.Table
+)
+
+// ErrTLSPolicy is wrapped by the errors of deliveries refused because a TLS
+// policy could not be met.
+var ErrTLSPolicy = errors.New("TLS policy violation")
+
+// SetPolicyTable installs local per-domain TLS rules. They take precedence over
+// DANE and MTA-STS for the domains they cover.
+func SetPolicyTable(t *tlspolicy.Table) {
+	policyTable = t
+}
+
+// Security is the TLS requirement for a connection to one MX host.
+type Security struct {
+	// Source names the policy that set the requirement: "dane", "mta-sts",
+	// "local" for the policy table, or empty for opportunistic STARTTLS.
+	Source string
+	// Required refuses to send the message unless STARTTLS succeeds.
+	Required bool
+	// Testing reports policy violations instead of enforcing them (MTA-STS
+	// testing mode).
+	Testing bool
+	// Disabled skips STARTTLS even when the server offers it.
+	Disabled bool
+	// SkipVerify accepts any server certificate.
+	SkipVerify bool
+	// TLSA, when set, authenticates the server certificate instead of the
+	// WebPKI.
+	TLSA []tlspolicy.TLSA
+	// Fingerprints, when set, pin the SHA-256 fingerprint of the server
+	// certificate instead of the WebPKI.
+	Fingerprints [][]byte
+}
+
+// tlsConfig returns the client TLS configuration that enforces s for host.
+func (s Security) tlsConfig(host string) *tls.Config {
+	conf := &tls.Config{
+		ServerName:               host,
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+	}
+	switch {
+	case len(s.TLSA) > 0:
+		// DANE replaces WebPKI validation (RFC 7672 section 3.1).
+		records := s.TLSA
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return tlspolicy.VerifyDANE(records, host, cs)
+		}
+	case len(s.Fingerprints) > 0:
+		fingerprints := s.Fingerprints
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return tlspolicy.VerifyFingerprint(fingerprints, cs)
+		}
+	case s.SkipVerify:
+		conf.InsecureSkipVerify = true
+	}
+	return conf
+}
+
+// localSecurity returns the requirement the policy table sets for domain, if any.
+func localSecurity(domain string) (Security, bool, error) {
+	if policyTable == nil {
+		return Security{}, false, nil
+	}
+	rule, ok, err := policyTable.Lookup(domain)
+	if err != nil || !ok {
+		return Security{}, false, err
+	}
+	sec := Security{Source: "local"}
+	switch rule.Mode {
+	case tlspolicy.ModeNone:
+		sec.Disabled = true
+	case tlspolicy.ModeOpportunistic:
+		sec.SkipVerify = true
+	case tlspolicy.ModeEncrypt:
+		sec.Required, sec.SkipVerify = true, true
+	case tlspolicy.ModeVerify:
+		sec.Required = true
+	case tlspolicy.ModeFingerprint:
+		sec.Required, sec.Fingerprints = true, rule.Fingerprints
+	}
+	return sec, true, nil
+}
+
+// domainPolicy returns the MTA-STS policy for domain when MTA-STS is enabled.
+// A failed discovery is logged and treated as no policy, as RFC 8461 section 5.1
+// prescribes when nothing is cached.
+func domainPolicy(domain string) *tlspolicy.STSPolicy {
+	if !config.Bool("SMTP_TLS_MTA_STS", true) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), policyLookupTimeout)
+	defer cancel()
+	policy, err := stsPolicies.Lookup(ctx, domain)
+	if err != nil {
+		audit.Log("delivery mta-sts discovery for %s failed: %v", domain, err)
+		return nil
+	}
+	if policy != nil && policy.Mode == tlspolicy.STSModeNone {
+		return nil
+	}
+	return policy
+}
+
+// daneResolver returns the resolver trusted for TLSA lookups, or nil when DANE
+// is off. DANE rests on the AD bit, so it is on by default only when
+// SMTP_TLS_DANE_RESOLVER names a validating resolver. SMTP_TLS_DANE=true without
+// one trusts the system nameservers.
+func daneResolver() tlspolicy.Resolver {
+	servers := config.DANEResolvers()
+	if !config.Bool("SMTP_TLS_DANE", len(servers) > 0) {
+		return nil
+	}
+	if len(servers) == 0 {
+		return policyResolver
+	}
+	return &tlspolicy.DNSResolver{Servers: servers, Timeout: tlsaLookupTimeout}
+}
+
+// securityFor decides the TLS requirement for delivering to host on behalf of
+// sts. DANE takes precedence over MTA-STS (RFC 8461 section 2). An error means
+// the host must not be used, for example because the MTA-STS policy does not
+// list it or an authenticated TLSA lookup failed. A failed TLSA lookup without
+// DNSSEC, such as SERVFAIL from an unsigned zone, counts as no TLSA records.
+func securityFor(host string, sts *tlspolicy.STSPolicy) (Security, error) {
+	if resolver := daneResolver(); resolver != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsaLookupTimeout)
+		records, err := tlspolicy.LookupTLSA(ctx, resolver, host, 25)
+		cancel()
+		if err != nil {
+			return Security{}, newError(StagePolicy, host, fmt.Errorf("dane: %w", err))
+		}
+		if len(records) > 0 {
+			return Security{Source: "dane", Required: true, TLSA: records}, nil
+		}
+	}
+	if sts == nil {
+		return Security{}, nil
+	}
+	testingMode := sts.Mode == tlspolicy.STSModeTesting
+	if !sts.Matches(host) {
+		if !testingMode {
+			return Security{}, newError(StagePolicy, host, fmt.Errorf("%w: mta-sts: MX host not permitted by policy", ErrTLSPolicy))
+		}
+		audit.Log("delivery mta-sts testing: MX %s not permitted by policy %s", host, sts.ID)
+	}
+	return Security{Source: "mta-sts", Required: true, Testing: testingMode}, nil
+}
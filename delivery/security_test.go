@@ -0,0 +1,303 @@
+package delivery
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopherpost/internal/tlspolicy"
+)
+
+type stubResolver struct {
+	tlsa map[string][]tlspolicy.TLSA
+	err  error
+	// secureErr marks err as an authenticated answer.
+	secureErr bool
+}
+
+func (s stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, tlspolicy.ErrNotFound
+}
+
+func (s stubResolver) LookupTLSA(ctx context.Context, name string) ([]tlspolicy.TLSA, bool, error) {
+	if s.err != nil {
+		return nil, s.secureErr, s.err
+	}
+	records, ok := s.tlsa[name]
+	if !ok {
+		return nil, true, tlspolicy.ErrNotFound
+	}
+	return records, true, nil
+}
+
+func stubPolicyResolver(t *testing.T, r tlspolicy.Resolver) {
+	t.Helper()
+	original := policyResolver
+	policyResolver = r
+	t.Cleanup(func() { policyResolver = original })
+}
+
+func TestSecurityForMTASTS(t *testing.T) {
+	stubPolicyResolver(t, stubResolver{})
+	policy := &tlspolicy.STSPolicy{ID: "1", Mode: tlspolicy.STSModeEnforce, MX: []string{"*.example.com"}}
+
+	sec, err := securityFor("mx1.example.com", policy)
+	if err != nil || !sec.Required || sec.Testing || sec.Source != "mta-sts" {
+		t.Fatalf("unexpected security %+v, %v", sec, err)
+	}
+
+	_, err = securityFor("mx.attacker.test", policy)
+	var derr *Error
+	if !errors.As(err, &derr) || derr.Stage != StagePolicy || IsPermanent(err) {
+		t.Fatalf("expected a temporary policy error for an unlisted MX, got %v", err)
+	}
+
+	policy.Mode = tlspolicy.STSModeTesting
+	sec, err = securityFor("mx.attacker.test", policy)
+	if err != nil || !sec.Testing {
+		t.Fatalf("testing mode should only report the mismatch, got %+v, %v", sec, err)
+	}
+
+	if sec, err := securityFor("mx1.example.com", nil); err != nil || sec.Required {
+		t.Fatalf("expected opportunistic TLS without a policy, got %+v, %v", sec, err)
+	}
+}
+
+func TestSecurityForDANE(t *testing.T) {
+	records := []tlspolicy.TLSA{{Usage: tlspolicy.UsageDANEEE, Selector: tlspolicy.SelectorSPKI, MatchingType: tlspolicy.MatchSHA256, Data: make([]byte, 32)}}
+	stubPolicyResolver(t, stubResolver{tlsa: map[string][]tlspolicy.TLSA{"_25._tcp.mx1.example.com": records}})
+	t.Setenv("SMTP_TLS_DANE_RESOLVER", "")
+	t.Setenv("SMTP_TLS_DANE", "")
+	if sec, err := securityFor("mx1.example.com", nil); err != nil || sec.Required {
+		t.Fatalf("expected DANE to be off without a validating resolver, got %+v, %v", sec, err)
+	}
+
+	t.Setenv("SMTP_TLS_DANE", "true")
+
+	sec, err := securityFor("mx1.example.com", nil)
+	if err != nil || sec.Source != "dane" || !sec.Required || len(sec.TLSA) != 1 {
+		t.Fatalf("unexpected security %+v, %v", sec, err)
+	}
+	if !sec.tlsConfig("mx1.example.com").InsecureSkipVerify {
+		t.Fatalf("DANE should replace WebPKI verification")
+	}
+
+	stubPolicyResolver(t, stubResolver{err: errors.New("servfail")})
+	if sec, err := securityFor("mx1.example.com", nil); err != nil || sec.Required {
+		t.Fatalf("expected an insecure TLSA failure to mean no TLSA records, got %+v, %v", sec, err)
+	}
+	policy := &tlspolicy.STSPolicy{ID: "1", Mode: tlspolicy.STSModeEnforce, MX: []string{"*.example.com"}}
+	if sec, err := securityFor("mx1.example.com", policy); err != nil || sec.Source != "mta-sts" {
+		t.Fatalf("expected MTA-STS to apply after an insecure TLSA failure, got %+v, %v", sec, err)
+	}
+
+	stubPolicyResolver(t, stubResolver{err: errors.New("malformed TLSA record"), secureErr: true})
+	if _, err := securityFor("mx1.example.com", nil); err == nil {
+		t.Fatalf("expected an authenticated TLSA failure to rule out the host")
+	}
+
+	t.Setenv("SMTP_TLS_DANE", "false")
+	if _, err := securityFor("mx1.example.com", nil); err != nil {
+		t.Fatalf("expected DANE to be skipped when disabled: %v", err)
+	}
+}
+
+func TestDANEResolver(t *testing.T) {
+	t.Setenv("SMTP_TLS_DANE", "")
+	t.Setenv("SMTP_TLS_DANE_RESOLVER", "127.0.0.1, [::1]:5353")
+	r, ok := daneResolver().(*tlspolicy.DNSResolver)
+	if !ok || strings.Join(r.Servers, ",") != "127.0.0.1:53,[::1]:5353" || r.Timeout != tlsaLookupTimeout {
+		t.Fatalf("expected the configured validating resolvers, got %+v", r)
+	}
+	t.Setenv("SMTP_TLS_DANE", "false")
+	if r := daneResolver(); r != nil {
+		t.Fatalf("expected SMTP_TLS_DANE=false to turn DANE off, got %+v", r)
+	}
+}
+
+func TestDialRefusesPlaintextWhenTLSRequired(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer ln.Close()
+	oldPort := smtpPort
+	smtpPort = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	defer func() { smtpPort = oldPort }()
+
+	commands := make(chan string, 4)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 test ESMTP\r\n")
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- line
+			fmt.Fprint(conn, "250 OK\r\n")
+		}
+	}()
+
+	_, err = Dial("127.0.0.1", Security{Source: "mta-sts", Required: true})
+	var derr *Error
+	if !errors.As(err, &derr) || derr.Stage != StageStartTLS {
+		t.Fatalf("expected a STARTTLS error, got %v", err)
+	}
+	for cmd := range commands {
+		if len(cmd) >= 4 && cmd[:4] == "MAIL" {
+			t.Fatalf("message transaction started in the clear")
+		}
+	}
+}
+
+func usePolicyTable(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tls_policy")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write policy file: %v", err)
+	}
+	table, err := tlspolicy.LoadTable(path)
+	if err != nil {
+		t.Fatalf("LoadTable: %v", err)
+	}
+	original := policyTable
+	SetPolicyTable(table)
+	t.Cleanup(func() { policyTable = original })
+}
+
+func TestDeliverTransactionsAppliesPolicyTable(t *testing.T) {
+	usePolicyTable(t, "*.example.com encrypt\n")
+	// A failing resolver proves DANE and MTA-STS are not consulted.
+	stubPolicyResolver(t, stubResolver{err: errors.New("bogus"), secureErr: true})
+	stubDelivery(t, []string{"mx1.example.com"}, nil, func(host string, tx Transaction) (Result, error) {
+		return make(Result, len(tx.To)), nil
+	})
+	t.Setenv("SMTP_TLS_DANE", "true")
+	inner := dialFunc
+	var got Security
+	dialFunc = func(host string, sec Security) (sender, error) {
+		got = sec
+		return inner(host, sec)
+	}
+
+	results := DeliverTransactions("eu.example.com", []Transaction{{From: "a@example.org", To: []string{"one@eu.example.com"}, Data: []byte("x")}})
+	if results[0][0] != nil {
+		t.Fatalf("delivery failed: %v", results[0][0])
+	}
+	if got.Source != "local" || !got.Required || !got.SkipVerify {
+		t.Fatalf("expected the encrypt rule to apply, got %+v", got)
+	}
+}
+
+// serveSTARTTLS accepts one session that offers STARTTLS with cert and reports
+// the commands it receives.
+func serveSTARTTLS(t *testing.T, cert tls.Certificate) <-chan string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	oldPort := smtpPort
+	smtpPort = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	t.Cleanup(func() { smtpPort = oldPort })
+
+	commands := make(chan string, 16)
+	go func() {
+		defer close(commands)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 test ESMTP\r\n")
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimSpace(line)
+			commands <- cmd
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"):
+				fmt.Fprint(conn, "250-test\r\n250 STARTTLS\r\n")
+			case cmd == "STARTTLS":
+				fmt.Fprint(conn, "220 Ready to start TLS\r\n")
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				conn = tlsConn
+				br = bufio.NewReader(conn)
+			case cmd == "QUIT":
+				fmt.Fprint(conn, "221 Bye\r\n")
+				return
+			default:
+				fmt.Fprint(conn, "250 OK\r\n")
+			}
+		}
+	}()
+	return commands
+}
+
+func TestDialPinnedFingerprint(t *testing.T) {
+	// httptest provides a self-signed certificate for 127.0.0.1.
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	serverCert := srv.TLS.Certificates[0]
+	sum := sha256.Sum256(serverCert.Certificate[0])
+
+	commands := serveSTARTTLS(t, serverCert)
+	client, err := Dial("127.0.0.1", Security{Source: "local", Required: true, Fingerprints: [][]byte{sum[:]}})
+	if err != nil {
+		t.Fatalf("Dial with the pinned certificate: %v", err)
+	}
+	_ = client.Close()
+	for range commands {
+	}
+
+	serveSTARTTLS(t, serverCert)
+	_, err = Dial("127.0.0.1", Security{Source: "local", Required: true, Fingerprints: [][]byte{make([]byte, sha256.Size)}})
+	var derr *Error
+	if !errors.As(err, &derr) || derr.Stage != StageStartTLS || !errors.Is(err, ErrTLSPolicy) {
+		t.Fatalf("expected a typed TLS policy error, got %v", err)
+	}
+}
+
+func TestDialPolicyNoneSkipsSTARTTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	commands := serveSTARTTLS(t, srv.TLS.Certificates[0])
+
+	client, err := Dial("127.0.0.1", Security{Source: "local", Disabled: true})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	_ = client.Close()
+	for cmd := range commands {
+		if cmd == "STARTTLS" {
+			t.Fatalf("STARTTLS sent although the policy disables it")
+		}
+	}
+}
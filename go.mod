@@ -5,8 +5,8 @@ go 1.21
 toolchain go1.21.0
 
 require (
-	github.com/emersion/go-msgauth v0.4.0
+	github.com/emersion/go-msgauth v0.6.8
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.15.0
+	golang.org/x/net v0.18.0
 )
-
-require golang.org/x/crypto v0.0.0-20190411191339-88737f569e3a // indirect
@@ -0,0 +1,261 @@
+// Package alias rewrites recipient addresses through an alias map, in the manner
+// of /etc/aliases and virtual tables: single addresses are redirected, lists
+// expand to several recipients, and a domain may have a catch-all.
+package alias
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLoop is returned when an alias expands, directly or indirectly, to itself
+// or nests deeper than maxDepth.
+var ErrLoop = errors.New("alias: expansion loop")
+
+const maxDepth = 10
+
+// Map is an alias file. Each line has the form
+//
+//	source: target, target...
+//
+// where the colon is optional. A source is a full address, "@example.com" for the
+// catch-all of a domain, or a bare local part such as "postmaster" that applies
+// to every domain passed to Load. A target is a full address or a bare local part
+// in the domain of the address being expanded. Targets are expanded again, and a
+// target equal to its own source stops the expansion there, so
+//
+//	alice@example.com: alice@example.com, archive@example.com
+//
+// keeps a copy for alice. Blank lines and lines starting with '#' are ignored.
+// The file is reloaded automatically when its modification time changes.
+type Map struct {
+	path    string
+	domains map[string]struct{}
+
+	mu      sync.Mutex
+	modTime time.Time
+	entries map[string][]string
+}
+
+// Load reads the alias file at path. Bare local-part sources apply to domains.
+func Load(path string, domains ...string) (*Map, error) {
+	m := &Map{path: path, domains: make(map[string]struct{})}
+	for _, d := range domains {
+		m.domains[strings.ToLower(strings.TrimSuffix(d, "."))] = struct{}{}
+	}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Expand resolves rcpt into its final recipients. It reports false, and returns
+// nothing, when no entry matches rcpt. An address with a "+detail" suffix
+// matches its own entry first and then the entry for the address without it.
+// The catch-all is not consulted; see CatchAll.
+func (m *Map) Expand(rcpt string) ([]string, bool, error) {
+	if err := m.reload(); err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	targets, ok := m.lookup(rcpt)
+	if !ok {
+		return nil, false, nil
+	}
+	out, err := m.expand(rcpt, targets)
+	return out, true, err
+}
+
+// CatchAll resolves rcpt through the catch-all of its domain, for recipients that
+// do not otherwise exist. It reports false when the domain has none.
+func (m *Map) CatchAll(rcpt string) ([]string, bool, error) {
+	if err := m.reload(); err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, domain := split(rcpt)
+	targets, ok := m.entries["@"+domain]
+	if !ok {
+		return nil, false, nil
+	}
+	out, err := m.expand(rcpt, qualify(targets, domain))
+	return out, true, err
+}
+
+// expand walks the targets of rcpt depth first, collecting each final
+// recipient once. Callers hold m.mu.
+func (m *Map) expand(rcpt string, targets []string) ([]string, error) {
+	var out []string
+	seen := make(map[string]bool)
+	path := map[string]bool{strings.ToLower(rcpt): true}
+	add := func(addr string) {
+		if key := strings.ToLower(addr); !seen[key] {
+			seen[key] = true
+			out = append(out, addr)
+		}
+	}
+
+	var walk func(source string, targets []string, depth int) error
+	walk = func(source string, targets []string, depth int) error {
+		if depth > maxDepth {
+			return fmt.Errorf("%w: %s nests more than %d levels", ErrLoop, rcpt, maxDepth)
+		}
+		for _, target := range targets {
+			key := strings.ToLower(target)
+			if key == strings.ToLower(source) {
+				add(target)
+				continue
+			}
+			if path[key] {
+				return fmt.Errorf("%w: %s reaches %s again", ErrLoop, rcpt, target)
+			}
+			next, ok := m.lookup(target)
+			if !ok {
+				add(target)
+				continue
+			}
+			path[key] = true
+			err := walk(target, next, depth+1)
+			delete(path, key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(rcpt, targets, 1); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// lookup returns the targets of the most specific entry for addr other than the
+// catch-all, with bare local parts qualified by addr's domain. Callers hold m.mu.
+func (m *Map) lookup(addr string) ([]string, bool) {
+	local, domain := split(addr)
+	if domain == "" {
+		return nil, false
+	}
+	base, _, hasDetail := strings.Cut(local, "+")
+	keys := []string{local + "@" + domain}
+	if hasDetail {
+		keys = append(keys, base+"@"+domain)
+	}
+	if _, ok := m.domains[domain]; ok {
+		keys = append(keys, local)
+		if hasDetail {
+			keys = append(keys, base)
+		}
+	}
+	for _, key := range keys {
+		if targets, ok := m.entries[key]; ok {
+			return qualify(targets, domain), true
+		}
+	}
+	return nil, false
+}
+
+// StripDetail removes a "+detail" suffix from the local part of addr, reporting
+// whether there was one.
+func StripDetail(addr string) (string, bool) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, false
+	}
+	base, _, ok := strings.Cut(addr[:at], "+")
+	if !ok || base == "" {
+		return addr, false
+	}
+	return base + addr[at:], true
+}
+
+func split(addr string) (local, domain string) {
+	addr = strings.ToLower(addr)
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, ""
+	}
+	return addr[:at], strings.TrimSuffix(addr[at+1:], ".")
+}
+
+func qualify(targets []string, domain string) []string {
+	out := make([]string, len(targets))
+	for i, t := range targets {
+		if !strings.Contains(t, "@") {
+			t += "@" + domain
+		}
+		out[i] = t
+	}
+	return out
+}
+
+func (m *Map) reload() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return fmt.Errorf("aliases: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.entries != nil && info.ModTime().Equal(m.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return fmt.Errorf("aliases: %w", err)
+	}
+	entries, err := parse(data)
+	if err != nil {
+		return fmt.Errorf("aliases %s: %w", m.path, err)
+	}
+	m.entries = entries
+	m.modTime = info.ModTime()
+	return nil
+}
+
+func parse(data []byte) (map[string][]string, error) {
+	entries := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source, rest, found := strings.Cut(line, ":")
+		if !found {
+			fields := strings.Fields(line)
+			source, rest = fields[0], strings.Join(fields[1:], " ")
+		}
+		source = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(source), "."))
+		if at := strings.LastIndex(source, "@"); source == "" || strings.ContainsAny(source, " \t") || at == len(source)-1 {
+			return nil, fmt.Errorf("line %d: invalid alias %q", lineNo, source)
+		}
+		var targets []string
+		for _, t := range strings.FieldsFunc(rest, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			if strings.HasPrefix(t, "@") || strings.HasSuffix(t, "@") {
+				return nil, fmt.Errorf("line %d: invalid target %q", lineNo, t)
+			}
+			targets = append(targets, t)
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("line %d: alias %s has no targets", lineNo, source)
+		}
+		if _, dup := entries[source]; dup {
+			return nil, fmt.Errorf("line %d: duplicate alias %s", lineNo, source)
+		}
+		entries[source] = targets
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
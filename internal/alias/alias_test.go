@@ -0,0 +1,132 @@
+package alias
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeAliases(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write aliases: %v", err)
+	}
+	return path
+}
+
+func TestExpand(t *testing.T) {
+	path := writeAliases(t, `# role accounts
+postmaster: alice
+abuse:      postmaster, security@example.net
+team@example.com  alice, bob@example.com,carol@example.org
+alice@example.com: alice@example.com, archive
+news@example.com: team@example.com
+`)
+	m, err := Load(path, "example.com")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for rcpt, want := range map[string][]string{
+		"Postmaster@example.com":  {"alice@example.com", "archive@example.com"},
+		"abuse@example.com":       {"alice@example.com", "archive@example.com", "security@example.net"},
+		"team@example.com":        {"alice@example.com", "archive@example.com", "bob@example.com", "carol@example.org"},
+		"news+weekly@example.com": {"alice@example.com", "archive@example.com", "bob@example.com", "carol@example.org"},
+		"alice+lists@example.com": {"alice@example.com", "archive@example.com"},
+	} {
+		got, ok, err := m.Expand(rcpt)
+		if err != nil || !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("Expand(%q) = %v, %v, %v; want %v", rcpt, got, ok, err, want)
+		}
+	}
+	for _, rcpt := range []string{"bob@example.com", "postmaster@example.org"} {
+		if got, ok, err := m.Expand(rcpt); ok || err != nil {
+			t.Errorf("Expand(%q) = %v, %v, %v; want no match", rcpt, got, ok, err)
+		}
+	}
+}
+
+func TestCatchAll(t *testing.T) {
+	m, err := Load(writeAliases(t, "@example.com: catchall\ncatchall@example.com: alice@example.com\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, ok, _ := m.Expand("nobody@example.com"); ok {
+		t.Fatalf("Expand must not use the catch-all")
+	}
+	got, ok, err := m.CatchAll("nobody@example.com")
+	if err != nil || !ok || !reflect.DeepEqual(got, []string{"alice@example.com"}) {
+		t.Fatalf("CatchAll = %v, %v, %v", got, ok, err)
+	}
+	if _, ok, _ := m.CatchAll("nobody@example.org"); ok {
+		t.Fatalf("expected no catch-all for another domain")
+	}
+}
+
+func TestExpandLoop(t *testing.T) {
+	m, err := Load(writeAliases(t, "a@example.com: b@example.com\nb@example.com: c@example.com, d@example.com\nc@example.com: a@example.com\n"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, _, err := m.Expand("a@example.com"); !errors.Is(err, ErrLoop) {
+		t.Fatalf("expected a loop, got %v", err)
+	}
+
+	var chain string
+	for i := 0; i <= maxDepth; i++ {
+		chain += "l" + string(rune('a'+i)) + "@example.com: l" + string(rune('a'+i+1)) + "@example.com\n"
+	}
+	m, err = Load(writeAliases(t, chain))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, _, err := m.Expand("la@example.com"); !errors.Is(err, ErrLoop) {
+		t.Fatalf("expected deep nesting to be refused, got %v", err)
+	}
+}
+
+func TestMapReloads(t *testing.T) {
+	path := writeAliases(t, "info@example.com: alice@example.com\n")
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("info@example.com: bob@example.com\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if got, _, _ := m.Expand("info@example.com"); !reflect.DeepEqual(got, []string{"bob@example.com"}) {
+		t.Fatalf("expected the edited file to be reloaded, got %v", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, content := range []string{
+		"postmaster:\n",
+		"user@: alice@example.com\n",
+		"info@example.com: @example.org\n",
+		"info@example.com: a@example.com\ninfo@example.com: b@example.com\n",
+	} {
+		if _, err := parse([]byte(content)); err == nil {
+			t.Errorf("parse(%q): expected an error", content)
+		}
+	}
+}
+
+func TestStripDetail(t *testing.T) {
+	for in, want := range map[string]string{
+		"alice+news@example.com": "alice@example.com",
+		"alice@example.com":      "alice@example.com",
+		"+x@example.com":         "+x@example.com",
+	} {
+		if got, _ := StripDetail(in); got != want {
+			t.Errorf("StripDetail(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
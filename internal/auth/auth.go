@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrInvalidCredentials is returned when a username or password does not match.
+var ErrInvalidCredentials = errors.New("auth: invalid credentials")
+
+// Identity describes an authenticated submission user.
+type Identity struct {
+	Username string
+	// Domains lists the sender domains the user may use in MAIL FROM.
+	Domains []string
+}
+
+// MaySendFrom reports whether the identity owns the given sender domain.
+func (id *Identity) MaySendFrom(domain string) bool {
+	if id == nil {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range id.Domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Backend verifies submission credentials.
+type Backend interface {
+	// Authenticate returns the identity for valid credentials and
+	// ErrInvalidCredentials otherwise. Other errors indicate the backend itself failed.
+	Authenticate(username, password string) (*Identity, error)
+}
+
+// LoadFromEnv initializes the credential backend from environment variables.
+// It returns nil when authentication is not configured.
+//
+//	SMTP_AUTH_HTPASSWD – path to a bcrypt htpasswd-style credentials file
+func LoadFromEnv() (Backend, error) {
+	path := strings.TrimSpace(os.Getenv("SMTP_AUTH_HTPASSWD"))
+	if path == "" {
+		return nil, nil
+	}
+	backend, err := NewHtpasswd(path)
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	return backend, nil
+}
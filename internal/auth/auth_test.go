@@ -0,0 +1,28 @@
+package auth
+
+import "testing"
+
+func TestLoadFromEnvDisabled(t *testing.T) {
+	t.Setenv("SMTP_AUTH_HTPASSWD", "")
+	backend, err := LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv returned error: %v", err)
+	}
+	if backend != nil {
+		t.Fatalf("expected nil backend when unconfigured")
+	}
+}
+
+func TestLoadFromEnvMissingFile(t *testing.T) {
+	t.Setenv("SMTP_AUTH_HTPASSWD", t.TempDir()+"/missing")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Fatalf("expected error for missing credentials file")
+	}
+}
+
+func TestIdentityMaySendFromNil(t *testing.T) {
+	var id *Identity
+	if id.MaySendFrom("example.com") {
+		t.Fatalf("nil identity must not own any domain")
+	}
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when a username is unknown so lookups take the
+// same time whether or not the user exists.
+var dummyHash = []byte("$2a$10$YGvrFZ8J0P5v/ktlnKPVXOxgSAb3bUVXdLT3f4VzhgadA99y4bKU.")
+
+type htpasswdEntry struct {
+	hash    []byte
+	domains []string
+}
+
+// Htpasswd authenticates users against a bcrypt htpasswd-style file. Each line has
+// the form
+//
+//	username:bcrypt-hash[:domain,domain...]
+//
+// Blank lines and lines starting with '#' are ignored. When no domains are listed
+// and the username is an email address, its domain is used. The file is reloaded
+// automatically when its modification time changes.
+type Htpasswd struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	entries map[string]htpasswdEntry
+}
+
+// NewHtpasswd loads the credentials file at path.
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Authenticate implements Backend.
+func (h *Htpasswd) Authenticate(username, password string) (*Identity, error) {
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	key := strings.ToLower(username)
+	h.mu.Lock()
+	entry, ok := h.entries[key]
+	h.mu.Unlock()
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword(entry.hash, []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Username: key, Domains: append([]string(nil), entry.domains...)}, nil
+}
+
+func (h *Htpasswd) reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("htpasswd: %w", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.entries != nil && info.ModTime().Equal(h.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("htpasswd: %w", err)
+	}
+	entries, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("htpasswd %s: %w", h.path, err)
+	}
+	h.entries = entries
+	h.modTime = info.ModTime()
+	return nil
+}
+
+func parseHtpasswd(data []byte) (map[string]htpasswdEntry, error) {
+	entries := make(map[string]htpasswdEntry)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash[:domains]", lineNo)
+		}
+		hash := parts[1]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: unsupported password hash (bcrypt required)", lineNo)
+		}
+		username := strings.ToLower(parts[0])
+		var domains []string
+		if len(parts) == 3 {
+			for _, d := range strings.Split(parts[2], ",") {
+				if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+					domains = append(domains, d)
+				}
+			}
+		} else if at := strings.LastIndex(username, "@"); at >= 0 && at < len(username)-1 {
+			domains = []string{username[at+1:]}
+		}
+		entries[username] = htpasswdEntry{hash: []byte(hash), domains: domains}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
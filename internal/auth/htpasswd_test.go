@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	var data []byte
+	for _, line := range lines {
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+}
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+	return string(hash)
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeHtpasswd(t, path,
+		"# submission users",
+		"alice@example.com:"+bcryptHash(t, "secret"),
+		"ci:"+bcryptHash(t, "token")+":example.org, example.net",
+	)
+
+	backend, err := NewHtpasswd(path)
+	if err != nil {
+		t.Fatalf("NewHtpasswd: %v", err)
+	}
+
+	id, err := backend.Authenticate("Alice@Example.com", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if !id.MaySendFrom("example.com") || id.MaySendFrom("example.org") {
+		t.Fatalf("unexpected domains for alice: %v", id.Domains)
+	}
+
+	id, err = backend.Authenticate("ci", "token")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if !id.MaySendFrom("example.net") || !id.MaySendFrom("EXAMPLE.ORG.") {
+		t.Fatalf("unexpected domains for ci: %v", id.Domains)
+	}
+
+	if _, err := backend.Authenticate("alice@example.com", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := backend.Authenticate("nobody", "secret"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials for unknown user, got %v", err)
+	}
+}
+
+func TestHtpasswdReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeHtpasswd(t, path, "bob:"+bcryptHash(t, "old"))
+	backend, err := NewHtpasswd(path)
+	if err != nil {
+		t.Fatalf("NewHtpasswd: %v", err)
+	}
+
+	writeHtpasswd(t, path, "bob:"+bcryptHash(t, "new"))
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if _, err := backend.Authenticate("bob", "new"); err != nil {
+		t.Fatalf("expected reloaded password to work: %v", err)
+	}
+}
+
+func TestHtpasswdRejectsNonBcrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeHtpasswd(t, path, "carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=")
+	if _, err := NewHtpasswd(path); err == nil {
+		t.Fatalf("expected error for non-bcrypt hash")
+	}
+}
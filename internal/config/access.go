@@ -8,7 +8,11 @@ import (
 
 // AllowedNetworks returns CIDR blocks from SMTP_ALLOW_NETWORKS.
 func AllowedNetworks() []*net.IPNet {
-	value := strings.TrimSpace(os.Getenv("SMTP_ALLOW_NETWORKS"))
+	return parseNetworks(os.Getenv("SMTP_ALLOW_NETWORKS"))
+}
+
+func parseNetworks(value string) []*net.IPNet {
+	value = strings.TrimSpace(value)
 	if value == "" {
 		return nil
 	}
@@ -35,7 +39,11 @@ func AllowedNetworks() []*net.IPNet {
 
 // AllowedHosts returns exact hostnames from SMTP_ALLOW_HOSTS.
 func AllowedHosts() []string {
-	value := strings.TrimSpace(os.Getenv("SMTP_ALLOW_HOSTS"))
+	return parseHosts(os.Getenv("SMTP_ALLOW_HOSTS"))
+}
+
+func parseHosts(value string) []string {
+	value = strings.TrimSpace(value)
 	if value == "" {
 		return nil
 	}
@@ -51,7 +59,34 @@ func AllowedHosts() []string {
 	return hosts
 }
 
+// TrustedNetworks returns the CIDR blocks from SMTP_TRUSTED_NETWORKS whose
+// clients may relay without authenticating. It defaults to the loopback
+// addresses.
+func TrustedNetworks() []*net.IPNet {
+	value, ok := os.LookupEnv("SMTP_TRUSTED_NETWORKS")
+	if !ok {
+		value = "127.0.0.0/8,::1"
+	}
+	return parseNetworks(value)
+}
+
+// RelayDomains returns the domains from SMTP_RELAY_DOMAINS that the server
+// accepts mail for from anyone and relays onward, such as when it is a backup MX
+// or an inbound gateway.
+func RelayDomains() []string {
+	var domains []string
+	for _, d := range parseHosts(os.Getenv("SMTP_RELAY_DOMAINS")) {
+		domains = append(domains, strings.TrimSuffix(d, "."))
+	}
+	return domains
+}
+
 // RequireSenderDomain reports whether SMTP_REQUIRE_LOCAL_DOMAIN is enabled.
 func RequireSenderDomain() bool {
 	return Bool("SMTP_REQUIRE_LOCAL_DOMAIN", true)
 }
+
+// RequireTLS reports whether SMTP_REQUIRE_TLS demands STARTTLS before MAIL FROM.
+func RequireTLS() bool {
+	return Bool("SMTP_REQUIRE_TLS", false)
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestTrustedNetworks(t *testing.T) {
+	t.Setenv("SMTP_TRUSTED_NETWORKS", "")
+	os.Unsetenv("SMTP_TRUSTED_NETWORKS")
+	nets := TrustedNetworks()
+	if len(nets) != 2 || !nets[0].Contains(net.ParseIP("127.0.0.1")) || !nets[1].Contains(net.ParseIP("::1")) {
+		t.Fatalf("expected loopback by default, got %v", nets)
+	}
+
+	t.Setenv("SMTP_TRUSTED_NETWORKS", "")
+	if nets := TrustedNetworks(); len(nets) != 0 {
+		t.Fatalf("expected an empty value to trust nobody, got %v", nets)
+	}
+
+	t.Setenv("SMTP_TRUSTED_NETWORKS", "10.0.0.0/8, 192.0.2.7")
+	nets = TrustedNetworks()
+	if len(nets) != 2 || !nets[0].Contains(net.ParseIP("10.1.2.3")) || !nets[1].Contains(net.ParseIP("192.0.2.7")) {
+		t.Fatalf("unexpected trusted networks %v", nets)
+	}
+}
+
+func TestRelayDomains(t *testing.T) {
+	t.Setenv("SMTP_RELAY_DOMAINS", " Example.com., backup.example.org ,")
+	got := RelayDomains()
+	if len(got) != 2 || got[0] != "example.com" || got[1] != "backup.example.org" {
+		t.Fatalf("unexpected relay domains %v", got)
+	}
+}
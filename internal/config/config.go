@@ -1,10 +1,17 @@
 package config
 
 import (
+	"net"
 	"os"
+	"strings"
+	"time"
 )
 
-const defaultHostname = "localhost"
+const (
+	defaultHostname        = "localhost"
+	defaultShutdownTimeout = 30 * time.Second
+	defaultSRSMaxAge       = 21 * 24 * time.Hour
+)
 
 // Hostname returns the hostname the SMTP server should identify as.
 // Preference order: SMTP_HOSTNAME env var, system hostname, fallback.
@@ -17,3 +24,80 @@ func Hostname() string {
 	}
 	return defaultHostname
 }
+
+// ShutdownTimeout returns how long a graceful shutdown may wait for sessions and
+// queue deliveries to finish, from SMTP_SHUTDOWN_TIMEOUT (default 30 seconds).
+func ShutdownTimeout() time.Duration {
+	if d := Duration("SMTP_SHUTDOWN_TIMEOUT", defaultShutdownTimeout); d > 0 {
+		return d
+	}
+	return defaultShutdownTimeout
+}
+
+// AliasesFile returns the alias map path from SMTP_ALIASES_FILE, or "" when
+// aliases are disabled.
+func AliasesFile() string {
+	return strings.TrimSpace(os.Getenv("SMTP_ALIASES_FILE"))
+}
+
+// DKIMVerify reports whether SMTP_DKIM_VERIFY enables verification of the DKIM
+// signatures and ARC chains of inbound mail (default true).
+func DKIMVerify() bool {
+	return Bool("SMTP_DKIM_VERIFY", true)
+}
+
+// DMARC reports whether SMTP_DMARC enables DMARC evaluation of inbound mail
+// (default true). It needs DKIM verification.
+func DMARC() bool {
+	return Bool("SMTP_DMARC", true)
+}
+
+// ARCSeal reports whether SMTP_ARC_SEAL enables ARC sealing of mail that leaves
+// the server on listeners that do not set their own (default false).
+func ARCSeal() bool {
+	return Bool("SMTP_ARC_SEAL", false)
+}
+
+// SRSSecret returns the key for Sender Rewriting Scheme hashes from
+// SMTP_SRS_SECRET, or "" when forwarded mail keeps its original sender.
+func SRSSecret() string {
+	return strings.TrimSpace(os.Getenv("SMTP_SRS_SECRET"))
+}
+
+// SRSDomain returns the domain of rewritten senders from SMTP_SRS_DOMAIN,
+// defaulting to the server hostname.
+func SRSDomain() string {
+	if domain := strings.TrimSpace(os.Getenv("SMTP_SRS_DOMAIN")); domain != "" {
+		return strings.ToLower(strings.TrimSuffix(domain, "."))
+	}
+	return Hostname()
+}
+
+// SRSMaxAge returns how long rewritten senders accept bounces, from
+// SMTP_SRS_MAX_AGE (default 21 days).
+func SRSMaxAge() time.Duration {
+	if d := Duration("SMTP_SRS_MAX_AGE", defaultSRSMaxAge); d > 0 {
+		return d
+	}
+	return defaultSRSMaxAge
+}
+
+// TLSPolicyFile returns the path of the outbound TLS policy table from
+// SMTP_TLS_POLICY_FILE, or "" when no local policy is configured.
+func TLSPolicyFile() string {
+	return strings.TrimSpace(os.Getenv("SMTP_TLS_POLICY_FILE"))
+}
+
+// DANEResolvers returns the validating resolvers from SMTP_TLS_DANE_RESOLVER as
+// host:port addresses, port 53 unless given. DANE trusts their AD bit, so it is
+// enabled by default only when one is configured.
+func DANEResolvers() []string {
+	var servers []string
+	for _, host := range parseHosts(os.Getenv("SMTP_TLS_DANE_RESOLVER")) {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), "53")
+		}
+		servers = append(servers, host)
+	}
+	return servers
+}
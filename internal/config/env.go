@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strings"
+	"time"
 )
 
 // Bool reads an environment variable and returns a boolean value.
@@ -21,3 +22,17 @@ func Bool(key string, defaultValue bool) bool {
 		return defaultValue
 	}
 }
+
+// Duration reads an environment variable holding a Go duration such as "30s" or
+// "4h". Unset, malformed, or negative values result in the provided default.
+func Duration(key string, defaultValue time.Duration) time.Duration {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return defaultValue
+	}
+	return d
+}
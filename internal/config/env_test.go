@@ -3,6 +3,7 @@ package config
 import (
 	"runtime"
 	"testing"
+	"time"
 )
 
 func TestBool(t *testing.T) {
@@ -46,3 +47,42 @@ func TestQueueWorkers(t *testing.T) {
 		t.Fatalf("expected fallback to default for invalid value, got %d", got)
 	}
 }
+
+func TestDuration(t *testing.T) {
+	t.Setenv("DURATION_SET", "90m")
+	t.Setenv("DURATION_NOISE", "soon")
+	t.Setenv("DURATION_NEGATIVE", "-1h")
+
+	if got := Duration("DURATION_SET", time.Second); got != 90*time.Minute {
+		t.Fatalf("expected 90m, got %v", got)
+	}
+	if got := Duration("DURATION_MISSING", time.Second); got != time.Second {
+		t.Fatalf("expected default for missing key, got %v", got)
+	}
+	if got := Duration("DURATION_NOISE", time.Second); got != time.Second {
+		t.Fatalf("expected default for invalid value, got %v", got)
+	}
+	if got := Duration("DURATION_NEGATIVE", time.Second); got != time.Second {
+		t.Fatalf("expected default for negative value, got %v", got)
+	}
+}
+
+func TestQueueLifetimes(t *testing.T) {
+	t.Setenv("SMTP_QUEUE_MAX_LIFETIME", "")
+	t.Setenv("SMTP_QUEUE_DELAY_WARNING", "")
+	if got := QueueMaxLifetime(); got != 5*24*time.Hour {
+		t.Fatalf("expected 5 day default lifetime, got %v", got)
+	}
+	if got := QueueDelayWarning(); got != 0 {
+		t.Fatalf("expected delay warnings disabled by default, got %v", got)
+	}
+
+	t.Setenv("SMTP_QUEUE_MAX_LIFETIME", "0s")
+	if got := QueueMaxLifetime(); got != 5*24*time.Hour {
+		t.Fatalf("expected zero lifetime to fall back to default, got %v", got)
+	}
+	t.Setenv("SMTP_QUEUE_DELAY_WARNING", "4h")
+	if got := QueueDelayWarning(); got != 4*time.Hour {
+		t.Fatalf("expected 4h delay warning, got %v", got)
+	}
+}
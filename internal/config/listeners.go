@@ -0,0 +1,220 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSMTPPort        = "2525"
+	defaultBanner          = "GopherPost ready"
+	defaultMaxMessageBytes = 10 << 20 // 10 MiB
+)
+
+// TLSMode selects how a listener offers TLS.
+type TLSMode string
+
+const (
+	// TLSModeDefault defers to the global TLS settings: STARTTLS when a certificate
+	// is available (or implicit TLS with SMTP_TLS_IMPLICIT=true), plaintext otherwise.
+	TLSModeDefault TLSMode = ""
+	// TLSModeNone serves plaintext only and never advertises STARTTLS.
+	TLSModeNone TLSMode = "none"
+	// TLSModeStartTLS serves plaintext and offers the STARTTLS upgrade.
+	TLSModeStartTLS TLSMode = "starttls"
+	// TLSModeImplicit wraps the whole connection in TLS (SMTPS).
+	TLSModeImplicit TLSMode = "implicit"
+)
+
+// Listener describes one SMTP listening socket and the policy applied to the
+// sessions it accepts.
+type Listener struct {
+	Name            string
+	Addr            string
+	TLSMode         TLSMode
+	Banner          string
+	AllowNetworks   []*net.IPNet
+	AllowHosts      []string
+	MaxMessageBytes int64
+	RequireTLS      bool
+	RequireAuth     bool
+	// ARCSeal adds an ARC set to mail from this listener that leaves the
+	// server, whether relayed or forwarded.
+	ARCSeal bool
+}
+
+// AllowAll reports whether the listener accepts clients from any address. This is
+// the case for listeners that require AUTH and have no allowlist of their own;
+// credentials, not the client address, are the gate there.
+func (l *Listener) AllowAll() bool {
+	return l.RequireAuth && len(l.AllowNetworks) == 0 && len(l.AllowHosts) == 0
+}
+
+// listenerPreset holds defaults for well-known listener names.
+type listenerPreset struct {
+	port        string
+	tlsMode     TLSMode
+	requireTLS  bool
+	requireAuth bool
+}
+
+var listenerPresets = map[string]listenerPreset{
+	"smtp":        {port: "25"},
+	"submission":  {port: "587", tlsMode: TLSModeStartTLS, requireTLS: true, requireAuth: true},
+	"submissions": {port: "465", tlsMode: TLSModeImplicit, requireAuth: true},
+	"smtps":       {port: "465", tlsMode: TLSModeImplicit, requireAuth: true},
+}
+
+// Listeners returns the SMTP listeners to bind.
+//
+// When SMTP_LISTENERS is unset a single listener is built from SMTP_PORT and the
+// global settings. Otherwise SMTP_LISTENERS holds a comma-separated list of names
+// and each listener is configured through SMTP_LISTENER_<NAME>_* variables:
+//
+//	ADDR or PORT        – listen address or port (required unless the name is a preset)
+//	TLS                 – none, starttls, or implicit
+//	BANNER              – greeting text (default SMTP_BANNER)
+//	ALLOW_NETWORKS      – CIDR allowlist (default SMTP_ALLOW_NETWORKS)
+//	ALLOW_HOSTS         – hostname allowlist (default SMTP_ALLOW_HOSTS)
+//	MAX_MESSAGE_SIZE    – size limit in bytes (default SMTP_MAX_MESSAGE_SIZE)
+//	REQUIRE_TLS         – require STARTTLS before MAIL FROM (default SMTP_REQUIRE_TLS)
+//	REQUIRE_AUTH        – require AUTH before MAIL FROM (default false)
+//	ARC_SEAL            – ARC seal mail that leaves the server (default SMTP_ARC_SEAL)
+//
+// The names smtp (25), submission (587, STARTTLS and AUTH required) and
+// submissions or smtps (465, implicit TLS, AUTH required) carry presets. Listeners
+// that require AUTH and set no allowlist of their own accept any client address.
+func Listeners() ([]Listener, error) {
+	names := strings.TrimSpace(os.Getenv("SMTP_LISTENERS"))
+	if names == "" {
+		port := defaultSMTPPort
+		if env := os.Getenv("SMTP_PORT"); env != "" {
+			port = env
+		}
+		return []Listener{{
+			Name:            "default",
+			Addr:            ":" + port,
+			TLSMode:         globalTLSMode(),
+			Banner:          Banner(),
+			AllowNetworks:   AllowedNetworks(),
+			AllowHosts:      AllowedHosts(),
+			MaxMessageBytes: MaxMessageBytes(),
+			RequireTLS:      RequireTLS(),
+			ARCSeal:         ARCSeal(),
+		}}, nil
+	}
+
+	var listeners []Listener
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("listener %q configured twice", name)
+		}
+		seen[name] = true
+		l, err := loadListener(name)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("SMTP_LISTENERS contains no listener names")
+	}
+	return listeners, nil
+}
+
+func loadListener(name string) (Listener, error) {
+	preset := listenerPresets[name]
+	prefix := "SMTP_LISTENER_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_"
+	env := func(key string) string { return strings.TrimSpace(os.Getenv(prefix + key)) }
+
+	l := Listener{
+		Name:            name,
+		TLSMode:         preset.tlsMode,
+		Banner:          Banner(),
+		AllowNetworks:   AllowedNetworks(),
+		AllowHosts:      AllowedHosts(),
+		MaxMessageBytes: MaxMessageBytes(),
+		RequireTLS:      Bool(prefix+"REQUIRE_TLS", preset.requireTLS || RequireTLS()),
+		RequireAuth:     Bool(prefix+"REQUIRE_AUTH", preset.requireAuth),
+		ARCSeal:         Bool(prefix+"ARC_SEAL", ARCSeal()),
+	}
+	if l.TLSMode == TLSModeDefault {
+		l.TLSMode = globalTLSMode()
+	}
+
+	switch addr, port := env("ADDR"), env("PORT"); {
+	case addr != "":
+		l.Addr = addr
+	case port != "":
+		l.Addr = ":" + strings.TrimPrefix(port, ":")
+	case preset.port != "":
+		l.Addr = ":" + preset.port
+	default:
+		return Listener{}, fmt.Errorf("listener %q: set %sADDR or %sPORT", name, prefix, prefix)
+	}
+
+	if mode := env("TLS"); mode != "" {
+		switch TLSMode(strings.ToLower(mode)) {
+		case TLSModeNone, TLSModeStartTLS, TLSModeImplicit:
+			l.TLSMode = TLSMode(strings.ToLower(mode))
+		default:
+			return Listener{}, fmt.Errorf("listener %q: unknown TLS mode %q", name, mode)
+		}
+	}
+	if banner := os.Getenv(prefix + "BANNER"); banner != "" {
+		l.Banner = banner
+	}
+	_, ownNetworks := os.LookupEnv(prefix + "ALLOW_NETWORKS")
+	_, ownHosts := os.LookupEnv(prefix + "ALLOW_HOSTS")
+	if ownNetworks || ownHosts || l.RequireAuth {
+		l.AllowNetworks = parseNetworks(env("ALLOW_NETWORKS"))
+		l.AllowHosts = parseHosts(env("ALLOW_HOSTS"))
+	}
+	if size := env("MAX_MESSAGE_SIZE"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 1 {
+			return Listener{}, fmt.Errorf("listener %q: invalid MAX_MESSAGE_SIZE %q", name, size)
+		}
+		l.MaxMessageBytes = n
+	}
+	if l.RequireTLS && l.TLSMode == TLSModeNone {
+		return Listener{}, fmt.Errorf("listener %q: REQUIRE_TLS conflicts with TLS mode none", name)
+	}
+	return l, nil
+}
+
+// Banner returns the greeting text from SMTP_BANNER.
+func Banner() string {
+	if banner := os.Getenv("SMTP_BANNER"); banner != "" {
+		return banner
+	}
+	return defaultBanner
+}
+
+// MaxMessageBytes returns the message size limit from SMTP_MAX_MESSAGE_SIZE.
+func MaxMessageBytes() int64 {
+	value := strings.TrimSpace(os.Getenv("SMTP_MAX_MESSAGE_SIZE"))
+	if value == "" {
+		return defaultMaxMessageBytes
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 1 {
+		return defaultMaxMessageBytes
+	}
+	return n
+}
+
+func globalTLSMode() TLSMode {
+	if Bool("SMTP_TLS_IMPLICIT", false) {
+		return TLSModeImplicit
+	}
+	return TLSModeDefault
+}
@@ -0,0 +1,88 @@
+package config
+
+import "testing"
+
+func TestListenersDefault(t *testing.T) {
+	t.Setenv("SMTP_LISTENERS", "")
+	t.Setenv("SMTP_PORT", "2626")
+	t.Setenv("SMTP_BANNER", "")
+	t.Setenv("SMTP_MAX_MESSAGE_SIZE", "")
+	t.Setenv("SMTP_TLS_IMPLICIT", "")
+
+	listeners, err := Listeners()
+	if err != nil {
+		t.Fatalf("Listeners: %v", err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("expected one listener, got %d", len(listeners))
+	}
+	l := listeners[0]
+	if l.Addr != ":2626" || l.Banner != defaultBanner || l.MaxMessageBytes != defaultMaxMessageBytes || l.TLSMode != TLSModeDefault {
+		t.Fatalf("unexpected default listener %+v", l)
+	}
+}
+
+func TestListenersPresetsAndOverrides(t *testing.T) {
+	t.Setenv("SMTP_LISTENERS", "smtp, submission, smtps, relay")
+	t.Setenv("SMTP_ALLOW_NETWORKS", "10.0.0.0/8")
+	t.Setenv("SMTP_ALLOW_HOSTS", "")
+	t.Setenv("SMTP_REQUIRE_TLS", "")
+	t.Setenv("SMTP_TLS_IMPLICIT", "")
+	t.Setenv("SMTP_LISTENER_SMTP_BANNER", "inbound relay")
+	t.Setenv("SMTP_LISTENER_SMTP_MAX_MESSAGE_SIZE", "5000")
+	t.Setenv("SMTP_LISTENER_RELAY_ADDR", "127.0.0.1:2526")
+	t.Setenv("SMTP_LISTENER_RELAY_TLS", "none")
+	t.Setenv("SMTP_ARC_SEAL", "")
+	t.Setenv("SMTP_LISTENER_RELAY_ARC_SEAL", "true")
+
+	listeners, err := Listeners()
+	if err != nil {
+		t.Fatalf("Listeners: %v", err)
+	}
+	if len(listeners) != 4 {
+		t.Fatalf("expected 4 listeners, got %d", len(listeners))
+	}
+	inbound, submission, smtps, relay := listeners[0], listeners[1], listeners[2], listeners[3]
+
+	if inbound.Addr != ":25" || inbound.Banner != "inbound relay" || inbound.MaxMessageBytes != 5000 || inbound.RequireAuth {
+		t.Fatalf("unexpected smtp listener %+v", inbound)
+	}
+	if len(inbound.AllowNetworks) != 1 || inbound.AllowAll() {
+		t.Fatalf("expected smtp listener to inherit the global allowlist")
+	}
+	if submission.Addr != ":587" || submission.TLSMode != TLSModeStartTLS || !submission.RequireTLS || !submission.RequireAuth {
+		t.Fatalf("unexpected submission listener %+v", submission)
+	}
+	if !submission.AllowAll() {
+		t.Fatalf("expected submission listener to accept any client address")
+	}
+	if smtps.Addr != ":465" || smtps.TLSMode != TLSModeImplicit || !smtps.RequireAuth {
+		t.Fatalf("unexpected smtps listener %+v", smtps)
+	}
+	if inbound.ARCSeal || !relay.ARCSeal {
+		t.Fatalf("expected only the relay listener to ARC seal")
+	}
+	if relay.Addr != "127.0.0.1:2526" || relay.TLSMode != TLSModeNone {
+		t.Fatalf("unexpected relay listener %+v", relay)
+	}
+}
+
+func TestListenersErrors(t *testing.T) {
+	cases := map[string]map[string]string{
+		"missing address": {"SMTP_LISTENERS": "custom"},
+		"bad tls mode":    {"SMTP_LISTENERS": "smtp", "SMTP_LISTENER_SMTP_TLS": "sometimes"},
+		"duplicate":       {"SMTP_LISTENERS": "smtp,smtp"},
+		"bad size":        {"SMTP_LISTENERS": "smtp", "SMTP_LISTENER_SMTP_MAX_MESSAGE_SIZE": "big"},
+		"tls conflict":    {"SMTP_LISTENERS": "submission", "SMTP_LISTENER_SUBMISSION_TLS": "none"},
+	}
+	for name, env := range cases {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := Listeners(); err == nil {
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 )
 
+const defaultQueueMaxLifetime = 5 * 24 * time.Hour
+
 // QueueWorkers returns the configured number of concurrent delivery workers.
 // Defaults to the number of logical CPUs when unset or invalid.
 func QueueWorkers() int {
@@ -20,3 +23,18 @@ func QueueWorkers() int {
 	}
 	return workers
 }
+
+// QueueMaxLifetime returns how long a message may stay queued before it is
+// bounced back to the sender, from SMTP_QUEUE_MAX_LIFETIME (default 5 days).
+func QueueMaxLifetime() time.Duration {
+	if d := Duration("SMTP_QUEUE_MAX_LIFETIME", defaultQueueMaxLifetime); d > 0 {
+		return d
+	}
+	return defaultQueueMaxLifetime
+}
+
+// QueueDelayWarning returns how long a message may be delayed before the sender
+// is warned, from SMTP_QUEUE_DELAY_WARNING. Zero, the default, disables warnings.
+func QueueDelayWarning() time.Duration {
+	return Duration("SMTP_QUEUE_DELAY_WARNING", 0)
+}
@@ -0,0 +1,275 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	defaultRelayPort         = "587"
+	defaultImplicitRelayPort = "465"
+	defaultMaildirRoot       = "./data/maildir"
+)
+
+// Relay is an SMTP server that accepts outbound mail on our behalf (a smarthost),
+// so delivery skips MX lookup and sends everything through it.
+type Relay struct {
+	Name     string
+	Host     string
+	Port     string
+	TLSMode  TLSMode
+	Username string
+	Password string
+}
+
+// Addr returns the host:port to dial.
+func (r *Relay) Addr() string {
+	return net.JoinHostPort(r.Host, r.Port)
+}
+
+// Transports a route can select.
+const (
+	TransportDirect  = "direct"
+	TransportRelay   = "relay"
+	TransportLocal   = "local"
+	TransportWebhook = "webhook"
+	TransportDiscard = "discard"
+)
+
+// Webhook is an HTTP endpoint that receives messages as JSON POST requests.
+type Webhook struct {
+	Name   string
+	URL    string
+	Secret string
+}
+
+// Route sends mail for the recipients matching Pattern to a transport. Patterns
+// are addresses, exact domains, "*.example.com" for any subdomain of example.com,
+// or "*" for every recipient. Relay is set for TransportRelay and Webhook for
+// TransportWebhook. ARCSeal adds an ARC set to mail taking the route.
+type Route struct {
+	Pattern   string
+	Transport string
+	Relay     *Relay
+	Webhook   *Webhook
+	ARCSeal   bool
+}
+
+// Routing is the outbound routing configuration.
+type Routing struct {
+	// Smarthost, when set, carries all mail that no route claims.
+	Smarthost *Relay
+	Routes    []Route
+	// LocalDomains are delivered to Maildirs under MaildirRoot and never relayed.
+	LocalDomains []string
+}
+
+// OutboundRouting returns the outbound routing configuration.
+//
+// SMTP_SMARTHOST names the default relay as host or host:port and is configured
+// through SMTP_SMARTHOST_* variables:
+//
+//	PORT                – relay port (default 587, or 465 with implicit TLS)
+//	TLS                 – starttls (default), implicit, or none
+//	USERNAME, PASSWORD  – AUTH PLAIN credentials (optional; require TLS)
+//
+// SMTP_ROUTES holds a comma-separated list of pattern=target pairs. A pattern is a
+// recipient address, a domain, "*.domain" or "*". A target is one of
+//
+//	direct              – MX delivery
+//	smarthost           – the SMTP_SMARTHOST relay
+//	local               – a Maildir under SMTP_MAILDIR_ROOT
+//	discard             – accept and drop the message
+//	webhook:<name>      – POST to SMTP_WEBHOOK_<NAME>_URL, signed with _SECRET
+//	<name>              – a relay configured through SMTP_RELAY_<NAME>_HOST,
+//	                      _PORT, _TLS, _USERNAME and _PASSWORD
+//
+// SMTP_ARC_ROUTES lists the patterns of routes whose mail is ARC sealed; each
+// must appear in SMTP_ROUTES.
+func OutboundRouting() (Routing, error) {
+	routing := Routing{LocalDomains: LocalDomains()}
+	if host := strings.TrimSpace(os.Getenv("SMTP_SMARTHOST")); host != "" {
+		relay, err := loadRelay("smarthost", "SMTP_SMARTHOST_", host)
+		if err != nil {
+			return Routing{}, err
+		}
+		routing.Smarthost = relay
+	}
+
+	relays := make(map[string]*Relay)
+	webhooks := make(map[string]*Webhook)
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(os.Getenv("SMTP_ROUTES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, target, ok := strings.Cut(entry, "=")
+		pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+		target = strings.ToLower(strings.TrimSpace(target))
+		if !ok || pattern == "" || target == "" {
+			return Routing{}, fmt.Errorf("SMTP_ROUTES: expected pattern=target, got %q", entry)
+		}
+		if !validRoutePattern(pattern) {
+			return Routing{}, fmt.Errorf("SMTP_ROUTES: invalid pattern %q", pattern)
+		}
+		if seen[pattern] {
+			return Routing{}, fmt.Errorf("SMTP_ROUTES: %s routed twice", pattern)
+		}
+		seen[pattern] = true
+
+		route := Route{Pattern: pattern, Transport: target}
+		switch target {
+		case TransportDirect, TransportLocal, TransportDiscard:
+		case "smarthost":
+			if routing.Smarthost == nil {
+				return Routing{}, fmt.Errorf("SMTP_ROUTES: %s routes to the smarthost but SMTP_SMARTHOST is not set", pattern)
+			}
+			route.Transport, route.Relay = TransportRelay, routing.Smarthost
+		default:
+			if name, ok := strings.CutPrefix(target, TransportWebhook+":"); ok {
+				webhook, ok := webhooks[name]
+				if !ok {
+					var err error
+					if webhook, err = loadWebhook(name); err != nil {
+						return Routing{}, err
+					}
+					webhooks[name] = webhook
+				}
+				route.Transport, route.Webhook = TransportWebhook, webhook
+				break
+			}
+			relay, ok := relays[target]
+			if !ok {
+				prefix := envPrefix("SMTP_RELAY_", target)
+				host := strings.TrimSpace(os.Getenv(prefix + "HOST"))
+				if host == "" {
+					return Routing{}, fmt.Errorf("SMTP_ROUTES: relay %q for %s needs %sHOST", target, pattern, prefix)
+				}
+				var err error
+				if relay, err = loadRelay(target, prefix, host); err != nil {
+					return Routing{}, err
+				}
+				relays[target] = relay
+			}
+			route.Transport, route.Relay = TransportRelay, relay
+		}
+		routing.Routes = append(routing.Routes, route)
+	}
+
+	for _, pattern := range strings.Split(os.Getenv("SMTP_ARC_ROUTES"), ",") {
+		pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+		if pattern == "" {
+			continue
+		}
+		found := false
+		for i := range routing.Routes {
+			if routing.Routes[i].Pattern == pattern {
+				routing.Routes[i].ARCSeal, found = true, true
+			}
+		}
+		if !found {
+			return Routing{}, fmt.Errorf("SMTP_ARC_ROUTES: %s is not a route in SMTP_ROUTES", pattern)
+		}
+	}
+	return routing, nil
+}
+
+// validRoutePattern accepts an address, a domain, "*.domain" or "*".
+func validRoutePattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if local, domain, ok := strings.Cut(pattern, "@"); ok {
+		return local != "" && domain != "" && !strings.ContainsAny(pattern, "*") && !strings.Contains(domain, "@")
+	}
+	name := strings.TrimPrefix(pattern, "*.")
+	return name != "" && !strings.Contains(name, "*")
+}
+
+// envPrefix returns the variable prefix for a named relay or webhook.
+func envPrefix(kind, name string) string {
+	return kind + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_"
+}
+
+func loadWebhook(name string) (*Webhook, error) {
+	prefix := envPrefix("SMTP_WEBHOOK_", name)
+	w := &Webhook{
+		Name:   name,
+		URL:    strings.TrimSpace(os.Getenv(prefix + "URL")),
+		Secret: os.Getenv(prefix + "SECRET"),
+	}
+	if w.URL == "" {
+		return nil, fmt.Errorf("webhook %q: set %sURL", name, prefix)
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("webhook %q: invalid URL %q", name, w.URL)
+	}
+	return w, nil
+}
+
+// LocalDomains returns the domains this server delivers to local mailboxes, from
+// the comma-separated SMTP_LOCAL_DOMAINS.
+func LocalDomains() []string {
+	var domains []string
+	for _, d := range strings.Split(os.Getenv("SMTP_LOCAL_DOMAINS"), ",") {
+		if d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), ".")); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// MaildirRoot returns the directory holding local mailboxes, from
+// SMTP_MAILDIR_ROOT (default ./data/maildir).
+func MaildirRoot() string {
+	if root := strings.TrimSpace(os.Getenv("SMTP_MAILDIR_ROOT")); root != "" {
+		return root
+	}
+	return defaultMaildirRoot
+}
+
+func loadRelay(name, prefix, host string) (*Relay, error) {
+	env := func(key string) string { return strings.TrimSpace(os.Getenv(prefix + key)) }
+	r := &Relay{
+		Name:     name,
+		Host:     host,
+		TLSMode:  TLSModeStartTLS,
+		Username: env("USERNAME"),
+		Password: os.Getenv(prefix + "PASSWORD"),
+	}
+	if mode := env("TLS"); mode != "" {
+		switch TLSMode(strings.ToLower(mode)) {
+		case TLSModeNone, TLSModeStartTLS, TLSModeImplicit:
+			r.TLSMode = TLSMode(strings.ToLower(mode))
+		default:
+			return nil, fmt.Errorf("relay %q: unknown TLS mode %q", name, mode)
+		}
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		r.Host, r.Port = h, p
+	}
+	if port := env("PORT"); port != "" {
+		r.Port = port
+	}
+	if r.Port == "" {
+		r.Port = defaultRelayPort
+		if r.TLSMode == TLSModeImplicit {
+			r.Port = defaultImplicitRelayPort
+		}
+	}
+	if r.Host == "" {
+		return nil, fmt.Errorf("relay %q: empty host", name)
+	}
+	if (r.Username == "") != (r.Password == "") {
+		return nil, fmt.Errorf("relay %q: set both %sUSERNAME and %sPASSWORD", name, prefix, prefix)
+	}
+	if r.Username != "" && r.TLSMode == TLSModeNone {
+		return nil, fmt.Errorf("relay %q: AUTH credentials require TLS", name)
+	}
+	return r, nil
+}
@@ -0,0 +1,130 @@
+package config
+
+import "testing"
+
+func TestOutboundRoutingDisabled(t *testing.T) {
+	t.Setenv("SMTP_SMARTHOST", "")
+	t.Setenv("SMTP_ROUTES", "")
+	t.Setenv("SMTP_LOCAL_DOMAINS", "")
+
+	routing, err := OutboundRouting()
+	if err != nil {
+		t.Fatalf("OutboundRouting: %v", err)
+	}
+	if routing.Smarthost != nil || len(routing.Routes) != 0 || len(routing.LocalDomains) != 0 {
+		t.Fatalf("expected no relays, routes or local domains, got %+v", routing)
+	}
+}
+
+func TestOutboundRoutingSmarthostAndRoutes(t *testing.T) {
+	t.Setenv("SMTP_SMARTHOST", "relay.corp.example")
+	t.Setenv("SMTP_SMARTHOST_TLS", "")
+	t.Setenv("SMTP_SMARTHOST_USERNAME", "mailer")
+	t.Setenv("SMTP_SMARTHOST_PASSWORD", "secret")
+	t.Setenv("SMTP_ROUTES", "partner.example=direct, *.eu.example=esp, lab.eu.example=smarthost")
+	t.Setenv("SMTP_RELAY_ESP_HOST", "smtp.esp.example:2465")
+	t.Setenv("SMTP_RELAY_ESP_TLS", "implicit")
+
+	routing, err := OutboundRouting()
+	if err != nil {
+		t.Fatalf("OutboundRouting: %v", err)
+	}
+	smarthost := routing.Smarthost
+	if smarthost == nil || smarthost.Addr() != "relay.corp.example:587" || smarthost.TLSMode != TLSModeStartTLS || smarthost.Username != "mailer" {
+		t.Fatalf("unexpected smarthost %+v", smarthost)
+	}
+	if len(routing.Routes) != 3 {
+		t.Fatalf("expected 3 routes, got %+v", routing.Routes)
+	}
+	if r := routing.Routes[0]; r.Pattern != "partner.example" || r.Transport != TransportDirect {
+		t.Fatalf("unexpected route %+v", r)
+	}
+	if r := routing.Routes[1]; r.Pattern != "*.eu.example" || r.Transport != TransportRelay || r.Relay.Name != "esp" || r.Relay.Addr() != "smtp.esp.example:2465" || r.Relay.TLSMode != TLSModeImplicit {
+		t.Fatalf("unexpected route %+v", r)
+	}
+	if r := routing.Routes[2]; r.Transport != TransportRelay || r.Relay != smarthost {
+		t.Fatalf("expected lab.eu.example to use the smarthost, got %+v", r)
+	}
+}
+
+func TestOutboundRoutingTransports(t *testing.T) {
+	t.Setenv("SMTP_SMARTHOST", "")
+	t.Setenv("SMTP_ROUTES", "postmaster@example.com=local, archive.example=webhook:archive, *.archive.example=webhook:archive, *=discard")
+	t.Setenv("SMTP_WEBHOOK_ARCHIVE_URL", "https://hooks.example/mail")
+	t.Setenv("SMTP_WEBHOOK_ARCHIVE_SECRET", "s3cret")
+	t.Setenv("SMTP_ARC_ROUTES", "archive.example, *")
+
+	routing, err := OutboundRouting()
+	if err != nil {
+		t.Fatalf("OutboundRouting: %v", err)
+	}
+	want := []string{TransportLocal, TransportWebhook, TransportWebhook, TransportDiscard}
+	for i, r := range routing.Routes {
+		if r.Transport != want[i] {
+			t.Fatalf("route %d: expected %s, got %+v", i, want[i], r)
+		}
+	}
+	hook := routing.Routes[1].Webhook
+	if hook == nil || hook.URL != "https://hooks.example/mail" || hook.Secret != "s3cret" || routing.Routes[2].Webhook != hook {
+		t.Fatalf("unexpected webhook %+v", hook)
+	}
+	for i, seal := range []bool{false, true, false, true} {
+		if routing.Routes[i].ARCSeal != seal {
+			t.Fatalf("route %d: expected ARCSeal %t, got %+v", i, seal, routing.Routes[i])
+		}
+	}
+}
+
+func TestLocalDomains(t *testing.T) {
+	t.Setenv("SMTP_LOCAL_DOMAINS", " Example.COM, mail.example.org., ,")
+
+	routing, err := OutboundRouting()
+	if err != nil {
+		t.Fatalf("OutboundRouting: %v", err)
+	}
+	got := routing.LocalDomains
+	if len(got) != 2 || got[0] != "example.com" || got[1] != "mail.example.org" {
+		t.Fatalf("unexpected local domains %v", got)
+	}
+}
+
+func TestOutboundRoutingImplicitPort(t *testing.T) {
+	t.Setenv("SMTP_SMARTHOST", "smtp.esp.example")
+	t.Setenv("SMTP_SMARTHOST_TLS", "implicit")
+	t.Setenv("SMTP_SMARTHOST_USERNAME", "")
+	t.Setenv("SMTP_SMARTHOST_PASSWORD", "")
+	t.Setenv("SMTP_ROUTES", "")
+
+	routing, err := OutboundRouting()
+	if err != nil {
+		t.Fatalf("OutboundRouting: %v", err)
+	}
+	if routing.Smarthost.Addr() != "smtp.esp.example:465" {
+		t.Fatalf("expected port 465 for implicit TLS, got %s", routing.Smarthost.Addr())
+	}
+}
+
+func TestOutboundRoutingErrors(t *testing.T) {
+	cases := []map[string]string{
+		{"SMTP_SMARTHOST": "relay.example", "SMTP_SMARTHOST_TLS": "sometimes"},
+		{"SMTP_SMARTHOST": "relay.example", "SMTP_SMARTHOST_USERNAME": "mailer"},
+		{"SMTP_SMARTHOST": "relay.example", "SMTP_SMARTHOST_TLS": "none", "SMTP_SMARTHOST_USERNAME": "mailer", "SMTP_SMARTHOST_PASSWORD": "secret"},
+		{"SMTP_ROUTES": "example.com=smarthost"},
+		{"SMTP_ROUTES": "example.com=missing"},
+		{"SMTP_ROUTES": "example.com"},
+		{"SMTP_ROUTES": "a.*.example=direct"},
+		{"SMTP_ROUTES": "example.com=direct,example.com=direct"},
+		{"SMTP_ROUTES": "*@example.com=local"},
+		{"SMTP_ROUTES": "example.com=webhook:missing"},
+		{"SMTP_ROUTES": "example.com=webhook:bad", "SMTP_WEBHOOK_BAD_URL": "ftp://hooks.example"},
+		{"SMTP_ROUTES": "example.com=direct", "SMTP_ARC_ROUTES": "other.example"},
+	}
+	for _, env := range cases {
+		for _, key := range []string{"SMTP_SMARTHOST", "SMTP_SMARTHOST_TLS", "SMTP_SMARTHOST_USERNAME", "SMTP_SMARTHOST_PASSWORD", "SMTP_ROUTES", "SMTP_RELAY_MISSING_HOST", "SMTP_WEBHOOK_BAD_URL", "SMTP_ARC_ROUTES"} {
+			t.Setenv(key, env[key])
+		}
+		if _, err := OutboundRouting(); err == nil {
+			t.Errorf("expected %v to be rejected", env)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultSPFTimeout = 10 * time.Second
+
+// SPFAction is what the server does with a sender whose SPF check came out a
+// certain way.
+type SPFAction string
+
+const (
+	// SPFAccept accepts the message and records the result in its headers.
+	SPFAccept SPFAction = "accept"
+	// SPFReject refuses MAIL FROM with a permanent error.
+	SPFReject SPFAction = "reject"
+	// SPFDefer refuses MAIL FROM with a temporary error so the client retries.
+	SPFDefer SPFAction = "defer"
+)
+
+// SPFPolicy configures SPF verification of inbound senders.
+type SPFPolicy struct {
+	Enabled   bool
+	Fail      SPFAction
+	SoftFail  SPFAction
+	PermError SPFAction
+	TempError SPFAction
+	// Timeout bounds the DNS lookups of one check.
+	Timeout time.Duration
+}
+
+// Action returns the action for an SPF result such as "fail". Results without a
+// configurable action are accepted.
+func (p SPFPolicy) Action(result string) SPFAction {
+	switch result {
+	case "fail":
+		return p.Fail
+	case "softfail":
+		return p.SoftFail
+	case "permerror":
+		return p.PermError
+	case "temperror":
+		return p.TempError
+	}
+	return SPFAccept
+}
+
+// SPF returns the SPF policy: SMTP_SPF turns checking on or off (default off),
+// SMTP_SPF_FAIL, SMTP_SPF_SOFTFAIL, SMTP_SPF_PERMERROR and SMTP_SPF_TEMPERROR
+// pick accept, reject or defer for those results, and SMTP_SPF_TIMEOUT bounds
+// each check (default 10 seconds).
+func SPF() (SPFPolicy, error) {
+	p := SPFPolicy{Enabled: Bool("SMTP_SPF", false), Timeout: Duration("SMTP_SPF_TIMEOUT", defaultSPFTimeout)}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultSPFTimeout
+	}
+	for _, a := range []struct {
+		key    string
+		action *SPFAction
+		def    SPFAction
+	}{
+		{"SMTP_SPF_FAIL", &p.Fail, SPFReject},
+		{"SMTP_SPF_SOFTFAIL", &p.SoftFail, SPFAccept},
+		{"SMTP_SPF_PERMERROR", &p.PermError, SPFAccept},
+		{"SMTP_SPF_TEMPERROR", &p.TempError, SPFAccept},
+	} {
+		*a.action = a.def
+		value := strings.ToLower(strings.TrimSpace(os.Getenv(a.key)))
+		if value == "" {
+			continue
+		}
+		switch SPFAction(value) {
+		case SPFAccept, SPFReject, SPFDefer:
+			*a.action = SPFAction(value)
+		default:
+			return SPFPolicy{}, fmt.Errorf("%s: unknown action %q (want accept, reject or defer)", a.key, value)
+		}
+	}
+	return p, nil
+}
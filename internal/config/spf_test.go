@@ -0,0 +1,36 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSPF(t *testing.T) {
+	p, err := SPF()
+	if err != nil {
+		t.Fatalf("SPF: %v", err)
+	}
+	if p.Enabled || p.Fail != SPFReject || p.SoftFail != SPFAccept || p.PermError != SPFAccept || p.TempError != SPFAccept || p.Timeout != defaultSPFTimeout {
+		t.Fatalf("unexpected default policy %+v", p)
+	}
+	if p.Action("pass") != SPFAccept || p.Action("fail") != SPFReject {
+		t.Fatalf("unexpected actions for %+v", p)
+	}
+
+	t.Setenv("SMTP_SPF", "true")
+	t.Setenv("SMTP_SPF_SOFTFAIL", " Reject ")
+	t.Setenv("SMTP_SPF_TEMPERROR", "defer")
+	t.Setenv("SMTP_SPF_TIMEOUT", "3s")
+	p, err = SPF()
+	if err != nil {
+		t.Fatalf("SPF: %v", err)
+	}
+	if !p.Enabled || p.SoftFail != SPFReject || p.Action("temperror") != SPFDefer || p.Timeout != 3*time.Second {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+
+	t.Setenv("SMTP_SPF_PERMERROR", "bounce")
+	if _, err := SPF(); err == nil {
+		t.Fatal("expected an error for an unknown action")
+	}
+}
@@ -0,0 +1,209 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxARCInstances is the longest ARC chain RFC 8617 section 4.2.1 allows.
+const maxARCInstances = 50
+
+// ARCResult is the outcome of validating the ARC chain of a message
+// (RFC 8617 section 5.2).
+type ARCResult struct {
+	// Status is none without ARC sets, pass for a valid chain and fail
+	// otherwise.
+	Status Status
+	// Instance is the number of ARC sets, and Domain the signing domain of the
+	// newest ARC-Seal.
+	Instance int
+	Domain   string
+	// Reason explains failures.
+	Reason string
+}
+
+// arcSet holds the three header fields of one ARC instance.
+type arcSet struct {
+	results, signature, seal *headerField
+}
+
+// VerifyARC validates the ARC chain of message: the sets must be complete and
+// numbered 1 to N, each seal must carry the right cv= and verify, and the newest
+// ARC-Message-Signature must verify.
+func VerifyARC(ctx context.Context, resolver Resolver, message []byte) ARCResult {
+	fields, body := splitMessage(normalizeLineEndings(message))
+	sets, err := collectARCSets(fields)
+	if err != nil {
+		return ARCResult{Status: StatusFail, Reason: err.Error()}
+	}
+	n := len(sets) - 1
+	if n == 0 {
+		return ARCResult{Status: StatusNone}
+	}
+	fail := func(format string, args ...any) ARCResult {
+		return ARCResult{Status: StatusFail, Instance: n, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	seals := make([]map[string]string, n+1)
+	for i := 1; i <= n; i++ {
+		tags, err := parseTags(sets[i].seal.value())
+		if err != nil {
+			return fail("ARC-Seal i=%d: %v", i, err)
+		}
+		seals[i] = tags
+	}
+	if seals[n]["cv"] == "fail" {
+		return fail("chain already failed at i=%d", n)
+	}
+	for i := 1; i <= n; i++ {
+		want := "pass"
+		if i == 1 {
+			want = "none"
+		}
+		if cv := seals[i]["cv"]; cv != want {
+			return fail("ARC-Seal i=%d has cv=%s, want %s", i, cv, want)
+		}
+	}
+
+	if err := verifyARCMessageSignature(ctx, resolver, fields, body, sets[n].signature); err != nil {
+		return fail("ARC-Message-Signature i=%d: %v", n, err)
+	}
+	for i := n; i >= 1; i-- {
+		tags := seals[i]
+		sig, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+		if err != nil {
+			return fail("ARC-Seal i=%d: %v", i, err)
+		}
+		if err := verifySignature(ctx, resolver, tags["a"], tags["s"], tags["d"], sealedData(sets[:i+1]), sig); err != nil {
+			return fail("ARC-Seal i=%d: %v", i, err)
+		}
+	}
+	return ARCResult{Status: StatusPass, Instance: n, Domain: seals[n]["d"]}
+}
+
+// collectARCSets groups the ARC header fields by instance. The result is indexed
+// by instance, so its first element is unused.
+func collectARCSets(fields []headerField) ([]arcSet, error) {
+	byInstance := make(map[int]*arcSet)
+	highest := 0
+	for i := range fields {
+		f := &fields[i]
+		var slot func(*arcSet) **headerField
+		switch strings.ToLower(f.name) {
+		case "arc-authentication-results":
+			slot = func(s *arcSet) **headerField { return &s.results }
+		case "arc-message-signature":
+			slot = func(s *arcSet) **headerField { return &s.signature }
+		case "arc-seal":
+			slot = func(s *arcSet) **headerField { return &s.seal }
+		default:
+			continue
+		}
+		instance, err := arcInstance(f.value())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		set := byInstance[instance]
+		if set == nil {
+			set = &arcSet{}
+			byInstance[instance] = set
+		}
+		if *slot(set) != nil {
+			return nil, fmt.Errorf("duplicate %s for i=%d", f.name, instance)
+		}
+		*slot(set) = f
+		highest = max(highest, instance)
+	}
+
+	sets := make([]arcSet, highest+1)
+	for i := 1; i <= highest; i++ {
+		set := byInstance[i]
+		if set == nil || set.results == nil || set.signature == nil || set.seal == nil {
+			return nil, fmt.Errorf("ARC set i=%d is incomplete", i)
+		}
+		sets[i] = *set
+	}
+	return sets, nil
+}
+
+// arcInstance reads the i= tag that leads every ARC header field.
+func arcInstance(value string) (int, error) {
+	for _, part := range strings.Split(value, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || strings.TrimSpace(k) != "i" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 1 || n > maxARCInstances {
+			return 0, fmt.Errorf("invalid instance %q", v)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("missing instance tag")
+}
+
+// verifyARCMessageSignature verifies an ARC-Message-Signature the way DKIM
+// verifies a DKIM-Signature.
+func verifyARCMessageSignature(ctx context.Context, resolver Resolver, fields []headerField, body []byte, ams *headerField) error {
+	tags, err := parseTags(ams.value())
+	if err != nil {
+		return permFail("%v", err)
+	}
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return permFail("missing %s= tag", tag)
+		}
+	}
+	headerCanon, bodyCanon, err := parseCanonicalization(tags["c"])
+	if err != nil {
+		return permFail("%v", err)
+	}
+	h := strings.Split(tags["h"], ":")
+	for _, name := range h {
+		if strings.EqualFold(strings.TrimSpace(name), "ARC-Seal") {
+			return permFail("signs ARC-Seal")
+		}
+	}
+
+	canonical := canonicalBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return permFail("invalid l= tag")
+		}
+		canonical = canonical[:min(n, len(canonical))]
+	}
+	bodyHash := sha256.Sum256(canonical)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != stripWhitespace(tags["bh"]) {
+		return permFail("body hash did not verify")
+	}
+
+	data := signedHeaders(fields, h, headerCanon) + strings.TrimSuffix(canonicalHeader(withoutSignature(ams.raw), headerCanon), "\r\n")
+	sig, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+	if err != nil {
+		return permFail("%v", err)
+	}
+	return verifySignature(ctx, resolver, tags["a"], tags["s"], tags["d"], []byte(data), sig)
+}
+
+// sealedData returns what the ARC-Seal of the last set in sets signs: every set
+// in order, each as ARC-Authentication-Results, ARC-Message-Signature and
+// ARC-Seal, relaxed, with the final seal's signature emptied.
+func sealedData(sets []arcSet) []byte {
+	var b bytes.Buffer
+	last := len(sets) - 1
+	for i := 1; i <= last; i++ {
+		b.WriteString(canonicalHeader(sets[i].results.raw, "relaxed"))
+		b.WriteString(canonicalHeader(sets[i].signature.raw, "relaxed"))
+		if i < last {
+			b.WriteString(canonicalHeader(sets[i].seal.raw, "relaxed"))
+		}
+	}
+	b.WriteString(strings.TrimSuffix(canonicalHeader(withoutSignature(sets[last].seal.raw), "relaxed"), "\r\n"))
+	return b.Bytes()
+}
@@ -0,0 +1,77 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// addARCSet seals message as ARC instance i with cv, signing From and Subject.
+func addARCSet(t *testing.T, key *rsa.PrivateKey, message string, i int, cv string) string {
+	t.Helper()
+	sign := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	fields, body := splitMessage([]byte(message))
+	bodyHash := sha256.Sum256(canonicalBody(body, "relaxed"))
+
+	aar := headerField{name: "ARC-Authentication-Results", raw: fmt.Sprintf("ARC-Authentication-Results: i=%d; hop%d.example; spf=pass\r\n", i, i)}
+	ams := fmt.Sprintf("ARC-Message-Signature: i=%d; a=rsa-sha256; c=relaxed/relaxed; d=example.net; s=arc;\r\n\th=from:subject; bh=%s; b=", i, base64.StdEncoding.EncodeToString(bodyHash[:]))
+	ams += sign([]byte(signedHeaders(fields, []string{"from", "subject"}, "relaxed")+strings.TrimSuffix(canonicalHeader(ams+"\r\n", "relaxed"), "\r\n"))) + "\r\n"
+
+	sets, err := collectARCSets(fields)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	seal := fmt.Sprintf("ARC-Seal: i=%d; a=rsa-sha256; cv=%s; d=example.net; s=arc; b=", i, cv)
+	sets = append(sets, arcSet{results: &aar, signature: &headerField{raw: ams}, seal: &headerField{raw: seal + "\r\n"}})
+	seal += sign(sealedData(sets)) + "\r\n"
+	return seal + ams + aar.raw + message
+}
+
+func TestVerifyARC(t *testing.T) {
+	key, record := testKey(t)
+	resolver := keyResolver{txt: map[string]string{"arc._domainkey.example.net": record}}
+	message := "From: alice@example.com\r\nSubject: hello\r\n\r\nHello\r\n"
+	verify := func(m string) ARCResult { return VerifyARC(context.Background(), resolver, []byte(m)) }
+
+	if r := verify(message); r.Status != StatusNone {
+		t.Fatalf("expected none without ARC sets, got %+v", r)
+	}
+	once := addARCSet(t, key, message, 1, "none")
+	if r := verify(once); r.Status != StatusPass || r.Instance != 1 || r.Domain != "example.net" {
+		t.Fatalf("expected one valid set to pass, got %+v", r)
+	}
+	twice := addARCSet(t, key, "Received: from hop1\r\n"+once, 2, "pass")
+	if r := verify(twice); r.Status != StatusPass || r.Instance != 2 {
+		t.Fatalf("expected two valid sets to pass, got %+v", r)
+	}
+
+	for name, m := range map[string]string{
+		"modified body":   strings.Replace(twice, "Hello", "Goodbye", 1),
+		"modified seal":   strings.Replace(twice, "hop1.example", "evil.example", 1),
+		"wrong cv":        addARCSet(t, key, message, 1, "pass"),
+		"failed chain":    addARCSet(t, key, once, 2, "fail"),
+		"missing set":     addARCSet(t, key, message, 2, "pass"),
+		"incomplete set":  strings.Replace(once, "ARC-Authentication-Results: i=1", "X-Removed: i=1", 1),
+		"duplicate field": "ARC-Seal: i=1; cv=none\r\n" + once,
+	} {
+		if r := verify(m); r.Status != StatusFail {
+			t.Errorf("%s: expected fail, got %+v", name, r)
+		}
+	}
+	if r := VerifyARC(context.Background(), keyResolver{}, []byte(once)); r.Status != StatusFail {
+		t.Fatalf("expected a missing key to fail, got %+v", r)
+	}
+}
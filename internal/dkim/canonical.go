@@ -0,0 +1,257 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// headerField is one raw header field of a message, including its folding and
+// trailing CRLF.
+type headerField struct {
+	name string
+	raw  string
+}
+
+// value returns the unfolded field body after the colon.
+func (f headerField) value() string {
+	_, v, _ := strings.Cut(f.raw, ":")
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(v))
+}
+
+// splitMessage splits a CRLF message into its header fields and body.
+func splitMessage(message []byte) ([]headerField, []byte) {
+	var fields []headerField
+	rest := message
+	for len(rest) > 0 {
+		if bytes.HasPrefix(rest, []byte("\r\n")) {
+			return fields, rest[2:]
+		}
+		end := 0
+		for {
+			i := bytes.Index(rest[end:], []byte("\r\n"))
+			if i < 0 {
+				end = len(rest)
+				break
+			}
+			end += i + 2
+			if end == len(rest) || (rest[end] != ' ' && rest[end] != '\t') {
+				break
+			}
+		}
+		raw := string(rest[:end])
+		name, _, _ := strings.Cut(raw, ":")
+		fields = append(fields, headerField{name: strings.TrimSpace(name), raw: raw})
+		rest = rest[end:]
+	}
+	return fields, nil
+}
+
+var wsp = regexp.MustCompile(`[ \t]+`)
+
+// canonicalHeader canonicalizes a raw header field (RFC 6376 section 3.4).
+func canonicalHeader(raw, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.TrimSpace(wsp.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// canonicalBody canonicalizes a CRLF message body (RFC 6376 section 3.4).
+func canonicalBody(body []byte, canon string) []byte {
+	if canon != "simple" {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, line := range lines {
+			lines[i] = bytes.TrimRight(wsp.ReplaceAll(line, []byte(" ")), " ")
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 {
+		if canon == "simple" {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+	return append(body, '\r', '\n')
+}
+
+// parseTags parses a DKIM tag list such as "v=1; a=rsa-sha256; d=example.com".
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag %q", part)
+		}
+		k = strings.TrimSpace(k)
+		if _, dup := tags[k]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", k)
+		}
+		tags[k] = strings.TrimSpace(v)
+	}
+	return tags, nil
+}
+
+var signatureValue = regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// withoutSignature empties the b= tag of a raw signature header field.
+func withoutSignature(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	return name + ":" + signatureValue.ReplaceAllString(value, "$1$2")
+}
+
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// verifyError is a signature that did not verify, and whether that was a
+// temporary condition.
+type verifyError struct {
+	temporary bool
+	msg       string
+}
+
+func (e *verifyError) Error() string { return e.msg }
+
+func permFail(format string, args ...any) error {
+	return &verifyError{msg: fmt.Sprintf(format, args...)}
+}
+
+// lookupKey fetches the public key published for selector in domain.
+func lookupKey(ctx context.Context, resolver Resolver, selector, domain string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, permFail("no key at %s", name)
+		}
+		return nil, &verifyError{temporary: true, msg: fmt.Sprintf("key lookup %s: %v", name, err)}
+	}
+	if len(txts) != 1 {
+		return nil, permFail("%d TXT records at %s", len(txts), name)
+	}
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, permFail("key at %s: %v", name, err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, permFail("key at %s has version %q", name, v)
+	}
+	data, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["p"]))
+	if err != nil {
+		return nil, permFail("key at %s: %v", name, err)
+	}
+	if len(data) == 0 {
+		return nil, permFail("key at %s is revoked", name)
+	}
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			if key, err := x509.ParsePKCS1PublicKey(data); err == nil {
+				return key, nil
+			}
+			return nil, permFail("key at %s: %v", name, err)
+		}
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return nil, permFail("key at %s is not an RSA key", name)
+		}
+		return key, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, permFail("key at %s has the wrong size for Ed25519", name)
+		}
+		return ed25519.PublicKey(data), nil
+	default:
+		return nil, permFail("key at %s has unsupported type %q", name, k)
+	}
+}
+
+// verifySignature checks sig over data with the key published for selector in
+// domain, for an a= tag of rsa-sha256 or ed25519-sha256.
+func verifySignature(ctx context.Context, resolver Resolver, algorithm, selector, domain string, data, sig []byte) error {
+	key, err := lookupKey(ctx, resolver, selector, domain)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "rsa-sha256" {
+			return permFail("algorithm %s does not match the RSA key", algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig); err != nil {
+			return permFail("signature did not verify")
+		}
+	case ed25519.PublicKey:
+		if algorithm != "ed25519-sha256" {
+			return permFail("algorithm %s does not match the Ed25519 key", algorithm)
+		}
+		if !ed25519.Verify(k, sum[:], sig) {
+			return permFail("signature did not verify")
+		}
+	}
+	return nil
+}
+
+// signedHeaders canonicalizes the fields named in h in the order DKIM signs them:
+// each name takes the bottom-most instance not yet used, and missing fields are
+// skipped.
+func signedHeaders(fields []headerField, h []string, canon string) string {
+	used := make(map[int]bool)
+	var b strings.Builder
+	for _, name := range h {
+		name = strings.TrimSpace(name)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				b.WriteString(canonicalHeader(fields[i].raw, canon))
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// parseCanonicalization splits a c= tag into header and body canonicalization.
+func parseCanonicalization(c string) (string, string, error) {
+	if c == "" {
+		return "simple", "simple", nil
+	}
+	header, body, ok := strings.Cut(c, "/")
+	if !ok {
+		body = "simple"
+	}
+	for _, v := range []string{header, body} {
+		if v != "simple" && v != "relaxed" {
+			return "", "", fmt.Errorf("unknown canonicalization %q", c)
+		}
+	}
+	return header, body, nil
+}
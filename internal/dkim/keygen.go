@@ -0,0 +1,65 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// minRSABits is the smallest RSA key GenerateKey creates; RFC 8301 requires
+// verifiers to reject anything shorter than 1024 bits and signers to use at
+// least 1024, recommending 2048.
+const minRSABits = 1024
+
+// GenerateKey creates a signing key for algorithm "rsa", with bits bits (2048
+// when zero), or "ed25519" (RFC 8463).
+func GenerateKey(algorithm string, bits int) (crypto.Signer, error) {
+	switch strings.ToLower(algorithm) {
+	case "rsa":
+		if bits == 0 {
+			bits = 2048
+		}
+		if bits < minRSABits {
+			return nil, fmt.Errorf("dkim: RSA keys need at least %d bits", minRSABits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("dkim: unknown key algorithm %q", algorithm)
+	}
+}
+
+// MarshalKey encodes key as a PKCS #8 PEM block, which the keyring and
+// SMTP_DKIM_KEY_PATH read.
+func MarshalKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// TXTRecord returns the DNS TXT record that publishes the public half of key,
+// such as "v=DKIM1; k=ed25519; p=...".
+func TXTRecord(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return "", fmt.Errorf("dkim: %w", err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub), nil
+	default:
+		return "", fmt.Errorf("dkim: unsupported key type %T", pub)
+	}
+}
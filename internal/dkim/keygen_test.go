@@ -0,0 +1,62 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestGenerateKey(t *testing.T) {
+	for _, tt := range []struct {
+		algorithm string
+		bits      int
+		record    string
+	}{
+		{"rsa", 1024, "v=DKIM1; k=rsa; p="},
+		{"ed25519", 0, "v=DKIM1; k=ed25519; p="},
+	} {
+		key, err := GenerateKey(tt.algorithm, tt.bits)
+		if err != nil {
+			t.Fatalf("GenerateKey(%s): %v", tt.algorithm, err)
+		}
+		data, err := MarshalKey(key)
+		if err != nil {
+			t.Fatalf("MarshalKey(%s): %v", tt.algorithm, err)
+		}
+		parsed, err := parsePrivateKey(data)
+		if err != nil {
+			t.Fatalf("parse %s key: %v", tt.algorithm, err)
+		}
+		switch k := parsed.(type) {
+		case *rsa.PrivateKey:
+			if !k.Equal(key) {
+				t.Fatalf("RSA key did not round-trip")
+			}
+		case ed25519.PrivateKey:
+			if !k.Equal(key) {
+				t.Fatalf("Ed25519 key did not round-trip")
+			}
+		}
+
+		record, err := TXTRecord(key)
+		if err != nil || len(record) <= len(tt.record) || record[:len(tt.record)] != tt.record {
+			t.Fatalf("TXTRecord(%s) = %q, %v", tt.algorithm, record, err)
+		}
+		pub, err := lookupKey(context.Background(), keyResolver{txt: map[string]string{"s._domainkey.example.com": record}}, "s", "example.com")
+		if err != nil {
+			t.Fatalf("lookupKey(%s): %v", tt.algorithm, err)
+		}
+		if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(pub) {
+			t.Fatalf("%s record does not publish the key", tt.algorithm)
+		}
+	}
+
+	if _, err := GenerateKey("rsa", 512); err == nil {
+		t.Fatal("expected a short RSA key to be refused")
+	}
+	if _, err := GenerateKey("dsa", 0); err == nil {
+		t.Fatal("expected an unknown algorithm to be refused")
+	}
+}
@@ -0,0 +1,334 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoKey reports that no signing key is configured for a domain, or that all
+// of its keys have expired. Mail from such domains is sent unsigned rather than
+// signed with a key the domain does not publish.
+var ErrNoKey = errors.New("dkim: no signing key")
+
+// now is the clock for key schedules and signature timestamps; tests replace it.
+var now = time.Now
+
+// signingKey is a private key, the selector its public half is published under,
+// the period it signs in and the options it signs with. Zero times leave the
+// period open.
+type signingKey struct {
+	selector  string
+	key       crypto.Signer
+	notBefore time.Time
+	notAfter  time.Time
+	options   signOptions
+}
+
+func (k signingKey) activeAt(t time.Time) bool {
+	return (k.notBefore.IsZero() || !t.Before(k.notBefore)) && (k.notAfter.IsZero() || t.Before(k.notAfter))
+}
+
+// keyring holds the signing keys of each domain. It reads a directory laid out
+// as <domain>/<selector>.pem or a file of lines
+//
+//	domain selector key-path [not-before=TIME] [not-after=TIME] [OPTION=VALUE]...
+//
+// where TIME is a date such as 2025-01-31 (midnight UTC) or an RFC 3339 time,
+// and OPTION is one of headers, oversign, canonicalization or expiration,
+// overriding the SMTP_DKIM_* setting of that name for the key.
+// Blank lines and lines starting with # are ignored, and relative key paths are
+// resolved against the file's directory. A domain may list several keys; all
+// that are active sign, which covers the overlap of a key rotation. The keyring
+// is reloaded automatically when the directory, the file or any key changes.
+type keyring struct {
+	path     string
+	defaults signOptions
+
+	mu    sync.Mutex
+	stamp string
+	files []string
+	keys  map[string][]signingKey
+	// failure is the last reload error logged, so that it is logged once.
+	failure string
+}
+
+// loadKeyring reads the keyring at path. Keys sign with defaults unless their
+// line overrides them.
+func loadKeyring(path string, defaults signOptions) (*keyring, error) {
+	r := &keyring{path: path, defaults: defaults}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload rereads the keyring when any of its files changed since the last load.
+// Once a load has succeeded, a failed reload is logged and the keys loaded
+// before keep signing, so a key file caught mid-write or a line naming a key
+// not yet copied does not stop mail. The reload is retried on the next call.
+func (r *keyring) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.load()
+	if err == nil || r.keys == nil {
+		r.failure = ""
+		return err
+	}
+	if msg := err.Error(); msg != r.failure {
+		r.failure = msg
+		log.Printf("%v; signing with the keys loaded before", err)
+	}
+	return nil
+}
+
+// load reads the keyring if its fingerprint changed. Callers hold r.mu.
+func (r *keyring) load() error {
+	stamp, err := r.fingerprint()
+	if err != nil {
+		return fmt.Errorf("dkim: keyring: %w", err)
+	}
+	if r.keys != nil && stamp == r.stamp {
+		return nil
+	}
+	keys, files, err := r.read()
+	if err != nil {
+		return err
+	}
+	// The fingerprint covers the key files the file layout names, which are
+	// only known now.
+	r.keys, r.files = keys, files
+	if r.stamp, err = r.fingerprint(); err != nil {
+		return fmt.Errorf("dkim: keyring: %w", err)
+	}
+	return nil
+}
+
+// fingerprint summarizes the names, sizes and modification times of the files
+// the keyring is read from. Callers hold r.mu.
+func (r *keyring) fingerprint() (string, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return "", err
+	}
+	paths := r.files
+	if info.IsDir() {
+		if paths, err = filepath.Glob(filepath.Join(r.path, "*", "*.pem")); err != nil {
+			return "", err
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %d\n", info.ModTime().UnixNano(), info.Size())
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", p, info.ModTime().UnixNano(), info.Size())
+	}
+	return b.String(), nil
+}
+
+// read parses the keyring and returns its keys and the key files it named.
+// Callers hold r.mu.
+func (r *keyring) read() (map[string][]signingKey, []string, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dkim: keyring: %w", err)
+	}
+	keys := make(map[string][]signingKey)
+	var files []string
+	add := func(domain, keyPath string, k signingKey) error {
+		domain = normalizeDomain(domain)
+		if domain == "" || k.selector == "" {
+			return fmt.Errorf("dkim: keyring: %s: missing domain or selector", keyPath)
+		}
+		for _, other := range keys[domain] {
+			if other.selector == k.selector {
+				return fmt.Errorf("dkim: keyring: selector %s listed twice for %s", k.selector, domain)
+			}
+		}
+		data, err := os.ReadFile(keyPath)
+		if err != nil {
+			return fmt.Errorf("dkim: keyring: %w", err)
+		}
+		if k.key, err = parsePrivateKey(data); err != nil {
+			return fmt.Errorf("dkim: keyring: %s: %w", keyPath, err)
+		}
+		keys[domain] = append(keys[domain], k)
+		files = append(files, keyPath)
+		return nil
+	}
+
+	if info.IsDir() {
+		matches, err := filepath.Glob(filepath.Join(r.path, "*", "*.pem"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("dkim: keyring: %w", err)
+		}
+		for _, match := range matches {
+			domain := filepath.Base(filepath.Dir(match))
+			if strings.HasPrefix(domain, ".") {
+				continue
+			}
+			if err := add(domain, match, signingKey{selector: strings.TrimSuffix(filepath.Base(match), ".pem"), options: r.defaults}); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else {
+		data, err := os.ReadFile(r.path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dkim: keyring: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				return nil, nil, fmt.Errorf("dkim: keyring: %s:%d: expected domain, selector and key path", r.path, n)
+			}
+			k := signingKey{selector: fields[1], options: r.defaults}
+			for _, field := range fields[3:] {
+				name, value, _ := strings.Cut(field, "=")
+				var err error
+				switch name {
+				case "not-before":
+					k.notBefore, err = parseKeyTime(value)
+				case "not-after":
+					k.notAfter, err = parseKeyTime(value)
+				default:
+					err = k.options.set(name, value)
+				}
+				if err != nil {
+					return nil, nil, fmt.Errorf("dkim: keyring: %s:%d: %s: %w", r.path, n, name, err)
+				}
+			}
+			if err := k.options.check(); err != nil {
+				return nil, nil, fmt.Errorf("dkim: keyring: %s:%d: %w", r.path, n, err)
+			}
+			keyPath := fields[2]
+			if !filepath.IsAbs(keyPath) {
+				keyPath = filepath.Join(filepath.Dir(r.path), keyPath)
+			}
+			if err := add(fields[0], keyPath, k); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("dkim: keyring: no keys found in %s", r.path)
+	}
+	return keys, files, nil
+}
+
+// parseKeyTime reads a key schedule time: a date, taken as midnight UTC, or an
+// RFC 3339 time.
+func parseKeyTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// active returns the keys of domain that sign at t, and whether the domain is
+// in the keyring at all.
+func (r *keyring) active(domain string, t time.Time) ([]signingKey, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all, ok := r.keys[domain]
+	var keys []signingKey
+	for _, k := range all {
+		if k.activeAt(t) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, ok
+}
+
+// keysFor returns the keys that sign for domain and the d= domain they sign
+// as. A keyring entry with active keys for domain or its nearest parent wins, so
+// that news.example.com signs with the keys of example.com. Otherwise the single
+// key from SMTP_DKIM_SELECTOR signs: as domain itself when there is no keyring,
+// and alongside a keyring only as SMTP_DKIM_DOMAIN, for it and its subdomains.
+// A changed keyring is reloaded first.
+func (s *Signer) keysFor(domain string) ([]signingKey, string, error) {
+	domain = normalizeDomain(domain)
+	expired := false
+	if s.keys != nil {
+		if err := s.keys.reload(); err != nil {
+			return nil, "", err
+		}
+		t := now()
+		for d := domain; d != ""; {
+			keys, listed := s.keys.active(d, t)
+			if len(keys) > 0 {
+				return keys, d, nil
+			}
+			expired = expired || listed
+			_, parent, ok := strings.Cut(d, ".")
+			if !ok || !strings.Contains(parent, ".") {
+				break
+			}
+			d = parent
+		}
+	}
+	if s.key != nil {
+		single := []signingKey{{selector: s.selector, key: s.key, options: s.options}}
+		if s.keys == nil {
+			return single, domain, nil
+		}
+		if s.domain != "" && (domain == s.domain || strings.HasSuffix(domain, "."+s.domain)) {
+			return single, s.domain, nil
+		}
+	}
+	if expired {
+		return nil, "", fmt.Errorf("%w for %s: every key is outside its schedule", ErrNoKey, domain)
+	}
+	return nil, "", fmt.Errorf("%w for %s", ErrNoKey, domain)
+}
+
+// sealingKey returns the key that ARC seals as domain. RSA is preferred, as
+// ARC verifiers need not support Ed25519.
+func (s *Signer) sealingKey(domain string) (signingKey, string, error) {
+	keys, d, err := s.keysFor(domain)
+	if err != nil {
+		return signingKey{}, "", err
+	}
+	for _, k := range keys {
+		if _, ok := k.key.Public().(*rsa.PublicKey); ok {
+			return k, d, nil
+		}
+	}
+	return keys[0], d, nil
+}
+
+// Domains lists the domains of the keyring in order.
+func (s *Signer) Domains() []string {
+	if s == nil || s.keys == nil {
+		return nil
+	}
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+	domains := make([]string, 0, len(s.keys.keys))
+	for d := range s.keys.keys {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
@@ -0,0 +1,159 @@
+package dkim
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultHeaders are the header fields signed unless SMTP_DKIM_HEADERS lists
+// others.
+var defaultHeaders = []string{"from", "to", "subject", "date", "mime-version", "content-type", "message-id"}
+
+// signOptions are the settings a key signs with. Zero values take the defaults:
+// defaultHeaders, relaxed/relaxed and no expiration. The whole body is always
+// signed.
+type signOptions struct {
+	// headers are signed in every instance present.
+	headers []string
+	// oversign fields are signed once more than they are present, so a copy
+	// added later breaks the signature.
+	oversign []string
+	// headerCanon and bodyCanon are "simple" or "relaxed".
+	headerCanon, bodyCanon string
+	// expiration sets x= that long after t=; zero leaves signatures valid.
+	expiration time.Duration
+}
+
+// optionEnv names the variable that sets each option for every key. Body length
+// limits are listed only so that setting one is refused rather than ignored.
+var optionEnv = []struct{ name, env string }{
+	{"headers", "SMTP_DKIM_HEADERS"},
+	{"oversign", "SMTP_DKIM_OVERSIGN"},
+	{"canonicalization", "SMTP_DKIM_CANONICALIZATION"},
+	{"body-limit", "SMTP_DKIM_BODY_LIMIT"},
+	{"expiration", "SMTP_DKIM_EXPIRATION"},
+}
+
+// optionsFromEnv reads the signing options that apply to every key unless its
+// keyring line overrides them.
+func optionsFromEnv() (signOptions, error) {
+	var o signOptions
+	for _, opt := range optionEnv {
+		if value := strings.TrimSpace(os.Getenv(opt.env)); value != "" {
+			if err := o.set(opt.name, value); err != nil {
+				return signOptions{}, fmt.Errorf("dkim: %s: %w", opt.env, err)
+			}
+		}
+	}
+	if err := o.check(); err != nil {
+		return signOptions{}, fmt.Errorf("dkim: SMTP_DKIM_HEADERS: %w", err)
+	}
+	return o, nil
+}
+
+// set applies one option by its keyring name.
+func (o *signOptions) set(name, value string) error {
+	switch name {
+	case "headers":
+		o.headers = headerList(value)
+		if len(o.headers) == 0 {
+			return fmt.Errorf("empty header list")
+		}
+	case "oversign":
+		o.oversign = headerList(value)
+	case "canonicalization":
+		header, body, err := parseCanonicalization(strings.ToLower(value))
+		if err != nil {
+			return err
+		}
+		o.headerCanon, o.bodyCanon = header, body
+	case "body-limit":
+		return fmt.Errorf("body length limits are not supported: verifiers, including SMTP_DKIM_VERIFY, fail signatures with l=")
+	case "expiration":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid expiration %q", value)
+		}
+		o.expiration = d
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
+
+// check reports settings that cannot make a valid signature.
+func (o signOptions) check() error {
+	for _, list := range [][]string{o.signedFields(), o.oversign} {
+		for _, name := range list {
+			if name == "from" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the From header must be signed")
+}
+
+// signedFields returns the headers setting or its default.
+func (o signOptions) signedFields() []string {
+	if len(o.headers) == 0 {
+		return defaultHeaders
+	}
+	return o.headers
+}
+
+// canonicalization returns the header and body canonicalization.
+func (o signOptions) canonicalization() (string, string) {
+	if o.headerCanon == "" {
+		return "relaxed", "relaxed"
+	}
+	return o.headerCanon, o.bodyCanon
+}
+
+// headerNames returns the h= list for fields: each signed header once per
+// instance, and each oversigned header once more than that.
+func (o signOptions) headerNames(fields []headerField) []string {
+	count := func(name string) int {
+		n := 0
+		for _, f := range fields {
+			if strings.EqualFold(f.name, name) {
+				n++
+			}
+		}
+		return n
+	}
+	over := make(map[string]bool)
+	for _, name := range o.oversign {
+		over[name] = true
+	}
+	var h []string
+	for _, name := range o.signedFields() {
+		if over[name] {
+			continue
+		}
+		for i := count(name); i > 0; i-- {
+			h = append(h, name)
+		}
+	}
+	for _, name := range o.oversign {
+		for i := count(name); i >= 0; i-- {
+			h = append(h, name)
+		}
+	}
+	return h
+}
+
+// headerList splits a list of header names separated by commas or colons.
+func headerList(value string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ':' }) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,198 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	msgauthdkim "github.com/emersion/go-msgauth/dkim"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv("SMTP_DKIM_HEADERS", "From, To,subject,from")
+	t.Setenv("SMTP_DKIM_OVERSIGN", "from:subject")
+	t.Setenv("SMTP_DKIM_CANONICALIZATION", "Simple/Relaxed")
+	t.Setenv("SMTP_DKIM_EXPIRATION", "72h")
+	o, err := optionsFromEnv()
+	if err != nil {
+		t.Fatalf("optionsFromEnv: %v", err)
+	}
+	if got := strings.Join(o.headers, ","); got != "from,to,subject" {
+		t.Errorf("headers = %q", got)
+	}
+	if got := strings.Join(o.oversign, ","); got != "from,subject" {
+		t.Errorf("oversign = %q", got)
+	}
+	if o.headerCanon != "simple" || o.bodyCanon != "relaxed" || o.expiration != 72*time.Hour {
+		t.Errorf("unexpected options %+v", o)
+	}
+
+	for env, value := range map[string]string{
+		"SMTP_DKIM_HEADERS":          "to,subject",
+		"SMTP_DKIM_CANONICALIZATION": "strict",
+		"SMTP_DKIM_BODY_LIMIT":       "4096",
+		"SMTP_DKIM_EXPIRATION":       "3 days",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("SMTP_DKIM_OVERSIGN", "")
+			t.Setenv(env, value)
+			if _, err := optionsFromEnv(); err == nil || !strings.Contains(err.Error(), env) {
+				t.Fatalf("expected an error naming %s, got %v", env, err)
+			}
+		})
+	}
+}
+
+func TestHeaderNames(t *testing.T) {
+	fields, _ := splitMessage([]byte("From: a@example.com\r\nTo: b@example.net\r\nTo: c@example.net\r\nSubject: hi\r\n\r\n"))
+	o := signOptions{headers: []string{"from", "to", "subject", "date"}, oversign: []string{"from", "subject", "reply-to"}}
+	if got := strings.Join(o.headerNames(fields), ":"); got != "to:to:from:from:subject:subject:reply-to" {
+		t.Fatalf("h = %q", got)
+	}
+	if got := strings.Join((signOptions{}).headerNames(fields), ":"); got != "from:to:to:subject" {
+		t.Fatalf("default h = %q", got)
+	}
+}
+
+func TestSignWithOptions(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	resolver := keyResolver{txt: map[string]string{"sel._domainkey.example.com": publicRecord(t, &key.PublicKey)}}
+	verify := func(message string) Result {
+		t.Helper()
+		results, err := Verify(context.Background(), resolver, []byte(message))
+		if err != nil || len(results) != 1 {
+			t.Fatalf("Verify = %+v, %v", results, err)
+		}
+		return results[0]
+	}
+	signer := &Signer{domain: "example.com", selector: "sel", key: key, options: signOptions{
+		headers:     []string{"from", "to", "subject"},
+		oversign:    []string{"from"},
+		headerCanon: "simple",
+		bodyCanon:   "simple",
+		expiration:  time.Hour,
+	}}
+	message := "From: alice@example.com\r\nTo: bob@example.net\r\nSubject: hi\r\n\r\nHello\r\n"
+	signed, err := signer.Sign([]byte(message), "alice@example.com")
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	for _, tag := range []string{"c=simple/simple;", "h=to:subject:from:from;", "x="} {
+		if !strings.Contains(string(signed), tag) {
+			t.Errorf("expected %s in:\n%s", tag, signed)
+		}
+	}
+	if r := verify(string(signed)); r.Status != StatusPass {
+		t.Fatalf("signature did not verify: %s", r.Reason)
+	}
+	forged := strings.Replace(string(signed), "From: alice@example.com\r\n", "From: mallory@example.org\r\nFrom: alice@example.com\r\n", 1)
+	if r := verify(forged); r.Status == StatusPass {
+		t.Fatalf("an added From header should break the oversigned signature")
+	}
+
+	now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	t.Cleanup(func() { now = time.Now })
+	expired, err := signer.Sign([]byte(message), "alice@example.com")
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if r := verify(string(expired)); r.Status == StatusPass {
+		t.Fatalf("expected the signature to have expired")
+	}
+	now = time.Now
+}
+
+// TestSignRoundTrip checks every canonicalization and header selection against
+// go-msgauth's verifier rather than this package's own code.
+func TestSignRoundTrip(t *testing.T) {
+	rsaKey, rsaRecord := testKey(t)
+	edKey, err := GenerateKey("ed25519", 0)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	edRecord, err := TXTRecord(edKey)
+	if err != nil {
+		t.Fatalf("TXTRecord: %v", err)
+	}
+	records := map[string]string{"rsa._domainkey.example.com": rsaRecord, "ed._domainkey.example.com": edRecord}
+	lookup := func(domain string) ([]string, error) {
+		if record, ok := records[domain]; ok {
+			return []string{record}, nil
+		}
+		return nil, fmt.Errorf("no record for %s", domain)
+	}
+	message := "From: Alice <alice@example.com>\r\nTo:  bob@example.net ,\r\n\tcarol@example.net\r\nSubject:   Mixed   case\t \r\n" +
+		"subject: a second subject\r\nDate: Mon, 1 Jan 2024 00:00:00 +0000\r\n\r\n  Hello   world \r\n\r\nBye\t\r\n\r\n\r\n"
+
+	selections := map[string]signOptions{
+		"default headers": {},
+		"listed headers":  {headers: []string{"from", "to", "subject"}},
+		"oversigned":      {headers: []string{"from", "to", "date"}, oversign: []string{"from", "subject", "reply-to"}},
+		"only oversigned": {headers: []string{"to"}, oversign: []string{"from"}},
+		"with expiration": {oversign: []string{"from"}, expiration: time.Hour},
+	}
+	for _, canon := range []string{"simple/simple", "simple/relaxed", "relaxed/simple", "relaxed/relaxed"} {
+		for name, o := range selections {
+			if err := o.set("canonicalization", canon); err != nil {
+				t.Fatalf("set canonicalization %s: %v", canon, err)
+			}
+			for _, k := range []signingKey{{selector: "rsa", key: rsaKey, options: o}, {selector: "ed", key: edKey, options: o}} {
+				signed, err := k.sign([]byte(message), "example.com")
+				if err != nil {
+					t.Fatalf("%s, %s, %s: sign: %v", canon, name, k.selector, err)
+				}
+				verifications, err := msgauthdkim.VerifyWithOptions(bytes.NewReader(signed), &msgauthdkim.VerifyOptions{LookupTXT: lookup})
+				if err != nil || len(verifications) != 1 || verifications[0].Err != nil {
+					t.Errorf("%s, %s, %s: go-msgauth did not verify the signature: %+v, %v\n%s", canon, name, k.selector, verifications, err, signed)
+				}
+			}
+		}
+	}
+}
+
+func TestKeyringOptions(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, filepath.Join(dir, "a.pem"))
+	file := filepath.Join(dir, "keyring")
+	content := "example.com a a.pem\npartner.example b a.pem canonicalization=simple headers=from,subject expiration=24h oversign=\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	defaults := signOptions{oversign: []string{"from"}, expiration: time.Hour}
+	ring, err := loadKeyring(file, defaults)
+	if err != nil {
+		t.Fatalf("loadKeyring: %v", err)
+	}
+	if o := ring.keys["example.com"][0].options; len(o.oversign) != 1 || o.expiration != time.Hour || o.headers != nil {
+		t.Errorf("example.com should sign with the defaults, got %+v", o)
+	}
+	o := ring.keys["partner.example"][0].options
+	if o.headerCanon != "simple" || o.bodyCanon != "simple" || strings.Join(o.headers, ",") != "from,subject" ||
+		o.expiration != 24*time.Hour || len(o.oversign) != 0 {
+		t.Errorf("partner.example overrides not applied: %+v", o)
+	}
+
+	for name, content := range map[string]string{
+		"unsigned from":        "example.com a a.pem headers=to,subject oversign=\n",
+		"body limit":           "example.com a a.pem body-limit=100\n",
+		"unknown option":       "example.com a a.pem hash=sha1\n",
+		"bad canonicalization": "example.com a a.pem canonicalization=relaxed/strict\n",
+	} {
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadKeyring(file, defaults); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Seal adds an ARC set (RFC 8617 section 5.1) to message: an
+// ARC-Authentication-Results field carrying results under authservID, an
+// ARC-Message-Signature over the message and an ARC-Seal over the chain. The
+// existing chain is validated first and its verdict recorded in cv=. Messages
+// whose chain already failed, or that carry the most sets allowed, are returned
+// unchanged.
+//
+// Sealing needs SMTP_DKIM_DOMAIN: the seal speaks for this host, not for the
+// sender.
+func (s *Signer) Seal(ctx context.Context, resolver Resolver, message []byte, authservID, results string) ([]byte, error) {
+	if s == nil || (s.key == nil && s.keys == nil) {
+		return message, nil
+	}
+	if s.domain == "" {
+		return nil, fmt.Errorf("dkim: ARC sealing requires SMTP_DKIM_DOMAIN")
+	}
+	k, domain, err := s.sealingKey(s.domain)
+	if err != nil {
+		return nil, err
+	}
+	message = normalizeLineEndings(message)
+	fields, body := splitMessage(message)
+
+	cv := StatusNone
+	sets, err := collectARCSets(fields)
+	instance := len(sets) - 1
+	switch {
+	case err != nil:
+		// A malformed chain is sealed as failed after the seals present.
+		instance = 0
+		for _, f := range fields {
+			if strings.EqualFold(f.name, "ARC-Seal") {
+				instance++
+			}
+		}
+		cv = StatusFail
+	case instance > 0:
+		if tags, err := parseTags(sets[instance].seal.value()); err == nil && tags["cv"] == string(StatusFail) {
+			return message, nil
+		}
+		cv = VerifyARC(ctx, resolver, message).Status
+	}
+	if instance >= maxARCInstances {
+		return message, nil
+	}
+	instance++
+
+	algorithm, err := keyAlgorithm(k.key)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := now().Unix()
+	aar := headerField{name: "ARC-Authentication-Results", raw: fmt.Sprintf("ARC-Authentication-Results: i=%d; %s;\r\n\t%s\r\n", instance, authservID, results)}
+
+	bodyHash := sha256.Sum256(canonicalBody(body, "relaxed"))
+	h := sealedHeaderKeys(fields, k.options)
+	ams := fmt.Sprintf("ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		instance, algorithm, domain, k.selector, timestamp, strings.Join(h, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	sig, err := sign(k.key, []byte(signedHeaders(fields, h, "relaxed")+strings.TrimSuffix(canonicalHeader(ams+"\r\n", "relaxed"), "\r\n")))
+	if err != nil {
+		return nil, fmt.Errorf("dkim: sealing with selector %s failed: %w", k.selector, err)
+	}
+	amsField := headerField{name: "ARC-Message-Signature", raw: ams + sig + "\r\n"}
+
+	seal := fmt.Sprintf("ARC-Seal: i=%d; a=%s; t=%d; cv=%s;\r\n\td=%s; s=%s;\r\n\tb=", instance, algorithm, timestamp, cv, domain, k.selector)
+	if cv == StatusFail {
+		// A failed seal covers only its own set (RFC 8617 section 5.1.1).
+		sets = make([]arcSet, 1)
+	}
+	sets = append(sets, arcSet{results: &aar, signature: &amsField, seal: &headerField{name: "ARC-Seal", raw: seal + "\r\n"}})
+	if sig, err = sign(k.key, sealedData(sets)); err != nil {
+		return nil, fmt.Errorf("dkim: sealing with selector %s failed: %w", k.selector, err)
+	}
+
+	out := make([]byte, 0, len(message)+len(seal)+len(amsField.raw)+len(aar.raw)+len(sig)+2)
+	out = append(out, seal+sig+"\r\n"...)
+	out = append(out, amsField.raw...)
+	out = append(out, aar.raw...)
+	return append(out, message...), nil
+}
+
+// sealedHeaderKeys lists the header fields the ARC-Message-Signature covers:
+// the fields the sealing key signs for DKIM and any DKIM signatures, as present
+// in fields.
+func sealedHeaderKeys(fields []headerField, o signOptions) []string {
+	var h []string
+	for _, key := range o.signedFields() {
+		for _, f := range fields {
+			if strings.EqualFold(f.name, key) {
+				h = append(h, key)
+				break
+			}
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "DKIM-Signature") {
+			h = append(h, "dkim-signature")
+		}
+	}
+	return h
+}
+
+// keyAlgorithm returns the a= tag for key.
+func keyAlgorithm(key crypto.Signer) (string, error) {
+	switch key.Public().(type) {
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	default:
+		return "", fmt.Errorf("dkim: unsupported key type %T", key.Public())
+	}
+}
+
+// sign signs the SHA-256 hash of data with key, returning the base64 signature.
+// Errors come from key unwrapped, for the caller to say what it was signing.
+func sign(key crypto.Signer, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		// RFC 8463 signs the hash itself with pure Ed25519.
+		opts = crypto.Hash(0)
+	}
+	sig, err := key.Sign(rand.Reader, sum[:], opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
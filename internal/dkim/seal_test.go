@@ -0,0 +1,90 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSealBuildsValidChain(t *testing.T) {
+	key, record := testKey(t)
+	signer := &Signer{domain: "forwarder.example", selector: "arc", key: key, options: signOptions{headers: []string{"from", "subject"}}}
+	resolver := keyResolver{txt: map[string]string{"arc._domainkey.forwarder.example": record}}
+	ctx := context.Background()
+	message := []byte("From: alice@example.com\nSubject: hello\n\nHello\n")
+
+	once, err := signer.Seal(ctx, resolver, message, "mx.forwarder.example", "spf=pass smtp.mailfrom=example.com")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !bytes.HasPrefix(once, []byte("ARC-Seal: i=1; a=rsa-sha256;")) || !bytes.Contains(once, []byte("cv=none")) {
+		t.Fatalf("unexpected first set:\n%s", once)
+	}
+	if !bytes.Contains(once, []byte("ARC-Authentication-Results: i=1; mx.forwarder.example;\r\n\tspf=pass smtp.mailfrom=example.com\r\n")) {
+		t.Fatalf("missing ARC-Authentication-Results:\n%s", once)
+	}
+	if r := VerifyARC(ctx, resolver, once); r.Status != StatusPass || r.Instance != 1 || r.Domain != "forwarder.example" {
+		t.Fatalf("expected the sealed message to pass, got %+v", r)
+	}
+
+	twice, err := signer.Seal(ctx, resolver, once, "mx.forwarder.example", "arc=pass")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !bytes.Contains(twice, []byte("ARC-Seal: i=2;")) || !bytes.Contains(twice, []byte("cv=pass")) {
+		t.Fatalf("unexpected second set:\n%s", twice)
+	}
+	if r := VerifyARC(ctx, resolver, twice); r.Status != StatusPass || r.Instance != 2 {
+		t.Fatalf("expected two sets to pass, got %+v", r)
+	}
+
+	tampered := bytes.Replace(once, []byte("Hello"), []byte("Goodbye"), 1)
+	failed, err := signer.Seal(ctx, resolver, tampered, "mx.forwarder.example", "arc=fail")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !bytes.Contains(failed, []byte("ARC-Seal: i=2;")) || !bytes.Contains(failed, []byte("cv=fail")) {
+		t.Fatalf("expected a failed seal, got:\n%s", failed)
+	}
+	again, err := signer.Seal(ctx, resolver, failed, "mx.forwarder.example", "arc=fail")
+	if err != nil || !bytes.Equal(again, failed) {
+		t.Fatalf("expected a failed chain to be left alone, got err %v", err)
+	}
+}
+
+func TestSealEd25519(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	signer := &Signer{domain: "forwarder.example", selector: "ed", key: key, options: signOptions{headers: []string{"from"}}}
+	resolver := keyResolver{txt: map[string]string{"ed._domainkey.forwarder.example": "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}}
+	now = func() time.Time { return time.Unix(1735689600, 0) }
+	t.Cleanup(func() { now = time.Now })
+	sealed, err := signer.Seal(context.Background(), resolver, []byte("From: alice@example.com\r\n\r\nHi\r\n"), "mx.test", "none")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !strings.Contains(string(sealed), "a=ed25519-sha256") {
+		t.Fatalf("expected an Ed25519 seal:\n%s", sealed)
+	}
+	if strings.Count(string(sealed), "t=1735689600;") != 2 {
+		t.Fatalf("expected the seal and message signature to use the package clock:\n%s", sealed)
+	}
+	if r := VerifyARC(context.Background(), resolver, sealed); r.Status != StatusPass {
+		t.Fatalf("expected the Ed25519 seal to pass, got %+v", r)
+	}
+}
+
+func TestSealRequiresDomain(t *testing.T) {
+	key, _ := testKey(t)
+	signer := &Signer{selector: "arc", key: key}
+	if _, err := signer.Seal(context.Background(), keyResolver{}, []byte("From: a@b.example\r\n\r\n"), "mx.test", "none"); err == nil {
+		t.Fatal("expected sealing without a domain to fail")
+	}
+}
@@ -3,21 +3,28 @@ package dkim
 import (
 	"bytes"
 	"crypto"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"net/mail"
 	"os"
 	"strings"
-
-	msgauthdkim "github.com/emersion/go-msgauth/dkim"
+	"time"
 )
 
-// Signer applies DKIM signatures to messages when configured.
+// Signer applies DKIM signatures to messages when configured. Keys come from a
+// keyring indexed by domain, a single key that signs for any domain, or both, in
+// which case the single key signs only for SMTP_DKIM_DOMAIN.
 type Signer struct {
-	domain     string
-	selector   string
-	key        crypto.Signer
-	headerKeys []string
+	domain   string
+	selector string
+	key      crypto.Signer
+	keys     *keyring
+	// options apply to the single key, and to keyring keys that do not
+	// override them.
+	options signOptions
 }
 
 // Selector returns the configured DKIM selector string.
@@ -36,25 +43,52 @@ func (s *Signer) Domain() string {
 	return s.domain
 }
 
-// LoadFromEnv initializes a Signer using environment variables.
-// Required env vars:
+// LoadFromEnv initializes a Signer using environment variables. Keys come from
+// SMTP_DKIM_KEYS, the single key settings, or both:
 //
-//	SMTP_DKIM_SELECTOR – DKIM selector string
-//	SMTP_DKIM_KEY_PATH or SMTP_DKIM_PRIVATE_KEY – PEM encoded private key
+//	SMTP_DKIM_KEYS – keyring directory (<domain>/<selector>.pem) or file of
+//	                 "domain selector key-path" lines
+//	SMTP_DKIM_SELECTOR – DKIM selector string of the single key
+//	SMTP_DKIM_KEY_PATH or SMTP_DKIM_PRIVATE_KEY – PEM encoded single key
 //
 // Optional:
 //
-//	SMTP_DKIM_DOMAIN – overrides the domain extracted from the sender address
+//	SMTP_DKIM_DOMAIN – signs all mail as this domain instead of the From domain
+//	SMTP_DKIM_HEADERS, SMTP_DKIM_OVERSIGN, SMTP_DKIM_CANONICALIZATION,
+//	SMTP_DKIM_EXPIRATION – signing options, which keyring file lines may
+//	override per key
 func LoadFromEnv() (*Signer, error) {
+	keysPath := strings.TrimSpace(os.Getenv("SMTP_DKIM_KEYS"))
 	selector := strings.TrimSpace(os.Getenv("SMTP_DKIM_SELECTOR"))
 	keyPath := strings.TrimSpace(os.Getenv("SMTP_DKIM_KEY_PATH"))
 	inlineKey := os.Getenv("SMTP_DKIM_PRIVATE_KEY")
-	domain := strings.TrimSpace(os.Getenv("SMTP_DKIM_DOMAIN"))
+	domain := normalizeDomain(os.Getenv("SMTP_DKIM_DOMAIN"))
 
-	if selector == "" && keyPath == "" && inlineKey == "" && domain == "" {
+	if keysPath == "" && selector == "" && keyPath == "" && inlineKey == "" && domain == "" {
 		return nil, nil
 	}
 
+	options, err := optionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	signer := &Signer{domain: domain, options: options}
+	if keysPath != "" {
+		keys, err := loadKeyring(keysPath, options)
+		if err != nil {
+			return nil, err
+		}
+		signer.keys = keys
+	}
+	if keysPath != "" && selector == "" && keyPath == "" && inlineKey == "" {
+		if domain != "" {
+			if _, _, err := signer.keysFor(domain); err != nil {
+				return nil, fmt.Errorf("dkim: SMTP_DKIM_DOMAIN: %w", err)
+			}
+		}
+		return signer, nil
+	}
+
 	if selector == "" {
 		return nil, fmt.Errorf("dkim: SMTP_DKIM_SELECTOR is required when enabling DKIM")
 	}
@@ -77,56 +111,80 @@ func LoadFromEnv() (*Signer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dkim: parse private key: %w", err)
 	}
-
-	return &Signer{
-		domain:   domain,
-		selector: selector,
-		key:      key,
-		headerKeys: []string{
-			"from",
-			"to",
-			"subject",
-			"date",
-			"mime-version",
-			"content-type",
-			"message-id",
-		},
-	}, nil
+	signer.selector, signer.key = selector, key
+	return signer, nil
 }
 
-// Sign ensures the message carries a DKIM signature. When the message already includes
-// a DKIM-Signature header it is left untouched.
+// Sign ensures the message carries a DKIM signature. The key is picked by the
+// domain of the From header, falling back to the envelope sender when the header
+// has no usable address. When the message already includes a DKIM-Signature
+// header for the signing domain it is left untouched; signatures by other
+// domains, such as those of a message being forwarded, are kept alongside ours.
+// Every active key of the domain signs, so a rotation can overlap old and new
+// selectors. A domain without a key yields an error wrapping ErrNoKey.
 func (s *Signer) Sign(message []byte, from string) ([]byte, error) {
-	if s == nil || s.key == nil {
-		return message, nil
-	}
-	if hasSignature(message) {
+	if s == nil || (s.key == nil && s.keys == nil) {
 		return message, nil
 	}
 
 	domain := s.domain
+	if domain == "" && from == "" {
+		// Bounces have no sender domain to sign for.
+		return message, nil
+	}
+	if domain == "" {
+		domain = headerFromDomain(message)
+	}
 	if domain == "" {
 		domain = extractDomain(from)
 	}
 	if domain == "" {
 		return nil, fmt.Errorf("dkim: unable to determine signing domain")
 	}
+	keys, domain, err := s.keysFor(domain)
+	if err != nil {
+		return nil, err
+	}
+	if hasSignature(message, domain) {
+		return message, nil
+	}
 
-	opts := &msgauthdkim.SignOptions{
-		Domain:                 domain,
-		Selector:               s.selector,
-		Signer:                 s.key,
-		HeaderCanonicalization: msgauthdkim.CanonicalizationRelaxed,
-		BodyCanonicalization:   msgauthdkim.CanonicalizationRelaxed,
-		HeaderKeys:             s.headerKeys,
+	message = normalizeLineEndings(message)
+	for _, k := range keys {
+		if message, err = k.sign(message, domain); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// sign prepends the DKIM-Signature of k for domain to a CRLF message.
+func (k signingKey) sign(message []byte, domain string) ([]byte, error) {
+	algorithm, err := keyAlgorithm(k.key)
+	if err != nil {
+		return nil, err
 	}
+	o := k.options
+	headerCanon, bodyCanon := o.canonicalization()
+	fields, body := splitMessage(message)
+
+	bodyHash := sha256.Sum256(canonicalBody(body, bodyCanon))
 
-	var signed bytes.Buffer
-	reader := bytes.NewReader(normalizeLineEndings(message))
-	if err := msgauthdkim.Sign(&signed, reader, opts); err != nil {
-		return nil, fmt.Errorf("dkim: signing failed: %w", err)
+	timestamp := now().Unix()
+	var expiry string
+	if o.expiration > 0 {
+		expiry = fmt.Sprintf(" x=%d;", timestamp+int64(o.expiration/time.Second))
 	}
-	return signed.Bytes(), nil
+	h := o.headerNames(fields)
+	header := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=%s/%s; d=%s; s=%s;\r\n\tt=%d;%s h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, headerCanon, bodyCanon, domain, k.selector, timestamp, expiry, strings.Join(h, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	sig, err := sign(k.key, []byte(signedHeaders(fields, h, headerCanon)+strings.TrimSuffix(canonicalHeader(header+"\r\n", headerCanon), "\r\n")))
+	if err != nil {
+		return nil, fmt.Errorf("dkim: signing with selector %s failed: %w", k.selector, err)
+	}
+	out := make([]byte, 0, len(header)+len(sig)+2+len(message))
+	out = append(out, header+sig+"\r\n"...)
+	return append(out, message...), nil
 }
 
 func parsePrivateKey(pemData []byte) (crypto.Signer, error) {
@@ -173,15 +231,51 @@ func extractDomain(address string) string {
 	return ""
 }
 
-func hasSignature(message []byte) bool {
-	upper := bytes.ToUpper(message)
-	return bytes.Contains(upper, []byte("\nDKIM-SIGNATURE:")) || bytes.HasPrefix(upper, []byte("DKIM-SIGNATURE:"))
+// headerFromDomain returns the domain of the single address in the single From
+// header of message, or "" when there is none.
+func headerFromDomain(message []byte) string {
+	fields, _ := splitMessage(normalizeLineEndings(message))
+	var from []string
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "From") {
+			from = append(from, f.value())
+		}
+	}
+	if len(from) != 1 {
+		return ""
+	}
+	addrs, err := mail.ParseAddressList(from[0])
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	return extractDomain(addrs[0].Address)
+}
+
+func hasSignature(message []byte, domain string) bool {
+	fields, _ := splitMessage(normalizeLineEndings(message))
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		if tags, err := parseTags(f.value()); err == nil && strings.EqualFold(tags["d"], domain) {
+			return true
+		}
+	}
+	return false
 }
 
+// normalizeLineEndings turns every bare LF into CRLF. Messages read from the
+// SMTP session use LF, while header fields added on the way in end in CRLF.
 func normalizeLineEndings(data []byte) []byte {
-	if bytes.Contains(data, []byte("\r\n")) || !bytes.Contains(data, []byte("\n")) {
+	if bytes.Count(data, []byte("\n")) == bytes.Count(data, []byte("\r\n")) {
 		return data
 	}
-	lines := bytes.Split(data, []byte{'\n'})
-	return bytes.Join(lines, []byte("\r\n"))
+	out := make([]byte, 0, len(data)+bytes.Count(data, []byte("\n")))
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
 }
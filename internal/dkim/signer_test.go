@@ -1,10 +1,14 @@
 package dkim
 
 import (
+	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"io"
 	"strings"
 	"testing"
 )
@@ -51,9 +55,9 @@ func TestSignerSignAddsHeader(t *testing.T) {
 		t.Fatalf("generate key: %v", err)
 	}
 	signer := &Signer{
-		selector:   "test",
-		key:        key,
-		headerKeys: []string{"from", "subject"},
+		selector: "test",
+		key:      key,
+		options:  signOptions{headers: []string{"from", "subject"}},
 	}
 
 	raw := "From: sender@example.com\nSubject: Test\n\nBody\n"
@@ -76,12 +80,12 @@ func TestSignerSkipsWhenHeaderPresent(t *testing.T) {
 		t.Fatalf("generate key: %v", err)
 	}
 	signer := &Signer{
-		selector:   "test",
-		key:        key,
-		headerKeys: []string{"from"},
+		selector: "test",
+		key:      key,
+		options:  signOptions{headers: []string{"from"}},
 	}
 
-	raw := "DKIM-Signature: existing\r\nFrom: sender@example.com\r\n\r\nBody\r\n"
+	raw := "DKIM-Signature: v=1; d=Example.com; s=old; b=abc\r\nFrom: sender@example.com\r\n\r\nBody\r\n"
 	signed, err := signer.Sign([]byte(raw), "sender@example.com")
 	if err != nil {
 		t.Fatalf("Sign returned error: %v", err)
@@ -89,4 +93,51 @@ func TestSignerSkipsWhenHeaderPresent(t *testing.T) {
 	if string(signed) != raw {
 		t.Fatalf("expected message to remain unchanged when signature exists")
 	}
+
+	forwarded := "DKIM-Signature: v=1; d=origin.example; s=sel; b=abc\r\nFrom: sender@example.com\r\n\r\nBody\r\n"
+	signed, err = signer.Sign([]byte(forwarded), "sender@example.com")
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+	if strings.Count(string(signed), "DKIM-Signature:") != 2 {
+		t.Fatalf("expected a signature next to another domain's, got %q", signed)
+	}
+}
+
+// brokenKey is an RSA key whose Sign always fails, as a hardware key might.
+type brokenKey struct{ *rsa.PrivateKey }
+
+func (brokenKey) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("token removed")
+}
+
+func TestSignerReportsSigningFailure(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	signer := &Signer{domain: "example.com", selector: "test", key: brokenKey{key}}
+
+	_, err = signer.Sign([]byte("From: sender@example.com\r\n\r\nBody\r\n"), "sender@example.com")
+	if err == nil || err.Error() != "dkim: signing with selector test failed: token removed" {
+		t.Fatalf("unexpected signing error %v", err)
+	}
+	_, err = signer.Seal(context.Background(), keyResolver{}, []byte("From: sender@example.com\r\n\r\nBody\r\n"), "mx.example.com", "spf=pass")
+	if err == nil || err.Error() != "dkim: sealing with selector test failed: token removed" {
+		t.Fatalf("unexpected sealing error %v", err)
+	}
+}
+
+func TestSignerSkipsNullSenderWithoutDomain(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	signer := &Signer{selector: "test", key: key, options: signOptions{headers: []string{"from"}}}
+
+	raw := "From: MAILER-DAEMON@example.com\r\n\r\nBounce\r\n"
+	signed, err := signer.Sign([]byte(raw), "")
+	if err != nil || string(signed) != raw {
+		t.Fatalf("expected a bounce to pass unsigned, got %q (err %v)", signed, err)
+	}
 }
@@ -0,0 +1,94 @@
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	msgauthdkim "github.com/emersion/go-msgauth/dkim"
+)
+
+// maxSignatures bounds the DKIM signatures verified per message, and so the work
+// a sender can cause.
+const maxSignatures = 10
+
+// Resolver looks up the TXT records that publish DKIM keys. *net.Resolver
+// satisfies it; tests substitute a stub so they run offline.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Status is a verification result as named in Authentication-Results headers
+// (RFC 8601).
+type Status string
+
+const (
+	StatusNone      Status = "none"
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+// Result is the outcome of verifying one DKIM-Signature.
+type Result struct {
+	Status Status
+	// Domain is the signing domain (d=), and Identifier the agent or user
+	// identifier (i=).
+	Domain     string
+	Identifier string
+	Selector   string
+	// HeaderB holds the first characters of the signature, which tell apart
+	// several signatures by the same domain.
+	HeaderB string
+	// Reason explains failures.
+	Reason string
+}
+
+// Verify checks every DKIM-Signature of message, in header order. A message
+// without signatures yields none.
+func Verify(ctx context.Context, resolver Resolver, message []byte) ([]Result, error) {
+	message = normalizeLineEndings(message)
+	fields, _ := splitMessage(message)
+	var signatures []map[string]string
+	for _, f := range fields {
+		if strings.EqualFold(f.name, "DKIM-Signature") {
+			tags, _ := parseTags(f.value())
+			signatures = append(signatures, tags)
+		}
+	}
+	if len(signatures) == 0 {
+		return nil, nil
+	}
+
+	verifications, err := msgauthdkim.VerifyWithOptions(bytes.NewReader(message), &msgauthdkim.VerifyOptions{
+		LookupTXT:        func(name string) ([]string, error) { return resolver.LookupTXT(ctx, name) },
+		MaxVerifications: maxSignatures,
+	})
+	if err != nil && err != msgauthdkim.ErrTooManySignatures {
+		return nil, err
+	}
+	results := make([]Result, len(verifications))
+	for i, v := range verifications {
+		r := Result{Status: StatusPass, Domain: v.Domain, Identifier: v.Identifier}
+		if tags := signatures[i]; tags != nil {
+			r.Selector = tags["s"]
+			if b := stripWhitespace(tags["b"]); len(b) > 8 {
+				r.HeaderB = b[:8]
+			} else {
+				r.HeaderB = b
+			}
+		}
+		switch {
+		case v.Err == nil:
+		case msgauthdkim.IsTempFail(v.Err):
+			r.Status, r.Reason = StatusTempError, v.Err.Error()
+		case msgauthdkim.IsPermFail(v.Err):
+			r.Status, r.Reason = StatusPermError, v.Err.Error()
+		default:
+			r.Status, r.Reason = StatusFail, v.Err.Error()
+		}
+		results[i] = r
+	}
+	return results, nil
+}
@@ -0,0 +1,96 @@
+package dkim
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+// keyResolver serves DKIM key records from a map; names in fail return a
+// server failure and other names do not exist.
+type keyResolver struct {
+	txt  map[string]string
+	fail map[string]bool
+}
+
+func (r keyResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return []string{txt}, nil
+	}
+	if r.fail[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func testKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key, publicRecord(t, &key.PublicKey)
+}
+
+// publicRecord returns the DNS record publishing the RSA key pub.
+func publicRecord(t *testing.T, pub *rsa.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+func TestVerify(t *testing.T) {
+	key, record := testKey(t)
+	signer := &Signer{domain: "example.com", selector: "sel", key: key, options: signOptions{headers: []string{"from", "subject"}}}
+	signed, err := signer.Sign([]byte("From: alice@example.com\r\nSubject: hi\r\n\r\nHello\r\n"), "alice@example.com")
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	resolver := keyResolver{txt: map[string]string{"sel._domainkey.example.com": record}}
+
+	results, err := Verify(context.Background(), resolver, signed)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Verify = %v, %v", results, err)
+	}
+	if r := results[0]; r.Status != StatusPass || r.Domain != "example.com" || r.Selector != "sel" || len(r.HeaderB) != 8 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+
+	tampered := []byte(strings.Replace(string(signed), "Hello", "Goodbye", 1))
+	if results, _ := Verify(context.Background(), resolver, tampered); results[0].Status != StatusFail {
+		t.Fatalf("expected a modified body to fail, got %+v", results[0])
+	}
+	if results, _ := Verify(context.Background(), keyResolver{}, signed); results[0].Status != StatusPermError {
+		t.Fatalf("expected a missing key to be a permerror, got %+v", results[0])
+	}
+	down := keyResolver{fail: map[string]bool{"sel._domainkey.example.com": true}}
+	if results, _ := Verify(context.Background(), down, signed); results[0].Status != StatusTempError {
+		t.Fatalf("expected a DNS failure to be a temperror, got %+v", results[0])
+	}
+	if results, err := Verify(context.Background(), resolver, []byte("From: a@example.com\r\n\r\nx\r\n")); err != nil || results != nil {
+		t.Fatalf("expected no results for an unsigned message, got %v, %v", results, err)
+	}
+}
+
+func TestCanonicalization(t *testing.T) {
+	if got := canonicalHeader("Subject :  Hello \r\n\t  World  \r\n", "relaxed"); got != "subject:Hello World\r\n" {
+		t.Errorf("relaxed header = %q", got)
+	}
+	if got := string(canonicalBody([]byte(" a  b \r\n\r\n\r\n"), "relaxed")); got != " a b\r\n" {
+		t.Errorf("relaxed body = %q", got)
+	}
+	if got := string(canonicalBody(nil, "simple")); got != "\r\n" {
+		t.Errorf("simple empty body = %q", got)
+	}
+	if got := withoutSignature("DKIM-Signature: a=rsa-sha256; bh=xyz;\r\n b=abc\r\n def; d=x\r\n"); got != "DKIM-Signature: a=rsa-sha256; bh=xyz;\r\n b=; d=x\r\n" {
+		t.Errorf("withoutSignature = %q", got)
+	}
+}
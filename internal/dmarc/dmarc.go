@@ -0,0 +1,167 @@
+// Package dmarc evaluates DMARC (RFC 7489) for inbound mail: it checks that an
+// SPF or DKIM pass is aligned with the domain of the From header and reports
+// the policy the domain owner published.
+package dmarc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+
+	msgauthdmarc "github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Resolver looks up the TXT records that publish DMARC policies. *net.Resolver
+// satisfies it; tests substitute a stub so they run offline.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Status is a DMARC result as named in Authentication-Results headers.
+type Status string
+
+const (
+	None      Status = "none"
+	Pass      Status = "pass"
+	Fail      Status = "fail"
+	TempError Status = "temperror"
+	PermError Status = "permerror"
+)
+
+// errLookup marks DNS failures, which make the result a temperror.
+var errLookup = errors.New("dmarc: lookup failed")
+
+// Identifiers are the authenticated domains of a message.
+type Identifiers struct {
+	// From is the domain of the From header, see FromDomain.
+	From string
+	// SPF is the domain that passed SPF, or "" when SPF did not pass.
+	SPF string
+	// DKIM lists the domains of passing DKIM signatures.
+	DKIM []string
+}
+
+// Result is the DMARC verdict for a message.
+type Result struct {
+	Status Status
+	// Domain is the From domain, and Policy the policy published for it, which
+	// is empty without a record.
+	Domain string
+	Policy msgauthdmarc.Policy
+	Reason string
+}
+
+// Evaluate looks up the DMARC record of id.From, falling back to its
+// organizational domain, and reports whether an SPF or DKIM domain is aligned.
+func Evaluate(ctx context.Context, resolver Resolver, id Identifiers) Result {
+	from := strings.ToLower(strings.TrimSuffix(id.From, "."))
+	result := Result{Domain: from}
+	org := OrganizationalDomain(from)
+
+	record, err := lookup(ctx, resolver, from)
+	atOrg := false
+	if errors.Is(err, msgauthdmarc.ErrNoPolicy) && org != from {
+		record, err = lookup(ctx, resolver, org)
+		atOrg = true
+	}
+	switch {
+	case errors.Is(err, msgauthdmarc.ErrNoPolicy):
+		result.Status = None
+		return result
+	case errors.Is(err, errLookup):
+		result.Status, result.Reason = TempError, err.Error()
+		return result
+	case err != nil:
+		result.Status, result.Reason = PermError, err.Error()
+		return result
+	}
+
+	result.Policy = record.Policy
+	if atOrg && record.SubdomainPolicy != "" {
+		result.Policy = record.SubdomainPolicy
+	}
+	if id.SPF != "" && aligned(from, id.SPF, record.SPFAlignment) {
+		result.Status = Pass
+		return result
+	}
+	for _, d := range id.DKIM {
+		if aligned(from, d, record.DKIMAlignment) {
+			result.Status = Pass
+			return result
+		}
+	}
+	result.Status, result.Reason = Fail, "no aligned SPF or DKIM pass"
+	return result
+}
+
+// lookup fetches and parses the DMARC record at _dmarc.domain.
+func lookup(ctx context.Context, resolver Resolver, domain string) (*msgauthdmarc.Record, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, msgauthdmarc.ErrNoPolicy
+		}
+		return nil, fmt.Errorf("%w: _dmarc.%s: %v", errLookup, domain, err)
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	// Several records are treated as none (RFC 7489 section 6.6.3).
+	if len(records) != 1 {
+		return nil, msgauthdmarc.ErrNoPolicy
+	}
+	return msgauthdmarc.Parse(records[0])
+}
+
+func aligned(from, domain string, mode msgauthdmarc.AlignmentMode) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if mode == msgauthdmarc.AlignmentStrict {
+		return domain == from
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(from)
+}
+
+// OrganizationalDomain returns the registrable part of domain according to the
+// public suffix list, such as "example.co.uk" for "mail.example.co.uk".
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
+
+// FromDomain returns the domain of the single author in the From header of
+// message. Messages with no From header, several, or several addresses in it
+// have no DMARC identity.
+func FromDomain(message []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return "", fmt.Errorf("dmarc: %w", err)
+	}
+	values := msg.Header["From"]
+	if len(values) != 1 {
+		return "", fmt.Errorf("dmarc: message has %d From headers", len(values))
+	}
+	addrs, err := mail.ParseAddressList(values[0])
+	if err != nil {
+		return "", fmt.Errorf("dmarc: From header: %w", err)
+	}
+	if len(addrs) != 1 {
+		return "", fmt.Errorf("dmarc: From header has %d addresses", len(addrs))
+	}
+	at := strings.LastIndex(addrs[0].Address, "@")
+	if at < 0 {
+		return "", fmt.Errorf("dmarc: From address %q has no domain", addrs[0].Address)
+	}
+	return strings.ToLower(addrs[0].Address[at+1:]), nil
+}
@@ -0,0 +1,69 @@
+package dmarc
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+type txtResolver map[string][]string
+
+func (r txtResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		return txt, nil
+	}
+	if name == "_dmarc.down.example" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestEvaluate(t *testing.T) {
+	resolver := txtResolver{
+		"_dmarc.example.com":    {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.example": {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+		"_dmarc.broken.example": {"v=DMARC1; p=bogus"},
+		"_dmarc.twice.example":  {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.example.co.uk":  {"v=DMARC1; p=none"},
+	}
+	tests := []struct {
+		name   string
+		id     Identifiers
+		status Status
+		policy string
+	}{
+		{"spf aligned", Identifiers{From: "example.com", SPF: "example.com"}, Pass, "reject"},
+		{"relaxed spf", Identifiers{From: "example.com", SPF: "bounces.example.com"}, Pass, "reject"},
+		{"relaxed dkim", Identifiers{From: "example.com", DKIM: []string{"other.example", "mail.example.com"}}, Pass, "reject"},
+		{"unaligned", Identifiers{From: "example.com", SPF: "other.example", DKIM: []string{"other.example"}}, Fail, "reject"},
+		{"subdomain policy", Identifiers{From: "news.example.com"}, Fail, "quarantine"},
+		{"strict", Identifiers{From: "strict.example", DKIM: []string{"mail.strict.example"}}, Fail, "quarantine"},
+		{"strict exact", Identifiers{From: "Strict.example.", SPF: "strict.example"}, Pass, "quarantine"},
+		{"public suffix", Identifiers{From: "shop.example.co.uk", SPF: "evil.co.uk"}, Fail, "none"},
+		{"no record", Identifiers{From: "unknown.example", SPF: "unknown.example"}, None, ""},
+		{"several records", Identifiers{From: "twice.example"}, None, ""},
+		{"broken record", Identifiers{From: "broken.example"}, PermError, ""},
+		{"dns failure", Identifiers{From: "down.example"}, TempError, ""},
+	}
+	for _, tt := range tests {
+		r := Evaluate(context.Background(), resolver, tt.id)
+		if r.Status != tt.status || string(r.Policy) != tt.policy {
+			t.Errorf("%s: Evaluate = %+v, want %s with policy %q", tt.name, r, tt.status, tt.policy)
+		}
+	}
+}
+
+func TestFromDomain(t *testing.T) {
+	for message, want := range map[string]string{
+		"From: Alice <alice@Example.COM>\r\nSubject: x\r\n\r\nbody": "example.com",
+		"Subject: x\r\nFrom: bob@mail.example.org\r\n\r\n":          "mail.example.org",
+		"From: a@one.example, b@two.example\r\n\r\n":                "",
+		"From: a@one.example\r\nFrom: a@one.example\r\n\r\n":        "",
+		"Subject: no author\r\n\r\n":                                "",
+	} {
+		got, err := FromDomain([]byte(message))
+		if got != want || (want == "") != (err != nil) {
+			t.Errorf("FromDomain(%q) = %q, %v; want %q", message, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Package dsn builds RFC 3464 delivery status notifications.
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Action is the RFC 3464 action reported for a recipient.
+type Action string
+
+const (
+	// Failed reports that the message could not be delivered and will not be retried.
+	Failed Action = "failed"
+	// Delayed reports that delivery is still being retried.
+	Delayed Action = "delayed"
+)
+
+// Recipient describes the delivery status of one recipient.
+type Recipient struct {
+	Address        string
+	Action         Action
+	Status         string // RFC 3463 status code, e.g. "5.1.1".
+	DiagnosticCode string // Reply from the remote server, e.g. "smtp; 550 5.1.1 No such user".
+	RemoteMTA      string
+	LastAttempt    time.Time
+	WillRetryUntil time.Time // Only reported for delayed recipients.
+	Reason         string    // Human-readable explanation for the text part.
+}
+
+// Report is a delivery status notification for one original message.
+type Report struct {
+	ReportingMTA string // Hostname of this server.
+	Sender       string // Envelope sender of the original message; receives the report.
+	MessageID    string // Queue ID of the original message.
+	ArrivalDate  time.Time
+	Recipients   []Recipient
+	Original     []byte // Original message; only its header is returned.
+}
+
+var enhancedCode = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// Diagnose derives the RFC 3463 status and RFC 3464 Diagnostic-Code for a
+// delivery error. Replies from a remote SMTP server are reported verbatim and
+// keep their enhanced status code when the server sent one; any other error gets
+// the generic status for class (4 or 5) and no diagnostic code.
+func Diagnose(err error, class int) (status, diagnostic string) {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		msg := strings.Join(strings.Fields(reply.Msg), " ")
+		status = enhancedCode.FindString(msg)
+		if status == "" {
+			status = fmt.Sprintf("%d.0.0", reply.Code/100)
+		}
+		return status, fmt.Sprintf("smtp; %d %s", reply.Code, msg)
+	}
+	return fmt.Sprintf("%d.0.0", class), ""
+}
+
+// Build renders r as a multipart/report message. The caller must send it with
+// a null reverse-path so that it can never itself be bounced.
+func Build(r Report) ([]byte, error) {
+	if r.Sender == "" {
+		return nil, errors.New("dsn: report has no recipient (original sender is null)")
+	}
+	if len(r.Recipients) == 0 {
+		return nil, errors.New("dsn: report lists no recipients")
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Description": {"Notification"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeLines(part, humanText(r))
+
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"message/delivery-status"},
+		"Content-Description": {"Delivery report"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeLines(part, statusFields(r))
+
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/rfc822-headers"},
+		"Content-Description": {"Undelivered message headers"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(originalHeader(r.Original)); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	subject := "Undelivered Mail Returned to Sender"
+	if delayedOnly(r.Recipients) {
+		subject = "Delayed Mail (still being retried)"
+	}
+	var msg bytes.Buffer
+	writeLines(&msg, []string{
+		fmt.Sprintf("From: Mail Delivery System <MAILER-DAEMON@%s>", r.ReportingMTA),
+		fmt.Sprintf("To: <%s>", r.Sender),
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%s@%s>", randomID(), r.ReportingMTA),
+		"Auto-Submitted: auto-replied",
+		"MIME-Version: 1.0",
+		fmt.Sprintf("Content-Type: multipart/report; report-type=delivery-status; boundary=%q", mw.Boundary()),
+		"",
+	})
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func humanText(r Report) []string {
+	lines := []string{fmt.Sprintf("This is the mail system at host %s.", r.ReportingMTA), ""}
+	if delayedOnly(r.Recipients) {
+		lines = append(lines,
+			"Your message could not be delivered yet. The mail system will keep trying;",
+			"you do not need to resend it.",
+		)
+	} else {
+		lines = append(lines,
+			"Your message could not be delivered to one or more recipients.",
+			"It will not be retried.",
+		)
+	}
+	lines = append(lines, "")
+	for _, rcpt := range r.Recipients {
+		line := fmt.Sprintf("<%s>", rcpt.Address)
+		if rcpt.Reason != "" {
+			line += ": " + rcpt.Reason
+		}
+		lines = append(lines, line)
+		if rcpt.Action == Delayed && !rcpt.WillRetryUntil.IsZero() {
+			lines = append(lines, "    Retrying until "+rcpt.WillRetryUntil.Format(time.RFC1123Z))
+		}
+	}
+	if r.MessageID != "" {
+		lines = append(lines, "", "Queue ID: "+r.MessageID)
+	}
+	return lines
+}
+
+func statusFields(r Report) []string {
+	lines := []string{"Reporting-MTA: dns; " + r.ReportingMTA}
+	if !r.ArrivalDate.IsZero() {
+		lines = append(lines, "Arrival-Date: "+r.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range r.Recipients {
+		lines = append(lines,
+			"",
+			"Final-Recipient: rfc822; "+rcpt.Address,
+			"Action: "+string(rcpt.Action),
+			"Status: "+rcpt.Status,
+		)
+		if rcpt.RemoteMTA != "" {
+			lines = append(lines, "Remote-MTA: dns; "+rcpt.RemoteMTA)
+		}
+		if rcpt.DiagnosticCode != "" {
+			lines = append(lines, "Diagnostic-Code: "+rcpt.DiagnosticCode)
+		}
+		if !rcpt.LastAttempt.IsZero() {
+			lines = append(lines, "Last-Attempt-Date: "+rcpt.LastAttempt.Format(time.RFC1123Z))
+		}
+		if rcpt.Action == Delayed && !rcpt.WillRetryUntil.IsZero() {
+			lines = append(lines, "Will-Retry-Until: "+rcpt.WillRetryUntil.Format(time.RFC1123Z))
+		}
+	}
+	return lines
+}
+
+// originalHeader returns the header section of msg with CRLF line endings.
+func originalHeader(msg []byte) []byte {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(msg))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(msg)+1)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		out.WriteString(line)
+		out.WriteString("\r\n")
+	}
+	return out.Bytes()
+}
+
+func delayedOnly(recipients []Recipient) bool {
+	for _, rcpt := range recipients {
+		if rcpt.Action != Delayed {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(w io.Writer, lines []string) {
+	for _, line := range lines {
+		_, _ = io.WriteString(w, line+"\r\n")
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
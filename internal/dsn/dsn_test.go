@@ -0,0 +1,127 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiagnose(t *testing.T) {
+	reply := fmt.Errorf("rcpt to: %w", &textproto.Error{Code: 550, Msg: "5.1.1 No such user\nhere"})
+	status, diagnostic := Diagnose(reply, 5)
+	if status != "5.1.1" || diagnostic != "smtp; 550 5.1.1 No such user here" {
+		t.Fatalf("unexpected diagnosis %q %q", status, diagnostic)
+	}
+
+	status, diagnostic = Diagnose(&textproto.Error{Code: 554, Msg: "Rejected"}, 5)
+	if status != "5.0.0" || diagnostic != "smtp; 554 Rejected" {
+		t.Fatalf("unexpected diagnosis without enhanced code %q %q", status, diagnostic)
+	}
+
+	status, diagnostic = Diagnose(errors.New("dial: connection refused"), 4)
+	if status != "4.0.0" || diagnostic != "" {
+		t.Fatalf("unexpected diagnosis for network error %q %q", status, diagnostic)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	original := "From: sender@example.com\r\nSubject: Hello\r\n\r\nsecret body\r\n"
+	data, err := Build(Report{
+		ReportingMTA: "mx.example.com",
+		Sender:       "sender@example.com",
+		MessageID:    "abc123",
+		ArrivalDate:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Recipients: []Recipient{{
+			Address:        "rcpt@example.net",
+			Action:         Failed,
+			Status:         "5.1.1",
+			DiagnosticCode: "smtp; 550 5.1.1 No such user",
+			LastAttempt:    time.Now(),
+		}},
+		Original: []byte(original),
+	})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("parse report: %v", err)
+	}
+	if got := msg.Header.Get("To"); got != "<sender@example.com>" {
+		t.Fatalf("unexpected To %q", got)
+	}
+	if got := msg.Header.Get("Auto-Submitted"); got != "auto-replied" {
+		t.Fatalf("unexpected Auto-Submitted %q", got)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("unexpected content type %q: %v", msg.Header.Get("Content-Type"), err)
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		types = append(types, part.Header.Get("Content-Type"))
+		parts = append(parts, string(body))
+	}
+	if len(parts) != 3 || types[1] != "message/delivery-status" || types[2] != "text/rfc822-headers" {
+		t.Fatalf("unexpected parts %v", types)
+	}
+	for _, field := range []string{
+		"Reporting-MTA: dns; mx.example.com",
+		"Final-Recipient: rfc822; rcpt@example.net",
+		"Action: failed",
+		"Status: 5.1.1",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user",
+	} {
+		if !strings.Contains(parts[1], field) {
+			t.Fatalf("delivery-status part missing %q:\n%s", field, parts[1])
+		}
+	}
+	if !strings.Contains(parts[2], "Subject: Hello") || strings.Contains(parts[2], "secret body") {
+		t.Fatalf("expected only the original header to be returned, got %q", parts[2])
+	}
+}
+
+func TestBuildDelayed(t *testing.T) {
+	data, err := Build(Report{
+		ReportingMTA: "mx.example.com",
+		Sender:       "sender@example.com",
+		Recipients: []Recipient{{
+			Address:        "rcpt@example.net",
+			Action:         Delayed,
+			Status:         "4.0.0",
+			WillRetryUntil: time.Now().Add(time.Hour),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if !bytes.Contains(data, []byte("Subject: Delayed Mail")) || !bytes.Contains(data, []byte("Will-Retry-Until: ")) {
+		t.Fatalf("expected a delay notice:\n%s", data)
+	}
+}
+
+func TestBuildRequiresSender(t *testing.T) {
+	if _, err := Build(Report{Recipients: []Recipient{{Address: "rcpt@example.net", Action: Failed}}}); err == nil {
+		t.Fatalf("expected error for report without sender")
+	}
+}
@@ -16,28 +16,76 @@ var (
 
 // ParseCommandAddress extracts and normalises the address portion from a SMTP command line.
 // It accepts commands such as "MAIL FROM:<user@example.com>" and "RCPT TO:<user@example.com>".
+// ESMTP parameters following the address are ignored; use ParseCommandParams to read them.
 func ParseCommandAddress(line string) (string, error) {
+	addr, _, err := ParseCommandParams(line)
+	return addr, err
+}
+
+// ParseCommandParams extracts the normalised address and any ESMTP parameters from
+// a SMTP command line such as "MAIL FROM:<user@example.com> SIZE=1024 BODY=8BITMIME".
+// Parameter keywords are upper-cased; parameters without a value map to "".
+func ParseCommandParams(line string) (string, map[string]string, error) {
+	return parseCommand(line, false)
+}
+
+// ParseReversePath is ParseCommandParams for MAIL FROM, which also accepts the
+// null reverse-path "<>" used by bounces and returns it as "".
+func ParseReversePath(line string) (string, map[string]string, error) {
+	return parseCommand(line, true)
+}
+
+func parseCommand(line string, allowNull bool) (string, map[string]string, error) {
 	if strings.ContainsAny(line, "\r\n") {
-		return "", fmt.Errorf("%w: unexpected newline", ErrInvalidCommand)
+		return "", nil, fmt.Errorf("%w: unexpected newline", ErrInvalidCommand)
 	}
 
 	parts := strings.SplitN(line, ":", 2)
 	if len(parts) != 2 {
-		return "", fmt.Errorf("%w: missing ':' separator", ErrInvalidCommand)
+		return "", nil, fmt.Errorf("%w: missing ':' separator", ErrInvalidCommand)
 	}
 
-	addr := strings.TrimSpace(parts[1])
-	addr = strings.Trim(addr, "<>")
-	if addr == "" {
-		return "", fmt.Errorf("%w: empty address", ErrInvalidAddress)
+	path, rest := splitPath(strings.TrimSpace(parts[1]))
+	addr := strings.Trim(path, "<>")
+	if addr == "" && !(allowNull && path == "<>") {
+		return "", nil, fmt.Errorf("%w: empty address", ErrInvalidAddress)
 	}
 
-	parsed, err := mail.ParseAddress(addr)
-	if err != nil {
-		return "", fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	if addr != "" {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+		}
+		addr = strings.ToLower(parsed.Address)
 	}
 
-	return strings.ToLower(parsed.Address), nil
+	var params map[string]string
+	for _, field := range strings.Fields(rest) {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		key, value, _ := strings.Cut(field, "=")
+		if key == "" {
+			return "", nil, fmt.Errorf("%w: malformed parameter %q", ErrInvalidCommand, field)
+		}
+		params[strings.ToUpper(key)] = value
+	}
+
+	return addr, params, nil
+}
+
+// splitPath separates the reverse- or forward-path from trailing ESMTP parameters.
+func splitPath(s string) (string, string) {
+	if strings.HasPrefix(s, "<") {
+		if end := strings.Index(s, ">"); end >= 0 {
+			return s[:end+1], s[end+1:]
+		}
+		return s, ""
+	}
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
 }
 
 // Domain returns the domain component of a validated email address.
@@ -51,6 +51,45 @@ func TestParseCommandAddress(t *testing.T) {
 	}
 }
 
+func TestParseCommandParams(t *testing.T) {
+	addr, params, err := ParseCommandParams("MAIL FROM:<User@Example.com> SIZE=1024 body=8BITMIME SMTPUTF8")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if addr != "user@example.com" {
+		t.Fatalf("unexpected address %q", addr)
+	}
+	if params["SIZE"] != "1024" || params["BODY"] != "8BITMIME" {
+		t.Fatalf("unexpected params %v", params)
+	}
+	if v, ok := params["SMTPUTF8"]; !ok || v != "" {
+		t.Fatalf("expected valueless SMTPUTF8 parameter, got %v", params)
+	}
+
+	if _, params, err := ParseCommandParams("RCPT TO:<rcpt@example.net>"); err != nil || params != nil {
+		t.Fatalf("expected no params, got %v (err %v)", params, err)
+	}
+	if _, _, err := ParseCommandParams("MAIL FROM:<user@example.com> =oops"); err == nil {
+		t.Fatalf("expected error for malformed parameter")
+	}
+}
+
+func TestParseReversePath(t *testing.T) {
+	addr, params, err := ParseReversePath("MAIL FROM:<> SIZE=100")
+	if err != nil || addr != "" || params["SIZE"] != "100" {
+		t.Fatalf("expected the null sender, got %q %v (err %v)", addr, params, err)
+	}
+	if addr, _, err := ParseReversePath("MAIL FROM:<User@Example.com>"); err != nil || addr != "user@example.com" {
+		t.Fatalf("unexpected address %q (err %v)", addr, err)
+	}
+	if _, _, err := ParseCommandParams("MAIL FROM:<>"); err == nil {
+		t.Fatalf("ParseCommandParams must not accept the null path")
+	}
+	if _, _, err := ParseReversePath("MAIL FROM:"); err == nil {
+		t.Fatalf("expected error for a missing reverse-path")
+	}
+}
+
 func TestDomain(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -0,0 +1,73 @@
+package recipient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Callout asks an HTTP service whether a recipient exists. It sends
+//
+//	GET <url>?recipient=user%40example.com
+//
+// and reads the status: 2xx accepts the recipient, 404 and 410 reject it, and
+// anything else, including network errors, fails the lookup. When domains are
+// given, recipients in other domains are skipped without a request.
+type Callout struct {
+	URL     string
+	Domains map[string]struct{}
+	Client  *http.Client
+}
+
+// NewCallout returns a callout to rawURL answering for domains, or for every
+// domain when none are given.
+func NewCallout(rawURL string, timeout time.Duration, domains ...string) (*Callout, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("recipient callout: invalid URL %q", rawURL)
+	}
+	c := &Callout{URL: rawURL, Client: &http.Client{Timeout: timeout}}
+	for _, d := range domains {
+		if c.Domains == nil {
+			c.Domains = make(map[string]struct{})
+		}
+		c.Domains[strings.ToLower(strings.TrimSuffix(d, "."))] = struct{}{}
+	}
+	return c, nil
+}
+
+// Verify implements Verifier.
+func (c *Callout) Verify(rcpt string) (Verdict, error) {
+	if c.Domains != nil {
+		at := strings.LastIndex(rcpt, "@")
+		if _, ok := c.Domains[strings.ToLower(strings.TrimSuffix(rcpt[at+1:], "."))]; !ok {
+			return Skip, nil
+		}
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return Skip, fmt.Errorf("recipient callout: %w", err)
+	}
+	query := u.Query()
+	query.Set("recipient", rcpt)
+	u.RawQuery = query.Encode()
+
+	resp, err := c.Client.Get(u.String())
+	if err != nil {
+		return Skip, fmt.Errorf("recipient callout: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return Accept, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return Reject, nil
+	default:
+		return Skip, fmt.Errorf("recipient callout: service returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,55 @@
+package recipient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCalloutVerify(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("recipient") {
+		case "alice@example.com":
+			w.WriteHeader(http.StatusOK)
+		case "gone@example.com":
+			w.WriteHeader(http.StatusGone)
+		case "broken@example.com":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewCallout(srv.URL+"/verify?token=x", time.Second, "Example.com")
+	if err != nil {
+		t.Fatalf("NewCallout: %v", err)
+	}
+	for rcpt, want := range map[string]Verdict{
+		"alice@example.com": Accept,
+		"bob@example.com":   Reject,
+		"gone@example.com":  Reject,
+		"alice@other.test":  Skip,
+	} {
+		if got, err := c.Verify(rcpt); err != nil || got != want {
+			t.Errorf("Verify(%q) = %v, %v; want %v", rcpt, got, err, want)
+		}
+	}
+	if _, err := c.Verify("broken@example.com"); err == nil {
+		t.Fatalf("expected a 503 to fail the lookup")
+	}
+
+	srv.Close()
+	if _, err := c.Verify("alice@example.com"); err == nil {
+		t.Fatalf("expected an unreachable service to fail the lookup")
+	}
+}
+
+func TestNewCalloutInvalidURL(t *testing.T) {
+	for _, raw := range []string{"", "ftp://lookup.example", "http://"} {
+		if _, err := NewCallout(raw, time.Second); err == nil {
+			t.Errorf("NewCallout(%q): expected an error", raw)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package recipient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File verifies recipients against a map file. Each line has the form
+//
+//	user@example.com [value]
+//	@example.com [value]
+//
+// where the second form accepts every address in the domain. The value is
+// ignored, so Postfix relay_recipient_maps sources can be used unchanged. A
+// domain with at least one entry is owned by the file: addresses in it that are
+// not listed are rejected. Blank lines and lines starting with '#' are ignored.
+// The file is reloaded automatically when its modification time changes.
+type File struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	list    list
+}
+
+// NewFile loads the recipient map at path.
+func NewFile(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Verify implements Verifier. A failed reload is reported as an error rather
+// than answered from the stale map.
+func (f *File) Verify(rcpt string) (Verdict, error) {
+	if err := f.reload(); err != nil {
+		return Skip, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.list.verify(rcpt), nil
+}
+
+func (f *File) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("recipient map: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.list != nil && info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("recipient map: %w", err)
+	}
+	l, err := parseList(data)
+	if err != nil {
+		return fmt.Errorf("recipient map %s: %w", f.path, err)
+	}
+	f.list = l
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func parseList(data []byte) (list, error) {
+	l := make(list)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := l.add(fields[0]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
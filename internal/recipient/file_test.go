@@ -0,0 +1,56 @@
+package recipient
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileVerifyReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recipients")
+	if err := os.WriteFile(path, []byte("# users\nalice@example.com OK\n@lists.example\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	for rcpt, want := range map[string]Verdict{
+		"alice@example.com":    Accept,
+		"bob@example.com":      Reject,
+		"dev@lists.example":    Accept,
+		"alice@elsewhere.test": Skip,
+	} {
+		if got, err := f.Verify(rcpt); err != nil || got != want {
+			t.Errorf("Verify(%q) = %v, %v; want %v", rcpt, got, err, want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("bob@example.com\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if got, _ := f.Verify("bob@example.com"); got != Accept {
+		t.Fatalf("expected the edited map to be reloaded, got %v", got)
+	}
+	if got, _ := f.Verify("alice@example.com"); got != Reject {
+		t.Fatalf("expected alice to be gone after the reload, got %v", got)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := f.Verify("bob@example.com"); err == nil {
+		t.Fatalf("expected an error once the map disappears")
+	}
+}
+
+func TestParseListErrors(t *testing.T) {
+	if _, err := parseList([]byte("alice@example.com\nnot-an-address\n")); err == nil {
+		t.Fatalf("expected an invalid entry to be rejected")
+	}
+}
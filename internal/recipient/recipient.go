@@ -0,0 +1,188 @@
+// Package recipient verifies RCPT TO addresses before mail is accepted, so that
+// mail for users who do not exist is refused during the SMTP dialogue instead of
+// bounced after queueing.
+package recipient
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Verdict is a verifier's answer for one recipient.
+type Verdict int
+
+const (
+	// Skip means the verifier is not responsible for the recipient's domain.
+	Skip Verdict = iota
+	// Accept means the recipient exists.
+	Accept
+	// Reject means the recipient's domain is known but the user is not.
+	Reject
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Accept:
+		return "accept"
+	case Reject:
+		return "reject"
+	default:
+		return "skip"
+	}
+}
+
+// Verifier checks whether a recipient exists. An error means the lookup itself
+// failed and the client should try again later.
+type Verifier interface {
+	Verify(rcpt string) (Verdict, error)
+}
+
+// Chain asks each verifier in turn and returns the first verdict other than Skip.
+type Chain []Verifier
+
+// Verify implements Verifier.
+func (c Chain) Verify(rcpt string) (Verdict, error) {
+	for _, v := range c {
+		verdict, err := v.Verify(rcpt)
+		if err != nil || verdict != Skip {
+			return verdict, err
+		}
+	}
+	return Skip, nil
+}
+
+// Static verifies recipients against a fixed list of addresses and "@example.com"
+// entries, each of which accepts a whole domain. Addresses in a listed domain that
+// are not themselves listed are rejected; other domains are skipped.
+type Static struct {
+	list list
+}
+
+// NewStatic returns a verifier for the given entries.
+func NewStatic(entries []string) (*Static, error) {
+	l := make(list)
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if err := l.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return &Static{list: l}, nil
+}
+
+// Verify implements Verifier.
+func (s *Static) Verify(rcpt string) (Verdict, error) {
+	return s.list.verify(rcpt), nil
+}
+
+// list maps each domain it is responsible for to its valid local parts. A nil
+// set accepts every local part.
+type list map[string]map[string]struct{}
+
+// add records entry, either "user@example.com" for one address or "@example.com"
+// for every address in the domain.
+func (l list) add(entry string) error {
+	entry = strings.ToLower(entry)
+	at := strings.LastIndex(entry, "@")
+	if at < 0 || at == len(entry)-1 {
+		return fmt.Errorf("invalid recipient entry %q", entry)
+	}
+	local, domain := entry[:at], strings.TrimSuffix(entry[at+1:], ".")
+	users, known := l[domain]
+	switch {
+	case local == "":
+		l[domain] = nil
+	case known && users == nil:
+		// The domain already accepts everyone.
+	default:
+		if users == nil {
+			users = make(map[string]struct{})
+			l[domain] = users
+		}
+		users[local] = struct{}{}
+	}
+	return nil
+}
+
+func (l list) verify(rcpt string) Verdict {
+	rcpt = strings.ToLower(rcpt)
+	at := strings.LastIndex(rcpt, "@")
+	if at < 0 {
+		return Skip
+	}
+	users, ok := l[strings.TrimSuffix(rcpt[at+1:], ".")]
+	if !ok {
+		return Skip
+	}
+	if users == nil {
+		return Accept
+	}
+	if _, ok := users[rcpt[:at]]; ok {
+		return Accept
+	}
+	return Reject
+}
+
+// LoadFromEnv builds the verifier chain from environment variables, in the order
+// listed. It returns nil when recipient verification is not configured. The
+// callout answers for accepted, the domains the server receives mail for, unless
+// SMTP_RECIPIENT_CALLOUT_DOMAINS narrows it.
+//
+//	SMTP_RECIPIENTS                 – comma-separated addresses and @domains
+//	SMTP_RECIPIENTS_FILE            – path to a recipient map, see File
+//	SMTP_RECIPIENT_CALLOUT_URL      – HTTP lookup service, see Callout
+//	SMTP_RECIPIENT_CALLOUT_DOMAINS  – domains the lookup service answers for (default accepted)
+//	SMTP_RECIPIENT_CALLOUT_TIMEOUT  – lookup timeout (default 5s)
+func LoadFromEnv(accepted ...string) (Verifier, error) {
+	var chain Chain
+	if list := strings.TrimSpace(os.Getenv("SMTP_RECIPIENTS")); list != "" {
+		static, err := NewStatic(strings.Split(list, ","))
+		if err != nil {
+			return nil, fmt.Errorf("SMTP_RECIPIENTS: %w", err)
+		}
+		chain = append(chain, static)
+	}
+	if path := strings.TrimSpace(os.Getenv("SMTP_RECIPIENTS_FILE")); path != "" {
+		file, err := NewFile(path)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, file)
+	}
+	if url := strings.TrimSpace(os.Getenv("SMTP_RECIPIENT_CALLOUT_URL")); url != "" {
+		timeout := 5 * time.Second
+		if raw := strings.TrimSpace(os.Getenv("SMTP_RECIPIENT_CALLOUT_TIMEOUT")); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("SMTP_RECIPIENT_CALLOUT_TIMEOUT: invalid duration %q", raw)
+			}
+			timeout = d
+		}
+		var domains []string
+		for _, d := range strings.Split(os.Getenv("SMTP_RECIPIENT_CALLOUT_DOMAINS"), ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		if len(domains) == 0 {
+			domains = accepted
+		}
+		callout, err := NewCallout(url, timeout, domains...)
+		if err != nil {
+			return nil, err
+		}
+		if callout.Domains == nil {
+			// Without accepted domains the callout answers for none, never all.
+			callout.Domains = make(map[string]struct{})
+		}
+		chain = append(chain, callout)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
@@ -0,0 +1,109 @@
+package recipient
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStaticVerify(t *testing.T) {
+	v, err := NewStatic([]string{"Alice@Example.com", " bob@example.com", "@catchall.example", ""})
+	if err != nil {
+		t.Fatalf("NewStatic: %v", err)
+	}
+	for rcpt, want := range map[string]Verdict{
+		"alice@example.com":       Accept,
+		"BOB@EXAMPLE.COM":         Accept,
+		"carol@example.com":       Reject,
+		"anyone@catchall.example": Accept,
+		"alice@example.org":       Skip,
+	} {
+		if got, err := v.Verify(rcpt); err != nil || got != want {
+			t.Errorf("Verify(%q) = %v, %v; want %v", rcpt, got, err, want)
+		}
+	}
+	if _, err := NewStatic([]string{"example.com"}); err == nil {
+		t.Fatalf("expected an entry without @ to be rejected")
+	}
+}
+
+type verifierFunc func(string) (Verdict, error)
+
+func (f verifierFunc) Verify(rcpt string) (Verdict, error) { return f(rcpt) }
+
+func TestChainFirstVerdictWins(t *testing.T) {
+	lookupErr := errors.New("down")
+	var calls int
+	count := func(verdict Verdict, err error) Verifier {
+		return verifierFunc(func(string) (Verdict, error) {
+			calls++
+			return verdict, err
+		})
+	}
+
+	chain := Chain{count(Skip, nil), count(Reject, nil), count(Accept, nil)}
+	if got, err := chain.Verify("a@example.com"); err != nil || got != Reject || calls != 2 {
+		t.Fatalf("got %v, %v after %d calls", got, err, calls)
+	}
+	if got, err := (Chain{count(Skip, nil)}).Verify("a@example.com"); err != nil || got != Skip {
+		t.Fatalf("expected Skip from an undecided chain, got %v, %v", got, err)
+	}
+	if _, err := (Chain{count(Skip, lookupErr), count(Accept, nil)}).Verify("a@example.com"); !errors.Is(err, lookupErr) {
+		t.Fatalf("expected the lookup error to stop the chain, got %v", err)
+	}
+}
+
+func TestLoadFromEnv(t *testing.T) {
+	t.Setenv("SMTP_RECIPIENTS", "")
+	t.Setenv("SMTP_RECIPIENTS_FILE", "")
+	t.Setenv("SMTP_RECIPIENT_CALLOUT_URL", "")
+	v, err := LoadFromEnv()
+	if err != nil || v != nil {
+		t.Fatalf("expected no verifier when unconfigured, got %v, %v", v, err)
+	}
+
+	t.Setenv("SMTP_RECIPIENTS", "alice@example.com")
+	t.Setenv("SMTP_RECIPIENT_CALLOUT_URL", "http://127.0.0.1:1/verify")
+	t.Setenv("SMTP_RECIPIENT_CALLOUT_DOMAINS", "example.org")
+	t.Setenv("SMTP_RECIPIENT_CALLOUT_TIMEOUT", "2s")
+	v, err = LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv: %v", err)
+	}
+	chain, ok := v.(Chain)
+	if !ok || len(chain) != 2 {
+		t.Fatalf("expected a static verifier and a callout, got %#v", v)
+	}
+	if c := chain[1].(*Callout); c.Client.Timeout.String() != "2s" {
+		t.Fatalf("unexpected callout timeout %v", c.Client.Timeout)
+	}
+
+	t.Setenv("SMTP_RECIPIENT_CALLOUT_DOMAINS", "")
+	v, err = LoadFromEnv("relay.example")
+	if err != nil {
+		t.Fatalf("LoadFromEnv: %v", err)
+	}
+	c := v.(Chain)[1].(*Callout)
+	if _, ok := c.Domains["relay.example"]; !ok || len(c.Domains) != 1 {
+		t.Fatalf("expected the callout to default to the accepted domains, got %v", c.Domains)
+	}
+	if verdict, err := c.Verify("someone@gmail.com"); verdict != Skip || err != nil {
+		t.Fatalf("expected other domains to be skipped without a request, got %v, %v", verdict, err)
+	}
+	v, err = LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv: %v", err)
+	}
+	if verdict, err := v.(Chain)[1].Verify("someone@gmail.com"); verdict != Skip || err != nil {
+		t.Fatalf("expected a callout without accepted domains to answer for none, got %v, %v", verdict, err)
+	}
+
+	t.Setenv("SMTP_RECIPIENT_CALLOUT_TIMEOUT", "soon")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Fatalf("expected an invalid timeout to be rejected")
+	}
+	t.Setenv("SMTP_RECIPIENT_CALLOUT_TIMEOUT", "")
+	t.Setenv("SMTP_RECIPIENTS_FILE", t.TempDir()+"/missing")
+	if _, err := LoadFromEnv(); err == nil {
+		t.Fatalf("expected a missing recipient map to be rejected")
+	}
+}
@@ -0,0 +1,466 @@
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Processing limits from RFC 7208 section 4.6.4.
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+	maxMXNames     = 10
+	maxPTRNames    = 10
+)
+
+type evaluation struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+
+	lookups int
+	voids   int
+}
+
+// term is a parsed mechanism or modifier.
+type term struct {
+	qualifier Result
+	name      string
+	arg       string // domain-spec or address, unexpanded
+	hasArg    bool
+	cidr4     int
+	cidr6     int
+}
+
+// checkHost implements check_host() for domain. The error explains temperror and
+// permerror results.
+func (e *evaluation) checkHost(domain string) (Result, error) {
+	if !validDomain(domain) {
+		return None, nil
+	}
+	record, err := e.record(domain)
+	if errors.Is(err, errNoRecord) {
+		return None, nil
+	}
+	if err != nil {
+		var perm permError
+		if errors.As(err, &perm) {
+			return PermError, err
+		}
+		return TempError, err
+	}
+	mechanisms, redirect, err := parseRecord(record)
+	if err != nil {
+		return PermError, err
+	}
+
+	for _, m := range mechanisms {
+		matched, err := e.match(m, domain)
+		if err != nil {
+			var perm permError
+			if errors.As(err, &perm) {
+				return PermError, err
+			}
+			return TempError, err
+		}
+		if matched {
+			return m.qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		if err := e.countLookup(); err != nil {
+			return PermError, err
+		}
+		target, err := e.expand(redirect, domain)
+		if err != nil {
+			return PermError, err
+		}
+		result, err := e.checkHost(target)
+		if result == None {
+			return PermError, permError(fmt.Sprintf("redirect to %s has no SPF record", target))
+		}
+		return result, err
+	}
+	return Neutral, nil
+}
+
+var errNoRecord = errors.New("no SPF record")
+
+// permError marks errors that make the result permerror rather than temperror.
+type permError string
+
+func (e permError) Error() string { return string(e) }
+
+// record returns the single v=spf1 record published at domain.
+func (e *evaluation) record(domain string) (string, error) {
+	txts, err := e.resolver.LookupTXT(e.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", errNoRecord
+		}
+		return "", fmt.Errorf("TXT lookup for %s: %w", domain, err)
+	}
+	var found []string
+	for _, txt := range txts {
+		if len(txt) >= 6 && strings.EqualFold(txt[:6], "v=spf1") && (len(txt) == 6 || txt[6] == ' ') {
+			found = append(found, txt)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", errNoRecord
+	case 1:
+		return found[0], nil
+	default:
+		return "", permError(fmt.Sprintf("%s publishes %d SPF records", domain, len(found)))
+	}
+}
+
+// parseRecord parses every term up front: a syntax error anywhere makes the whole
+// record a permerror (RFC 7208 section 4.6).
+func parseRecord(record string) ([]term, string, error) {
+	var mechanisms []term
+	var redirect string
+	var seenRedirect, seenExp bool
+	for _, field := range strings.Fields(record)[1:] {
+		if name, value, ok := modifier(field); ok {
+			switch strings.ToLower(name) {
+			case "redirect":
+				if seenRedirect {
+					return nil, "", permError("duplicate redirect modifier")
+				}
+				seenRedirect, redirect = true, value
+			case "exp":
+				if seenExp {
+					return nil, "", permError("duplicate exp modifier")
+				}
+				seenExp = true
+			}
+			continue
+		}
+		m, err := parseMechanism(field)
+		if err != nil {
+			return nil, "", err
+		}
+		mechanisms = append(mechanisms, m)
+	}
+	// redirect is ignored when the record has an all mechanism.
+	for _, m := range mechanisms {
+		if m.name == "all" {
+			redirect = ""
+		}
+	}
+	return mechanisms, redirect, nil
+}
+
+// modifier splits a name=value term. Names start with a letter and continue with
+// letters, digits, '-', '_' and '.'.
+func modifier(field string) (string, string, bool) {
+	name, value, ok := strings.Cut(field, "=")
+	if !ok || name == "" || !isAlpha(name[0]) {
+		return "", "", false
+	}
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !isAlpha(c) && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return "", "", false
+		}
+	}
+	return name, value, true
+}
+
+func parseMechanism(field string) (term, error) {
+	m := term{qualifier: Pass, cidr4: 32, cidr6: 128}
+	switch field[0] {
+	case '+':
+		field = field[1:]
+	case '-':
+		m.qualifier, field = Fail, field[1:]
+	case '~':
+		m.qualifier, field = SoftFail, field[1:]
+	case '?':
+		m.qualifier, field = Neutral, field[1:]
+	}
+	end := strings.IndexAny(field, ":/")
+	if end < 0 {
+		end = len(field)
+	}
+	m.name = strings.ToLower(field[:end])
+	rest := field[end:]
+	if strings.HasPrefix(rest, ":") {
+		m.hasArg = true
+		rest = rest[1:]
+	}
+
+	bad := func() (term, error) { return term{}, permError(fmt.Sprintf("invalid mechanism %q", field)) }
+	switch m.name {
+	case "all":
+		if rest != "" || m.hasArg {
+			return bad()
+		}
+	case "include", "exists":
+		if !m.hasArg || rest == "" {
+			return bad()
+		}
+		m.arg = rest
+	case "ptr":
+		if m.hasArg && rest == "" {
+			return bad()
+		}
+		m.arg = rest
+	case "a", "mx":
+		spec := rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			spec = rest[:i]
+			var err error
+			if m.cidr4, m.cidr6, err = parseDualCIDR(rest[i:]); err != nil {
+				return bad()
+			}
+		}
+		if m.hasArg && spec == "" {
+			return bad()
+		}
+		m.arg = spec
+	case "ip4", "ip6":
+		if !m.hasArg || rest == "" {
+			return bad()
+		}
+		addr, length, hasLength := strings.Cut(rest, "/")
+		ip := net.ParseIP(addr)
+		if ip == nil || (m.name == "ip4") != (ip.To4() != nil && !strings.Contains(addr, ":")) {
+			return bad()
+		}
+		bits := 32
+		if m.name == "ip6" {
+			bits = 128
+		}
+		if hasLength {
+			n, err := strconv.Atoi(length)
+			if err != nil || n < 0 || n > bits || strings.HasPrefix(length, "0") && length != "0" {
+				return bad()
+			}
+			bits = n
+		}
+		m.arg = addr
+		if m.name == "ip4" {
+			m.cidr4 = bits
+		} else {
+			m.cidr6 = bits
+		}
+	default:
+		return bad()
+	}
+	return m, nil
+}
+
+// parseDualCIDR parses "/n", "//m" or "/n//m".
+func parseDualCIDR(s string) (int, int, error) {
+	cidr4, cidr6 := 32, 128
+	v4, v6, hasV6 := strings.Cut(s, "//")
+	parse := func(v string, max int) (int, error) {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > max || (len(v) > 1 && v[0] == '0') {
+			return 0, errors.New("invalid prefix length")
+		}
+		return n, nil
+	}
+	var err error
+	if v4 != "" {
+		if !strings.HasPrefix(v4, "/") {
+			return 0, 0, errors.New("invalid prefix length")
+		}
+		if cidr4, err = parse(v4[1:], 32); err != nil {
+			return 0, 0, err
+		}
+	}
+	if hasV6 {
+		if cidr6, err = parse(v6, 128); err != nil {
+			return 0, 0, err
+		}
+	}
+	return cidr4, cidr6, nil
+}
+
+// match evaluates one mechanism for the current domain.
+func (e *evaluation) match(m term, domain string) (bool, error) {
+	target := domain
+	if m.arg != "" && m.name != "ip4" && m.name != "ip6" {
+		expanded, err := e.expand(m.arg, domain)
+		if err != nil {
+			return false, err
+		}
+		target = expanded
+	}
+
+	switch m.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return e.inNetwork(net.ParseIP(m.arg), m.cidr4, m.cidr6), nil
+	case "include":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		result, err := e.checkHost(target)
+		switch result {
+		case Pass:
+			return true, nil
+		case Fail, SoftFail, Neutral:
+			return false, nil
+		case TempError:
+			return false, err
+		default:
+			if err == nil {
+				err = permError(fmt.Sprintf("include:%s has no SPF record", target))
+			}
+			return false, permError(err.Error())
+		}
+	case "a":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		return e.matchHost(target, m.cidr4, m.cidr6)
+	case "mx":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		mxs, err := e.resolver.LookupMX(e.ctx, target)
+		if err != nil {
+			return false, e.lookupFailed(target, err)
+		}
+		if len(mxs) > maxMXNames {
+			return false, permError(fmt.Sprintf("%s has more than %d MX records", target, maxMXNames))
+		}
+		for _, mx := range mxs {
+			matched, err := e.matchHost(strings.TrimSuffix(mx.Host, "."), m.cidr4, m.cidr6)
+			if matched || err != nil {
+				return matched, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		return e.matchPTR(target), nil
+	case "exists":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		addrs, err := e.resolver.LookupIPAddr(e.ctx, target)
+		if err != nil {
+			return false, e.lookupFailed(target, err)
+		}
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, e.countVoid()
+	}
+	return false, permError("unknown mechanism " + m.name)
+}
+
+// matchHost reports whether the client address is among target's addresses.
+func (e *evaluation) matchHost(target string, cidr4, cidr6 int) (bool, error) {
+	addrs, err := e.resolver.LookupIPAddr(e.ctx, target)
+	if err != nil {
+		return false, e.lookupFailed(target, err)
+	}
+	for _, a := range addrs {
+		if e.inNetwork(a.IP, cidr4, cidr6) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchPTR implements the ptr mechanism: some validated reverse name of the
+// client must be target or a subdomain of it. DNS errors simply fail to match.
+func (e *evaluation) matchPTR(target string) bool {
+	names, err := e.resolver.LookupAddr(e.ctx, e.ip.String())
+	if err != nil {
+		return false
+	}
+	if len(names) > maxPTRNames {
+		names = names[:maxPTRNames]
+	}
+	target = strings.ToLower(target)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		if ok, _ := e.matchHost(name, 32, 128); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *evaluation) inNetwork(ip net.IP, cidr4, cidr6 int) bool {
+	if ip == nil {
+		return false
+	}
+	if client4, ip4 := e.ip.To4(), ip.To4(); client4 != nil || ip4 != nil {
+		if client4 == nil || ip4 == nil {
+			return false
+		}
+		return ip4.Mask(net.CIDRMask(cidr4, 32)).Equal(client4.Mask(net.CIDRMask(cidr4, 32)))
+	}
+	return ip.Mask(net.CIDRMask(cidr6, 128)).Equal(e.ip.Mask(net.CIDRMask(cidr6, 128)))
+}
+
+func (e *evaluation) countLookup() error {
+	e.lookups++
+	if e.lookups > maxLookups {
+		return permError(fmt.Sprintf("more than %d DNS lookups", maxLookups))
+	}
+	return nil
+}
+
+func (e *evaluation) countVoid() error {
+	e.voids++
+	if e.voids > maxVoidLookups {
+		return permError(fmt.Sprintf("more than %d void DNS lookups", maxVoidLookups))
+	}
+	return nil
+}
+
+// lookupFailed turns a DNS error into a void lookup (no such name) or a
+// temperror.
+func (e *evaluation) lookupFailed(name string, err error) error {
+	if isNotFound(err) {
+		return e.countVoid()
+	}
+	return fmt.Errorf("lookup %s: %w", name, err)
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// validDomain reports whether domain is a usable fully qualified name.
+func validDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,140 @@
+package spf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expand expands the macros of a domain-spec (RFC 7208 section 7) evaluated for
+// domain. The result is shortened from the left to fit in 253 characters.
+func (e *evaluation) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if c != '%' {
+			if c < 0x21 || c > 0x7e {
+				return "", permError(fmt.Sprintf("invalid character in %q", spec))
+			}
+			b.WriteByte(c)
+			continue
+		}
+		if i+1 == len(spec) {
+			return "", permError(fmt.Sprintf("truncated macro in %q", spec))
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", permError(fmt.Sprintf("unterminated macro in %q", spec))
+			}
+			value, err := e.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", permError(fmt.Sprintf("invalid macro in %q", spec))
+		}
+	}
+
+	out := strings.TrimSuffix(b.String(), ".")
+	for len(out) > 253 {
+		dot := strings.IndexByte(out, '.')
+		if dot < 0 {
+			return "", permError("expanded domain too long")
+		}
+		out = out[dot+1:]
+	}
+	return out, nil
+}
+
+// macro expands the body of one %{...} macro: a letter, an optional number of
+// rightmost parts to keep, an optional 'r' to reverse, and delimiters.
+func (e *evaluation) macro(body, domain string) (string, error) {
+	if body == "" {
+		return "", permError("empty macro")
+	}
+	value, err := e.macroValue(body[0], domain)
+	if err != nil {
+		return "", err
+	}
+	rest := body[1:]
+
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		if keep, err = strconv.Atoi(rest[:digits]); err != nil || keep == 0 {
+			return "", permError(fmt.Sprintf("invalid macro %%{%s}", body))
+		}
+	}
+	rest = rest[digits:]
+	reverse := false
+	if strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R") {
+		reverse, rest = true, rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permError(fmt.Sprintf("invalid macro %%{%s}", body))
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+func (e *evaluation) macroValue(letter byte, domain string) (string, error) {
+	at := strings.LastIndex(e.sender, "@")
+	switch letter | 0x20 {
+	case 's':
+		return e.sender, nil
+	case 'l':
+		return e.sender[:at], nil
+	case 'o':
+		return e.sender[at+1:], nil
+	case 'd':
+		return domain, nil
+	case 'i':
+		if ip4 := e.ip.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+		var nibbles []string
+		for _, b := range e.ip.To16() {
+			nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+		}
+		return strings.Join(nibbles, "."), nil
+	case 'p':
+		// Validating the client's name costs DNS lookups for no benefit; RFC 7208
+		// section 7.3 permits "unknown".
+		return "unknown", nil
+	case 'v':
+		if e.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case 'h':
+		return e.helo, nil
+	}
+	return "", permError(fmt.Sprintf("invalid macro letter %q", letter))
+}
@@ -0,0 +1,51 @@
+package spf
+
+import (
+	"net"
+	"testing"
+)
+
+// The examples of RFC 7208 section 7.4.
+func TestExpand(t *testing.T) {
+	e := &evaluation{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	for spec, want := range map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}":   "bad.strong.lp.3.2.0.192.in-addr._spf.example.com",
+		"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}":  "3.2.0.192.in-addr.strong.lp._spf.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"%{h}.%%.%_.%-":                     "mx.example.org.%. .%20",
+	} {
+		got, err := e.expand(spec, "email.example.com")
+		if err != nil || got != want {
+			t.Errorf("expand(%q) = %q, %v; want %q", spec, got, err, want)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	got, err := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if err != nil || got != want {
+		t.Errorf("expand IPv6 = %q, %v; want %q", got, err, want)
+	}
+
+	for _, spec := range []string{"%{x}", "%{d0}", "%{", "50%", "%a", "%{d2*}"} {
+		if _, err := e.expand(spec, "example.com"); err == nil {
+			t.Errorf("expand(%q) succeeded, want error", spec)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package spf evaluates Sender Policy Framework records (RFC 7208) for inbound
+// mail and formats the Received-SPF and Authentication-Results headers that
+// record the outcome.
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Result is an SPF result as defined in RFC 7208 section 2.6.
+type Result string
+
+const (
+	None      Result = "none"
+	Neutral   Result = "neutral"
+	Pass      Result = "pass"
+	Fail      Result = "fail"
+	SoftFail  Result = "softfail"
+	TempError Result = "temperror"
+	PermError Result = "permerror"
+)
+
+// Resolver answers the DNS queries SPF needs. *net.Resolver satisfies it; tests
+// substitute a stub so they run offline.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Checker evaluates SPF policies.
+type Checker struct {
+	Resolver Resolver
+	// Receiver names this host in Received-SPF headers.
+	Receiver string
+}
+
+// NewChecker returns a checker using resolver that identifies as receiver.
+func NewChecker(resolver Resolver, receiver string) *Checker {
+	return &Checker{Resolver: resolver, Receiver: receiver}
+}
+
+// Verdict is the outcome of checking one sender.
+type Verdict struct {
+	Result Result
+	// Identity is "mailfrom", or "helo" when the null sender was checked through
+	// the HELO name.
+	Identity string
+	Sender   string
+	Domain   string
+	IP       net.IP
+	HELO     string
+	// Reason explains errors.
+	Reason string
+}
+
+// Check evaluates the MAIL FROM identity of a client at ip that greeted with
+// helo. The null sender is checked as postmaster@helo, as RFC 7208 section 2.4
+// requires.
+func (c *Checker) Check(ctx context.Context, ip net.IP, mailFrom, helo string) Verdict {
+	v := Verdict{Identity: "mailfrom", Sender: mailFrom, IP: ip, HELO: helo}
+	if mailFrom == "" {
+		v.Identity = "helo"
+		v.Sender = "postmaster@" + helo
+	}
+	switch at := strings.LastIndex(v.Sender, "@"); {
+	case at < 0:
+		v.Sender = "postmaster@" + v.Sender
+	case at == 0:
+		v.Sender = "postmaster" + v.Sender
+	}
+	v.Domain = strings.TrimSuffix(v.Sender[strings.LastIndex(v.Sender, "@")+1:], ".")
+	e := &evaluation{ctx: ctx, resolver: c.Resolver, ip: ip, sender: v.Sender, helo: helo}
+	var err error
+	v.Result, err = e.checkHost(v.Domain)
+	if err != nil {
+		v.Reason = err.Error()
+	}
+	return v
+}
+
+// ReceivedSPF returns the Received-SPF header for v, terminated by CRLF.
+func (c *Checker) ReceivedSPF(v Verdict) string {
+	var comment string
+	switch v.Result {
+	case Pass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", v.Sender, v.IP)
+	case Fail, SoftFail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", v.Sender, v.IP)
+	case Neutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", v.IP, v.Sender)
+	case None:
+		comment = fmt.Sprintf("domain of %s does not provide an SPF record", v.Sender)
+	default:
+		comment = fmt.Sprintf("error in processing during lookup of %s: %s", v.Sender, v.Reason)
+	}
+	return fmt.Sprintf("Received-SPF: %s (%s: %s) client-ip=%s; envelope-from=%q; helo=%s; receiver=%s; identity=%s;\r\n",
+		v.Result, c.Receiver, comment, v.IP, v.Sender, v.HELO, c.Receiver, v.Identity)
+}
+
+// AuthResult returns the spf method result for an Authentication-Results header
+// (RFC 8601), such as "spf=pass smtp.mailfrom=alice@example.com".
+func (v Verdict) AuthResult() string {
+	if v.Identity == "helo" {
+		return fmt.Sprintf("spf=%s smtp.helo=%s", v.Result, v.HELO)
+	}
+	return fmt.Sprintf("spf=%s smtp.mailfrom=%s", v.Result, v.Sender)
+}
@@ -0,0 +1,185 @@
+package spf
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// stubResolver answers from maps keyed by lowercase name. Names missing from
+// every map do not exist; names in fail return a server failure.
+type stubResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func (r stubResolver) err(name string) error {
+	if r.fail[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r stubResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	name = strings.ToLower(name)
+	if v, ok := r.txt[name]; ok {
+		return v, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.ToLower(host)
+	v, ok := r.ip[host]
+	if !ok {
+		return nil, r.err(host)
+	}
+	var out []net.IPAddr
+	for _, s := range v {
+		out = append(out, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	return out, nil
+}
+
+func (r stubResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	name = strings.ToLower(name)
+	v, ok := r.mx[name]
+	if !ok {
+		return nil, r.err(name)
+	}
+	var out []*net.MX
+	for i, host := range v {
+		out = append(out, &net.MX{Host: host + ".", Pref: uint16(10 * (i + 1))})
+	}
+	return out, nil
+}
+
+func (r stubResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	if v, ok := r.ptr[addr]; ok {
+		return v, nil
+	}
+	return nil, r.err(addr)
+}
+
+func TestCheck(t *testing.T) {
+	resolver := stubResolver{
+		txt: map[string][]string{
+			"example.com":         {"some verification token", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:mail.example.com mx include:_spf.example.net -all"},
+			"_spf.example.net":    {"v=spf1 ip4:198.51.100.7 ~all"},
+			"soft.example":        {"v=spf1 ~all"},
+			"neutral.example":     {"v=spf1 ?all"},
+			"empty.example":       {"v=spf1"},
+			"redirect.example":    {"v=spf1 redirect=example.com"},
+			"nowhere.example":     {"v=spf1 redirect=missing.example"},
+			"twice.example":       {"v=spf1 -all", "v=spf1 +all"},
+			"syntax.example":      {"v=spf1 ip4:192.0.2.1 foo:bar -all"},
+			"broken.example":      {"v=spf1 include:missing.example -all"},
+			"temp.example":        {"v=spf1 include:down.example -all"},
+			"exists.example":      {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"ptr.example":         {"v=spf1 ptr -all"},
+			"helo.example":        {"v=spf1 a -all"},
+			"cidr.example":        {"v=spf1 a:net.example/24//64 -all"},
+			"loop.example":        {"v=spf1 include:loop.example -all"},
+			"voids.example":       {"v=spf1 a:v1.example a:v2.example a:v3.example -all"},
+			"allredirect.example": {"v=spf1 -all redirect=example.com"},
+		},
+		ip: map[string][]string{
+			"mail.example.com": {"203.0.113.5"},
+			"mx1.example.com":  {"203.0.113.25", "2001:db8:ffff::25"},
+			"helo.example":     {"203.0.113.99"},
+			"net.example":      {"203.0.113.1", "2001:db8:1:2::1"},
+			"mx.ptr.example":   {"203.0.113.77"},
+			"7.100.51.198.alice.user._spf.exists.example": {"127.0.0.2"},
+		},
+		mx:   map[string][]string{"example.com": {"mx1.example.com"}},
+		ptr:  map[string][]string{"203.0.113.77": {"mx.ptr.example.", "spoof.other.example."}},
+		fail: map[string]bool{"down.example": true},
+	}
+	checker := NewChecker(resolver, "mx.test")
+
+	tests := []struct {
+		ip, from, helo string
+		want           Result
+	}{
+		{"192.0.2.10", "alice@example.com", "client.example", Pass},
+		{"2001:db8::1", "alice@example.com", "client.example", Pass},
+		{"203.0.113.5", "alice@example.com", "client.example", Pass},
+		{"203.0.113.25", "alice@example.com", "client.example", Pass},
+		{"2001:db8:ffff::25", "alice@example.com", "client.example", Pass},
+		{"198.51.100.7", "alice@EXAMPLE.com", "client.example", Pass},
+		{"198.51.100.8", "alice@example.com", "client.example", Fail},
+		{"198.51.100.8", "bob@soft.example", "client.example", SoftFail},
+		{"198.51.100.8", "bob@neutral.example", "client.example", Neutral},
+		{"198.51.100.8", "bob@empty.example", "client.example", Neutral},
+		{"192.0.2.10", "bob@redirect.example", "client.example", Pass},
+		{"198.51.100.8", "bob@redirect.example", "client.example", Fail},
+		{"192.0.2.10", "bob@allredirect.example", "client.example", Fail},
+		{"198.51.100.8", "bob@unknown.example", "client.example", None},
+		{"198.51.100.8", "bob@nowhere.example", "client.example", PermError},
+		{"198.51.100.8", "bob@twice.example", "client.example", PermError},
+		{"192.0.2.1", "bob@syntax.example", "client.example", PermError},
+		{"198.51.100.8", "bob@broken.example", "client.example", PermError},
+		{"198.51.100.8", "bob@temp.example", "client.example", TempError},
+		{"198.51.100.8", "bob@down.example", "client.example", TempError},
+		{"198.51.100.7", "alice.user@exists.example", "client.example", Pass},
+		{"198.51.100.7", "bob@exists.example", "client.example", Fail},
+		{"203.0.113.77", "bob@ptr.example", "client.example", Pass},
+		{"203.0.113.78", "bob@ptr.example", "client.example", Fail},
+		{"203.0.113.200", "bob@cidr.example", "client.example", Pass},
+		{"2001:db8:1:2::ff", "bob@cidr.example", "client.example", Pass},
+		{"2001:db8:1:3::1", "bob@cidr.example", "client.example", Fail},
+		{"198.51.100.8", "bob@loop.example", "client.example", PermError},
+		{"198.51.100.8", "bob@voids.example", "client.example", PermError},
+		{"203.0.113.99", "", "helo.example", Pass},
+		{"203.0.113.98", "", "helo.example", Fail},
+		{"198.51.100.8", "bob@localhost", "client.example", None},
+	}
+	for _, tt := range tests {
+		v := checker.Check(context.Background(), net.ParseIP(tt.ip), tt.from, tt.helo)
+		if v.Result != tt.want {
+			t.Errorf("Check(%s, %q, %s) = %s (%s), want %s", tt.ip, tt.from, tt.helo, v.Result, v.Reason, tt.want)
+		}
+	}
+}
+
+func TestCheckLookupLimit(t *testing.T) {
+	txt := map[string][]string{}
+	record := "v=spf1"
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"} {
+		record += " include:" + name + ".example"
+		txt[name+".example"] = []string{"v=spf1 -all"}
+	}
+	txt["many.example"] = []string{record + " -all"}
+	checker := NewChecker(stubResolver{txt: txt}, "mx.test")
+	v := checker.Check(context.Background(), net.ParseIP("192.0.2.1"), "bob@many.example", "client.example")
+	if v.Result != PermError || !strings.Contains(v.Reason, "DNS lookups") {
+		t.Fatalf("Check = %s (%s), want permerror for too many lookups", v.Result, v.Reason)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	checker := NewChecker(stubResolver{}, "mx.test")
+	v := Verdict{Result: Pass, Identity: "mailfrom", Sender: "alice@example.com", Domain: "example.com", IP: net.ParseIP("192.0.2.1"), HELO: "client.example"}
+	want := `Received-SPF: pass (mx.test: domain of alice@example.com designates 192.0.2.1 as permitted sender) client-ip=192.0.2.1; envelope-from="alice@example.com"; helo=client.example; receiver=mx.test; identity=mailfrom;` + "\r\n"
+	if got := checker.ReceivedSPF(v); got != want {
+		t.Errorf("ReceivedSPF =\n%q\nwant\n%q", got, want)
+	}
+	if got := v.AuthResult(); got != "spf=pass smtp.mailfrom=alice@example.com" {
+		t.Errorf("AuthResult = %q", got)
+	}
+
+	v = checker.Check(context.Background(), net.ParseIP("192.0.2.1"), "", "client.example")
+	if v.Sender != "postmaster@client.example" || v.Identity != "helo" {
+		t.Errorf("null sender verdict = %+v", v)
+	}
+	if got := v.AuthResult(); got != "spf=none smtp.helo=client.example" {
+		t.Errorf("AuthResult = %q", got)
+	}
+	if got := checker.ReceivedSPF(Verdict{Result: TempError, Sender: "a@b.example", Reason: "timeout"}); !strings.Contains(got, "error in processing during lookup of a@b.example: timeout") {
+		t.Errorf("ReceivedSPF = %q", got)
+	}
+}
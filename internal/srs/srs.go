@@ -0,0 +1,182 @@
+// Package srs implements the Sender Rewriting Scheme, which lets a forwarder
+// replace the envelope sender of forwarded mail with an address in its own
+// domain, so SPF checks at the destination pass, while still returning bounces
+// to the original sender.
+//
+// Addresses follow the format used by libsrs2 and postsrsd:
+//
+//	SRS0=HHHH=TT=example.org=alice@forwarder.example
+//	SRS1=HHHH=first.example==HHHH=TT=example.org=alice@forwarder.example
+//
+// where HHHH is a truncated, base64-encoded HMAC-SHA1 and TT the day the
+// address was made, in base32 modulo 1024.
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotSRS is returned by Reverse for addresses that are not SRS addresses.
+	ErrNotSRS = errors.New("srs: not an SRS address")
+	// ErrMalformed is returned for SRS addresses that cannot be parsed.
+	ErrMalformed = errors.New("srs: malformed address")
+	// ErrHash is returned when the hash of an SRS address does not verify.
+	ErrHash = errors.New("srs: invalid hash")
+	// ErrExpired is returned when the timestamp of an SRS0 address is too old or
+	// in the future.
+	ErrExpired = errors.New("srs: address expired")
+)
+
+const (
+	hashLength    = 4
+	timePrecision = 24 * time.Hour
+	timeSlots     = 1024
+	base32Chars   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+)
+
+// Rewriter rewrites senders into Domain and reverses such addresses.
+type Rewriter struct {
+	Domain string
+	// MaxAge bounds how long SRS0 addresses are accepted back.
+	MaxAge time.Duration
+
+	secret []byte
+	now    func() time.Time
+}
+
+// New returns a rewriter for domain keyed by secret that accepts addresses up
+// to maxAge old.
+func New(secret, domain string, maxAge time.Duration) *Rewriter {
+	return &Rewriter{
+		Domain: strings.ToLower(strings.TrimSuffix(domain, ".")),
+		MaxAge: maxAge,
+		secret: []byte(secret),
+		now:    time.Now,
+	}
+}
+
+// IsSRS reports whether the local part of addr is an SRS0 or SRS1 address.
+func IsSRS(addr string) bool {
+	local := addr
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		local = addr[:at]
+	}
+	return len(local) > 5 && (strings.EqualFold(local[:5], "SRS0=") || strings.EqualFold(local[:5], "SRS1="))
+}
+
+// Forward rewrites sender into the rewriter's domain. Senders already in that
+// domain are returned unchanged, and SRS addresses of other forwarders become
+// SRS1 addresses pointing back at them.
+func (r *Rewriter) Forward(sender string) (string, error) {
+	at := strings.LastIndex(sender, "@")
+	if at <= 0 || at == len(sender)-1 {
+		return "", fmt.Errorf("srs: cannot rewrite sender %q", sender)
+	}
+	local, domain := sender[:at], sender[at+1:]
+	if strings.EqualFold(strings.TrimSuffix(domain, "."), r.Domain) {
+		return sender, nil
+	}
+
+	if IsSRS(local) {
+		if strings.EqualFold(local[:4], "SRS1") {
+			// SRS1=HHHH=first==rest: keep the first forwarder, rehash.
+			parts := strings.SplitN(local[5:], "=", 3)
+			if len(parts) != 3 || parts[1] == "" {
+				return "", ErrMalformed
+			}
+			first, rest := parts[1], parts[2]
+			return "SRS1=" + r.hash(first, rest) + "=" + first + "=" + rest + "@" + r.Domain, nil
+		}
+		// An SRS0 address of the previous hop keeps its own hash.
+		rest := local[4:]
+		return "SRS1=" + r.hash(domain, rest) + "=" + domain + "=" + rest + "@" + r.Domain, nil
+	}
+
+	stamp := timestamp(r.now())
+	return "SRS0=" + r.hash(stamp, domain, local) + "=" + stamp + "=" + domain + "=" + local + "@" + r.Domain, nil
+}
+
+// Reverse decodes an SRS address in any domain. SRS0 addresses yield the
+// original sender after their hash and age are checked. SRS1 addresses yield the
+// SRS0 address at the first forwarder after their hash is checked.
+func (r *Rewriter) Reverse(addr string) (string, error) {
+	local := addr
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		local = addr[:at]
+	}
+	if !IsSRS(local) {
+		return "", ErrNotSRS
+	}
+
+	if strings.EqualFold(local[:4], "SRS1") {
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return "", ErrMalformed
+		}
+		hash, first, rest := parts[0], parts[1], parts[2]
+		if !r.checkHash(hash, first, rest) {
+			return "", ErrHash
+		}
+		return "SRS0" + rest + "@" + first, nil
+	}
+
+	parts := strings.SplitN(local[5:], "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", ErrMalformed
+	}
+	hash, stamp, domain, user := parts[0], parts[1], parts[2], parts[3]
+	if !r.checkHash(hash, stamp, domain, user) {
+		return "", ErrHash
+	}
+	if err := r.checkTimestamp(stamp); err != nil {
+		return "", err
+	}
+	return user + "@" + domain, nil
+}
+
+func (r *Rewriter) hash(parts ...string) string {
+	mac := hmac.New(sha1.New, r.secret)
+	for _, p := range parts {
+		// Hash lowercased input: MTAs on the way back may change the case.
+		mac.Write([]byte(strings.ToLower(p)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// checkHash compares case-insensitively, as libsrs2 does, since the address may
+// have been lowercased in transit.
+func (r *Rewriter) checkHash(hash string, parts ...string) bool {
+	return len(hash) == hashLength && hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(r.hash(parts...))))
+}
+
+func timestamp(t time.Time) string {
+	days := (t.Unix() / int64(timePrecision/time.Second)) % timeSlots
+	return string([]byte{base32Chars[days>>5&31], base32Chars[days&31]})
+}
+
+func (r *Rewriter) checkTimestamp(stamp string) error {
+	if len(stamp) != 2 {
+		return ErrMalformed
+	}
+	var then int64
+	for _, c := range strings.ToUpper(stamp) {
+		i := strings.IndexRune(base32Chars, c)
+		if i < 0 {
+			return ErrMalformed
+		}
+		then = then<<5 | int64(i)
+	}
+	today := (r.now().Unix() / int64(timePrecision/time.Second)) % timeSlots
+	age := (today - then + timeSlots) % timeSlots
+	if time.Duration(age)*timePrecision > r.MaxAge {
+		return ErrExpired
+	}
+	return nil
+}
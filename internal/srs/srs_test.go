@@ -0,0 +1,115 @@
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRewriter(now time.Time) *Rewriter {
+	r := New("s3cret", "Forwarder.example", 21*24*time.Hour)
+	r.now = func() time.Time { return now }
+	return r
+}
+
+func TestForwardAndReverse(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	r := testRewriter(now)
+
+	addr, err := r.Forward("alice@example.org")
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	if !strings.HasPrefix(addr, "SRS0=") || !strings.HasSuffix(addr, "=example.org=alice@forwarder.example") {
+		t.Fatalf("unexpected SRS0 address %q", addr)
+	}
+	if !IsSRS(addr) {
+		t.Fatalf("IsSRS(%q) = false", addr)
+	}
+	for _, candidate := range []string{addr, strings.ToLower(addr)} {
+		orig, err := r.Reverse(candidate)
+		if err != nil || orig != "alice@example.org" {
+			t.Fatalf("Reverse(%q) = %q, %v", candidate, orig, err)
+		}
+	}
+
+	if got, err := r.Forward("bob@forwarder.example"); err != nil || got != "bob@forwarder.example" {
+		t.Fatalf("expected our own domain to be left alone, got %q, %v", got, err)
+	}
+	if _, err := r.Forward("not-an-address"); err == nil {
+		t.Fatalf("expected an error for a sender without a domain")
+	}
+}
+
+func TestForwardSRS1(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	first := New("other-secret", "first.example", 21*24*time.Hour)
+	first.now = func() time.Time { return now }
+	srs0, err := first.Forward("alice@example.org")
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+
+	r := testRewriter(now)
+	srs1, err := r.Forward(srs0)
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=first.example==") {
+		t.Fatalf("unexpected SRS1 address %q", srs1)
+	}
+	back, err := r.Reverse(srs1)
+	if err != nil || !strings.EqualFold(back, srs0) {
+		t.Fatalf("Reverse(%q) = %q, %v; want %q", srs1, back, err, srs0)
+	}
+	if orig, err := first.Reverse(back); err != nil || orig != "alice@example.org" {
+		t.Fatalf("first hop Reverse = %q, %v", orig, err)
+	}
+
+	// A third forwarder keeps pointing at the first one.
+	third := New("third-secret", "third.example", 21*24*time.Hour)
+	srs1b, err := third.Forward(srs1)
+	if err != nil || !strings.Contains(srs1b, "=first.example==") {
+		t.Fatalf("expected SRS1 to keep the first forwarder, got %q, %v", srs1b, err)
+	}
+	if back, err := third.Reverse(srs1b); err != nil || !strings.EqualFold(back, srs0) {
+		t.Fatalf("third hop Reverse = %q, %v", back, err)
+	}
+}
+
+func TestReverseRejects(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	r := testRewriter(now)
+	addr, err := r.Forward("alice@example.org")
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+
+	tampered := strings.Replace(addr, "=alice@", "=mallory@", 1)
+	if _, err := r.Reverse(tampered); !errors.Is(err, ErrHash) {
+		t.Fatalf("expected a tampered address to fail the hash, got %v", err)
+	}
+	if _, err := New("wrong", "forwarder.example", time.Hour).Reverse(addr); !errors.Is(err, ErrHash) {
+		t.Fatalf("expected another secret to fail the hash, got %v", err)
+	}
+
+	late := testRewriter(now.Add(22 * 24 * time.Hour))
+	if _, err := late.Reverse(addr); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected an old address to expire, got %v", err)
+	}
+	if _, err := testRewriter(now.Add(20 * 24 * time.Hour)).Reverse(addr); err != nil {
+		t.Fatalf("expected a 20 day old address to be accepted, got %v", err)
+	}
+
+	for addr, want := range map[string]error{
+		"alice@forwarder.example":                          ErrNotSRS,
+		"SRS0=abcd@forwarder.example":                      ErrMalformed,
+		"SRS1=abcd=first@forwarder.example":                ErrMalformed,
+		"SRS0=abcd=!!=example.org=alice@forwarder.example": ErrHash,
+	} {
+		if _, err := r.Reverse(addr); !errors.Is(err, want) {
+			t.Errorf("Reverse(%q) = %v, want %v", addr, err, want)
+		}
+	}
+}
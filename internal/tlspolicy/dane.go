@@ -0,0 +1,130 @@
+package tlspolicy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// TLSA usages, selectors and matching types from RFC 6698 that SMTP uses.
+const (
+	UsageDANETA = 2
+	UsageDANEEE = 3
+
+	SelectorCert = 0
+	SelectorSPKI = 1
+
+	MatchFull   = 0
+	MatchSHA256 = 1
+	MatchSHA512 = 2
+)
+
+// TLSA is one TLSA resource record.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// LookupTLSA returns the usable DANE records for an SMTP server at host:port.
+// Only DNSSEC-authenticated answers count, and only DANE-TA(2) and DANE-EE(3)
+// records are usable for SMTP (RFC 7672 section 3.1.3); a nil result means the
+// server is not DANE-protected. A failed lookup is returned as an error only
+// when the failed answer was authenticated, so callers avoid downgrading a
+// signed zone; any other failure is indistinguishable from an unsigned zone,
+// which has no usable TLSA records (RFC 7672 section 2.1.1).
+func LookupTLSA(ctx context.Context, r Resolver, host string, port int) ([]TLSA, error) {
+	name := fmt.Sprintf("_%d._tcp.%s", port, host)
+	records, secure, err := r.LookupTLSA(ctx, name)
+	switch {
+	case errors.Is(err, ErrNotFound), !secure:
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("TLSA lookup for %s: %w", name, err)
+	}
+	var usable []TLSA
+	for _, rec := range records {
+		if (rec.Usage == UsageDANETA || rec.Usage == UsageDANEEE) && rec.Selector <= SelectorSPKI && rec.MatchingType <= MatchSHA512 {
+			usable = append(usable, rec)
+		}
+	}
+	return usable, nil
+}
+
+// VerifyDANE checks the certificate chain in cs against records. A DANE-EE
+// record must match the server certificate itself; names and validity dates are
+// not checked (RFC 7672 section 3.1.1). A DANE-TA record must match a certificate
+// in the presented chain that then anchors a valid chain for host.
+func VerifyDANE(records []TLSA, host string, cs tls.ConnectionState) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("dane: server presented no certificate")
+	}
+	for _, rec := range records {
+		switch rec.Usage {
+		case UsageDANEEE:
+			if rec.matches(certs[0]) {
+				return nil
+			}
+		case UsageDANETA:
+			for i, anchor := range certs {
+				if !rec.matches(anchor) {
+					continue
+				}
+				if verifyAnchoredChain(certs[:i], anchor, host) == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("dane: no TLSA record for %s matches the server certificate", host)
+}
+
+// verifyAnchoredChain verifies that chain (leaf first) leads to anchor and that
+// the leaf is valid for host. An empty chain means the anchor is the leaf.
+func verifyAnchoredChain(chain []*x509.Certificate, anchor *x509.Certificate, host string) error {
+	if len(chain) == 0 {
+		return anchor.VerifyHostname(host)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+func (r TLSA) matches(cert *x509.Certificate) bool {
+	var selected []byte
+	switch r.Selector {
+	case SelectorCert:
+		selected = cert.Raw
+	case SelectorSPKI:
+		selected = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.MatchingType {
+	case MatchFull:
+		return bytes.Equal(selected, r.Data)
+	case MatchSHA256:
+		sum := sha256.Sum256(selected)
+		return bytes.Equal(sum[:], r.Data)
+	case MatchSHA512:
+		sum := sha512.Sum512(selected)
+		return bytes.Equal(sum[:], r.Data)
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package tlspolicy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type stubResolver struct {
+	txt    map[string][]string
+	tlsa   map[string][]TLSA
+	secure bool
+	err    error
+}
+
+func (s *stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	records, ok := s.txt[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return records, nil
+}
+
+func (s *stubResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error) {
+	if s.err != nil {
+		return nil, s.secure, s.err
+	}
+	records, ok := s.tlsa[name]
+	if !ok {
+		return nil, s.secure, ErrNotFound
+	}
+	return records, s.secure, nil
+}
+
+func selfSigned(t *testing.T, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert
+}
+
+func TestLookupTLSARequiresDNSSEC(t *testing.T) {
+	r := &stubResolver{tlsa: map[string][]TLSA{
+		"_25._tcp.mx.example.com": {
+			{Usage: UsageDANEEE, Selector: SelectorSPKI, MatchingType: MatchSHA256, Data: []byte{1}},
+			{Usage: 1, Selector: SelectorSPKI, MatchingType: MatchSHA256, Data: []byte{2}},
+		},
+	}}
+
+	records, err := LookupTLSA(context.Background(), r, "mx.example.com", 25)
+	if err != nil || records != nil {
+		t.Fatalf("expected insecure answers to be ignored, got %v, %v", records, err)
+	}
+
+	r.secure = true
+	records, err = LookupTLSA(context.Background(), r, "mx.example.com", 25)
+	if err != nil {
+		t.Fatalf("LookupTLSA: %v", err)
+	}
+	if len(records) != 1 || records[0].Usage != UsageDANEEE {
+		t.Fatalf("expected only the DANE-EE record to be usable, got %+v", records)
+	}
+	r.err = errors.New("rcode 2")
+	if _, err := LookupTLSA(context.Background(), r, "mx.example.com", 25); err == nil {
+		t.Fatalf("expected an authenticated failure to be returned")
+	}
+	r.secure = false
+	if records, err := LookupTLSA(context.Background(), r, "mx.example.com", 25); err != nil || records != nil {
+		t.Fatalf("expected an insecure failure to mean no records, got %v, %v", records, err)
+	}
+}
+
+func TestVerifyDANE(t *testing.T) {
+	cert := selfSigned(t, "mx.example.com")
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	ee := []TLSA{{Usage: UsageDANEEE, Selector: SelectorSPKI, MatchingType: MatchSHA256, Data: spki[:]}}
+	if err := VerifyDANE(ee, "other.example.net", cs); err != nil {
+		t.Fatalf("DANE-EE should ignore the name: %v", err)
+	}
+
+	ta := []TLSA{{Usage: UsageDANETA, Selector: SelectorCert, MatchingType: MatchFull, Data: cert.Raw}}
+	if err := VerifyDANE(ta, "mx.example.com", cs); err != nil {
+		t.Fatalf("DANE-TA: %v", err)
+	}
+	if err := VerifyDANE(ta, "other.example.net", cs); err == nil {
+		t.Fatalf("DANE-TA should check the name")
+	}
+
+	other := selfSigned(t, "mx.example.com")
+	if err := VerifyDANE(ee, "mx.example.com", tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}); err == nil {
+		t.Fatalf("expected a certificate mismatch")
+	}
+}
@@ -0,0 +1,271 @@
+// Package tlspolicy discovers and applies outbound TLS policy: MTA-STS (RFC 8461),
+// DANE TLSA records for SMTP (RFC 7672), and locally configured per-domain rules.
+package tlspolicy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrNotFound is returned when a name has no records of the requested type.
+var ErrNotFound = errors.New("tlspolicy: no such record")
+
+// Resolver answers the DNS queries behind MTA-STS and DANE. Tests substitute a
+// stub; production uses DNSResolver.
+type Resolver interface {
+	// LookupTXT returns the TXT strings at name, each record's strings joined.
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	// LookupTLSA returns the TLSA records at name and whether the answer was
+	// authenticated by DNSSEC. On error, secure reports whether the failed
+	// answer was authenticated.
+	LookupTLSA(ctx context.Context, name string) (records []TLSA, secure bool, err error)
+}
+
+// typeTLSA is the TLSA record type (RFC 6698), which dnsmessage does not name.
+const typeTLSA dnsmessage.Type = 52
+
+const ednsPayloadSize = 1232
+
+// DNSResolver is a minimal stub resolver. It relies on a validating recursive
+// resolver for DNSSEC and reports the AD bit of its answers as the security
+// status, which is why it should only be pointed at a trusted (ideally local)
+// nameserver.
+type DNSResolver struct {
+	Servers []string
+	Timeout time.Duration
+}
+
+// NewDNSResolver returns a resolver using the nameservers in /etc/resolv.conf,
+// or 127.0.0.1 when none are configured.
+func NewDNSResolver() *DNSResolver {
+	return &DNSResolver{Servers: systemNameservers("/etc/resolv.conf"), Timeout: 5 * time.Second}
+}
+
+func systemNameservers(path string) []string {
+	var servers []string
+	if data, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// LookupTXT implements Resolver.
+func (r *DNSResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answers, _, err := r.query(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, body := range answers {
+		txt, ok := body.(*dnsmessage.TXTResource)
+		if !ok {
+			return nil, errors.New("tlspolicy: malformed TXT record")
+		}
+		out = append(out, strings.Join(txt.TXT, ""))
+	}
+	return out, nil
+}
+
+// LookupTLSA implements Resolver.
+func (r *DNSResolver) LookupTLSA(ctx context.Context, name string) ([]TLSA, bool, error) {
+	answers, secure, err := r.query(ctx, name, typeTLSA)
+	if err != nil {
+		return nil, secure, err
+	}
+	var out []TLSA
+	for _, body := range answers {
+		rec, ok := body.(*dnsmessage.UnknownResource)
+		if !ok || len(rec.Data) < 3 {
+			return nil, secure, errors.New("tlspolicy: malformed TLSA record")
+		}
+		out = append(out, TLSA{
+			Usage:        rec.Data[0],
+			Selector:     rec.Data[1],
+			MatchingType: rec.Data[2],
+			Data:         append([]byte(nil), rec.Data[3:]...),
+		})
+	}
+	return out, secure, nil
+}
+
+// query asks each server in turn and returns the answers of qtype, and whether
+// the response was authenticated.
+func (r *DNSResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.ResourceBody, bool, error) {
+	msg, question, id, err := buildQuery(name, qtype)
+	if err != nil {
+		return nil, false, err
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	var lastErr error
+	for _, server := range r.Servers {
+		resp, err := exchange(ctx, "udp", server, msg, timeout)
+		if err == nil && truncated(resp) {
+			resp, err = exchange(ctx, "tcp", server, msg, timeout)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return parseResponse(resp, id, question)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("tlspolicy: no nameservers configured")
+	}
+	return nil, false, lastErr
+}
+
+func exchange(ctx context.Context, network, server string, msg []byte, timeout time.Duration) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if network == "tcp" {
+		framed := make([]byte, 2+len(msg))
+		binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+		copy(framed[2:], msg)
+		if _, err := conn.Write(framed); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// buildQuery encodes a recursive query for name and qtype with an EDNS0 OPT
+// record that sets the DO bit, so a validating resolver reports the AD bit. It
+// returns the question and ID the response must echo.
+func buildQuery(name string, qtype dnsmessage.Type) ([]byte, dnsmessage.Question, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, dnsmessage.Question{}, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, dnsmessage.Question{}, 0, fmt.Errorf("tlspolicy: invalid name %q: %w", name, err)
+	}
+	question := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, RecursionDesired: true, AuthenticData: true})
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(ednsPayloadSize, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, dnsmessage.Question{}, 0, err
+	}
+	if err := b.StartQuestions(); err != nil {
+		return nil, dnsmessage.Question{}, 0, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, dnsmessage.Question{}, 0, fmt.Errorf("tlspolicy: invalid name %q: %w", name, err)
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, dnsmessage.Question{}, 0, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, dnsmessage.Question{}, 0, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, dnsmessage.Question{}, 0, fmt.Errorf("tlspolicy: invalid name %q: %w", name, err)
+	}
+	return msg, question, id, nil
+}
+
+// truncated reports whether msg has the TC bit set, asking for a retry over TCP.
+func truncated(msg []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	return err == nil && h.Truncated
+}
+
+// parseResponse checks that msg answers question under id and returns the
+// answers of the question's type and class. Only a response that echoes the
+// question is trusted, including its AD bit.
+func parseResponse(msg []byte, id uint16, question dnsmessage.Question) ([]dnsmessage.ResourceBody, bool, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, false, fmt.Errorf("tlspolicy: malformed DNS response: %w", err)
+	}
+	if h.ID != id {
+		return nil, false, errors.New("tlspolicy: DNS response ID mismatch")
+	}
+	if !h.Response {
+		return nil, false, errors.New("tlspolicy: DNS message is not a response")
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false, fmt.Errorf("tlspolicy: malformed DNS response: %w", err)
+	}
+	if len(questions) != 1 || questions[0].Type != question.Type || questions[0].Class != question.Class ||
+		!strings.EqualFold(questions[0].Name.String(), question.Name.String()) {
+		return nil, false, fmt.Errorf("tlspolicy: DNS response does not answer the query for %s", question.Name)
+	}
+	secure := h.AuthenticData
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, secure, ErrNotFound
+	default:
+		return nil, secure, fmt.Errorf("tlspolicy: DNS server returned rcode %d", h.RCode)
+	}
+	resources, err := p.AllAnswers()
+	if err != nil {
+		return nil, false, fmt.Errorf("tlspolicy: malformed DNS response: %w", err)
+	}
+	var answers []dnsmessage.ResourceBody
+	for _, rr := range resources {
+		if rr.Header.Type == question.Type && rr.Header.Class == question.Class {
+			answers = append(answers, rr.Body)
+		}
+	}
+	if len(answers) == 0 {
+		return nil, secure, ErrNotFound
+	}
+	return answers, secure, nil
+}
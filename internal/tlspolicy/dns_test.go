@@ -0,0 +1,136 @@
+package tlspolicy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers every UDP query on a local port with the message respond
+// builds for it. The response ID is filled in from the query.
+func serveDNS(t *testing.T, respond func(q dnsmessage.Question) dnsmessage.Message) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			resp := respond(query.Questions[0])
+			resp.Header.ID = query.Header.ID
+			resp.Header.Response = true
+			packed, err := resp.Pack()
+			if err != nil {
+				t.Errorf("pack response: %v", err)
+				return
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// answerWith responds with answer, which maps a query type to the RDATA returned
+// for it, echoing the question. Types without an entry get NXDOMAIN.
+func answerWith(secure bool, answer map[dnsmessage.Type][]byte) func(q dnsmessage.Question) dnsmessage.Message {
+	return func(q dnsmessage.Question) dnsmessage.Message {
+		m := dnsmessage.Message{
+			Header:    dnsmessage.Header{RecursionDesired: true, RecursionAvailable: true, AuthenticData: secure},
+			Questions: []dnsmessage.Question{q},
+		}
+		rdata, ok := answer[q.Type]
+		if !ok {
+			m.Header.RCode = dnsmessage.RCodeNameError
+			return m
+		}
+		m.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 300},
+			Body:   &dnsmessage.UnknownResource{Type: q.Type, Data: rdata},
+		}}
+		return m
+	}
+}
+
+func TestDNSResolverLookupTXT(t *testing.T) {
+	record := "v=STSv1; id=20240101"
+	rdata := append([]byte{byte(len(record))}, record...)
+	server := serveDNS(t, answerWith(false, map[dnsmessage.Type][]byte{dnsmessage.TypeTXT: rdata}))
+	r := &DNSResolver{Servers: []string{server}, Timeout: time.Second}
+
+	got, err := r.LookupTXT(context.Background(), "_mta-sts.example.com")
+	if err != nil {
+		t.Fatalf("LookupTXT: %v", err)
+	}
+	if len(got) != 1 || got[0] != record {
+		t.Fatalf("unexpected TXT records %q", got)
+	}
+}
+
+func TestDNSResolverLookupTLSA(t *testing.T) {
+	server := serveDNS(t, answerWith(true, map[dnsmessage.Type][]byte{typeTLSA: {3, 1, 1, 0xab, 0xcd}}))
+	r := &DNSResolver{Servers: []string{server}, Timeout: time.Second}
+
+	records, secure, err := r.LookupTLSA(context.Background(), "_25._tcp.mx.example.com")
+	if err != nil {
+		t.Fatalf("LookupTLSA: %v", err)
+	}
+	if !secure {
+		t.Fatalf("expected the AD bit to mark the answer secure")
+	}
+	if len(records) != 1 || records[0].Usage != UsageDANEEE || records[0].Selector != SelectorSPKI || string(records[0].Data) != "\xab\xcd" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
+
+func TestDNSResolverNotFound(t *testing.T) {
+	server := serveDNS(t, answerWith(false, nil))
+	r := &DNSResolver{Servers: []string{server}, Timeout: time.Second}
+
+	if _, err := r.LookupTXT(context.Background(), "_mta-sts.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDNSResolverChecksQuestion(t *testing.T) {
+	answer := answerWith(true, map[dnsmessage.Type][]byte{typeTLSA: {3, 1, 1, 0xab}})
+	other := dnsmessage.MustNewName("_25._tcp.mx.attacker.test.")
+	server := serveDNS(t, func(q dnsmessage.Question) dnsmessage.Message {
+		q.Name = other
+		return answer(q)
+	})
+	r := &DNSResolver{Servers: []string{server}, Timeout: time.Second}
+
+	records, secure, err := r.LookupTLSA(context.Background(), "_25._tcp.mx.example.com")
+	if err == nil || secure || records != nil || !strings.Contains(err.Error(), "does not answer") {
+		t.Fatalf("expected a response for another name to be rejected, got %v, %v, %v", records, secure, err)
+	}
+}
+
+func TestDNSResolverServerFailure(t *testing.T) {
+	server := serveDNS(t, func(q dnsmessage.Question) dnsmessage.Message {
+		return dnsmessage.Message{
+			Header:    dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure},
+			Questions: []dnsmessage.Question{q},
+		}
+	})
+	r := &DNSResolver{Servers: []string{server}, Timeout: time.Second}
+
+	if _, secure, err := r.LookupTLSA(context.Background(), "_25._tcp.mx.example.com"); err == nil || secure {
+		t.Fatalf("expected an insecure SERVFAIL error, got secure=%v, %v", secure, err)
+	}
+}
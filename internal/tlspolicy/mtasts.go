@@ -0,0 +1,232 @@
+package tlspolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STSMode is the mode of an MTA-STS policy.
+type STSMode string
+
+const (
+	STSModeNone    STSMode = "none"
+	STSModeTesting STSMode = "testing"
+	STSModeEnforce STSMode = "enforce"
+)
+
+const (
+	maxPolicyBytes = 64 << 10
+	maxPolicyAge   = 31557600 * time.Second // RFC 8461 section 3.2
+)
+
+// STSPolicy is a parsed MTA-STS policy.
+type STSPolicy struct {
+	ID      string
+	Mode    STSMode
+	MX      []string
+	MaxAge  time.Duration
+	Fetched time.Time
+}
+
+// Expired reports whether the policy's max_age has passed at now.
+func (p *STSPolicy) Expired(now time.Time) bool {
+	return now.After(p.Fetched.Add(p.MaxAge))
+}
+
+// Matches reports whether the MX host is permitted by the policy. Patterns may
+// start with "*." to match exactly one leading label (RFC 8461 section 4.1).
+func (p *STSPolicy) Matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			label, rest, found := strings.Cut(host, ".")
+			if found && label != "" && rest == suffix {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSTSPolicy parses the body of an mta-sts.txt policy file.
+func ParseSTSPolicy(body string) (*STSPolicy, error) {
+	p := &STSPolicy{}
+	var version string
+	haveMaxAge := false
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("mta-sts: malformed policy line %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			p.Mode = STSMode(value)
+		case "mx":
+			p.MX = append(p.MX, value)
+		case "max_age":
+			secs, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || secs < 0 {
+				return nil, fmt.Errorf("mta-sts: invalid max_age %q", value)
+			}
+			p.MaxAge = time.Duration(secs) * time.Second
+			if p.MaxAge > maxPolicyAge {
+				p.MaxAge = maxPolicyAge
+			}
+			haveMaxAge = true
+		}
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("mta-sts: unsupported version %q", version)
+	}
+	switch p.Mode {
+	case STSModeEnforce, STSModeTesting:
+		if len(p.MX) == 0 {
+			return nil, errors.New("mta-sts: policy lists no mx patterns")
+		}
+	case STSModeNone:
+	default:
+		return nil, fmt.Errorf("mta-sts: unknown mode %q", p.Mode)
+	}
+	if !haveMaxAge {
+		return nil, errors.New("mta-sts: policy has no max_age")
+	}
+	return p, nil
+}
+
+// STSCache discovers MTA-STS policies and caches them for their max_age. The
+// policy id published in DNS decides when a cached policy is refreshed.
+type STSCache struct {
+	Resolver Resolver
+	Client   *http.Client
+
+	mu       sync.Mutex
+	policies map[string]*STSPolicy
+	now      func() time.Time
+}
+
+// NewSTSCache returns a cache that looks up policy ids with r.
+func NewSTSCache(r Resolver) *STSCache {
+	return &STSCache{
+		Resolver: r,
+		Client: &http.Client{
+			Timeout: 60 * time.Second,
+			// RFC 8461 section 3.3: redirects must not be followed.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		policies: make(map[string]*STSPolicy),
+		now:      time.Now,
+	}
+}
+
+// Lookup returns the MTA-STS policy for domain, or nil when the domain has none.
+// A valid cached policy is kept when discovery or fetching fails, as RFC 8461
+// section 5.1 requires, so a DNS or HTTPS outage cannot strip the policy.
+func (c *STSCache) Lookup(ctx context.Context, domain string) (*STSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := c.now()
+
+	c.mu.Lock()
+	cached := c.policies[domain]
+	c.mu.Unlock()
+	if cached != nil && cached.Expired(now) {
+		cached = nil
+	}
+
+	id, err := c.policyID(ctx, domain)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return cached, nil
+	case err != nil:
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	case cached != nil && cached.ID == id:
+		return cached, nil
+	}
+
+	policy, err := c.fetch(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy.ID = id
+	policy.Fetched = now
+	c.mu.Lock()
+	c.policies[domain] = policy
+	c.mu.Unlock()
+	return policy, nil
+}
+
+// policyID returns the id from the _mta-sts TXT record of domain.
+func (c *STSCache) policyID(ctx context.Context, domain string) (string, error) {
+	records, err := c.Resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+	var ids []string
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		for _, field := range strings.Split(record, ";") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(field), "="); ok && key == "id" {
+				ids = append(ids, value)
+			}
+		}
+	}
+	// Zero or several STSv1 records mean no policy (RFC 8461 section 3.1).
+	if len(ids) != 1 || ids[0] == "" {
+		return "", ErrNotFound
+	}
+	return ids[0], nil
+}
+
+func (c *STSCache) fetch(ctx context.Context, domain string) (*STSPolicy, error) {
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("mta-sts: fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mta-sts: fetch %s: status %s", url, resp.Status)
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || mediaType != "text/plain" {
+		return nil, fmt.Errorf("mta-sts: fetch %s: unexpected content type %q", url, resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPolicyBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("mta-sts: fetch %s: %w", url, err)
+	}
+	if len(body) > maxPolicyBytes {
+		return nil, fmt.Errorf("mta-sts: policy at %s exceeds %d bytes", url, maxPolicyBytes)
+	}
+	return ParseSTSPolicy(string(body))
+}
@@ -0,0 +1,117 @@
+package tlspolicy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseSTSPolicy(t *testing.T) {
+	p, err := ParseSTSPolicy("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n")
+	if err != nil {
+		t.Fatalf("ParseSTSPolicy: %v", err)
+	}
+	if p.Mode != STSModeEnforce || p.MaxAge != 24*time.Hour || len(p.MX) != 2 {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+	for host, want := range map[string]bool{
+		"mail.example.com":      true,
+		"MAIL.example.com.":     true,
+		"mx1.example.net":       true,
+		"a.mx1.example.net":     false,
+		"example.net":           false,
+		"mail.example.com.evil": false,
+	} {
+		if got := p.Matches(host); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	for _, body := range []string{
+		"version: STSv1\nmode: enforce\nmax_age: 60\n",
+		"version: STSv2\nmode: none\nmax_age: 60\n",
+		"version: STSv1\nmode: strict\nmx: a.example\nmax_age: 60\n",
+		"version: STSv1\nmode: none\n",
+	} {
+		if _, err := ParseSTSPolicy(body); err == nil {
+			t.Errorf("expected %q to be rejected", body)
+		}
+	}
+}
+
+// stsServer serves body as the policy of every domain and returns a cache whose
+// HTTP client is routed to it.
+func stsServer(t *testing.T, r Resolver, body *string) (*STSCache, *int) {
+	t.Helper()
+	fetches := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetches++
+		if req.URL.Path != "/.well-known/mta-sts.txt" || req.Host != "mta-sts.example.com" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(*body))
+	}))
+	t.Cleanup(srv.Close)
+
+	cache := NewSTSCache(r)
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	cache.Client.Transport = transport
+	return cache, &fetches
+}
+
+func TestSTSCacheLookup(t *testing.T) {
+	r := &stubResolver{txt: map[string][]string{"_mta-sts.example.com": {"v=STSv1; id=1"}}}
+	body := "version: STSv1\nmode: enforce\nmx: mx.example.com\nmax_age: 3600\n"
+	cache, fetches := stsServer(t, r, &body)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	policy, err := cache.Lookup(context.Background(), "example.com")
+	if err != nil || policy == nil || policy.Mode != STSModeEnforce || policy.ID != "1" {
+		t.Fatalf("unexpected policy %+v, %v", policy, err)
+	}
+
+	// The same id is served from the cache, and a DNS outage keeps the policy.
+	if _, err := cache.Lookup(context.Background(), "example.com"); err != nil || *fetches != 1 {
+		t.Fatalf("expected a cached policy, fetches=%d err=%v", *fetches, err)
+	}
+	r.err = errors.New("servfail")
+	if policy, err := cache.Lookup(context.Background(), "example.com"); err != nil || policy == nil {
+		t.Fatalf("expected the cached policy during an outage, got %+v, %v", policy, err)
+	}
+	r.err = nil
+
+	// A new id triggers a refresh.
+	r.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	body = "version: STSv1\nmode: testing\nmx: mx.example.com\nmax_age: 3600\n"
+	policy, err = cache.Lookup(context.Background(), "example.com")
+	if err != nil || policy.Mode != STSModeTesting || *fetches != 2 {
+		t.Fatalf("expected a refreshed policy, got %+v, %v (fetches=%d)", policy, err, *fetches)
+	}
+
+	// Once expired, a domain without a TXT record has no policy.
+	delete(r.txt, "_mta-sts.example.com")
+	now = now.Add(2 * time.Hour)
+	if policy, err := cache.Lookup(context.Background(), "example.com"); err != nil || policy != nil {
+		t.Fatalf("expected no policy, got %+v, %v", policy, err)
+	}
+}
+
+func TestSTSCacheNoPolicy(t *testing.T) {
+	cache, fetches := stsServer(t, &stubResolver{}, new(string))
+	policy, err := cache.Lookup(context.Background(), "example.org")
+	if err != nil || policy != nil || *fetches != 0 {
+		t.Fatalf("expected no policy without a TXT record, got %+v, %v", policy, err)
+	}
+}
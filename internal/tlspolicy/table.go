@@ -0,0 +1,193 @@
+package tlspolicy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mode is the TLS requirement a local policy rule sets for a destination.
+type Mode string
+
+const (
+	// ModeNone never uses STARTTLS, even when it is offered.
+	ModeNone Mode = "none"
+	// ModeOpportunistic uses STARTTLS when offered without verifying the
+	// certificate, and delivers in the clear otherwise.
+	ModeOpportunistic Mode = "opportunistic"
+	// ModeEncrypt requires STARTTLS but accepts any certificate.
+	ModeEncrypt Mode = "encrypt"
+	// ModeVerify requires STARTTLS with a certificate valid for the MX host.
+	ModeVerify Mode = "verify"
+	// ModeFingerprint requires STARTTLS with a certificate whose SHA-256
+	// fingerprint is listed in the rule.
+	ModeFingerprint Mode = "fingerprint"
+)
+
+// Rule is one entry of a policy table.
+type Rule struct {
+	Pattern      string
+	Mode         Mode
+	Fingerprints [][]byte
+}
+
+// Table maps destination domains to local TLS policy rules. Each line of the file
+// has the form
+//
+//	domain mode [sha256:fingerprint...]
+//
+// where domain is an exact domain, "*.example.com" for any subdomain of
+// example.com, or "*" for every other domain. Blank lines and lines starting with
+// '#' are ignored. The file is reloaded automatically when its modification time
+// changes.
+type Table struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	rules   map[string]Rule
+}
+
+// LoadTable loads the policy file at path.
+func LoadTable(path string) (*Table, error) {
+	t := &Table{path: path}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Lookup returns the rule for domain. An exact entry wins over wildcards, and a
+// longer wildcard over a shorter one. An error means the file changed and could
+// not be reloaded; callers should not deliver rather than guess the policy.
+func (t *Table) Lookup(domain string) (Rule, bool, error) {
+	if err := t.reload(); err != nil {
+		return Rule{}, false, err
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rule, ok := t.rules[domain]; ok {
+		return rule, true, nil
+	}
+	for rest := domain; ; {
+		_, parent, found := strings.Cut(rest, ".")
+		if !found {
+			break
+		}
+		if rule, ok := t.rules["*."+parent]; ok {
+			return rule, true, nil
+		}
+		rest = parent
+	}
+	rule, ok := t.rules["*"]
+	return rule, ok, nil
+}
+
+func (t *Table) reload() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return fmt.Errorf("tls policy: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rules != nil && info.ModTime().Equal(t.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		return fmt.Errorf("tls policy: %w", err)
+	}
+	rules, err := parseTable(data)
+	if err != nil {
+		return fmt.Errorf("tls policy %s: %w", t.path, err)
+	}
+	t.rules = rules
+	t.modTime = info.ModTime()
+	return nil
+}
+
+func parseTable(data []byte) (map[string]Rule, error) {
+	rules := make(map[string]Rule)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected domain and mode", lineNo)
+		}
+		pattern := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		if name := strings.TrimPrefix(pattern, "*."); pattern != "*" && (name == "" || strings.Contains(name, "*")) {
+			return nil, fmt.Errorf("line %d: invalid domain pattern %q", lineNo, fields[0])
+		}
+		rule := Rule{Pattern: pattern, Mode: Mode(strings.ToLower(fields[1]))}
+		switch rule.Mode {
+		case ModeFingerprint:
+			if len(fields) == 2 {
+				return nil, fmt.Errorf("line %d: fingerprint mode needs at least one fingerprint", lineNo)
+			}
+			for _, field := range fields[2:] {
+				fp, err := parseFingerprint(field)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				rule.Fingerprints = append(rule.Fingerprints, fp)
+			}
+		case ModeNone, ModeOpportunistic, ModeEncrypt, ModeVerify:
+			if len(fields) > 2 {
+				return nil, fmt.Errorf("line %d: unexpected arguments for mode %s", lineNo, rule.Mode)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown mode %q", lineNo, fields[1])
+		}
+		if _, dup := rules[pattern]; dup {
+			return nil, fmt.Errorf("line %d: duplicate entry for %s", lineNo, pattern)
+		}
+		rules[pattern] = rule
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// parseFingerprint decodes "sha256:<hex>", where the hex digits may be separated
+// by colons as printed by openssl.
+func parseFingerprint(s string) ([]byte, error) {
+	digest, ok := strings.CutPrefix(strings.ToLower(s), "sha256:")
+	if !ok {
+		return nil, fmt.Errorf("fingerprint %q must start with sha256:", s)
+	}
+	fp, err := hex.DecodeString(strings.ReplaceAll(digest, ":", ""))
+	if err != nil || len(fp) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", s)
+	}
+	return fp, nil
+}
+
+// VerifyFingerprint checks that the server certificate in cs has one of the
+// SHA-256 fingerprints.
+func VerifyFingerprint(fingerprints [][]byte, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("fingerprint: server presented no certificate")
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	for _, fp := range fingerprints {
+		if bytes.Equal(fp, sum[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("fingerprint: server certificate sha256:%x is not pinned", sum)
+}
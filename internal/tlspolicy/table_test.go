@@ -0,0 +1,118 @@
+package tlspolicy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTable(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write policy file: %v", err)
+	}
+}
+
+func TestTableLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tls_policy")
+	writeTable(t, path, `# partners must present valid certificates
+partner.example      verify
+*.partner.example    encrypt
+*.lab.partner.example none
+relay.internal       fingerprint sha256:`+strings.Repeat("ab", 32)+`
+*                    opportunistic
+`)
+	table, err := LoadTable(path)
+	if err != nil {
+		t.Fatalf("LoadTable: %v", err)
+	}
+	for domain, want := range map[string]Mode{
+		"partner.example":        ModeVerify,
+		"PARTNER.example.":       ModeVerify,
+		"eu.partner.example":     ModeEncrypt,
+		"a.b.partner.example":    ModeEncrypt,
+		"mx.lab.partner.example": ModeNone,
+		"relay.internal":         ModeFingerprint,
+		"example.com":            ModeOpportunistic,
+	} {
+		rule, ok, err := table.Lookup(domain)
+		if err != nil || !ok || rule.Mode != want {
+			t.Errorf("Lookup(%q) = %v, %v, %v; want %s", domain, rule.Mode, ok, err, want)
+		}
+	}
+	rule, _, _ := table.Lookup("relay.internal")
+	if len(rule.Fingerprints) != 1 || len(rule.Fingerprints[0]) != sha256.Size {
+		t.Fatalf("unexpected fingerprints %x", rule.Fingerprints)
+	}
+}
+
+func TestTableReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tls_policy")
+	writeTable(t, path, "partner.example verify\n")
+	table, err := LoadTable(path)
+	if err != nil {
+		t.Fatalf("LoadTable: %v", err)
+	}
+	if _, ok, _ := table.Lookup("other.example"); ok {
+		t.Fatalf("expected no rule for other.example")
+	}
+
+	writeTable(t, path, "partner.example verify\nother.example encrypt\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if rule, ok, err := table.Lookup("other.example"); err != nil || !ok || rule.Mode != ModeEncrypt {
+		t.Fatalf("expected the reloaded rule, got %+v, %v, %v", rule, ok, err)
+	}
+
+	writeTable(t, path, "other.example bogus\n")
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if _, _, err := table.Lookup("other.example"); err == nil {
+		t.Fatalf("expected an invalid file to be reported")
+	}
+}
+
+func TestParseTableErrors(t *testing.T) {
+	for _, content := range []string{
+		"partner.example\n",
+		"partner.example strict\n",
+		"partner.example verify extra\n",
+		"partner.example fingerprint\n",
+		"partner.example fingerprint md5:00\n",
+		"partner.example fingerprint sha256:abcd\n",
+		"a.*.example verify\n",
+		"partner.example verify\npartner.example none\n",
+	} {
+		if _, err := parseTable([]byte(content)); err == nil {
+			t.Errorf("expected %q to be rejected", content)
+		}
+	}
+}
+
+func TestVerifyFingerprint(t *testing.T) {
+	cert := selfSigned(t, "relay.internal")
+	sum := sha256.Sum256(cert.Raw)
+	colons := strings.ReplaceAll(fmt.Sprintf("% X", sum[:]), " ", ":")
+	fp, err := parseFingerprint("SHA256:" + colons)
+	if err != nil {
+		t.Fatalf("parseFingerprint: %v", err)
+	}
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if err := VerifyFingerprint([][]byte{fp}, cs); err != nil {
+		t.Fatalf("VerifyFingerprint: %v", err)
+	}
+	other := selfSigned(t, "relay.internal")
+	if err := VerifyFingerprint([][]byte{fp}, tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}); err == nil {
+		t.Fatalf("expected an unpinned certificate to be rejected")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopherpost/internal/dkim"
+)
+
+// maxTXTString is the longest character-string a TXT record holds; longer
+// records are split into several strings that resolvers join.
+const maxTXTString = 255
+
+// runKeygen implements "gopherpost dkim-keygen": it generates a DKIM key, writes
+// it to the keyring directory or a file, and prints the DNS record to publish.
+func runKeygen(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("dkim-keygen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	domain := fs.String("domain", "", "signing domain (required)")
+	selector := fs.String("selector", "", "selector to publish the key under (required)")
+	algorithm := fs.String("algorithm", "rsa", "key algorithm: rsa or ed25519")
+	bits := fs.Int("bits", 2048, "RSA key size")
+	dir := fs.String("keyring", "", "keyring directory to write <domain>/<selector>.pem into")
+	out := fs.String("out", "", "file to write the key to, instead of a keyring directory")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: gopherpost dkim-keygen -domain example.com -selector 2025a [-algorithm rsa|ed25519] (-keyring dir | -out file)\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	*domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(*domain), "."))
+	if *domain == "" || *selector == "" || (*dir == "") == (*out == "") {
+		fs.Usage()
+		return 2
+	}
+	path := *out
+	if *dir != "" {
+		path = filepath.Join(*dir, *domain, *selector+".pem")
+	}
+
+	key, err := dkim.GenerateKey(*algorithm, *bits)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	data, err := dkim.MarshalKey(key)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	record, err := dkim.TXTRecord(key)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := writeKey(path, data); err != nil {
+		fmt.Fprintf(stderr, "dkim-keygen: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "Wrote %s key to %s\n\n", *algorithm, path)
+	if *dir != "" {
+		// Keys in a keyring directory have no schedule: the key signs from
+		// the next message, before receivers can look it up.
+		fmt.Fprintf(stdout, "The key signs from the next message. Publish this record now; other keys of\n%s keep signing until it has propagated, and can be removed after that:\n\n", *domain)
+	} else {
+		fmt.Fprintf(stdout, "Publish this record, then add the key to a keyring file with a not-before time\nafter the record has propagated, for example:\n\n\t%s %s %s not-before=%s\n\n",
+			*domain, *selector, path, time.Now().UTC().AddDate(0, 0, 2).Format("2006-01-02"))
+	}
+	fmt.Fprintf(stdout, "%s._domainkey.%s. IN TXT %s\n", *selector, *domain, zoneStrings(record))
+	return 0
+}
+
+// writeKey creates path, and its directory, readable by the owner only. The key
+// is written to a temporary file first and linked into place complete, so a
+// keyring reload never reads it half written. It never replaces an existing
+// key, which may still be signing.
+func writeKey(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	// The leading dot and suffix keep the keyring from loading the temporary file.
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Link(f.Name(), path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists; choose a new selector", path)
+		}
+		return err
+	}
+	return nil
+}
+
+// zoneStrings quotes record for a zone file, split into strings of at most
+// maxTXTString characters.
+func zoneStrings(record string) string {
+	var parts []string
+	for len(record) > maxTXTString {
+		parts = append(parts, `"`+record[:maxTXTString]+`"`)
+		record = record[maxTXTString:]
+	}
+	parts = append(parts, `"`+record+`"`)
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return "( " + strings.Join(parts, "\n\t") + " )"
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+
+	"gopherpost/delivery"
+	"gopherpost/queue"
+	"gopherpost/storage"
+)
+
+// isLocal reports whether addr belongs to one of the server's local domains.
+func (s *server) isLocal(addr string) bool {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return false
+	}
+	_, ok := s.localDomains[strings.ToLower(addr[at+1:])]
+	return ok
+}
+
+// deliverLocal writes msg straight into the recipient's Maildir and drops its
+// spool copy. It reports false when the delivery failed, in which case msg is
+// left for the queue, whose router sends local domains back to the Maildir.
+func (s *server) deliverLocal(msg queue.QueuedMessage, data []byte) (bool, error) {
+	at := strings.LastIndex(msg.To, "@")
+	result := s.mailboxes.Deliver(strings.ToLower(msg.To[at+1:]), []delivery.Transaction{{
+		From: msg.From,
+		To:   []string{msg.To},
+		Data: data,
+	}})
+	if err := result[0][0]; err != nil {
+		return false, err
+	}
+	return true, storage.RemoveMessage(msg.SpoolPath)
+}
@@ -14,43 +14,50 @@ import (
 	"net/netip"
 	"net/textproto"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
 
+	"gopherpost/delivery"
 	health "gopherpost/health"
+	"gopherpost/internal/alias"
 	audit "gopherpost/internal/audit"
+	"gopherpost/internal/auth"
 	"gopherpost/internal/config"
 	"gopherpost/internal/dkim"
 	"gopherpost/internal/email"
 	"gopherpost/internal/metrics"
+	"gopherpost/internal/recipient"
+	"gopherpost/internal/spf"
+	"gopherpost/internal/srs"
+	"gopherpost/internal/tlspolicy"
 	"gopherpost/internal/version"
 	"gopherpost/queue"
 	"gopherpost/storage"
 	tlsconfig "gopherpost/tlsconfig"
+	"gopherpost/transport"
 )
 
 const (
-	defaultSMTPPort   = "2525"
 	defaultHealthAddr = ":8080"
-	defaultBanner     = "GopherPost ready"
-	maxMessageBytes   = 10 << 20 // 10 MiB
 	commandDeadline   = 15 * time.Minute
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dkim-keygen" {
+		os.Exit(runKeygen(os.Args[2:], os.Stdout, os.Stderr))
+	}
 	_ = godotenv.Load()
 	audit.RefreshFromEnv()
 	log.Printf("GopherPost version %s starting", version.Number)
 	audit.Log("version %s boot", version.Number)
 
-	port := defaultSMTPPort
-	if env := os.Getenv("SMTP_PORT"); env != "" {
-		port = env
-	}
-	addr := ":" + port
-
 	healthDisabled := config.Bool("SMTP_HEALTH_DISABLE", false)
 
 	healthAddr := defaultHealthAddr
@@ -66,14 +73,18 @@ func main() {
 		log.Fatalf("Failed to initialize DKIM: %v", err)
 	}
 	if dkimSigner != nil {
-		log.Printf("DKIM signing enabled (selector %s)", dkimSigner.Selector())
-		audit.Log("DKIM signing enabled selector %s domain %s", dkimSigner.Selector(), dkimSigner.Domain())
+		if selector := dkimSigner.Selector(); selector != "" {
+			log.Printf("DKIM signing enabled (selector %s)", selector)
+		}
+		if domains := dkimSigner.Domains(); len(domains) > 0 {
+			log.Printf("DKIM signing enabled from keyring for %s", strings.Join(domains, ", "))
+		}
+		audit.Log("DKIM signing enabled selector %s domain %s keyring %d", dkimSigner.Selector(), dkimSigner.Domain(), len(dkimSigner.Domains()))
 	}
-	banner := os.Getenv("SMTP_BANNER")
-	if banner == "" {
-		banner = defaultBanner
+	listeners, err := config.Listeners()
+	if err != nil {
+		log.Fatalf("Invalid listener configuration: %v", err)
 	}
-	greeting := fmt.Sprintf("%s %s", hostname, banner)
 
 	if healthDisabled {
 		log.Printf("Health server disabled via SMTP_HEALTH_DISABLE")
@@ -89,14 +100,65 @@ func main() {
 		log.Printf("Health endpoint listening on %s/healthz", healthListener.Addr().String())
 	}
 
+	routing, err := config.OutboundRouting()
+	if err != nil {
+		log.Fatalf("Invalid outbound routing: %v", err)
+	}
+	if routing.Smarthost != nil {
+		log.Printf("Outbound mail relayed via smarthost %s (%s)", routing.Smarthost.Addr(), routing.Smarthost.TLSMode)
+	}
+	if len(routing.Routes) > 0 {
+		log.Printf("Outbound routes configured: %d", len(routing.Routes))
+	}
+	if arcSealing(listeners, routing) {
+		if dkimSigner.Domain() == "" {
+			log.Fatalf("ARC sealing requires DKIM signing with SMTP_DKIM_DOMAIN set")
+		}
+		log.Printf("ARC sealing enabled (domain %s)", dkimSigner.Domain())
+	}
+	localDomains := make(map[string]struct{}, len(routing.LocalDomains))
+	for _, domain := range routing.LocalDomains {
+		localDomains[domain] = struct{}{}
+	}
+	if len(localDomains) > 0 {
+		log.Printf("Local domains delivered to %s: %s", config.MaildirRoot(), strings.Join(routing.LocalDomains, ", "))
+	}
+	relayDomains := make(map[string]struct{})
+	for _, domain := range config.RelayDomains() {
+		relayDomains[domain] = struct{}{}
+	}
+	trustedNetworks := config.TrustedNetworks()
+	log.Printf("Relay permitted for authenticated clients and %d trusted network(s); relay domains: %d", len(trustedNetworks), len(relayDomains))
+
+	router := transport.FromConfig(routing)
 	workerCount := config.QueueWorkers()
-	q := queue.NewManager(queue.WithWorkers(workerCount))
+	q := queue.NewManager(
+		queue.WithTransport(router),
+		queue.WithWorkers(workerCount),
+		queue.WithHostname(hostname),
+		queue.WithMaxLifetime(config.QueueMaxLifetime()),
+		queue.WithDelayWarning(config.QueueDelayWarning()),
+	)
 	if dir := strings.TrimSpace(os.Getenv("SMTP_QUEUE_PATH")); dir != "" {
 		storage.SetBaseDir(dir)
 		log.Printf("Queue storage path set to %s", dir)
 	}
 	log.Printf("Queue workers configured: %d", workerCount)
 	audit.Log("queue workers %d", workerCount)
+	report, err := q.Recover()
+	if err != nil {
+		log.Fatalf("Failed to recover queue from spool: %v", err)
+	}
+	log.Printf("Queue recovered %d spooled message(s), quarantined %d", report.Restored, report.Quarantined)
+	audit.Log("queue recovered %d quarantined %d", report.Restored, report.Quarantined)
+	if path := config.TLSPolicyFile(); path != "" {
+		table, err := tlspolicy.LoadTable(path)
+		if err != nil {
+			log.Fatalf("Failed to load TLS policy file: %v", err)
+		}
+		delivery.SetPolicyTable(table)
+		log.Printf("Outbound TLS policy loaded from %s", path)
+	}
 	q.Start()
 	defer q.Stop()
 
@@ -104,37 +166,204 @@ func main() {
 	if tlsErr != nil && !errors.Is(tlsErr, tlsconfig.ErrTLSDisabled) {
 		log.Fatalf("Failed to load TLS: %v", tlsErr)
 	}
-	baseListener, err := net.Listen("tcp", addr)
+	authBackend, err := auth.LoadFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		log.Fatalf("Failed to initialize SMTP AUTH: %v", err)
 	}
-	var ln net.Listener = baseListener
-	if tlsConf != nil {
-		ln = tls.NewListener(baseListener, tlsConf)
-		audit.Log("SMTP TLS enabled on %s", addr)
-		log.Printf("SMTP TLS enabled on %s", addr)
-	} else {
-		log.Printf("SMTP plaintext listening on %s", addr)
-		if tlsErr != nil {
-			log.Printf("TLS disabled: %v", tlsErr)
+	if authBackend != nil {
+		if tlsConf == nil {
+			log.Fatalf("SMTP_AUTH_HTPASSWD is set but TLS is unavailable: %v", tlsErr)
+		}
+		log.Printf("SMTP AUTH enabled (PLAIN, LOGIN over TLS)")
+		audit.Log("SMTP AUTH enabled")
+	}
+	ours := append(append([]string(nil), routing.LocalDomains...), config.RelayDomains()...)
+	recipients, err := recipient.LoadFromEnv(ours...)
+	if err != nil {
+		log.Fatalf("Failed to initialize recipient verification: %v", err)
+	}
+	if recipients != nil {
+		log.Printf("Recipient verification enabled")
+		audit.Log("recipient verification enabled")
+	}
+	var aliases *alias.Map
+	if path := config.AliasesFile(); path != "" {
+		aliases, err = alias.Load(path, ours...)
+		if err != nil {
+			log.Fatalf("Failed to load aliases: %v", err)
+		}
+		log.Printf("Aliases loaded from %s", path)
+	}
+	var rewriter *srs.Rewriter
+	if secret := config.SRSSecret(); secret != "" {
+		rewriter = srs.New(secret, config.SRSDomain(), config.SRSMaxAge())
+		log.Printf("Sender rewriting enabled for forwarded mail (domain %s)", rewriter.Domain)
+	}
+	spfPolicy, err := config.SPF()
+	if err != nil {
+		log.Fatalf("Invalid SPF configuration: %v", err)
+	}
+	var spfChecker *spf.Checker
+	if spfPolicy.Enabled {
+		spfChecker = spf.NewChecker(net.DefaultResolver, hostname)
+		log.Printf("SPF verification enabled (fail=%s, softfail=%s, permerror=%s, temperror=%s)", spfPolicy.Fail, spfPolicy.SoftFail, spfPolicy.PermError, spfPolicy.TempError)
+	}
+	var resolver dkim.Resolver
+	if config.DKIMVerify() {
+		resolver = net.DefaultResolver
+		log.Printf("DKIM and ARC verification enabled (DMARC %t)", config.DMARC())
+	}
+	srv := &server{
+		queue:     q,
+		hostname:  hostname,
+		signer:    dkimSigner,
+		tlsConfig: tlsConf,
+		auth:      authBackend,
+
+		localDomains: localDomains,
+		routes:       router,
+		mailboxes:    transport.Maildir{Root: config.MaildirRoot()},
+		recipients:   recipients,
+		aliases:      aliases,
+		srs:          rewriter,
+		spf:          spfChecker,
+		spfPolicy:    spfPolicy,
+		resolver:     resolver,
+		dmarc:        resolver != nil && config.DMARC(),
+
+		relayDomains:    relayDomains,
+		trustedNetworks: trustedNetworks,
+	}
+	if tlsConf == nil && tlsErr != nil {
+		log.Printf("TLS disabled: %v", tlsErr)
+	}
+	for i := range listeners {
+		l := &listeners[i]
+		if l.TLSMode == config.TLSModeDefault {
+			l.TLSMode = config.TLSModeNone
+			if tlsConf != nil {
+				l.TLSMode = config.TLSModeStartTLS
+			}
+		}
+		if l.TLSMode != config.TLSModeNone && tlsConf == nil {
+			log.Fatalf("Listener %s requires TLS mode %s but TLS is unavailable: %v", l.Name, l.TLSMode, tlsErr)
+		}
+		if l.RequireTLS && l.TLSMode == config.TLSModeNone {
+			log.Fatalf("Listener %s requires TLS but TLS is unavailable: %v", l.Name, tlsErr)
+		}
+		if l.RequireAuth && authBackend == nil {
+			log.Fatalf("Listener %s requires AUTH but SMTP_AUTH_HTPASSWD is not set", l.Name)
+		}
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s (%s): %v", l.Addr, l.Name, err)
+		}
+		if l.TLSMode == config.TLSModeImplicit {
+			ln = tls.NewListener(ln, tlsConf)
 		}
+		log.Printf("SMTP listener %s on %s (tls=%s, require_tls=%t, require_auth=%t, max_size=%d)", l.Name, l.Addr, l.TLSMode, l.RequireTLS, l.RequireAuth, l.MaxMessageBytes)
+		audit.Log("SMTP listener %s listening on %s tls %s", l.Name, l.Addr, l.TLSMode)
+		go srv.serve(ln, l)
 	}
 
-	audit.Log("SMTP server listening on %s", addr)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	// Restore default signal handling so a second signal terminates immediately.
+	stop()
+
+	grace := config.ShutdownTimeout()
+	log.Printf("Shutdown requested; draining sessions and queue (timeout %s)", grace)
+	audit.Log("shutdown begin timeout %s", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("SMTP sessions did not drain in time: %v", err)
+	}
+	if err := q.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Queue deliveries did not finish in time: %v", err)
+	}
+	log.Printf("Shutdown complete")
+	audit.Log("shutdown complete")
+}
+
+// serve accepts connections on ln and runs a session for each using policy l
+// until Shutdown closes the listener.
+func (s *server) serve(ln net.Listener, l *config.Listener) {
+	if !s.trackListener(ln) {
+		return
+	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("Accept error: %v", err)
+			if s.shuttingDown() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Accept error on %s: %v", l.Name, err)
 			continue
 		}
-		go handleSession(conn, q, greeting, hostname, dkimSigner)
+		go s.handleSession(conn, l)
 	}
 }
 
-func handleSession(conn net.Conn, q *queue.Manager, greeting string, hostname string, signer *dkim.Signer) {
-	defer conn.Close()
+// server carries the dependencies shared by every SMTP session. Per-listener
+// policy is passed to each session separately.
+type server struct {
+	queue     *queue.Manager
+	hostname  string
+	signer    *dkim.Signer
+	tlsConfig *tls.Config
+	auth      auth.Backend
+
+	// Local delivery, see local.go. Recipients in localDomains must have a
+	// mailbox and are never relayed. routes is the outbound router, which says
+	// which recipients are ARC sealed; see arc.go.
+	localDomains map[string]struct{}
+	routes       *transport.Router
+	mailboxes    transport.Maildir
+	// recipients, when set, vets every RCPT TO address. aliases, when set,
+	// rewrites accepted addresses; see recipients.go.
+	recipients recipient.Verifier
+	aliases    *alias.Map
+	// srs, when set, rewrites the sender of mail forwarded to other domains
+	// and decodes bounces to the rewritten addresses.
+	srs *srs.Rewriter
+	// spf, when set, checks the senders of clients that may not relay, and
+	// spfPolicy says what to do with each result; see spf.go.
+	spf       *spf.Checker
+	spfPolicy config.SPFPolicy
+	// resolver, when set, enables DKIM and ARC verification of inbound mail,
+	// and dmarc adds DMARC evaluation; see authres.go.
+	resolver dkim.Resolver
+	dmarc    bool
+
+	// Relay rules, see relay.go. Only authenticated sessions and trusted
+	// networks may send to domains that are neither local nor relay domains.
+	relayDomains    map[string]struct{}
+	trustedNetworks []*net.IPNet
+
+	// Shutdown state, see shutdown.go.
+	mu        sync.Mutex
+	closing   bool
+	listeners map[net.Listener]struct{}
+	sessions  map[*activeSession]struct{}
+	active    sync.WaitGroup
+}
+
+func (s *server) handleSession(conn net.Conn, l *config.Listener) {
+	sess, ok := s.trackSession(conn)
+	if !ok {
+		_, _ = fmt.Fprintf(conn, "421 4.3.2 %s Service shutting down\r\n", s.hostname)
+		_ = conn.Close()
+		return
+	}
+	defer s.untrackSession(sess)
+	q := s.queue
+	hostname := s.hostname
+	signer := s.signer
 	tp := textproto.NewConn(conn)
-	defer tp.Close()
+	defer func() { tp.Close() }()
+	_, tlsActive := conn.(*tls.Conn)
 
 	remoteAddr := conn.RemoteAddr()
 	remote := remoteAddr.String()
@@ -154,7 +383,22 @@ func handleSession(conn net.Conn, q *queue.Manager, greeting string, hostname st
 		alog("sent %d %s", code, msg)
 		return true
 	}
-	if !connAllowed(remoteAddr) {
+	sendLines := func(code int, lines []string) bool {
+		for i, msg := range lines {
+			sep := "-"
+			if i == len(lines)-1 {
+				sep = " "
+			}
+			if err := tp.PrintfLine("%d%s%s", code, sep, msg); err != nil {
+				log.Printf("send error to %s: %v", remote, err)
+				alog("send error: %v", err)
+				return false
+			}
+		}
+		alog("sent %d %s", code, strings.Join(lines, " | "))
+		return true
+	}
+	if !l.AllowAll() && !connAllowed(remoteAddr, l.AllowNetworks, l.AllowHosts) {
 		_ = send(554, "5.7.1 Access denied")
 		audit.Log("session %s rejected remote %s", sessionID, remote)
 		return
@@ -173,16 +417,31 @@ func handleSession(conn net.Conn, q *queue.Manager, greeting string, hostname st
 		return
 	}
 
-	if !send(220, greeting) {
+	if !send(220, fmt.Sprintf("%s %s", hostname, l.Banner)) {
 		return
 	}
+	var heloName string
+	var esmtp bool
+	var identity *auth.Identity
+	authFailures := 0
 	var from string
+	var haveSender bool // from is "" for the null sender
 	var to []string
+	var forwarded map[string]bool // alias targets that get an SRS sender
+	var spfVerdict *spf.Verdict
 	var data bytes.Buffer
+	clientIP := ""
+	remoteIP := extractIP(remoteAddr)
+	if remoteIP != nil {
+		clientIP = remoteIP.String()
+	}
 
 	reset := func() {
 		from = ""
+		haveSender = false
 		to = nil
+		forwarded = nil
+		spfVerdict = nil
 		data.Reset()
 	}
 	defer reset()
@@ -193,8 +452,19 @@ func handleSession(conn net.Conn, q *queue.Manager, greeting string, hostname st
 			alog("refresh deadline failed: %v", err)
 			return
 		}
+		if !s.markIdle(sess) {
+			_ = send(421, "4.3.2 Service shutting down")
+			alog("closed for shutdown")
+			return
+		}
 		line, err := tp.ReadLine()
+		s.markBusy(sess)
 		if err != nil {
+			if s.shuttingDown() {
+				_ = send(421, "4.3.2 Service shutting down")
+				alog("closed for shutdown")
+				return
+			}
 			log.Printf("session error: %v", err)
 			alog("read error: %v", err)
 			return
@@ -203,77 +473,281 @@ func handleSession(conn net.Conn, q *queue.Manager, greeting string, hostname st
 		cmd := strings.ToUpper(line)
 		switch {
 		case strings.HasPrefix(cmd, "HELO") || strings.HasPrefix(cmd, "EHLO"):
-			if !send(250, hostname) {
+			name := strings.TrimSpace(line[4:])
+			if name == "" {
+				if !send(501, "5.5.4 Syntax: "+cmd[:4]+" hostname") {
+					return
+				}
+				alog("%s without hostname rejected", cmd[:4])
+				continue
+			}
+			reset()
+			heloName = name
+			esmtp = cmd[:4] == "EHLO"
+			if esmtp {
+				greeting := fmt.Sprintf("%s greets %s", hostname, name)
+				if !sendLines(250, append([]string{greeting}, s.extensions(l, tlsActive)...)) {
+					return
+				}
+			} else if !send(250, hostname) {
 				return
 			}
-			alog("handshake %s", cmd[:4])
+			alog("handshake %s %s", cmd[:4], heloName)
+		case strings.HasPrefix(cmd, "STARTTLS"):
+			switch {
+			case tlsActive:
+				if !send(503, "5.5.1 TLS already active") {
+					return
+				}
+				alog("repeated STARTTLS rejected")
+				continue
+			case s.tlsConfig == nil || l.TLSMode != config.TLSModeStartTLS:
+				if !send(454, "4.7.0 TLS not available") {
+					return
+				}
+				alog("STARTTLS rejected: TLS not configured")
+				continue
+			case strings.TrimSpace(line[len("STARTTLS"):]) != "":
+				if !send(501, "5.5.4 Syntax error (no parameters allowed)") {
+					return
+				}
+				alog("STARTTLS with parameters rejected")
+				continue
+			}
+			if !send(220, "2.0.0 Ready to start TLS") {
+				return
+			}
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				log.Printf("TLS handshake with %s failed: %v", remote, err)
+				alog("tls handshake failed: %v", err)
+				return
+			}
+			// Discard all state learned before the upgrade, including anything the
+			// client may have pipelined behind STARTTLS (RFC 3207 section 4.2).
+			conn = tlsConn
+			tp = textproto.NewConn(tlsConn)
+			tlsActive = true
+			heloName = ""
+			esmtp = false
+			identity = nil
+			reset()
+			state := tlsConn.ConnectionState()
+			alog("tls established version %s cipher %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		case strings.HasPrefix(cmd, "AUTH"):
+			var code int
+			var msg string
+			switch {
+			case s.auth == nil:
+				code, msg = 502, "5.5.1 AUTH not available"
+			case !tlsActive:
+				code, msg = 538, "5.7.11 Encryption required for requested authentication mechanism"
+			case !esmtp:
+				code, msg = 503, "5.5.1 Send EHLO first"
+			case identity != nil:
+				code, msg = 503, "5.5.1 Already authenticated"
+			case haveSender:
+				code, msg = 503, "5.5.1 AUTH not permitted during a mail transaction"
+			}
+			if code != 0 {
+				if !send(code, msg) {
+					return
+				}
+				alog("AUTH rejected: %s", msg)
+				continue
+			}
+			id, code, msg, err := s.authenticate(tp, line)
+			if err != nil {
+				log.Printf("auth exchange with %s failed: %v", remote, err)
+				alog("auth exchange error: %v", err)
+				return
+			}
+			if !send(code, msg) {
+				return
+			}
+			if id == nil {
+				authFailures++
+				alog("authentication failed (%d/%d)", authFailures, maxAuthFailures)
+				if authFailures >= maxAuthFailures {
+					_ = send(421, "4.7.0 Too many authentication failures")
+					return
+				}
+				continue
+			}
+			identity = id
+			alog("authenticated as %s", identity.Username)
 		case strings.HasPrefix(cmd, "MAIL FROM:"):
-			addr, err := email.ParseCommandAddress(line)
+			if l.RequireTLS && !tlsActive {
+				if !send(530, "5.7.0 Must issue a STARTTLS command first") {
+					return
+				}
+				alog("MAIL FROM rejected: TLS required")
+				continue
+			}
+			if l.RequireAuth && identity == nil {
+				if !send(530, "5.7.0 Authentication required") {
+					return
+				}
+				alog("MAIL FROM rejected: authentication required")
+				continue
+			}
+			addr, params, err := email.ParseReversePath(line)
 			if err != nil {
-				if !send(501, "Invalid sender address") {
+				if !send(501, "5.1.7 Invalid sender address") {
 					return
 				}
 				alog("invalid MAIL FROM: %v", err)
 				continue
 			}
-			if requireLocalDomain {
+			if code, msg := checkMailParams(params, esmtp, l.MaxMessageBytes); code != 0 {
+				if !send(code, msg) {
+					return
+				}
+				alog("MAIL FROM parameters rejected: %s", msg)
+				continue
+			}
+			if requireLocalDomain && addr != "" {
 				domain, derr := email.Domain(addr)
 				if derr != nil {
-					if !send(501, "Invalid sender domain") {
+					if !send(501, "5.1.8 Invalid sender domain") {
 						return
 					}
 					alog("invalid sender domain: %v", derr)
 					continue
 				}
-				if expectedDomain != "" && !strings.EqualFold(domain, expectedDomain) {
-					if !send(553, "Sender domain not permitted") {
+				// Authenticated users may also send from the domains they own.
+				if expectedDomain != "" && !strings.EqualFold(domain, expectedDomain) && !identity.MaySendFrom(domain) {
+					if !send(553, "5.7.1 Sender domain not permitted") {
 						return
 					}
 					alog("sender domain %s rejected (expected %s)", domain, expectedDomain)
 					continue
 				}
 			}
+			var verdict *spf.Verdict
+			if s.spf != nil && s.isInbound(identity, remoteIP) {
+				v, action := s.checkSPF(remoteIP, addr, heloName)
+				if v.Reason != "" {
+					alog("spf %s for <%s>: %s", v.Result, addr, v.Reason)
+				} else {
+					alog("spf %s for <%s>", v.Result, addr)
+				}
+				var code int
+				var msg string
+				switch action {
+				case config.SPFReject:
+					code, msg = 550, "5.7.23 SPF validation failed"
+				case config.SPFDefer:
+					code, msg = 451, "4.7.24 SPF validation error"
+				}
+				if code != 0 {
+					if !send(code, msg) {
+						return
+					}
+					alog("MAIL FROM rejected: spf %s", v.Result)
+					continue
+				}
+				verdict = &v
+			}
 			from = addr
+			haveSender = true
 			to = nil
-			if !send(250, "Sender OK") {
+			forwarded = nil
+			spfVerdict = verdict
+			if !send(250, "2.1.0 Sender OK") {
 				return
 			}
-			alog("mail from %s", from)
+			alog("mail from <%s>", from)
 		case strings.HasPrefix(cmd, "RCPT TO:"):
-			if from == "" {
-				if !send(503, "Need MAIL command first") {
+			if !haveSender {
+				if !send(503, "5.5.1 Need MAIL command first") {
 					return
 				}
 				alog("RCPT before MAIL rejected")
 				continue
 			}
-			addr, err := email.ParseCommandAddress(line)
+			addr, params, err := email.ParseCommandParams(line)
 			if err != nil {
-				if !send(501, "Invalid recipient address") {
+				if !send(501, "5.1.3 Invalid recipient address") {
 					return
 				}
 				alog("invalid RCPT TO: %v", err)
 				continue
 			}
-			to = append(to, addr)
-			if !send(250, "Recipient OK") {
+			if len(params) > 0 {
+				if !send(555, "5.5.4 RCPT TO parameters not supported") {
+					return
+				}
+				alog("RCPT TO parameters rejected")
+				continue
+			}
+			if !s.acceptsFor(addr) && !s.mayRelay(identity, remoteIP) {
+				if !send(554, "5.7.1 Relay access denied") {
+					return
+				}
+				alog("relay to %s denied", addr)
+				continue
+			}
+			rcpts, aliased, err := s.resolveRecipient(addr)
+			switch {
+			case errors.Is(err, errUnknownRecipient):
+				if !send(550, "5.1.1 Mailbox unavailable") {
+					return
+				}
+				alog("unknown recipient %s rejected", addr)
+				continue
+			case errors.Is(err, errInvalidSRS):
+				if !send(550, "5.1.1 Invalid or expired SRS address") {
+					return
+				}
+				alog("recipient %s rejected: %v", addr, err)
+				continue
+			case errors.Is(err, alias.ErrLoop):
+				if !send(550, "5.4.6 Alias expansion loop") {
+					return
+				}
+				alog("recipient %s rejected: %v", addr, err)
+				continue
+			case err != nil:
+				if !send(450, "4.4.3 Recipient verification temporarily unavailable") {
+					return
+				}
+				alog("recipient lookup for %s failed: %v", addr, err)
+				continue
+			}
+			for _, rcpt := range rcpts {
+				if !slices.ContainsFunc(to, func(t string) bool { return strings.EqualFold(t, rcpt) }) {
+					to = append(to, rcpt)
+				}
+				if aliased && !s.isLocal(rcpt) {
+					if forwarded == nil {
+						forwarded = make(map[string]bool)
+					}
+					forwarded[strings.ToLower(rcpt)] = true
+				}
+			}
+			if !send(250, "2.1.5 Recipient OK") {
 				return
 			}
-			alog("rcpt add %s (total=%d)", addr, len(to))
+			if len(rcpts) == 1 && rcpts[0] == addr {
+				alog("rcpt add %s (total=%d)", addr, len(to))
+			} else {
+				alog("rcpt add %s as %s (total=%d)", addr, strings.Join(rcpts, ", "), len(to))
+			}
 		case strings.HasPrefix(cmd, "RSET"):
 			reset()
-			if !send(250, "State cleared") {
+			if !send(250, "2.0.0 State cleared") {
 				return
 			}
 			alog("state reset")
 		case strings.HasPrefix(cmd, "NOOP"):
-			if !send(250, "OK") {
+			if !send(250, "2.0.0 OK") {
 				return
 			}
 			alog("noop acknowledged")
 		case strings.HasPrefix(cmd, "DATA"):
-			if from == "" || len(to) == 0 {
-				if !send(503, "Need sender and recipient before DATA") {
+			if !haveSender || len(to) == 0 {
+				if !send(503, "5.5.1 Need sender and recipient before DATA") {
 					return
 				}
 				alog("DATA before MAIL/RCPT rejected")
@@ -287,46 +761,92 @@ func handleSession(conn net.Conn, q *queue.Manager, greeting string, hostname st
 			reader := tp.DotReader()
 			limited := &io.LimitedReader{
 				R: reader,
-				N: maxMessageBytes + 1,
+				N: l.MaxMessageBytes + 1,
 			}
 			_, err := io.Copy(&data, limited)
 			if err != nil {
-				if !send(554, "Read error") {
+				if !send(554, "5.6.0 Read error") {
 					return
 				}
 				alog("dot-reader copy error: %v", err)
 				return
 			}
 			if limited.N <= 0 {
-				if !send(552, "Message exceeds size limit") {
+				if !send(552, "5.3.4 Message exceeds size limit") {
 					return
 				}
-				alog("message exceeded max size (%d bytes)", maxMessageBytes)
+				alog("message exceeded max size (%d bytes)", l.MaxMessageBytes)
 				reset()
 				continue
 			}
 
 			messageBytes := append([]byte(nil), data.Bytes()...)
-			if signer != nil {
+			var authResults []string
+			inbound := s.isInbound(identity, remoteIP)
+			if inbound {
+				messageBytes, authResults = s.addAuthenticationResults(messageBytes, spfVerdict)
+			}
+			// Inbound mail is never signed: its From header is unverified, and a
+			// forwarded copy would leave with our signature on a forged sender.
+			if signer != nil && !inbound {
 				signed, err := signer.Sign(messageBytes, from)
-				if err != nil {
-					if !send(451, "Requested action aborted: DKIM signing failure") {
+				switch {
+				case errors.Is(err, dkim.ErrNoKey):
+					log.Printf("Message %s sent unsigned: %v", messageID, err)
+					alog("dkim signing skipped: %v", err)
+				case err != nil:
+					if !send(451, "4.3.0 Requested action aborted: DKIM signing failure") {
 						return
 					}
 					alog("dkim signing error: %v", err)
 					reset()
 					continue
+				default:
+					messageBytes = signed
+					alog("dkim signature applied")
 				}
-				messageBytes = signed
-				alog("dkim signature applied")
+			}
+			var sealedBytes []byte
+			if slices.ContainsFunc(to, func(rcpt string) bool { return s.sealsFor(l, rcpt) }) {
+				sealed, err := s.arcSeal(messageBytes, identity, authResults)
+				if err != nil {
+					if !send(451, "4.3.0 Requested action aborted: ARC sealing failure") {
+						return
+					}
+					alog("arc sealing error: %v", err)
+					reset()
+					continue
+				}
+				sealedBytes = sealed
+				alog("arc seal applied")
 			}
 			payload := queue.NewPayload(messageBytes)
+			var sealedPayload *queue.Payload
+			if sealedBytes != nil {
+				sealedPayload = queue.NewPayload(sealedBytes)
+			}
+			receivedAt := time.Now().UTC()
 			var queued []queue.QueuedMessage
 			var persistedPaths []string
 			var persistErr error
 
 			for _, rcpt := range to {
-				path, err := storage.SaveMessage(messageID, from, rcpt, messageBytes)
+				sender := from
+				if forwarded[strings.ToLower(rcpt)] {
+					sender = s.forwardSender(from)
+				}
+				body, bodyPayload := messageBytes, payload
+				if sealedPayload != nil && s.sealsFor(l, rcpt) {
+					body, bodyPayload = sealedBytes, sealedPayload
+				}
+				path, err := storage.Save(storage.Metadata{
+					ID:         messageID,
+					From:       sender,
+					To:         rcpt,
+					ReceivedAt: receivedAt,
+					ClientIP:   clientIP,
+					Helo:       heloName,
+				}, body)
 				if err != nil {
 					log.Printf("failed to persist message for %s: %v", rcpt, err)
 					alog("storage error for %s: %v", rcpt, err)
@@ -335,42 +855,57 @@ func handleSession(conn net.Conn, q *queue.Manager, greeting string, hostname st
 				}
 				persistedPaths = append(persistedPaths, path)
 				queued = append(queued, queue.QueuedMessage{
-					ID:      messageID,
-					From:    from,
-					To:      rcpt,
-					Payload: payload,
+					ID:         messageID,
+					From:       sender,
+					To:         rcpt,
+					Payload:    bodyPayload,
+					ReceivedAt: receivedAt,
+					SpoolPath:  path,
 				})
 			}
 			if persistErr != nil {
 				for _, path := range persistedPaths {
-					if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+					if err := storage.RemoveMessage(path); err != nil {
 						log.Printf("failed to roll back persisted message %s: %v", path, err)
 						alog("rollback error %s: %v", path, err)
 					}
 				}
-				if !send(451, "Requested action aborted: storage failure") {
+				if !send(451, "4.3.0 Requested action aborted: storage failure") {
 					return
 				}
 				alog("message %s aborted due to storage failure", messageID)
 				reset()
 				continue
 			}
+			delivered := 0
 			for _, msg := range queued {
+				if s.isLocal(msg.To) {
+					ok, err := s.deliverLocal(msg, messageBytes)
+					if ok {
+						delivered++
+						if err != nil {
+							log.Printf("failed to remove spooled copy %s: %v", msg.SpoolPath, err)
+						}
+						alog("message %s delivered to local mailbox %s", messageID, msg.To)
+						continue
+					}
+					alog("local delivery of %s to %s deferred to queue: %v", messageID, msg.To, err)
+				}
 				q.Enqueue(msg)
 			}
-			if !send(250, fmt.Sprintf("Message queued as %s", messageID)) {
+			if !send(250, fmt.Sprintf("2.0.0 Message queued as %s", messageID)) {
 				return
 			}
-			alog("message %s queued (size=%d bytes, recipients=%d)", messageID, len(messageBytes), len(to))
+			alog("message %s queued (size=%d bytes, recipients=%d, local=%d)", messageID, len(messageBytes), len(to), delivered)
 			reset()
 		case strings.HasPrefix(cmd, "QUIT"):
-			if !send(221, "Bye") {
+			if !send(221, "2.0.0 Bye") {
 				return
 			}
 			alog("quit requested")
 			return
 		default:
-			if !send(502, "Command not implemented") {
+			if !send(502, "5.5.2 Command not implemented") {
 				return
 			}
 			alog("unhandled command: %s", summarizeCommand(line))
@@ -378,6 +913,59 @@ func handleSession(conn net.Conn, q *queue.Manager, greeting string, hostname st
 	}
 }
 
+// extensions lists the ESMTP capabilities advertised in the EHLO reply. Only
+// features the server is configured to honour on this session are included.
+func (s *server) extensions(l *config.Listener, tlsActive bool) []string {
+	ext := []string{
+		fmt.Sprintf("SIZE %d", l.MaxMessageBytes),
+		"PIPELINING",
+		"8BITMIME",
+		"ENHANCEDSTATUSCODES",
+	}
+	if s.tlsConfig != nil && l.TLSMode == config.TLSModeStartTLS && !tlsActive {
+		ext = append(ext, "STARTTLS")
+	}
+	if s.auth != nil && tlsActive {
+		ext = append(ext, "AUTH PLAIN LOGIN")
+	}
+	return ext
+}
+
+// checkMailParams validates MAIL FROM parameters against the advertised extensions
+// and returns a non-zero reply code when the command must be rejected. Parameters
+// are only permitted once the client has greeted with EHLO.
+func checkMailParams(params map[string]string, esmtp bool, maxSize int64) (int, string) {
+	if len(params) == 0 {
+		return 0, ""
+	}
+	if !esmtp {
+		return 555, "5.5.4 MAIL FROM parameters require EHLO"
+	}
+	for key, value := range params {
+		switch key {
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return 501, "5.5.4 Invalid SIZE parameter"
+			}
+			if size > maxSize {
+				return 552, "5.3.4 Message size exceeds fixed maximum message size"
+			}
+		case "AUTH":
+			// RFC 4954 section 5: accepted and ignored, the session identity applies.
+		case "BODY":
+			switch strings.ToUpper(value) {
+			case "7BIT", "8BITMIME":
+			default:
+				return 501, "5.5.4 Unsupported BODY type"
+			}
+		default:
+			return 555, fmt.Sprintf("5.5.4 Unsupported parameter %s", key)
+		}
+	}
+	return 0, ""
+}
+
 func shortID() string {
 	b := make([]byte, 8)
 	if _, err := rand.Read(b); err != nil {
@@ -386,7 +974,7 @@ func shortID() string {
 	return hex.EncodeToString(b)
 }
 
-func connAllowed(addr net.Addr) bool {
+func connAllowed(addr net.Addr, allowedNets []*net.IPNet, allowedHosts []string) bool {
 	if addr == nil {
 		return false
 	}
@@ -394,8 +982,6 @@ func connAllowed(addr net.Addr) bool {
 	if untyped == "" {
 		return false
 	}
-	allowedNets := config.AllowedNetworks()
-	allowedHosts := config.AllowedHosts()
 	if len(allowedNets) == 0 && len(allowedHosts) == 0 {
 		return false
 	}
@@ -467,6 +1053,10 @@ func overridePort(addr, port string) string {
 
 func summarizeCommand(line string) string {
 	line = strings.TrimSpace(line)
+	if fields := strings.Fields(line); len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		// Never log SASL initial responses; they carry credentials.
+		return fields[0] + " " + fields[1] + " ***"
+	}
 	if len(line) > 120 {
 		return line[:117] + "..."
 	}
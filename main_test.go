@@ -1,9 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"gopherpost/internal/alias"
+	"gopherpost/internal/auth"
+	"gopherpost/internal/config"
+	"gopherpost/internal/dkim"
+	"gopherpost/internal/recipient"
+	"gopherpost/internal/spf"
+	"gopherpost/internal/srs"
+	"gopherpost/queue"
+	"gopherpost/storage"
+	tlsconfig "gopherpost/tlsconfig"
+	"gopherpost/transport"
 )
 
 func TestShortID(t *testing.T) {
@@ -45,17 +72,1153 @@ func TestSummarizeCommand(t *testing.T) {
 	if got := summarizeCommand("NOOP"); got != "NOOP" {
 		t.Fatalf("expected NOOP, got %q", got)
 	}
+	if got := summarizeCommand("AUTH PLAIN AGFsaWNlAHNlY3JldA=="); got != "AUTH PLAIN ***" {
+		t.Fatalf("expected credentials to be redacted, got %q", got)
+	}
 }
 
 func TestConnAllowed(t *testing.T) {
 	t.Setenv("SMTP_ALLOW_HOSTS", "example.com")
 	t.Setenv("SMTP_ALLOW_NETWORKS", "")
-	allowed := connAllowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 25, Zone: ""})
+	allowed := connAllowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 25, Zone: ""}, config.AllowedNetworks(), config.AllowedHosts())
 	if allowed {
 		t.Fatalf("expected connection to be blocked without matching host")
 	}
 	t.Setenv("SMTP_ALLOW_NETWORKS", "203.0.113.0/24")
-	if !connAllowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.10")}) {
+	if !connAllowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.10")}, config.AllowedNetworks(), config.AllowedHosts()) {
 		t.Fatalf("expected connection within network to be allowed")
 	}
 }
+
+// remoteConn overrides the peer address of a pipe so access checks see a real IP.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// startSession runs srv.handleSession with policy l over an in-memory pipe and
+// returns the client side after consuming the greeting.
+func startSession(t *testing.T, srv *server, l *config.Listener) (net.Conn, *textproto.Conn) {
+	t.Helper()
+	return startSessionFrom(t, srv, l, "127.0.0.1")
+}
+
+// startSessionFrom is startSession for a client connecting from ip.
+func startSessionFrom(t *testing.T, srv *server, l *config.Listener, ip string) (net.Conn, *textproto.Conn) {
+	t.Helper()
+	client, serverSide := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.handleSession(remoteConn{Conn: serverSide, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}, l)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Errorf("session did not terminate")
+		}
+	})
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	tp := textproto.NewConn(client)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	return client, tp
+}
+
+// command sends line and asserts the reply code, returning the reply text.
+func command(t *testing.T, tp *textproto.Conn, line string, code int) string {
+	t.Helper()
+	if err := tp.PrintfLine("%s", line); err != nil {
+		t.Fatalf("write %q: %v", line, err)
+	}
+	_, msg, err := tp.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	return msg
+}
+
+func testServer(t *testing.T) *server {
+	t.Helper()
+	t.Setenv("SMTP_TLS_DISABLE", "false")
+	t.Setenv("SMTP_TLS_CERT", "")
+	t.Setenv("SMTP_TLS_KEY", "")
+	t.Setenv("SMTP_REQUIRE_LOCAL_DOMAIN", "false")
+	conf, err := tlsconfig.LoadTLSConfig()
+	if err != nil {
+		t.Fatalf("LoadTLSConfig: %v", err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	return &server{
+		queue:           queue.NewManager(),
+		hostname:        "mx.test",
+		tlsConfig:       conf,
+		trustedNetworks: []*net.IPNet{loopback},
+	}
+}
+
+// testListener returns a STARTTLS listener policy admitting the loopback client.
+func testListener() *config.Listener {
+	_, loopback, _ := net.ParseCIDR("127.0.0.1/32")
+	return &config.Listener{
+		Name:            "test",
+		TLSMode:         config.TLSModeStartTLS,
+		Banner:          "ready",
+		AllowNetworks:   []*net.IPNet{loopback},
+		MaxMessageBytes: 10 << 20,
+	}
+}
+
+func TestSessionStartTLS(t *testing.T) {
+	srv := testServer(t)
+	l := testListener()
+	l.RequireTLS = true
+	client, tp := startSession(t, srv, l)
+
+	if reply := command(t, tp, "EHLO client.test", 250); !strings.Contains(reply, "STARTTLS") {
+		t.Fatalf("expected STARTTLS advertised, got %q", reply)
+	}
+	command(t, tp, "MAIL FROM:<a@example.com>", 530)
+	command(t, tp, "STARTTLS", 220)
+
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tp = textproto.NewConn(tlsClient)
+
+	if reply := command(t, tp, "EHLO client.test", 250); strings.Contains(reply, "STARTTLS") {
+		t.Fatalf("STARTTLS must not be advertised after the upgrade, got %q", reply)
+	}
+	command(t, tp, "STARTTLS", 503)
+	command(t, tp, "MAIL FROM:<a@example.com>", 250)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionStartTLSUnavailable(t *testing.T) {
+	srv := testServer(t)
+	srv.tlsConfig = nil
+	_, tp := startSession(t, srv, testListener())
+
+	if reply := command(t, tp, "EHLO client.test", 250); strings.Contains(reply, "STARTTLS") {
+		t.Fatalf("STARTTLS advertised without TLS config: %q", reply)
+	}
+	command(t, tp, "STARTTLS", 454)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionStartTLSResetsState(t *testing.T) {
+	srv := testServer(t)
+	client, tp := startSession(t, srv, testListener())
+
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "MAIL FROM:<a@example.com>", 250)
+	command(t, tp, "STARTTLS", 220)
+
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tp = textproto.NewConn(tlsClient)
+	command(t, tp, "RCPT TO:<b@example.net>", 503)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionEHLOCapabilities(t *testing.T) {
+	srv := testServer(t)
+	_, tp := startSession(t, srv, testListener())
+
+	reply := command(t, tp, "EHLO client.test", 250)
+	lines := strings.Split(reply, "\n")
+	if !strings.HasPrefix(lines[0], "mx.test") {
+		t.Fatalf("expected hostname on first line, got %q", lines[0])
+	}
+	for _, want := range []string{"SIZE 10485760", "PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "STARTTLS"} {
+		found := false
+		for _, line := range lines[1:] {
+			if line == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected %q in EHLO reply %q", want, reply)
+		}
+	}
+
+	command(t, tp, "MAIL FROM:<a@example.com> SIZE=20000000", 552)
+	command(t, tp, "MAIL FROM:<a@example.com> SIZE=1024 BODY=8BITMIME", 250)
+	command(t, tp, "RCPT TO:<b@example.net> NOTIFY=NEVER", 555)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionHELOIsMinimal(t *testing.T) {
+	srv := testServer(t)
+	_, tp := startSession(t, srv, testListener())
+
+	if reply := command(t, tp, "HELO client.test", 250); reply != "mx.test" {
+		t.Fatalf("expected bare hostname for HELO, got %q", reply)
+	}
+	command(t, tp, "MAIL FROM:<a@example.com> SIZE=1024", 555)
+	command(t, tp, "MAIL FROM:<a@example.com>", 250)
+	command(t, tp, "HELO", 501)
+	command(t, tp, "QUIT", 221)
+}
+
+// staticAuth is an in-memory auth.Backend for session tests.
+type staticAuth map[string]string
+
+func (a staticAuth) Authenticate(username, password string) (*auth.Identity, error) {
+	if pw, ok := a[username]; ok && pw == password {
+		return &auth.Identity{Username: username, Domains: []string{"example.org"}}, nil
+	}
+	return nil, auth.ErrInvalidCredentials
+}
+
+// upgrade performs STARTTLS on an established test session.
+func upgrade(t *testing.T, client net.Conn, tp *textproto.Conn) *textproto.Conn {
+	t.Helper()
+	command(t, tp, "STARTTLS", 220)
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return textproto.NewConn(tlsClient)
+}
+
+func TestSessionAuthPlain(t *testing.T) {
+	srv := testServer(t)
+	srv.auth = staticAuth{"alice": "secret"}
+	t.Setenv("SMTP_REQUIRE_LOCAL_DOMAIN", "true")
+	client, tp := startSession(t, srv, testListener())
+
+	if reply := command(t, tp, "EHLO client.test", 250); strings.Contains(reply, "AUTH") {
+		t.Fatalf("AUTH must not be offered before TLS, got %q", reply)
+	}
+	command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), 538)
+
+	tp = upgrade(t, client, tp)
+	if reply := command(t, tp, "EHLO client.test", 250); !strings.Contains(reply, "AUTH PLAIN LOGIN") {
+		t.Fatalf("expected AUTH advertised over TLS, got %q", reply)
+	}
+	command(t, tp, "MAIL FROM:<bob@example.org>", 553)
+	command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00wrong")), 535)
+	command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), 235)
+	command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), 503)
+	command(t, tp, "MAIL FROM:<bob@example.org> AUTH=<>", 250)
+	command(t, tp, "RSET", 250)
+	command(t, tp, "MAIL FROM:<bob@elsewhere.test>", 553)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionAuthLogin(t *testing.T) {
+	srv := testServer(t)
+	srv.auth = staticAuth{"alice": "secret"}
+	client, tp := startSession(t, srv, testListener())
+	command(t, tp, "EHLO client.test", 250)
+	tp = upgrade(t, client, tp)
+	command(t, tp, "EHLO client.test", 250)
+
+	if prompt := command(t, tp, "AUTH LOGIN", 334); prompt != base64.StdEncoding.EncodeToString([]byte("Username:")) {
+		t.Fatalf("unexpected username prompt %q", prompt)
+	}
+	command(t, tp, base64.StdEncoding.EncodeToString([]byte("alice")), 334)
+	command(t, tp, base64.StdEncoding.EncodeToString([]byte("secret")), 235)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionAuthDuringNullSenderTransaction(t *testing.T) {
+	srv := testServer(t)
+	srv.auth = staticAuth{"alice": "secret"}
+	client, tp := startSession(t, srv, testListener())
+	command(t, tp, "EHLO client.test", 250)
+	tp = upgrade(t, client, tp)
+	command(t, tp, "EHLO client.test", 250)
+
+	command(t, tp, "MAIL FROM:<>", 250)
+	command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), 503)
+	command(t, tp, "RSET", 250)
+	command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), 235)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionAuthFailureLimit(t *testing.T) {
+	srv := testServer(t)
+	srv.auth = staticAuth{}
+	client, tp := startSession(t, srv, testListener())
+	command(t, tp, "EHLO client.test", 250)
+	tp = upgrade(t, client, tp)
+	command(t, tp, "EHLO client.test", 250)
+
+	bad := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00mallory\x00guess"))
+	command(t, tp, bad, 535)
+	command(t, tp, bad, 535)
+	command(t, tp, bad, 535)
+	if _, _, err := tp.ReadResponse(421); err != nil {
+		t.Fatalf("expected 421 after repeated failures: %v", err)
+	}
+}
+
+func TestSessionListenerRequiresAuth(t *testing.T) {
+	srv := testServer(t)
+	srv.auth = staticAuth{"alice": "secret"}
+	l := testListener()
+	l.AllowNetworks = nil
+	l.RequireAuth = true
+	l.MaxMessageBytes = 1024
+	client, tp := startSession(t, srv, l)
+
+	if reply := command(t, tp, "EHLO client.test", 250); !strings.Contains(reply, "SIZE 1024") {
+		t.Fatalf("expected listener size limit advertised, got %q", reply)
+	}
+	tp = upgrade(t, client, tp)
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "MAIL FROM:<alice@example.org>", 530)
+	command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), 235)
+	command(t, tp, "MAIL FROM:<alice@example.org>", 250)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionListenerAccessDenied(t *testing.T) {
+	srv := testServer(t)
+	l := testListener()
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	l.AllowNetworks = []*net.IPNet{other}
+
+	client, serverSide := net.Pipe()
+	defer client.Close()
+	go srv.handleSession(remoteConn{Conn: serverSide, remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}, l)
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := textproto.NewConn(client).ReadResponse(554); err != nil {
+		t.Fatalf("expected 554 rejection: %v", err)
+	}
+}
+
+func TestSessionListenerWithoutStartTLS(t *testing.T) {
+	srv := testServer(t)
+	l := testListener()
+	l.TLSMode = config.TLSModeNone
+	_, tp := startSession(t, srv, l)
+
+	if reply := command(t, tp, "EHLO client.test", 250); strings.Contains(reply, "STARTTLS") {
+		t.Fatalf("STARTTLS advertised on a plaintext-only listener: %q", reply)
+	}
+	command(t, tp, "STARTTLS", 454)
+	command(t, tp, "QUIT", 221)
+}
+
+// shutdownAsync runs srv.Shutdown in the background and returns its result channel.
+func shutdownAsync(srv *server, timeout time.Duration) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		result <- srv.Shutdown(ctx)
+	}()
+	return result
+}
+
+func TestShutdownClosesIdleSession(t *testing.T) {
+	srv := testServer(t)
+	_, tp := startSession(t, srv, testListener())
+	command(t, tp, "EHLO client.test", 250)
+
+	result := shutdownAsync(srv, 2*time.Second)
+	if _, _, err := tp.ReadResponse(421); err != nil {
+		t.Fatalf("expected 421 on shutdown: %v", err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownLetsDataFinish(t *testing.T) {
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	srv := testServer(t)
+	_, tp := startSession(t, srv, testListener())
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "MAIL FROM:<a@example.com>", 250)
+	command(t, tp, "RCPT TO:<b@example.net>", 250)
+	command(t, tp, "DATA", 354)
+	if err := tp.PrintfLine("Subject: in flight"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	result := shutdownAsync(srv, 2*time.Second)
+	for !srv.shuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := tp.PrintfLine("\r\nbody\r\n."); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatalf("expected in-flight message to be accepted: %v", err)
+	}
+	if _, _, err := tp.ReadResponse(421); err != nil {
+		t.Fatalf("expected 421 after DATA: %v", err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if srv.queue.Depth() != 1 {
+		t.Fatalf("expected message to be queued, depth %d", srv.queue.Depth())
+	}
+}
+
+func TestShutdownForceClosesAfterTimeout(t *testing.T) {
+	srv := testServer(t)
+	_, tp := startSession(t, srv, testListener())
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "MAIL FROM:<a@example.com>", 250)
+	command(t, tp, "RCPT TO:<b@example.net>", 250)
+	command(t, tp, "DATA", 354)
+
+	if err := <-shutdownAsync(srv, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if _, err := tp.ReadLine(); err == nil {
+		t.Fatalf("expected connection to be closed")
+	}
+}
+
+func TestShutdownRejectsNewSessions(t *testing.T) {
+	srv := testServer(t)
+	if err := <-shutdownAsync(srv, time.Second); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	client, serverSide := net.Pipe()
+	defer client.Close()
+	go srv.handleSession(serverSide, testListener())
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := textproto.NewConn(client).ReadResponse(421); err != nil {
+		t.Fatalf("expected 421 for session after shutdown: %v", err)
+	}
+}
+
+func TestSessionLocalDelivery(t *testing.T) {
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "example.com", "alice"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	srv := testServer(t)
+	srv.localDomains = map[string]struct{}{"example.com": {}}
+	srv.mailboxes = transport.Maildir{Root: root}
+	_, tp := startSession(t, srv, testListener())
+
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "MAIL FROM:<a@example.org>", 250)
+	command(t, tp, "RCPT TO:<nobody@example.com>", 550)
+	command(t, tp, "RCPT TO:<Alice@Example.com>", 250)
+	command(t, tp, "RCPT TO:<b@example.net>", 250)
+	command(t, tp, "DATA", 354)
+	if err := tp.PrintfLine("Subject: local\r\n\r\nbody\r\n."); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatalf("expected message to be accepted: %v", err)
+	}
+	command(t, tp, "QUIT", 221)
+
+	entries, err := os.ReadDir(filepath.Join(root, "example.com", "alice", "new"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one message in the mailbox, got %v, %v", entries, err)
+	}
+	if srv.queue.Depth() != 1 {
+		t.Fatalf("expected only the remote recipient to be queued, depth %d", srv.queue.Depth())
+	}
+	var spooled []string
+	if err := storage.Walk(func(msg storage.SpooledMessage, err error) error {
+		if err != nil {
+			return err
+		}
+		spooled = append(spooled, msg.Metadata.To)
+		return nil
+	}); err != nil || len(spooled) != 1 || spooled[0] != "b@example.net" {
+		t.Fatalf("expected only the remote copy to stay spooled, got %v, %v", spooled, err)
+	}
+}
+
+type failingVerifier struct{}
+
+func (failingVerifier) Verify(string) (recipient.Verdict, error) {
+	return recipient.Skip, errors.New("lookup service down")
+}
+
+func TestSessionRecipientVerification(t *testing.T) {
+	static, err := recipient.NewStatic([]string{"alice@example.com"})
+	if err != nil {
+		t.Fatalf("NewStatic: %v", err)
+	}
+	srv := testServer(t)
+	srv.relayDomains = map[string]struct{}{"example.com": {}, "example.net": {}}
+	srv.recipients = static
+	_, tp := startSession(t, srv, testListener())
+
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "MAIL FROM:<a@example.org>", 250)
+	if reply := command(t, tp, "RCPT TO:<bob@example.com>", 550); !strings.Contains(reply, "5.1.1") {
+		t.Fatalf("expected 5.1.1 for an unknown user, got %q", reply)
+	}
+	command(t, tp, "RCPT TO:<alice@example.com>", 250)
+	command(t, tp, "RCPT TO:<someone@example.net>", 250)
+
+	srv.recipients = recipient.Chain{static, failingVerifier{}}
+	command(t, tp, "RCPT TO:<alice@example.com>", 250)
+	command(t, tp, "RCPT TO:<someone@example.net>", 450)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionRecipientCalloutSkipsRelay(t *testing.T) {
+	lookups := 0
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(service.Close)
+	callout, err := recipient.NewCallout(service.URL, time.Second, "relay.example")
+	if err != nil {
+		t.Fatalf("NewCallout: %v", err)
+	}
+	// A callout answering for every domain must still not see relayed mail.
+	callout.Domains = nil
+	srv := testServer(t)
+	srv.auth = staticAuth{"alice": "secret"}
+	srv.relayDomains = map[string]struct{}{"relay.example": {}}
+	srv.recipients = callout
+	client, tp := startSession(t, srv, testListener())
+
+	command(t, tp, "EHLO client.test", 250)
+	tp = upgrade(t, client, tp)
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), 235)
+	command(t, tp, "MAIL FROM:<a@example.org>", 250)
+	command(t, tp, "RCPT TO:<someone@gmail.com>", 250)
+	if lookups != 0 {
+		t.Fatalf("expected no lookup for a relay destination, got %d", lookups)
+	}
+	command(t, tp, "RCPT TO:<nobody@relay.example>", 550)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionRelayRules(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "local.example", "alice"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	srv := testServer(t)
+	srv.auth = staticAuth{"alice": "secret"}
+	srv.localDomains = map[string]struct{}{"local.example": {}}
+	srv.mailboxes = transport.Maildir{Root: root}
+	srv.relayDomains = map[string]struct{}{"relay.example": {}}
+	l := testListener()
+	l.AllowNetworks = nil
+	l.AllowHosts = []string{"198.51.100.7"}
+
+	t.Run("untrusted", func(t *testing.T) {
+		client, tp := startSessionFrom(t, srv, l, "198.51.100.7")
+		command(t, tp, "EHLO client.test", 250)
+		command(t, tp, "MAIL FROM:<a@example.org>", 250)
+		if reply := command(t, tp, "RCPT TO:<bob@remote.example>", 554); !strings.Contains(reply, "5.7.1") {
+			t.Fatalf("expected 5.7.1 relay denial, got %q", reply)
+		}
+		command(t, tp, "RCPT TO:<Alice@Local.example>", 250)
+		command(t, tp, "RCPT TO:<anyone@relay.example>", 250)
+		command(t, tp, "RCPT TO:<anyone@sub.relay.example>", 554)
+
+		tp = upgrade(t, client, tp)
+		command(t, tp, "EHLO client.test", 250)
+		command(t, tp, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")), 235)
+		command(t, tp, "MAIL FROM:<a@example.org>", 250)
+		command(t, tp, "RCPT TO:<bob@remote.example>", 250)
+		command(t, tp, "QUIT", 221)
+	})
+
+	t.Run("trusted", func(t *testing.T) {
+		_, tp := startSession(t, srv, testListener())
+		command(t, tp, "EHLO client.test", 250)
+		command(t, tp, "MAIL FROM:<a@example.org>", 250)
+		command(t, tp, "RCPT TO:<bob@remote.example>", 250)
+		command(t, tp, "QUIT", 221)
+	})
+
+	t.Run("nothing trusted", func(t *testing.T) {
+		srv.trustedNetworks = nil
+		_, tp := startSession(t, srv, testListener())
+		command(t, tp, "EHLO client.test", 250)
+		command(t, tp, "MAIL FROM:<a@example.org>", 250)
+		command(t, tp, "RCPT TO:<bob@remote.example>", 554)
+		command(t, tp, "RCPT TO:<alice@local.example>", 250)
+		command(t, tp, "QUIT", 221)
+	})
+}
+
+func TestSessionAliases(t *testing.T) {
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "example.com", "alice"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "aliases")
+	aliases := "postmaster: alice\nteam@example.com: alice, bob@example.net\nloop@example.com: loop2@example.com\nloop2@example.com: loop@example.com\nstale@example.com: gone@example.com\nhalf@example.com: gone@example.com, alice\n@catchall.example: alice@example.com\n"
+	if err := os.WriteFile(path, []byte(aliases), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	m, err := alias.Load(path, "example.com", "catchall.example")
+	if err != nil {
+		t.Fatalf("alias.Load: %v", err)
+	}
+	srv := testServer(t)
+	srv.localDomains = map[string]struct{}{"example.com": {}}
+	srv.relayDomains = map[string]struct{}{"catchall.example": {}}
+	srv.mailboxes = transport.Maildir{Root: root}
+	srv.recipients = mustStatic(t, "known@catchall.example")
+	srv.aliases = m
+	_, tp := startSession(t, srv, testListener())
+
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "MAIL FROM:<a@example.org>", 250)
+	if reply := command(t, tp, "RCPT TO:<loop@example.com>", 550); !strings.Contains(reply, "5.4.6") {
+		t.Fatalf("expected 5.4.6 for an alias loop, got %q", reply)
+	}
+	command(t, tp, "RCPT TO:<nobody@example.com>", 550)
+	command(t, tp, "RCPT TO:<postmaster@example.com>", 250)
+	command(t, tp, "RCPT TO:<team@example.com>", 250)
+	if reply := command(t, tp, "RCPT TO:<stale@example.com>", 550); !strings.Contains(reply, "5.1.1") {
+		t.Fatalf("expected 5.1.1 for an alias without existing mailboxes, got %q", reply)
+	}
+	command(t, tp, "RCPT TO:<half@example.com>", 250)
+	command(t, tp, "RCPT TO:<alice+lists@example.com>", 250)
+	command(t, tp, "RCPT TO:<anyone@catchall.example>", 250)
+	command(t, tp, "RCPT TO:<known@catchall.example>", 250)
+	command(t, tp, "DATA", 354)
+	if err := tp.PrintfLine("Subject: aliases\r\n\r\nbody\r\n."); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatalf("expected message to be accepted: %v", err)
+	}
+	command(t, tp, "QUIT", 221)
+
+	entries, err := os.ReadDir(filepath.Join(root, "example.com", "alice", "new"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected alice to get exactly one copy, got %v, %v", entries, err)
+	}
+	if srv.queue.Depth() != 2 {
+		t.Fatalf("expected bob@example.net and known@catchall.example to be queued, depth %d", srv.queue.Depth())
+	}
+}
+
+func mustStatic(t *testing.T, entries ...string) *recipient.Static {
+	t.Helper()
+	v, err := recipient.NewStatic(entries)
+	if err != nil {
+		t.Fatalf("NewStatic: %v", err)
+	}
+	return v
+}
+
+func TestSessionSRS(t *testing.T) {
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte("fwd@example.com: friend@remote.example, alice\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	aliases, err := alias.Load(path)
+	if err != nil {
+		t.Fatalf("alias.Load: %v", err)
+	}
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "example.com", "alice"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	srv := testServer(t)
+	srv.localDomains = map[string]struct{}{"example.com": {}}
+	srv.mailboxes = transport.Maildir{Root: root}
+	srv.aliases = aliases
+	srv.srs = srs.New("s3cret", "mx.test", 24*time.Hour)
+	l := testListener()
+	l.AllowNetworks = nil
+	l.AllowHosts = []string{"198.51.100.7"}
+	_, tp := startSessionFrom(t, srv, l, "198.51.100.7")
+
+	sendMessage := func(from, rcpt string) {
+		t.Helper()
+		command(t, tp, "MAIL FROM:<"+from+">", 250)
+		command(t, tp, "RCPT TO:<"+rcpt+">", 250)
+		command(t, tp, "DATA", 354)
+		if err := tp.PrintfLine("Subject: srs\r\n\r\nbody\r\n."); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, _, err := tp.ReadResponse(250); err != nil {
+			t.Fatalf("expected message to be accepted: %v", err)
+		}
+	}
+	spooled := func() map[string]string {
+		t.Helper()
+		senders := make(map[string]string)
+		if err := storage.Walk(func(msg storage.SpooledMessage, err error) error {
+			if err == nil {
+				senders[msg.Metadata.To] = msg.Metadata.From
+			}
+			return err
+		}); err != nil {
+			t.Fatalf("walk spool: %v", err)
+		}
+		return senders
+	}
+
+	command(t, tp, "EHLO client.test", 250)
+	sendMessage("sender@origin.example", "fwd@example.com")
+	rewritten := spooled()["friend@remote.example"]
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "=origin.example=sender@mx.test") {
+		t.Fatalf("expected the forwarded copy to carry an SRS sender, got %q", rewritten)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "example.com", "alice", "new")); len(entries) != 1 {
+		t.Fatalf("expected the local copy to be delivered, got %v", entries)
+	}
+
+	command(t, tp, "MAIL FROM:<>", 250)
+	tampered := strings.Replace(rewritten, "=sender@", "=victim@", 1)
+	if reply := command(t, tp, "RCPT TO:<"+tampered+">", 550); !strings.Contains(reply, "SRS") {
+		t.Fatalf("expected a tampered SRS address to be rejected, got %q", reply)
+	}
+	command(t, tp, "RCPT TO:<nobody@mx.test>", 554)
+	command(t, tp, "RSET", 250)
+
+	sendMessage("", rewritten)
+	if from, ok := spooled()["sender@origin.example"]; !ok || from != "" {
+		t.Fatalf("expected the bounce to be queued for the original sender with a null sender, got %q, %v", from, ok)
+	}
+	command(t, tp, "QUIT", 221)
+}
+
+// txtResolver serves SPF records from a map; every other name does not exist.
+type txtResolver map[string]string
+
+func (r txtResolver) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r txtResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, r.notFound(name)
+}
+
+func (r txtResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, r.notFound(host)
+}
+
+func (r txtResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, r.notFound(name)
+}
+
+func (r txtResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return nil, r.notFound(addr)
+}
+
+func TestSessionSPF(t *testing.T) {
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	srv := testServer(t)
+	srv.relayDomains = map[string]struct{}{"dest.example": {}}
+	srv.spf = spf.NewChecker(txtResolver{
+		"good.example": "v=spf1 ip4:198.51.100.0/24 -all",
+		"bad.example":  "v=spf1 ip4:192.0.2.1 -all",
+		"soft.example": "v=spf1 ~all",
+		"client.test":  "v=spf1 ip4:198.51.100.7 -all",
+	}, "mx.test")
+	srv.spfPolicy = config.SPFPolicy{
+		Enabled:   true,
+		Fail:      config.SPFReject,
+		SoftFail:  config.SPFDefer,
+		PermError: config.SPFAccept,
+		TempError: config.SPFAccept,
+		Timeout:   time.Second,
+	}
+	l := testListener()
+	l.AllowNetworks = nil
+	l.AllowHosts = []string{"198.51.100.7"}
+	_, tp := startSessionFrom(t, srv, l, "198.51.100.7")
+
+	command(t, tp, "EHLO client.test", 250)
+	if reply := command(t, tp, "MAIL FROM:<alice@bad.example>", 550); !strings.Contains(reply, "5.7.23") {
+		t.Fatalf("expected an SPF failure to be rejected, got %q", reply)
+	}
+	command(t, tp, "MAIL FROM:<alice@soft.example>", 451)
+	command(t, tp, "RCPT TO:<bob@dest.example>", 503)
+
+	headers := func(from string) string {
+		t.Helper()
+		storage.SetBaseDir(t.TempDir())
+		command(t, tp, "MAIL FROM:<"+from+">", 250)
+		command(t, tp, "RCPT TO:<bob@dest.example>", 250)
+		command(t, tp, "DATA", 354)
+		if err := tp.PrintfLine("Subject: spf\r\n\r\nbody\r\n."); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, _, err := tp.ReadResponse(250); err != nil {
+			t.Fatalf("expected message to be accepted: %v", err)
+		}
+		var data string
+		if err := storage.Walk(func(msg storage.SpooledMessage, err error) error {
+			data = string(msg.Data)
+			return err
+		}); err != nil {
+			t.Fatalf("walk spool: %v", err)
+		}
+		head, _, _ := strings.Cut(data, "Subject:")
+		return head
+	}
+	head := headers("alice@good.example")
+	if !strings.HasPrefix(head, "Received-SPF: pass (mx.test: domain of alice@good.example designates 198.51.100.7 as permitted sender)") ||
+		!strings.Contains(head, "\r\nAuthentication-Results: mx.test;\r\n\tspf=pass smtp.mailfrom=alice@good.example\r\n") {
+		t.Fatalf("unexpected SPF headers %q", head)
+	}
+	if head := headers(""); !strings.Contains(head, "spf=pass smtp.helo=client.test") {
+		t.Fatalf("expected the null sender to be checked through HELO, got %q", head)
+	}
+	if head := headers("alice@nospf.example"); !strings.HasPrefix(head, "Received-SPF: none") {
+		t.Fatalf("expected spf=none for a domain without a record, got %q", head)
+	}
+	command(t, tp, "QUIT", 221)
+
+	// Trusted clients are not checked.
+	storage.SetBaseDir(t.TempDir())
+	_, tp = startSession(t, srv, testListener())
+	command(t, tp, "EHLO localhost", 250)
+	command(t, tp, "MAIL FROM:<alice@bad.example>", 250)
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionMessageAuthentication(t *testing.T) {
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	t.Setenv("SMTP_DKIM_SELECTOR", "sel")
+	t.Setenv("SMTP_DKIM_DOMAIN", "good.example")
+	t.Setenv("SMTP_DKIM_PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	signer, err := dkim.LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv: %v", err)
+	}
+	signed, err := signer.Sign([]byte("From: Alice <alice@good.example>\r\nSubject: hi\r\n\r\nHello\r\n"), "alice@good.example")
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	srv := testServer(t)
+	srv.relayDomains = map[string]struct{}{"dest.example": {}}
+	srv.resolver = txtResolver{
+		"sel._domainkey.good.example": "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der),
+		"_dmarc.good.example":         "v=DMARC1; p=reject",
+	}
+	srv.dmarc = true
+	l := testListener()
+	l.AllowNetworks = nil
+	l.AllowHosts = []string{"198.51.100.7", "127.0.0.1"}
+
+	deliver := func(tp *textproto.Conn, message string) string {
+		t.Helper()
+		storage.SetBaseDir(t.TempDir())
+		command(t, tp, "MAIL FROM:<alice@good.example>", 250)
+		command(t, tp, "RCPT TO:<bob@dest.example>", 250)
+		command(t, tp, "DATA", 354)
+		w := tp.DotWriter()
+		if _, err := w.Write([]byte(message)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if _, _, err := tp.ReadResponse(250); err != nil {
+			t.Fatalf("expected message to be accepted: %v", err)
+		}
+		var data string
+		if err := storage.Walk(func(msg storage.SpooledMessage, err error) error {
+			data = string(msg.Data)
+			return err
+		}); err != nil {
+			t.Fatalf("walk spool: %v", err)
+		}
+		return data
+	}
+
+	_, tp := startSessionFrom(t, srv, l, "198.51.100.7")
+	command(t, tp, "EHLO client.test", 250)
+	data := deliver(tp, "Authentication-Results: MX.TEST; dkim=pass header.d=bank.example\r\n"+string(signed))
+	for _, want := range []string{
+		"Authentication-Results: mx.test;\r\n",
+		"dkim=pass header.d=good.example header.s=sel header.b=",
+		"arc=none",
+		"dmarc=pass (p=reject dis=none) header.from=good.example",
+	} {
+		if !strings.Contains(data, want) {
+			t.Errorf("expected %q in %q", want, data)
+		}
+	}
+	if strings.Contains(data, "bank.example") {
+		t.Errorf("expected the forged Authentication-Results to be removed, got %q", data)
+	}
+
+	data = deliver(tp, "From: ceo@good.example\r\nSubject: wire money\r\n\r\nNow\r\n")
+	if !strings.Contains(data, "dkim=none") || !strings.Contains(data, "dmarc=fail (p=reject dis=none) header.from=good.example") {
+		t.Errorf("expected an unsigned message to fail DMARC, got %q", data)
+	}
+	command(t, tp, "QUIT", 221)
+
+	_, tp = startSession(t, srv, l)
+	command(t, tp, "EHLO localhost", 250)
+	if data := deliver(tp, string(signed)); strings.Contains(data, "Authentication-Results") {
+		t.Errorf("expected mail from a trusted client to pass unverified, got %q", data)
+	}
+	command(t, tp, "QUIT", 221)
+}
+
+func TestSessionARCSeal(t *testing.T) {
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	t.Setenv("SMTP_DKIM_SELECTOR", "arc")
+	t.Setenv("SMTP_DKIM_DOMAIN", "forwarder.example")
+	t.Setenv("SMTP_DKIM_PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	signer, err := dkim.LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv: %v", err)
+	}
+	resolver := txtResolver{"arc._domainkey.forwarder.example": "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}
+
+	srv := testServer(t)
+	srv.signer = signer
+	srv.resolver = resolver
+	srv.routes = transport.NewRouter(transport.MX{}, transport.Rule{Pattern: "partner.example", Transport: transport.MX{}, ARCSeal: true})
+	_, tp := startSession(t, srv, testListener())
+	command(t, tp, "EHLO localhost", 250)
+	command(t, tp, "MAIL FROM:<alice@forwarder.example>", 250)
+	command(t, tp, "RCPT TO:<bob@partner.example>", 250)
+	command(t, tp, "RCPT TO:<carol@other.example>", 250)
+	command(t, tp, "DATA", 354)
+	if err := tp.PrintfLine("From: alice@forwarder.example\r\nSubject: hi\r\n\r\nHello\r\n."); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatalf("expected message to be accepted: %v", err)
+	}
+	command(t, tp, "QUIT", 221)
+
+	data := make(map[string]string)
+	if err := storage.Walk(func(msg storage.SpooledMessage, err error) error {
+		if err == nil {
+			data[msg.Metadata.To] = string(msg.Data)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("walk spool: %v", err)
+	}
+	sealed := data["bob@partner.example"]
+	if !strings.HasPrefix(sealed, "ARC-Seal: i=1;") || !strings.Contains(sealed, "ARC-Authentication-Results: i=1; mx.test;\r\n\tnone\r\n") {
+		t.Fatalf("expected the partner.example copy to be sealed, got %q", sealed)
+	}
+	if r := dkim.VerifyARC(context.Background(), resolver, []byte(sealed)); r.Status != dkim.StatusPass || r.Domain != "forwarder.example" {
+		t.Fatalf("expected the seal to verify, got %+v", r)
+	}
+	if other := data["carol@other.example"]; other == "" || strings.Contains(other, "ARC-") {
+		t.Fatalf("expected the other.example copy to be left unsealed, got %q", other)
+	}
+}
+
+// keyringSigner returns a signer whose keyring holds one key for domain.
+func keyringSigner(t *testing.T, domain string) *dkim.Signer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, domain), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(filepath.Join(dir, domain, "mail1.pem"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SMTP_DKIM_KEYS", dir)
+	t.Setenv("SMTP_DKIM_SELECTOR", "")
+	t.Setenv("SMTP_DKIM_KEY_PATH", "")
+	t.Setenv("SMTP_DKIM_PRIVATE_KEY", "")
+	t.Setenv("SMTP_DKIM_DOMAIN", "")
+	signer, err := dkim.LoadFromEnv()
+	if err != nil {
+		t.Fatalf("LoadFromEnv: %v", err)
+	}
+	return signer
+}
+
+func TestSessionDKIMKeyring(t *testing.T) {
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	srv := testServer(t)
+	srv.signer = keyringSigner(t, "signed.example")
+	_, tp := startSession(t, srv, testListener())
+	command(t, tp, "EHLO localhost", 250)
+	for _, from := range []string{"alice@signed.example", "bob@unsigned.example"} {
+		command(t, tp, "MAIL FROM:<"+from+">", 250)
+		command(t, tp, "RCPT TO:<carol@dest.example>", 250)
+		command(t, tp, "DATA", 354)
+		if err := tp.PrintfLine("From: %s\r\nSubject: hi\r\n\r\nHello\r\n.", from); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, _, err := tp.ReadResponse(250); err != nil {
+			t.Fatalf("expected mail from %s to be accepted: %v", from, err)
+		}
+	}
+	command(t, tp, "QUIT", 221)
+
+	signed := make(map[string]bool)
+	if err := storage.Walk(func(msg storage.SpooledMessage, err error) error {
+		if err == nil {
+			signed[msg.Metadata.From] = strings.Contains(string(msg.Data), "d=signed.example")
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("walk spool: %v", err)
+	}
+	if !signed["alice@signed.example"] || signed["bob@unsigned.example"] {
+		t.Fatalf("expected only signed.example mail to be signed, got %v", signed)
+	}
+}
+
+func TestSessionDKIMSkipsInbound(t *testing.T) {
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte("fwd: someone@offsite.example\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := alias.Load(path, "example.com")
+	if err != nil {
+		t.Fatalf("alias.Load: %v", err)
+	}
+	srv := testServer(t)
+	srv.trustedNetworks = nil
+	srv.localDomains = map[string]struct{}{"example.com": {}}
+	srv.aliases = m
+	srv.signer = keyringSigner(t, "example.com")
+	_, tp := startSession(t, srv, testListener())
+
+	// A stranger forging our domain must not get a copy signed by us.
+	command(t, tp, "EHLO client.test", 250)
+	command(t, tp, "MAIL FROM:<ceo@example.com>", 250)
+	command(t, tp, "RCPT TO:<fwd@example.com>", 250)
+	command(t, tp, "DATA", 354)
+	if err := tp.PrintfLine("From: ceo@example.com\r\nSubject: wire transfer\r\n\r\nPay now\r\n."); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := tp.ReadResponse(250); err != nil {
+		t.Fatalf("expected the message to be accepted: %v", err)
+	}
+	command(t, tp, "QUIT", 221)
+
+	var copies int
+	if err := storage.Walk(func(msg storage.SpooledMessage, err error) error {
+		if err != nil {
+			return err
+		}
+		copies++
+		if strings.Contains(string(msg.Data), "DKIM-Signature") {
+			t.Errorf("inbound mail forwarded to %s was DKIM signed:\n%s", msg.Metadata.To, msg.Data)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("walk spool: %v", err)
+	}
+	if copies != 1 {
+		t.Fatalf("expected one forwarded copy, got %d", copies)
+	}
+}
+
+func TestKeygen(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	if code := runKeygen([]string{"-domain", "Example.com.", "-selector", "2025a", "-keyring", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("runKeygen = %d: %s", code, stderr.String())
+	}
+	path := filepath.Join(dir, "example.com", "2025a.pem")
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a private key file at %s: %v", path, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "example.com", ".*")); len(leftovers) != 0 {
+		t.Fatalf("expected no temporary files, found %v", leftovers)
+	}
+	out := stdout.String()
+	if !strings.Contains(out, "signs from the next message") {
+		t.Fatalf("expected a warning that the key signs at once, got %q", out)
+	}
+	if !strings.Contains(out, "2025a._domainkey.example.com. IN TXT ( \"v=DKIM1; k=rsa; p=") {
+		t.Fatalf("expected a split TXT record, got %q", out)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if start := strings.Index(line, `"`); start >= 0 && strings.LastIndex(line, `"`)-start-1 > maxTXTString {
+			t.Fatalf("TXT string longer than %d characters: %q", maxTXTString, line)
+		}
+	}
+
+	stdout.Reset()
+	if code := runKeygen([]string{"-domain", "example.com", "-selector", "ed", "-algorithm", "ed25519", "-keyring", dir}, &stdout, &stderr); code != 0 {
+		t.Fatalf("runKeygen ed25519 = %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "ed._domainkey.example.com. IN TXT \"v=DKIM1; k=ed25519; p=") {
+		t.Fatalf("expected an Ed25519 record, got %q", stdout.String())
+	}
+	t.Setenv("SMTP_DKIM_KEYS", dir)
+	t.Setenv("SMTP_DKIM_SELECTOR", "")
+	t.Setenv("SMTP_DKIM_KEY_PATH", "")
+	t.Setenv("SMTP_DKIM_PRIVATE_KEY", "")
+	t.Setenv("SMTP_DKIM_DOMAIN", "")
+	signer, err := dkim.LoadFromEnv()
+	if err != nil {
+		t.Fatalf("generated keys do not load: %v", err)
+	}
+	signed, err := signer.Sign([]byte("From: alice@example.com\r\n\r\nHi\r\n"), "alice@example.com")
+	if err != nil || strings.Count(string(signed), "DKIM-Signature:") != 2 {
+		t.Fatalf("expected both generated keys to sign, got %q (%v)", signed, err)
+	}
+
+	if code := runKeygen([]string{"-domain", "example.com", "-selector", "2025a", "-keyring", dir}, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "already exists") {
+		t.Fatalf("expected an existing key to be kept, got %d: %s", code, stderr.String())
+	}
+	stdout.Reset()
+	staged := filepath.Join(t.TempDir(), "staged.pem")
+	if code := runKeygen([]string{"-domain", "example.com", "-selector", "2025b", "-out", staged}, &stdout, &stderr); code != 0 {
+		t.Fatalf("runKeygen -out = %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "example.com 2025b "+staged+" not-before=") {
+		t.Fatalf("expected a scheduled keyring line, got %q", stdout.String())
+	}
+	if code := runKeygen([]string{"-domain", "example.com"}, &stdout, &stderr); code != 2 {
+		t.Fatalf("expected a usage error, got %d", code)
+	}
+}
@@ -0,0 +1,89 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"gopherpost/delivery"
+	audit "gopherpost/internal/audit"
+	"gopherpost/internal/email"
+)
+
+// maxRecipientsPerTransaction caps RCPT TO commands per transaction at the
+// minimum every server must accept (RFC 5321 section 4.5.3.1.8).
+const maxRecipientsPerTransaction = 100
+
+// batch is the due work for one destination domain, delivered over shared
+// connections. Each transaction carries the recipients of one sender and payload;
+// msgs[i][j] is the queued message behind txs[i].To[j].
+type batch struct {
+	domain string
+	txs    []delivery.Transaction
+	msgs   [][]QueuedMessage
+}
+
+type transactionKey struct {
+	from    string
+	payload *Payload
+}
+
+// groupDue sorts due messages into per-domain batches, merging recipients that
+// share a sender and payload into one transaction. Messages that cannot be
+// delivered at all are completed with an error straight away.
+func (m *Manager) groupDue(due []QueuedMessage) []*batch {
+	var batches []*batch
+	byDomain := make(map[string]*batch)
+	txIndex := make(map[string]map[transactionKey]int)
+
+	for _, msg := range due {
+		if msg.Payload == nil {
+			log.Printf("Skipping message %s for %s: missing payload", msg.ID, msg.To)
+			audit.Log("queue skip %s -> %s missing payload", msg.ID, msg.To)
+			continue
+		}
+		domain, err := email.Domain(msg.To)
+		if err != nil {
+			m.complete(msg, fmt.Errorf("invalid email format: %w", err))
+			continue
+		}
+		domain = strings.ToLower(domain)
+
+		b, ok := byDomain[domain]
+		if !ok {
+			b = &batch{domain: domain}
+			byDomain[domain] = b
+			txIndex[domain] = make(map[transactionKey]int)
+			batches = append(batches, b)
+		}
+		key := transactionKey{from: msg.From, payload: msg.Payload}
+		i, ok := txIndex[domain][key]
+		if !ok || len(b.txs[i].To) >= maxRecipientsPerTransaction {
+			b.txs = append(b.txs, delivery.Transaction{From: msg.From, Data: msg.Payload.Bytes()})
+			b.msgs = append(b.msgs, nil)
+			i = len(b.txs) - 1
+			txIndex[domain][key] = i
+		}
+		b.txs[i].To = append(b.txs[i].To, msg.To)
+		b.msgs[i] = append(b.msgs[i], msg)
+	}
+	return batches
+}
+
+// deliverBatch sends b and completes each queued message with its recipient's
+// own result, so a partial rejection only affects the recipients concerned.
+func (m *Manager) deliverBatch(b *batch) {
+	results := m.transport.Deliver(b.domain, b.txs)
+	for i, msgs := range b.msgs {
+		for j, msg := range msgs {
+			var err error
+			switch {
+			case i >= len(results) || j >= len(results[i]):
+				err = fmt.Errorf("no delivery result for %s", msg.To)
+			default:
+				err = results[i][j]
+			}
+			m.complete(msg, err)
+		}
+	}
+}
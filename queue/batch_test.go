@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"net/textproto"
+	"testing"
+	"time"
+
+	"gopherpost/delivery"
+	"gopherpost/transport"
+)
+
+func TestProcessQueueGroupsByDomainAndPayload(t *testing.T) {
+	calls := make(map[string][]delivery.Transaction)
+	deliver := transport.Func(func(domain string, txs []delivery.Transaction) []delivery.Result {
+		calls[domain] = txs
+		results := make([]delivery.Result, len(txs))
+		for i, tx := range txs {
+			results[i] = make(delivery.Result, len(tx.To))
+			for j, rcpt := range tx.To {
+				if rcpt == "missing@example.com" {
+					results[i][j] = &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+				}
+				if rcpt == "busy@example.com" {
+					results[i][j] = &textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"}
+				}
+			}
+		}
+		return results
+	})
+
+	shared := NewPayload([]byte("shared"))
+	due := time.Now().Add(-time.Second)
+	m := NewManager(WithTransport(deliver))
+	for _, rcpt := range []string{"one@example.com", "missing@example.com", "busy@example.com", "other@example.org"} {
+		m.Enqueue(QueuedMessage{ID: "shared", From: "", To: rcpt, Payload: shared, NextRetry: due})
+	}
+	m.Enqueue(QueuedMessage{ID: "solo", From: "", To: "two@example.com", Payload: NewPayload([]byte("solo")), NextRetry: due})
+	m.processQueue()
+
+	if len(calls) != 2 {
+		t.Fatalf("expected one batch per domain, got %d", len(calls))
+	}
+	txs := calls["example.com"]
+	if len(txs) != 2 || len(txs[0].To) != 3 || len(txs[1].To) != 1 {
+		t.Fatalf("expected shared payload in one transaction and solo in another, got %+v", txs)
+	}
+	if got := m.Depth(); got != 1 || m.queue[0].To != "busy@example.com" {
+		t.Fatalf("expected only the deferred recipient to be requeued, queue %+v", m.queue)
+	}
+}
+
+func TestGroupDueSplitsLargeTransactions(t *testing.T) {
+	shared := NewPayload([]byte("body"))
+	var due []QueuedMessage
+	for i := 0; i < maxRecipientsPerTransaction+5; i++ {
+		due = append(due, QueuedMessage{ID: "big", From: "a@example.org", To: "user@example.com", Payload: shared})
+	}
+	batches := NewManager().groupDue(due)
+	if len(batches) != 1 || len(batches[0].txs) != 2 {
+		t.Fatalf("expected one batch with two transactions, got %+v", batches)
+	}
+	if len(batches[0].txs[0].To) != maxRecipientsPerTransaction || len(batches[0].txs[1].To) != 5 {
+		t.Fatalf("unexpected split %d/%d", len(batches[0].txs[0].To), len(batches[0].txs[1].To))
+	}
+}
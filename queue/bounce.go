@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	audit "gopherpost/internal/audit"
+	"gopherpost/internal/dsn"
+	"gopherpost/storage"
+)
+
+// fail gives up on msg after err, returns a failure notice to the sender and
+// removes the message from the spool. expired marks messages that outlived the
+// maximum queue lifetime rather than being rejected outright.
+func (m *Manager) fail(msg QueuedMessage, err error, expired bool) {
+	rcpt := recipientStatus(msg, dsn.Failed, err, 5)
+	reason := "rejected by the remote server"
+	if expired {
+		reason = fmt.Sprintf("gave up after %d attempts over %s", msg.Attempts, time.Since(msg.ReceivedAt).Round(time.Minute))
+		// RFC 3463: 4.4.7 delivery time expired.
+		rcpt.Status = "4.4.7"
+	}
+	rcpt.Reason = fmt.Sprintf("%s: %v", reason, err)
+	log.Printf("Giving up on message %s for %s (%s): %v", msg.ID, msg.To, reason, err)
+	audit.Log("queue failed %s -> %s attempts %d reason %s error %v", msg.ID, msg.To, msg.Attempts, reason, err)
+
+	m.notify(msg, rcpt)
+	releaseSpool(msg)
+}
+
+// warnDelayed tells the sender that msg is still queued after err.
+func (m *Manager) warnDelayed(msg QueuedMessage, err error) {
+	rcpt := recipientStatus(msg, dsn.Delayed, err, 4)
+	rcpt.WillRetryUntil = msg.ReceivedAt.Add(m.maxLifetime)
+	rcpt.Reason = fmt.Sprintf("delivery temporarily failed: %v", err)
+	log.Printf("Sending delay notice for message %s to %s", msg.ID, msg.To)
+	audit.Log("queue delayed %s -> %s attempts %d", msg.ID, msg.To, msg.Attempts)
+	m.notify(msg, rcpt)
+}
+
+func recipientStatus(msg QueuedMessage, action dsn.Action, err error, class int) dsn.Recipient {
+	status, diagnostic := dsn.Diagnose(err, class)
+	rcpt := dsn.Recipient{
+		Address:        msg.To,
+		Action:         action,
+		Status:         status,
+		DiagnosticCode: diagnostic,
+		LastAttempt:    time.Now(),
+	}
+	if msg.LastFailure != nil {
+		rcpt.RemoteMTA = msg.LastFailure.Host
+	}
+	return rcpt
+}
+
+// notify queues a delivery status notification about msg for its sender. Notices
+// travel with a null reverse-path, and messages that already have one are
+// themselves notices, so they are never reported on; this prevents bounce loops.
+func (m *Manager) notify(msg QueuedMessage, rcpt dsn.Recipient) {
+	if msg.From == "" {
+		log.Printf("Not reporting %s status for message %s: null reverse-path", rcpt.Action, msg.ID)
+		audit.Log("queue dsn suppressed %s -> %s null sender", msg.ID, msg.To)
+		return
+	}
+	report, err := dsn.Build(dsn.Report{
+		ReportingMTA: m.hostname,
+		Sender:       msg.From,
+		MessageID:    msg.ID,
+		ArrivalDate:  msg.ReceivedAt,
+		Recipients:   []dsn.Recipient{rcpt},
+		Original:     msg.Payload.Bytes(),
+	})
+	if err != nil {
+		log.Printf("Failed to build %s notice for message %s: %v", rcpt.Action, msg.ID, err)
+		audit.Log("queue dsn build error %s: %v", msg.ID, err)
+		return
+	}
+
+	notice := QueuedMessage{
+		ID:         newMessageID(),
+		From:       "",
+		To:         msg.From,
+		Payload:    NewPayload(report),
+		ReceivedAt: time.Now().UTC(),
+	}
+	path, err := storage.Save(storage.Metadata{
+		ID:         notice.ID,
+		From:       notice.From,
+		To:         notice.To,
+		ReceivedAt: notice.ReceivedAt,
+	}, report)
+	if err != nil {
+		// Still attempt delivery; the notice is only lost if we restart first.
+		log.Printf("Failed to persist %s notice %s: %v", rcpt.Action, notice.ID, err)
+		audit.Log("queue dsn persist error %s: %v", notice.ID, err)
+	} else {
+		notice.SpoolPath = path
+	}
+	audit.Log("queue dsn %s %s for %s -> %s", rcpt.Action, notice.ID, msg.ID, msg.From)
+	m.Enqueue(notice)
+}
+
+func newMessageID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
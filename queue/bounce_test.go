@@ -0,0 +1,181 @@
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"gopherpost/delivery"
+	"gopherpost/storage"
+)
+
+func useTempSpool(t *testing.T) {
+	t.Helper()
+	storage.SetBaseDir(t.TempDir())
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+}
+
+func TestPermanentFailureBounces(t *testing.T) {
+	useTempSpool(t)
+
+	deliver := perRecipient(func(from, to string, data []byte) error {
+		return &delivery.Error{Stage: delivery.StageRcpt, Host: "mx.example.net", Code: 550, EnhancedCode: "5.1.1", Message: "5.1.1 No such user",
+			Err: &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}}
+	})
+
+	m := NewManager(WithTransport(deliver), WithHostname("mx.test"))
+	path, err := storage.SaveMessage("orig", "sender@example.com", "rcpt@example.net", []byte("Subject: hi\r\n\r\nbody"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	m.Enqueue(QueuedMessage{
+		ID:        "orig",
+		From:      "sender@example.com",
+		To:        "rcpt@example.net",
+		Payload:   NewPayload([]byte("Subject: hi\r\n\r\nbody")),
+		SpoolPath: path,
+	})
+	m.processQueue()
+
+	if got := m.Depth(); got != 1 {
+		t.Fatalf("expected only the bounce to be queued, depth %d", got)
+	}
+	bounce := m.queue[0]
+	if bounce.From != "" || bounce.To != "sender@example.com" {
+		t.Fatalf("unexpected bounce envelope %q -> %q", bounce.From, bounce.To)
+	}
+	for _, want := range []string{"Action: failed", "Status: 5.1.1", "Reporting-MTA: dns; mx.test", "Subject: hi"} {
+		if !bytes.Contains(bounce.Payload.Bytes(), []byte(want)) {
+			t.Fatalf("bounce missing %q:\n%s", want, bounce.Payload.Bytes())
+		}
+	}
+	if !bytes.Contains(bounce.Payload.Bytes(), []byte("Remote-MTA: dns; mx.example.net")) {
+		t.Fatalf("bounce missing remote MTA:\n%s", bounce.Payload.Bytes())
+	}
+	if bounce.SpoolPath == "" {
+		t.Fatalf("expected bounce to be spooled")
+	}
+	if _, err := storage.ReadMetadata(path); err == nil {
+		t.Fatalf("expected original message to be removed from the spool")
+	}
+}
+
+func TestExpiredMessageBounces(t *testing.T) {
+	useTempSpool(t)
+
+	deliver := perRecipient(func(from, to string, data []byte) error {
+		return errors.New("dial: connection refused")
+	})
+
+	m := NewManager(WithTransport(deliver), WithMaxLifetime(time.Hour))
+	m.Enqueue(QueuedMessage{
+		ID:         "old",
+		From:       "sender@example.com",
+		To:         "rcpt@example.net",
+		Payload:    NewPayload([]byte("body")),
+		ReceivedAt: time.Now().Add(-2 * time.Hour),
+	})
+	m.processQueue()
+
+	if got := m.Depth(); got != 1 || m.queue[0].From != "" {
+		t.Fatalf("expected the expired message to be replaced by a bounce")
+	}
+	if !bytes.Contains(m.queue[0].Payload.Bytes(), []byte("Status: 4.4.7")) {
+		t.Fatalf("expected delivery time expired status:\n%s", m.queue[0].Payload.Bytes())
+	}
+}
+
+func TestBounceIsNeverBounced(t *testing.T) {
+	useTempSpool(t)
+
+	deliver := perRecipient(func(from, to string, data []byte) error {
+		return &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	})
+
+	m := NewManager(WithTransport(deliver))
+	m.Enqueue(QueuedMessage{
+		ID:      "bounce",
+		From:    "",
+		To:      "sender@example.com",
+		Payload: NewPayload([]byte("body")),
+	})
+	m.processQueue()
+
+	if got := m.Depth(); got != 0 {
+		t.Fatalf("expected failed bounce to be dropped, depth %d", got)
+	}
+}
+
+func TestDelayWarningSentOnce(t *testing.T) {
+	useTempSpool(t)
+
+	deliver := perRecipient(func(from, to string, data []byte) error {
+		if from == "" {
+			return nil
+		}
+		return &textproto.Error{Code: 451, Msg: "4.3.0 Try again later"}
+	})
+
+	m := NewManager(WithTransport(deliver), WithDelayWarning(time.Hour))
+	m.Enqueue(QueuedMessage{
+		ID:         "slow",
+		From:       "sender@example.com",
+		To:         "rcpt@example.net",
+		Payload:    NewPayload([]byte("body")),
+		ReceivedAt: time.Now().Add(-2 * time.Hour),
+	})
+	m.processQueue()
+
+	var notices, retries int
+	for _, msg := range m.queue {
+		if msg.From == "" {
+			notices++
+			if !bytes.Contains(msg.Payload.Bytes(), []byte("Action: delayed")) {
+				t.Fatalf("expected delay notice:\n%s", msg.Payload.Bytes())
+			}
+			continue
+		}
+		retries++
+		if !msg.DelayNotified {
+			t.Fatalf("expected message to be marked as notified")
+		}
+	}
+	if notices != 1 || retries != 1 {
+		t.Fatalf("expected one notice and one retry, got %d and %d", notices, retries)
+	}
+
+	for i := range m.queue {
+		m.queue[i].NextRetry = time.Now().Add(-time.Second)
+	}
+	m.processQueue()
+	if got := m.Depth(); got != 1 || m.queue[0].From == "" {
+		t.Fatalf("expected no second notice, queue %+v", m.queue)
+	}
+}
+
+func TestFailureReasonPersisted(t *testing.T) {
+	useTempSpool(t)
+
+	deliver := perRecipient(func(from, to string, data []byte) error {
+		return &delivery.Error{Stage: delivery.StageDial, Host: "mx.example.net", Err: errors.New("connection refused")}
+	})
+
+	path, err := storage.SaveMessage("retry", "sender@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	m := NewManager(WithTransport(deliver))
+	m.Enqueue(QueuedMessage{ID: "retry", From: "sender@example.com", To: "rcpt@example.net", Payload: NewPayload([]byte("body")), SpoolPath: path})
+	m.processQueue()
+
+	meta, err := storage.ReadMetadata(path)
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	failure := meta.LastFailure
+	if failure == nil || failure.Stage != "dial" || failure.Host != "mx.example.net" || failure.Message != "connection refused" {
+		t.Fatalf("unexpected failure reason %+v", failure)
+	}
+}
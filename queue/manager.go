@@ -1,6 +1,8 @@
 package queue
 
 import (
+	"context"
+	"errors"
 	"log"
 	"math/rand"
 	"runtime"
@@ -10,9 +12,11 @@ import (
 	"gopherpost/delivery"
 	audit "gopherpost/internal/audit"
 	"gopherpost/internal/metrics"
+	"gopherpost/storage"
+	"gopherpost/transport"
 )
 
-var deliverFunc = delivery.DeliverMessage
+const defaultMaxLifetime = 5 * 24 * time.Hour
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
@@ -23,9 +27,15 @@ type Manager struct {
 	queue    []QueuedMessage
 	mu       sync.Mutex
 	quit     chan struct{}
+	done     chan struct{}
 	once     sync.Once
 	stopOnce sync.Once
 	workers  int
+
+	transport    transport.Transport
+	hostname     string
+	maxLifetime  time.Duration
+	delayWarning time.Duration
 }
 
 // Option configures a Manager.
@@ -40,12 +50,56 @@ func WithWorkers(workers int) Option {
 	}
 }
 
+// WithTransport sets how messages leave the queue. The default delivers directly
+// to each domain's MX hosts.
+func WithTransport(t transport.Transport) Option {
+	return func(m *Manager) {
+		if t != nil {
+			m.transport = t
+		}
+	}
+}
+
+// WithHostname sets the name this server reports in bounce and delay notices.
+func WithHostname(hostname string) Option {
+	return func(m *Manager) {
+		if hostname != "" {
+			m.hostname = hostname
+		}
+	}
+}
+
+// WithMaxLifetime sets how long a message may remain queued, counted from when it
+// was received, before it is bounced back to the sender.
+func WithMaxLifetime(d time.Duration) Option {
+	return func(m *Manager) {
+		if d > 0 {
+			m.maxLifetime = d
+		}
+	}
+}
+
+// WithDelayWarning enables a one-off delay notice to the sender once a message has
+// been queued for d. Zero disables warnings.
+func WithDelayWarning(d time.Duration) Option {
+	return func(m *Manager) {
+		if d >= 0 {
+			m.delayWarning = d
+		}
+	}
+}
+
 // NewManager creates a new delivery queue manager.
 func NewManager(opts ...Option) *Manager {
 	m := &Manager{
 		queue:   make([]QueuedMessage, 0),
 		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
 		workers: runtime.NumCPU(),
+
+		transport:   transport.MX{},
+		hostname:    "localhost",
+		maxLifetime: defaultMaxLifetime,
 	}
 	for _, opt := range opts {
 		opt(m)
@@ -67,6 +121,9 @@ func (m *Manager) Enqueue(msg QueuedMessage) {
 	if msg.Attempts == 0 && msg.NextRetry.IsZero() {
 		msg.NextRetry = time.Now()
 	}
+	if msg.ReceivedAt.IsZero() {
+		msg.ReceivedAt = time.Now()
+	}
 	m.queue = append(m.queue, msg)
 	log.Printf("Queued message %s for %s (attempt %d)", msg.ID, msg.To, msg.Attempts)
 	audit.Log("queue enqueue %s -> %s attempt %d next %s", msg.ID, msg.To, msg.Attempts, msg.NextRetry.Format(time.RFC3339))
@@ -78,6 +135,7 @@ func (m *Manager) Enqueue(msg QueuedMessage) {
 func (m *Manager) Start() {
 	m.once.Do(func() {
 		go func() {
+			defer close(m.done)
 			ticker := time.NewTicker(5 * time.Second)
 			defer ticker.Stop()
 			m.processQueue()
@@ -100,6 +158,31 @@ func (m *Manager) Stop() {
 	})
 }
 
+// Shutdown stops the queue processor and waits for in-flight deliveries to
+// finish or ctx to expire. Messages that were not attempted stay in the spool and
+// are recovered on the next start.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.Stop()
+	// A processor that was never started has nothing to wait for; claiming the
+	// start also prevents a late Start from running after shutdown.
+	m.once.Do(func() { close(m.done) })
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) stopping() bool {
+	select {
+	case <-m.quit:
+		return true
+	default:
+		return false
+	}
+}
+
 // processQueue attempts to deliver messages that are due.
 func (m *Manager) processQueue() {
 	now := time.Now()
@@ -130,44 +213,73 @@ func (m *Manager) processQueue() {
 	sem := make(chan struct{}, workerCount)
 	var wg sync.WaitGroup
 
-	for _, msg := range due {
-		msg := msg
-		wg.Add(1)
+	batches := m.groupDue(due)
+	for i, b := range batches {
+		b := b
 		sem <- struct{}{}
+		if m.stopping() {
+			// Shutting down: leave the rest for the next run instead of starting
+			// deliveries the process may not live to finish.
+			<-sem
+			m.mu.Lock()
+			for _, rest := range batches[i:] {
+				for _, msgs := range rest.msgs {
+					m.queue = append(m.queue, msgs...)
+				}
+			}
+			metrics.SetQueueDepth(len(m.queue))
+			m.mu.Unlock()
+			break
+		}
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			defer func() { <-sem }()
+			m.deliverBatch(b)
+		}()
+	}
 
-			payload := msg.Payload
-			if payload == nil {
-				log.Printf("Skipping message %s for %s: missing payload", msg.ID, msg.To)
-				audit.Log("queue skip %s -> %s missing payload", msg.ID, msg.To)
-				return
-			}
+	wg.Wait()
+}
 
-			if err := deliverFunc(msg.From, msg.To, payload.Bytes()); err != nil {
-				msg.Attempts++
-				msg.NextRetry = time.Now().Add(backoffDuration(msg.Attempts))
-				msg.LastError = err.Error()
-				log.Printf("Retry %d for %s in %v (message %s): %v", msg.Attempts, msg.To, time.Until(msg.NextRetry), msg.ID, err)
-				metrics.DeliveryFailures.Add(1)
-				audit.Log("queue retry %s -> %s attempt %d next %s error %v", msg.ID, msg.To, msg.Attempts, msg.NextRetry.Format(time.RFC3339), err)
-
-				m.mu.Lock()
-				m.queue = append(m.queue, msg)
-				metrics.SetQueueDepth(len(m.queue))
-				m.mu.Unlock()
-				return
-			}
+// complete records the outcome of one delivery attempt for msg: it is released on
+// success, bounced on permanent failure or expiry, and otherwise rescheduled.
+func (m *Manager) complete(msg QueuedMessage, err error) {
+	if err != nil {
+		msg.Attempts++
+		msg.LastError = err.Error()
+		msg.LastFailure = failureOf(err)
+		metrics.DeliveryFailures.Add(1)
+		switch {
+		case delivery.IsPermanent(err):
+			m.fail(msg, err, false)
+			return
+		case time.Since(msg.ReceivedAt) >= m.maxLifetime:
+			m.fail(msg, err, true)
+			return
+		}
+		msg.NextRetry = time.Now().Add(backoffDuration(msg.Attempts))
+		log.Printf("Retry %d for %s in %v (message %s): %v", msg.Attempts, msg.To, time.Until(msg.NextRetry), msg.ID, err)
+		audit.Log("queue retry %s -> %s attempt %d next %s error %v", msg.ID, msg.To, msg.Attempts, msg.NextRetry.Format(time.RFC3339), err)
+		if m.delayWarning > 0 && !msg.DelayNotified && time.Since(msg.ReceivedAt) >= m.delayWarning {
+			m.warnDelayed(msg, err)
+			msg.DelayNotified = true
+		}
+		persistState(msg)
 
-			msg.LastError = ""
-			log.Printf("Delivered message %s to %s", msg.ID, msg.To)
-			metrics.MessagesDelivered.Add(1)
-			audit.Log("queue delivered %s -> %s attempts %d", msg.ID, msg.To, msg.Attempts)
-		}()
+		m.mu.Lock()
+		m.queue = append(m.queue, msg)
+		metrics.SetQueueDepth(len(m.queue))
+		m.mu.Unlock()
+		return
 	}
 
-	wg.Wait()
+	msg.LastError = ""
+	msg.LastFailure = nil
+	log.Printf("Delivered message %s to %s", msg.ID, msg.To)
+	metrics.MessagesDelivered.Add(1)
+	audit.Log("queue delivered %s -> %s attempts %d", msg.ID, msg.To, msg.Attempts)
+	releaseSpool(msg)
 }
 
 // Depth returns the current queue length.
@@ -177,6 +289,57 @@ func (m *Manager) Depth() int {
 	return len(m.queue)
 }
 
+// persistState records the retry state of msg in its spool metadata so a restart
+// resumes with the same attempt count and schedule.
+func persistState(msg QueuedMessage) {
+	if msg.SpoolPath == "" {
+		return
+	}
+	err := storage.UpdateMetadata(msg.SpoolPath, func(meta *storage.Metadata) {
+		meta.Attempts = msg.Attempts
+		attempted := time.Now().UTC()
+		meta.LastAttempt = &attempted
+		meta.NextRetry = msg.NextRetry
+		meta.LastError = msg.LastError
+		meta.LastFailure = msg.LastFailure
+		meta.DelayNotified = msg.DelayNotified
+	})
+	if err != nil {
+		log.Printf("Failed to persist queue state for %s (%s): %v", msg.ID, msg.To, err)
+		audit.Log("queue persist error %s -> %s: %v", msg.ID, msg.To, err)
+	}
+}
+
+// failureOf extracts the structured failure reason from a delivery error.
+func failureOf(err error) *storage.Failure {
+	var derr *delivery.Error
+	if !errors.As(err, &derr) {
+		return &storage.Failure{Message: err.Error()}
+	}
+	failure := &storage.Failure{
+		Stage:        string(derr.Stage),
+		Host:         derr.Host,
+		Code:         derr.Code,
+		EnhancedCode: derr.EnhancedCode,
+		Message:      derr.Message,
+	}
+	if failure.Message == "" && derr.Err != nil {
+		failure.Message = derr.Err.Error()
+	}
+	return failure
+}
+
+// releaseSpool removes the persisted copy of a delivered message.
+func releaseSpool(msg QueuedMessage) {
+	if msg.SpoolPath == "" {
+		return
+	}
+	if err := storage.RemoveMessage(msg.SpoolPath); err != nil {
+		log.Printf("Failed to remove spooled message %s: %v", msg.SpoolPath, err)
+		audit.Log("queue spool cleanup error %s: %v", msg.SpoolPath, err)
+	}
+}
+
 func backoffDuration(attempts int) time.Duration {
 	if attempts < 1 {
 		attempts = 1
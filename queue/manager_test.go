@@ -1,31 +1,45 @@
 package queue
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
 
+	"gopherpost/delivery"
 	"gopherpost/internal/metrics"
+	"gopherpost/transport"
 )
 
+// perRecipient adapts a per-recipient delivery stub to a Transport.
+func perRecipient(fn func(from, to string, data []byte) error) transport.Func {
+	return func(domain string, txs []delivery.Transaction) []delivery.Result {
+		results := make([]delivery.Result, len(txs))
+		for i, tx := range txs {
+			results[i] = make(delivery.Result, len(tx.To))
+			for j, rcpt := range tx.To {
+				results[i][j] = fn(tx.From, rcpt, tx.Data)
+			}
+		}
+		return results
+	}
+}
+
 func TestManagerProcessQueueSuccess(t *testing.T) {
 	metrics.ResetForTests()
 
-	originalDeliver := deliverFunc
-	defer func() { deliverFunc = originalDeliver }()
-
 	var delivered [][]byte
-	deliverFunc = func(from, to string, data []byte) error {
+	deliver := perRecipient(func(from, to string, data []byte) error {
 		if from != "sender@example.com" || to != "rcpt@example.net" {
 			t.Fatalf("unexpected envelope %s -> %s", from, to)
 		}
 		delivered = append(delivered, append([]byte(nil), data...))
 		return nil
-	}
+	})
 
-	m := NewManager()
+	m := NewManager(WithTransport(deliver))
 	msg := QueuedMessage{
 		ID:        "msg-1",
 		From:      "sender@example.com",
@@ -65,14 +79,11 @@ func TestManagerProcessQueueSuccess(t *testing.T) {
 func TestManagerProcessQueueFailure(t *testing.T) {
 	metrics.ResetForTests()
 
-	originalDeliver := deliverFunc
-	defer func() { deliverFunc = originalDeliver }()
-
-	deliverFunc = func(from, to string, data []byte) error {
+	deliver := perRecipient(func(from, to string, data []byte) error {
 		return errors.New("smtp unavailable")
-	}
+	})
 
-	m := NewManager()
+	m := NewManager(WithTransport(deliver))
 	msg := QueuedMessage{
 		ID:        "msg-2",
 		From:      "sender@example.com",
@@ -110,14 +121,11 @@ func TestManagerStopIdempotent(t *testing.T) {
 func TestManagerProcessQueueWorkerConcurrency(t *testing.T) {
 	metrics.ResetForTests()
 
-	originalDeliver := deliverFunc
-	defer func() { deliverFunc = originalDeliver }()
-
 	var mu sync.Mutex
 	current := 0
 	max := 0
 
-	deliverFunc = func(from, to string, data []byte) error {
+	deliver := perRecipient(func(from, to string, data []byte) error {
 		mu.Lock()
 		current++
 		if current > max {
@@ -132,13 +140,13 @@ func TestManagerProcessQueueWorkerConcurrency(t *testing.T) {
 		mu.Unlock()
 
 		return nil
-	}
+	})
 
 	makeMessage := func(id int) QueuedMessage {
 		return QueuedMessage{
 			ID:        fmt.Sprintf("msg-%d", id),
 			From:      "sender@example.com",
-			To:        fmt.Sprintf("rcpt-%d@example.net", id),
+			To:        fmt.Sprintf("rcpt@example-%d.net", id),
 			Payload:   NewPayload([]byte("body")),
 			Attempts:  1,
 			NextRetry: time.Now().Add(-time.Second),
@@ -146,7 +154,7 @@ func TestManagerProcessQueueWorkerConcurrency(t *testing.T) {
 	}
 
 	measure := func(workers int) int {
-		m := NewManager(WithWorkers(workers))
+		m := NewManager(WithTransport(deliver), WithWorkers(workers))
 		for i := 0; i < 6; i++ {
 			m.Enqueue(makeMessage(workers*100 + i))
 		}
@@ -171,3 +179,83 @@ func TestManagerProcessQueueWorkerConcurrency(t *testing.T) {
 		t.Fatalf("expected parallel workers to exceed 1 concurrent delivery, got %d", parallelMax)
 	}
 }
+
+func TestManagerShutdownWaitsForDeliveries(t *testing.T) {
+	metrics.ResetForTests()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int
+	var mu sync.Mutex
+	deliver := perRecipient(func(from, to string, data []byte) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		close(started)
+		<-release
+		return nil
+	})
+
+	m := NewManager(WithTransport(deliver), WithWorkers(1))
+	for i := 0; i < 2; i++ {
+		m.Enqueue(QueuedMessage{
+			ID:        fmt.Sprintf("msg-%d", i),
+			From:      "sender@example.com",
+			To:        fmt.Sprintf("rcpt@example-%d.net", i),
+			Payload:   NewPayload([]byte("body")),
+			NextRetry: time.Now().Add(-time.Second),
+		})
+	}
+	m.Start()
+	<-started
+
+	result := make(chan error, 1)
+	go func() { result <- m.Shutdown(context.Background()) }()
+	select {
+	case err := <-result:
+		t.Fatalf("Shutdown returned before delivery finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Fatalf("expected no new deliveries after shutdown, got %d", calls)
+	}
+	if got := m.Depth(); got != 1 {
+		t.Fatalf("expected undelivered message to remain queued, depth %d", got)
+	}
+}
+
+func TestManagerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	deliver := perRecipient(func(from, to string, data []byte) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	m := NewManager(WithTransport(deliver))
+	m.Enqueue(QueuedMessage{ID: "slow", From: "a@example.com", To: "b@example.net", Payload: NewPayload([]byte("body"))})
+	m.Start()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+}
+
+func TestManagerShutdownWithoutStart(t *testing.T) {
+	m := NewManager()
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
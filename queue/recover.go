@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	audit "gopherpost/internal/audit"
+	"gopherpost/internal/email"
+	"gopherpost/storage"
+)
+
+// RecoveryReport summarises a spool recovery pass.
+type RecoveryReport struct {
+	Restored    int
+	Quarantined int
+}
+
+// Recover rebuilds the queue from messages persisted in the spool directory,
+// restoring their attempt counts, retry schedule and last error. Sidecars left
+// without a payload are removed first. Entries that are corrupt or cannot be
+// delivered are moved to the spool quarantine folder. It must run before the
+// queue starts and before new messages are accepted.
+func (m *Manager) Recover() (RecoveryReport, error) {
+	var report RecoveryReport
+	payloads := make(map[string]*Payload)
+	if removed, err := storage.RemoveOrphanMetadata(); err != nil {
+		return report, err
+	} else if removed > 0 {
+		log.Printf("Removed %d spool sidecars without a payload", removed)
+	}
+
+	err := storage.Walk(func(entry storage.SpooledMessage, loadErr error) error {
+		if reason := recoverable(entry, loadErr); reason != "" {
+			target, err := storage.Quarantine(entry.Path)
+			if err != nil {
+				return fmt.Errorf("quarantine %s: %w", entry.Path, err)
+			}
+			report.Quarantined++
+			log.Printf("Quarantined spooled message %s: %s", target, reason)
+			audit.Log("queue recover quarantine %s reason %s", target, reason)
+			return nil
+		}
+
+		meta := entry.Metadata
+		payload, ok := payloads[meta.ID]
+		if !ok || !bytes.Equal(payload.Bytes(), entry.Data) {
+			payload = NewPayload(entry.Data)
+			payloads[meta.ID] = payload
+		}
+		m.Enqueue(QueuedMessage{
+			ID:            meta.ID,
+			From:          meta.From,
+			To:            meta.To,
+			Payload:       payload,
+			ReceivedAt:    meta.ReceivedAt,
+			Attempts:      meta.Attempts,
+			NextRetry:     meta.NextRetry,
+			LastError:     meta.LastError,
+			LastFailure:   meta.LastFailure,
+			DelayNotified: meta.DelayNotified,
+			SpoolPath:     entry.Path,
+		})
+		report.Restored++
+		return nil
+	})
+	return report, err
+}
+
+// recoverable returns a non-empty reason when a spool entry must be quarantined.
+func recoverable(entry storage.SpooledMessage, loadErr error) string {
+	if loadErr != nil {
+		return loadErr.Error()
+	}
+	if len(entry.Data) == 0 {
+		return "empty payload"
+	}
+	if _, err := email.Domain(entry.Metadata.To); err != nil {
+		return fmt.Sprintf("undeliverable recipient %q: %v", entry.Metadata.To, err)
+	}
+	return ""
+}
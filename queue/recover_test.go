@@ -0,0 +1,154 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopherpost/internal/metrics"
+	"gopherpost/storage"
+)
+
+func TestManagerRecover(t *testing.T) {
+	metrics.ResetForTests()
+	tmp := t.TempDir()
+	storage.SetBaseDir(tmp)
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+
+	first, err := storage.SaveMessage("msg-1", "sender@example.com", "a@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	if _, err := storage.SaveMessage("msg-1", "sender@example.com", "b@example.net", []byte("body")); err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	next := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	meta, err := storage.ReadMetadata(first)
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	meta.Attempts = 2
+	meta.NextRetry = next
+	meta.LastError = "connection refused"
+	if err := storage.WriteMetadata(first, meta); err != nil {
+		t.Fatalf("WriteMetadata: %v", err)
+	}
+
+	corrupt, err := storage.SaveMessage("msg-2", "sender@example.com", "c@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	if err := os.Remove(storage.MetadataPath(corrupt)); err != nil {
+		t.Fatalf("remove metadata: %v", err)
+	}
+
+	// A payload spooled before sidecars existed is restored from its headers.
+	legacyDir := filepath.Join(tmp, "2024-05-01")
+	if err := os.MkdirAll(legacyDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	legacy := filepath.Join(legacyDir, "msg-0_"+recipientHash("d@example.net")+".eml")
+	if err := os.WriteFile(legacy, []byte("From: sender@example.com\r\nTo: d@example.net\r\n\r\nbody"), 0o600); err != nil {
+		t.Fatalf("write legacy payload: %v", err)
+	}
+
+	m := NewManager()
+	report, err := m.Recover()
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+	if report.Restored != 3 || report.Quarantined != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if m.Depth() != 3 {
+		t.Fatalf("expected depth 3, got %d", m.Depth())
+	}
+
+	var restored *QueuedMessage
+	for i := range m.queue {
+		if m.queue[i].To == "a@example.net" {
+			restored = &m.queue[i]
+		}
+	}
+	if restored == nil {
+		t.Fatalf("expected a@example.net to be restored")
+	}
+	if legacyMsg := m.queue[0]; legacyMsg.ID != "msg-0" || legacyMsg.To != "d@example.net" || legacyMsg.From != "sender@example.com" || legacyMsg.SpoolPath != legacy {
+		t.Fatalf("legacy payload not restored first: %+v", legacyMsg)
+	}
+	if restored.Attempts != 2 || !restored.NextRetry.Equal(next) || restored.LastError != "connection refused" {
+		t.Fatalf("retry state not restored: %+v", restored)
+	}
+	if restored.SpoolPath != first {
+		t.Fatalf("expected spool path %s, got %s", first, restored.SpoolPath)
+	}
+	if m.queue[1].Payload != m.queue[2].Payload {
+		t.Fatalf("expected recipients of one message to share a payload")
+	}
+
+	if _, err := os.Stat(filepath.Join(tmp, "quarantine", filepath.Base(corrupt))); err != nil {
+		t.Fatalf("expected corrupt entry in quarantine: %v", err)
+	}
+}
+
+// recipientHash returns the recipient token of a spool filename.
+func recipientHash(addr string) string {
+	sum := sha256.Sum256([]byte(addr))
+	return hex.EncodeToString(sum[:8])
+}
+
+func TestManagerSpoolLifecycle(t *testing.T) {
+	metrics.ResetForTests()
+	tmp := t.TempDir()
+	storage.SetBaseDir(tmp)
+	t.Cleanup(func() { storage.SetBaseDir("./data/spool") })
+
+	path, err := storage.SaveMessage("msg-3", "sender@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	msg := QueuedMessage{
+		ID:        "msg-3",
+		From:      "sender@example.com",
+		To:        "rcpt@example.net",
+		Payload:   NewPayload([]byte("body")),
+		NextRetry: time.Now().Add(-time.Second),
+		SpoolPath: path,
+	}
+
+	failing := true
+	deliver := perRecipient(func(from, to string, data []byte) error {
+		if failing {
+			return os.ErrDeadlineExceeded
+		}
+		return nil
+	})
+
+	m := NewManager(WithTransport(deliver))
+	m.Enqueue(msg)
+	m.processQueue()
+
+	meta, err := storage.ReadMetadata(path)
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if meta.Attempts != 1 || meta.LastError == "" || meta.NextRetry.IsZero() {
+		t.Fatalf("expected retry state to be persisted, got %+v", meta)
+	}
+
+	failing = false
+	m.mu.Lock()
+	m.queue[0].NextRetry = time.Now().Add(-time.Second)
+	m.mu.Unlock()
+	m.processQueue()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected delivered payload to be removed, got %v", err)
+	}
+	if _, err := os.Stat(storage.MetadataPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected delivered metadata to be removed, got %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package queue
 
-import "time"
+import (
+	"time"
+
+	"gopherpost/storage"
+)
 
 // Payload wraps immutable SMTP message data shared across recipients.
 type Payload struct {
@@ -21,13 +25,19 @@ func (p *Payload) Bytes() []byte {
 }
 
 // QueuedMessage represents a message waiting to be delivered to a single recipient.
-// Payload must never be mutated after enqueueing.
+// Payload must never be mutated after enqueueing. SpoolPath, when set, locates the
+// persisted copy whose metadata is kept in step with the delivery state. An empty
+// From is the null reverse-path used by bounces, which are never bounced in turn.
 type QueuedMessage struct {
-	ID        string
-	From      string
-	To        string
-	Payload   *Payload
-	Attempts  int
-	NextRetry time.Time
-	LastError string
+	ID            string
+	From          string
+	To            string
+	Payload       *Payload
+	ReceivedAt    time.Time
+	Attempts      int
+	NextRetry     time.Time
+	LastError     string
+	LastFailure   *storage.Failure
+	DelayNotified bool
+	SpoolPath     string
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"gopherpost/internal/alias"
+	"gopherpost/internal/recipient"
+	"gopherpost/internal/srs"
+)
+
+var (
+	// errUnknownRecipient means no mailbox, verifier, alias or catch-all
+	// accepts an address.
+	errUnknownRecipient = errors.New("unknown recipient")
+	// errInvalidSRS means an SRS address failed its hash or age check.
+	errInvalidSRS = errors.New("invalid SRS address")
+)
+
+// resolveRecipient returns the recipients that mail for addr goes to, and
+// whether they come from an alias. A bounce to one of our SRS addresses goes to
+// the original sender. Other addresses resolve to their alias expansion, less
+// local targets without a mailbox, or to themselves once they are known to
+// exist. A local address with a "+detail"
+// suffix is delivered to the mailbox without it, and addresses nothing else
+// accepts fall back to their domain's catch-all alias. errUnknownRecipient,
+// errInvalidSRS and alias.ErrLoop are permanent; other errors mean a lookup
+// failed.
+func (s *server) resolveRecipient(addr string) ([]string, bool, error) {
+	if s.isSRSAddress(addr) {
+		orig, err := s.srs.Reverse(addr)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %w", errInvalidSRS, err)
+		}
+		return []string{orig}, false, nil
+	}
+	if s.aliases != nil {
+		rcpts, ok, err := s.aliases.Expand(addr)
+		if err != nil {
+			return nil, true, err
+		}
+		if ok {
+			rcpts, err = s.existingTargets(rcpts)
+			return rcpts, true, err
+		}
+	}
+	known, err := s.verifyRecipient(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	if known {
+		return []string{addr}, false, nil
+	}
+	if base, ok := alias.StripDetail(addr); ok {
+		known, err := s.verifyRecipient(base)
+		if err != nil {
+			return nil, false, err
+		}
+		if known && s.isLocal(addr) {
+			return []string{base}, false, nil
+		}
+		if known {
+			return []string{addr}, false, nil
+		}
+	}
+	if s.aliases != nil {
+		rcpts, ok, err := s.aliases.CatchAll(addr)
+		if err != nil {
+			return nil, true, err
+		}
+		if ok {
+			rcpts, err = s.existingTargets(rcpts)
+			return rcpts, true, err
+		}
+	}
+	return nil, false, errUnknownRecipient
+}
+
+// existingTargets drops the local targets of an alias expansion that have no
+// mailbox, so a stale alias does not leave mail stuck in the queue. It returns
+// errUnknownRecipient when no target is left.
+func (s *server) existingTargets(rcpts []string) ([]string, error) {
+	var kept []string
+	for _, rcpt := range rcpts {
+		if s.isLocal(rcpt) {
+			known, err := s.verifyRecipient(rcpt)
+			if err != nil {
+				return nil, err
+			}
+			if !known {
+				log.Printf("alias target %s has no mailbox; skipping it", rcpt)
+				continue
+			}
+		}
+		kept = append(kept, rcpt)
+	}
+	if len(kept) == 0 {
+		return nil, errUnknownRecipient
+	}
+	return kept, nil
+}
+
+// isSRSAddress reports whether addr is an SRS address in our SRS domain.
+func (s *server) isSRSAddress(addr string) bool {
+	if s.srs == nil || !srs.IsSRS(addr) {
+		return false
+	}
+	at := strings.LastIndex(addr, "@")
+	return strings.EqualFold(strings.TrimSuffix(addr[at+1:], "."), s.srs.Domain)
+}
+
+// forwardSender returns the envelope sender for mail from that is forwarded to
+// another domain: an SRS address when rewriting is enabled and from is a
+// foreign address, and from itself otherwise.
+func (s *server) forwardSender(from string) string {
+	if s.srs == nil || from == "" || s.isLocal(from) {
+		return from
+	}
+	rewritten, err := s.srs.Forward(from)
+	if err != nil {
+		log.Printf("srs: keeping sender %s: %v", from, err)
+		return from
+	}
+	return rewritten
+}
+
+// verifyRecipient reports whether mail for addr may be accepted. Local domains
+// need an existing mailbox; other domains we accept for are left to the
+// configured verifiers, which accept anything they are not responsible for.
+// Relay destinations, such as mail an authenticated client sends to another
+// provider, are never verified. An error means the lookup failed and the client
+// should retry.
+func (s *server) verifyRecipient(addr string) (bool, error) {
+	if s.isLocal(addr) {
+		return s.mailboxes.Exists(addr)
+	}
+	if s.recipients == nil || !s.acceptsFor(addr) {
+		return true, nil
+	}
+	verdict, err := s.recipients.Verify(addr)
+	return verdict != recipient.Reject, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"gopherpost/internal/auth"
+)
+
+// mayRelay reports whether the session may send mail to any domain: it has
+// authenticated, or the client is on a trusted network.
+func (s *server) mayRelay(identity *auth.Identity, ip net.IP) bool {
+	if identity != nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.trustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsFor reports whether the server takes mail for addr from anyone, because
+// its domain is local or a relay domain, or it is one of our SRS addresses.
+func (s *server) acceptsFor(addr string) bool {
+	if s.isLocal(addr) || s.isSRSAddress(addr) {
+		return true
+	}
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return false
+	}
+	_, ok := s.relayDomains[strings.ToLower(addr[at+1:])]
+	return ok
+}
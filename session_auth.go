@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/textproto"
+	"strings"
+
+	"gopherpost/internal/auth"
+)
+
+const maxAuthFailures = 3
+
+var errAuthCancelled = errors.New("authentication cancelled")
+
+// authenticate runs the SASL exchange for an AUTH command line. It returns the
+// identity on success together with the reply to send. A non-nil error means the
+// connection failed mid-exchange and the session must end.
+func (s *server) authenticate(tp *textproto.Conn, line string) (*auth.Identity, int, string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, 501, "5.5.4 Syntax: AUTH mechanism [initial-response]", nil
+	}
+	mechanism := strings.ToUpper(fields[1])
+	initial, hasInitial := "", len(fields) == 3
+	if hasInitial {
+		initial = fields[2]
+		if initial == "=" {
+			initial = ""
+		}
+	}
+
+	// next returns the client's decoded response to prompt, or the initial
+	// response when one was supplied with the command.
+	next := func(prompt string) (string, error) {
+		if hasInitial {
+			hasInitial = false
+			return decodeSASL(initial)
+		}
+		if err := tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt))); err != nil {
+			return "", err
+		}
+		resp, err := tp.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(resp) == "*" {
+			return "", errAuthCancelled
+		}
+		return decodeSASL(resp)
+	}
+
+	var username, password string
+	switch mechanism {
+	case "PLAIN":
+		resp, err := next("")
+		if reply, msg, ioErr := saslFailure(err); reply != 0 || ioErr != nil {
+			return nil, reply, msg, ioErr
+		}
+		parts := strings.Split(resp, "\x00")
+		if len(parts) != 3 {
+			return nil, 501, "5.5.2 Malformed PLAIN response", nil
+		}
+		if parts[0] != "" && parts[0] != parts[1] {
+			return nil, 535, "5.7.8 Authorization identity not permitted", nil
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		user, err := next("Username:")
+		if reply, msg, ioErr := saslFailure(err); reply != 0 || ioErr != nil {
+			return nil, reply, msg, ioErr
+		}
+		pass, err := next("Password:")
+		if reply, msg, ioErr := saslFailure(err); reply != 0 || ioErr != nil {
+			return nil, reply, msg, ioErr
+		}
+		username, password = user, pass
+	default:
+		return nil, 504, "5.5.4 Unrecognized authentication mechanism", nil
+	}
+
+	id, err := s.auth.Authenticate(username, password)
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		return nil, 535, "5.7.8 Authentication credentials invalid", nil
+	case err != nil:
+		return nil, 454, "4.7.0 Temporary authentication failure", nil
+	}
+	return id, 235, "2.7.0 Authentication successful", nil
+}
+
+// saslFailure maps an error from a SASL step to the reply that ends the exchange.
+// Connection errors are passed back so the session can terminate.
+func saslFailure(err error) (int, string, error) {
+	switch {
+	case err == nil:
+		return 0, "", nil
+	case errors.Is(err, errAuthCancelled):
+		return 501, "5.0.0 Authentication cancelled", nil
+	case isBase64Error(err):
+		return 501, "5.5.2 Cannot decode response", nil
+	default:
+		return 0, "", err
+	}
+}
+
+func decodeSASL(s string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func isBase64Error(err error) bool {
+	var corrupt base64.CorruptInputError
+	return errors.As(err, &corrupt)
+}
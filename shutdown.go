@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// activeSession is the shutdown bookkeeping for one SMTP session. A session is
+// idle while it waits for the client's next command. Shutdown interrupts idle
+// sessions at once and lets busy ones finish their current command, such as a
+// DATA transfer, first.
+type activeSession struct {
+	conn net.Conn
+	idle bool
+}
+
+// trackListener registers ln so Shutdown can close it. It reports false when the
+// server is already shutting down, in which case ln has been closed.
+func (s *server) trackListener(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		_ = ln.Close()
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+// trackSession registers a new session on conn. It reports false when the
+// server is shutting down and the session must not start.
+func (s *server) trackSession(conn net.Conn) (*activeSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil, false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[*activeSession]struct{})
+	}
+	sess := &activeSession{conn: conn}
+	s.sessions[sess] = struct{}{}
+	s.active.Add(1)
+	return sess, true
+}
+
+func (s *server) untrackSession(sess *activeSession) {
+	s.mu.Lock()
+	delete(s.sessions, sess)
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+// markIdle flags sess as waiting for a command. It reports false when shutdown
+// has begun and the session should say goodbye instead of reading. The read
+// deadline must be set before calling so Shutdown's deadline always wins.
+func (s *server) markIdle(sess *activeSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	sess.idle = true
+	return true
+}
+
+func (s *server) markBusy(sess *activeSession) {
+	s.mu.Lock()
+	sess.idle = false
+	s.mu.Unlock()
+}
+
+func (s *server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Shutdown stops accepting connections, interrupts idle sessions so they can
+// reply 421, and waits for busy sessions to finish their current command. When
+// ctx expires first the remaining connections are closed and ctx.Err() is
+// returned; clients whose DATA was cut off never received a 250 and will retry.
+func (s *server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for ln := range s.listeners {
+		_ = ln.Close()
+	}
+	for sess := range s.sessions {
+		if sess.idle {
+			_ = sess.conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	for sess := range s.sessions {
+		_ = sess.conn.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"gopherpost/internal/config"
+	"gopherpost/internal/spf"
+)
+
+// checkSPF evaluates the SPF policy of the sender's domain for a client at ip
+// and returns the verdict with the action configured for its result.
+func (s *server) checkSPF(ip net.IP, from, helo string) (spf.Verdict, config.SPFAction) {
+	ctx := context.Background()
+	if s.spfPolicy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.spfPolicy.Timeout)
+		defer cancel()
+	}
+	v := s.spf.Check(ctx, ip, from, helo)
+	return v, s.spfPolicy.Action(string(v.Result))
+}
@@ -16,19 +16,35 @@ var baseDir = "./data/spool"
 // SaveMessage stores the message on disk for inspection or retry persistence and
 // returns the full path to the persisted file.
 func SaveMessage(id string, from string, to string, data []byte) (string, error) {
-	safeID, err := sanitizeComponent(id)
+	return Save(Metadata{ID: id, From: from, To: to}, data)
+}
+
+// Save persists data together with a metadata sidecar describing the message and
+// returns the full path to the payload. ReceivedAt defaults to the current time.
+// The sidecar is written first, so a crash in between leaves only a sidecar,
+// which RemoveOrphanMetadata cleans up, rather than a payload without envelope.
+func Save(meta Metadata, data []byte) (string, error) {
+	safeID, err := sanitizeComponent(meta.ID)
 	if err != nil {
 		return "", err
 	}
-	recipientToken := hashRecipient(to)
+	recipientToken := hashRecipient(meta.To)
+	if meta.ReceivedAt.IsZero() {
+		meta.ReceivedAt = time.Now().UTC()
+	}
+	meta.ID = safeID
 
-	dir := filepath.Join(baseDir, time.Now().UTC().Format("2006-01-02"))
+	dir := filepath.Join(baseDir, time.Now().UTC().Format(dayLayout))
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return "", err
 	}
-	filename := filepath.Join(dir, fmt.Sprintf("%s_%s.eml", safeID, recipientToken))
+	filename := filepath.Join(dir, fmt.Sprintf("%s_%s%s", safeID, recipientToken, payloadExt))
+	if err := WriteMetadata(filename, meta); err != nil {
+		return "", err
+	}
 	payload := append([]byte(nil), data...)
-	if err := os.WriteFile(filename, payload, 0o600); err != nil {
+	if err := writeFileAtomic(filename, payload, 0o600); err != nil {
+		_ = os.Remove(MetadataPath(filename))
 		return "", err
 	}
 	return filename, nil
@@ -29,11 +29,19 @@ func TestSaveMessage(t *testing.T) {
 	if err != nil {
 		t.Fatalf("ReadDir day: %v", err)
 	}
-	if len(files) != 1 {
-		t.Fatalf("expected 1 file, got %d", len(files))
+	if len(files) != 2 {
+		t.Fatalf("expected payload and metadata files, got %d", len(files))
 	}
 
-	name := files[0].Name()
+	var name string
+	for _, f := range files {
+		if filepath.Ext(f.Name()) == ".eml" {
+			name = f.Name()
+		}
+	}
+	if name == "" {
+		t.Fatalf("expected an .eml payload in %s", dayDir)
+	}
 	if strings.Contains(name, "recipient@example.com") {
 		t.Fatalf("expected recipient to be hashed, got %q", name)
 	}
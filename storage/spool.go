@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	dayLayout     = "2006-01-02"
+	payloadExt    = ".eml"
+	metadataExt   = ".meta"
+	quarantineDir = "quarantine"
+)
+
+// MetadataVersion is the sidecar format version written by this build. Readers
+// reject sidecars with a different version rather than guessing at their layout.
+const MetadataVersion = 1
+
+// Metadata records the envelope, session details, and delivery state of a
+// spooled message. It is stored as JSON in a .meta sidecar next to the payload.
+// LastAttempt is nil until the first delivery attempt.
+type Metadata struct {
+	Version       int        `json:"version"`
+	ID            string     `json:"id"`
+	From          string     `json:"from"`
+	To            string     `json:"to"`
+	ReceivedAt    time.Time  `json:"received_at"`
+	ClientIP      string     `json:"client_ip,omitempty"`
+	Helo          string     `json:"helo,omitempty"`
+	Attempts      int        `json:"attempts"`
+	LastAttempt   *time.Time `json:"last_attempt,omitempty"`
+	NextRetry     time.Time  `json:"next_retry"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastFailure   *Failure   `json:"last_failure,omitempty"`
+	DelayNotified bool       `json:"delay_notified,omitempty"`
+}
+
+// Failure is the structured reason for the most recent failed delivery attempt:
+// the SMTP stage that failed, the MX host, and the remote reply if there was one.
+type Failure struct {
+	Stage        string `json:"stage,omitempty"`
+	Host         string `json:"host,omitempty"`
+	Code         int    `json:"code,omitempty"`
+	EnhancedCode string `json:"enhanced_code,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+// SpooledMessage is a payload recovered from the spool together with its metadata.
+type SpooledMessage struct {
+	Path     string
+	Metadata Metadata
+	Data     []byte
+}
+
+// MetadataPath returns the sidecar path for the payload stored at path.
+func MetadataPath(path string) string {
+	return strings.TrimSuffix(path, payloadExt) + metadataExt
+}
+
+// WriteMetadata atomically replaces the metadata sidecar of the payload at path.
+func WriteMetadata(path string, meta Metadata) error {
+	meta.Version = MetadataVersion
+	encoded, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(MetadataPath(path), append(encoded, '\n'), 0o600)
+}
+
+// ReadMetadata loads the metadata sidecar of the payload at path.
+func ReadMetadata(path string) (Metadata, error) {
+	var meta Metadata
+	raw, err := os.ReadFile(MetadataPath(path))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return meta, fmt.Errorf("decode metadata: %w", err)
+	}
+	if meta.Version != MetadataVersion {
+		return meta, fmt.Errorf("unsupported metadata version %d", meta.Version)
+	}
+	return meta, nil
+}
+
+// UpdateMetadata applies fn to the current sidecar of the payload at path and
+// atomically writes the result back.
+func UpdateMetadata(path string, fn func(*Metadata)) error {
+	meta, err := ReadMetadata(path)
+	if err != nil {
+		return err
+	}
+	fn(&meta)
+	return WriteMetadata(path, meta)
+}
+
+// RemoveMessage deletes a spooled payload and its metadata sidecar.
+func RemoveMessage(path string) error {
+	var errs []error
+	for _, p := range []string{path, MetadataPath(path)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Quarantine moves a spooled payload and its sidecar out of the active spool so it
+// is kept for inspection but never recovered again. It returns the new payload path.
+func Quarantine(path string) (string, error) {
+	dir := filepath.Join(baseDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := os.Rename(MetadataPath(path), MetadataPath(target)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return target, nil
+}
+
+// Walk visits every payload stored under the dated spool folders in chronological
+// order. A payload without a sidecar, as spooled before sidecars existed, gets
+// one rebuilt from its headers. Entries whose payload or metadata cannot be read,
+// or whose metadata does not match the filename, are passed to fn with a non-nil
+// error so the caller can decide how to dispose of them. Returning an error from
+// fn stops the walk.
+func Walk(fn func(msg SpooledMessage, err error) error) error {
+	return walkFiles(payloadExt, func(path string) error {
+		msg, loadErr := load(path)
+		return fn(msg, loadErr)
+	})
+}
+
+// RemoveOrphanMetadata deletes sidecars whose payload is missing, left behind
+// when Save was interrupted. It returns how many were removed and must not run
+// while messages are being saved.
+func RemoveOrphanMetadata() (int, error) {
+	removed := 0
+	err := walkFiles(metadataExt, func(path string) error {
+		payload := strings.TrimSuffix(path, metadataExt) + payloadExt
+		if _, err := os.Stat(payload); !errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// walkFiles calls fn for every file with extension ext in the dated spool
+// folders, oldest folder first.
+func walkFiles(ext string, fn func(path string) error) error {
+	days, err := os.ReadDir(baseDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Name() < days[j].Name() })
+	for _, day := range days {
+		if !day.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(dayLayout, day.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join(baseDir, day.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() || filepath.Ext(file.Name()) != ext {
+				continue
+			}
+			if err := fn(filepath.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func load(path string) (SpooledMessage, error) {
+	msg := SpooledMessage{Path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return msg, err
+	}
+	msg.Data = data
+	meta, err := ReadMetadata(path)
+	if errors.Is(err, os.ErrNotExist) {
+		meta, err = rebuildMetadata(path, data)
+	}
+	if err != nil {
+		return msg, err
+	}
+	msg.Metadata = meta
+	expected := fmt.Sprintf("%s_%s%s", meta.ID, hashRecipient(meta.To), payloadExt)
+	if filepath.Base(path) != expected {
+		return msg, fmt.Errorf("metadata does not match payload %s", filepath.Base(path))
+	}
+	return msg, nil
+}
+
+// rebuildMetadata recreates and writes the sidecar of a payload spooled without
+// one. The ID comes from the filename, the recipient is the header address whose
+// hash the filename carries, the sender is the Return-Path or else the From
+// address, and the payload's modification time stands in for ReceivedAt.
+func rebuildMetadata(path string, data []byte) (Metadata, error) {
+	name := strings.TrimSuffix(filepath.Base(path), payloadExt)
+	sep := strings.LastIndex(name, "_")
+	if sep <= 0 {
+		return Metadata{}, fmt.Errorf("no metadata, and %s does not name a message", filepath.Base(path))
+	}
+	meta := Metadata{ID: name[:sep]}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return Metadata{}, fmt.Errorf("no metadata, and the headers cannot be read: %w", err)
+	}
+	for _, field := range []string{"Delivered-To", "X-Original-To", "To", "Cc"} {
+		for _, value := range msg.Header[field] {
+			addrs, _ := mail.ParseAddressList(value)
+			for _, addr := range addrs {
+				if meta.To == "" && hashRecipient(addr.Address) == name[sep+1:] {
+					meta.To = addr.Address
+				}
+			}
+		}
+	}
+	if meta.To == "" {
+		return Metadata{}, errors.New("no metadata, and no header names the recipient")
+	}
+	if returnPath := strings.TrimSpace(msg.Header.Get("Return-Path")); returnPath != "" {
+		if addr, err := mail.ParseAddress(returnPath); err == nil {
+			meta.From = addr.Address
+		}
+	} else if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		meta.From = addr.Address
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	meta.ReceivedAt = info.ModTime().UTC()
+	if err := WriteMetadata(path, meta); err != nil {
+		return Metadata{}, err
+	}
+	meta.Version = MetadataVersion
+	return meta, nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	cleanup := func() { _ = os.Remove(tmpName) }
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		cleanup()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		cleanup()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		cleanup()
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		cleanup()
+		return err
+	}
+	return nil
+}
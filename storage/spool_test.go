@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	tmp := t.TempDir()
+	SetBaseDir(tmp)
+	t.Cleanup(func() { SetBaseDir("./data/spool") })
+
+	path, err := SaveMessage("abc123", "from@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage returned error: %v", err)
+	}
+	meta, err := ReadMetadata(path)
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if meta.ID != "abc123" || meta.From != "from@example.com" || meta.To != "rcpt@example.net" || meta.LastAttempt != nil {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+	if data, err := os.ReadFile(MetadataPath(path)); err != nil || strings.Contains(string(data), "last_attempt") {
+		t.Fatalf("expected a fresh sidecar without last_attempt, got %s (%v)", data, err)
+	}
+
+	next := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	meta.Attempts = 3
+	meta.NextRetry = next
+	meta.LastError = "451 try later"
+	attempted := next.Add(-time.Hour)
+	meta.LastAttempt = &attempted
+	if err := WriteMetadata(path, meta); err != nil {
+		t.Fatalf("WriteMetadata: %v", err)
+	}
+	got, err := ReadMetadata(path)
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if got.Attempts != 3 || !got.NextRetry.Equal(next) || got.LastError != "451 try later" || got.LastAttempt == nil || !got.LastAttempt.Equal(attempted) {
+		t.Fatalf("metadata not updated: %+v", got)
+	}
+}
+
+func TestWalkReportsCorruptEntries(t *testing.T) {
+	tmp := t.TempDir()
+	SetBaseDir(tmp)
+	t.Cleanup(func() { SetBaseDir("./data/spool") })
+
+	good, err := SaveMessage("good", "from@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	bad, err := SaveMessage("bad", "from@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	if err := os.WriteFile(MetadataPath(bad), []byte("{not json"), 0o600); err != nil {
+		t.Fatalf("corrupt metadata: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "not-a-day"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	seen := map[string]error{}
+	if err := Walk(func(msg SpooledMessage, err error) error {
+		seen[msg.Path] = err
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(seen))
+	}
+	if seen[good] != nil {
+		t.Fatalf("expected good entry to load, got %v", seen[good])
+	}
+	if seen[bad] == nil {
+		t.Fatalf("expected corrupt entry to report an error")
+	}
+}
+
+func TestQuarantineAndRemove(t *testing.T) {
+	tmp := t.TempDir()
+	SetBaseDir(tmp)
+	t.Cleanup(func() { SetBaseDir("./data/spool") })
+
+	path, err := SaveMessage("q1", "from@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	target, err := Quarantine(path)
+	if err != nil {
+		t.Fatalf("Quarantine: %v", err)
+	}
+	if filepath.Dir(target) != filepath.Join(tmp, quarantineDir) {
+		t.Fatalf("unexpected quarantine location %s", target)
+	}
+	for _, p := range []string{target, MetadataPath(target)} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("expected %s to exist: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected original payload to be moved")
+	}
+
+	if err := RemoveMessage(target); err != nil {
+		t.Fatalf("RemoveMessage: %v", err)
+	}
+	if _, err := os.Stat(MetadataPath(target)); !os.IsNotExist(err) {
+		t.Fatalf("expected metadata to be removed")
+	}
+}
+
+func TestSaveRecordsSessionMetadata(t *testing.T) {
+	tmp := t.TempDir()
+	SetBaseDir(tmp)
+	t.Cleanup(func() { SetBaseDir("./data/spool") })
+
+	received := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	path, err := Save(Metadata{
+		ID:         "meta1",
+		From:       "from@example.com",
+		To:         "rcpt@example.net",
+		ReceivedAt: received,
+		ClientIP:   "192.0.2.10",
+		Helo:       "client.example.com",
+	}, []byte("body"))
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if err := UpdateMetadata(path, func(meta *Metadata) {
+		meta.Attempts++
+		meta.LastError = "timeout"
+	}); err != nil {
+		t.Fatalf("UpdateMetadata: %v", err)
+	}
+
+	meta, err := ReadMetadata(path)
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
+	}
+	if meta.Version != MetadataVersion {
+		t.Fatalf("expected version %d, got %d", MetadataVersion, meta.Version)
+	}
+	if !meta.ReceivedAt.Equal(received) || meta.ClientIP != "192.0.2.10" || meta.Helo != "client.example.com" {
+		t.Fatalf("session metadata not preserved: %+v", meta)
+	}
+	if meta.Attempts != 1 || meta.LastError != "timeout" {
+		t.Fatalf("retry state not updated: %+v", meta)
+	}
+}
+
+func TestReadMetadataRejectsUnknownVersion(t *testing.T) {
+	tmp := t.TempDir()
+	SetBaseDir(tmp)
+	t.Cleanup(func() { SetBaseDir("./data/spool") })
+
+	path, err := SaveMessage("v2", "from@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	if err := os.WriteFile(MetadataPath(path), []byte(`{"version": 99, "id": "v2"}`), 0o600); err != nil {
+		t.Fatalf("write metadata: %v", err)
+	}
+	if _, err := ReadMetadata(path); err == nil {
+		t.Fatalf("expected error for unsupported metadata version")
+	}
+}
+
+func TestWalkRebuildsMissingMetadata(t *testing.T) {
+	tmp := t.TempDir()
+	SetBaseDir(tmp)
+	t.Cleanup(func() { SetBaseDir("./data/spool") })
+
+	// Payloads written before sidecars existed carry only the ID and a hash of
+	// the recipient in their name.
+	dir := filepath.Join(tmp, "2024-05-01")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	legacy := filepath.Join(dir, "old_1_"+hashRecipient("bob@example.net")+payloadExt)
+	data := "Return-Path: <alice@example.org>\r\nFrom: Alice <alice@example.org>\r\nTo: Carol <carol@example.net>, Bob <Bob@Example.net>\r\n\r\nhi\r\n"
+	unknown := filepath.Join(dir, "old2_"+hashRecipient("hidden@example.net")+payloadExt)
+	for path, content := range map[string]string{legacy: data, unknown: "To: carol@example.net\r\n\r\nhi\r\n"} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write payload: %v", err)
+		}
+	}
+	modified := time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(legacy, modified, modified); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	seen := map[string]SpooledMessage{}
+	errs := map[string]error{}
+	if err := Walk(func(msg SpooledMessage, err error) error {
+		seen[msg.Path], errs[msg.Path] = msg, err
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if errs[legacy] != nil {
+		t.Fatalf("expected the legacy payload to load, got %v", errs[legacy])
+	}
+	if meta := seen[legacy].Metadata; meta.ID != "old_1" || meta.To != "Bob@Example.net" || meta.From != "alice@example.org" || !meta.ReceivedAt.Equal(modified) {
+		t.Fatalf("unexpected rebuilt metadata %+v", meta)
+	}
+	if _, err := ReadMetadata(legacy); err != nil {
+		t.Fatalf("expected the rebuilt sidecar to be written: %v", err)
+	}
+	if errs[unknown] == nil {
+		t.Fatalf("expected a payload whose recipient no header names to report an error")
+	}
+}
+
+func TestRemoveOrphanMetadata(t *testing.T) {
+	tmp := t.TempDir()
+	SetBaseDir(tmp)
+	t.Cleanup(func() { SetBaseDir("./data/spool") })
+
+	kept, err := SaveMessage("kept", "from@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	orphan, err := SaveMessage("orphan", "from@example.com", "rcpt@example.net", []byte("body"))
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	if err := os.Remove(orphan); err != nil {
+		t.Fatalf("remove payload: %v", err)
+	}
+	if n, err := RemoveOrphanMetadata(); n != 1 || err != nil {
+		t.Fatalf("RemoveOrphanMetadata = %d, %v", n, err)
+	}
+	if _, err := os.Stat(MetadataPath(orphan)); !os.IsNotExist(err) {
+		t.Fatalf("expected the orphaned sidecar to be removed")
+	}
+	if _, err := ReadMetadata(kept); err != nil {
+		t.Fatalf("expected the complete entry to keep its sidecar: %v", err)
+	}
+}
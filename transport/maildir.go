@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopherpost/delivery"
+	audit "gopherpost/internal/audit"
+	"gopherpost/internal/config"
+)
+
+// StageMaildir identifies failures of local Maildir delivery.
+const StageMaildir delivery.Stage = "maildir"
+
+// Maildir delivers into local mailboxes laid out as Root/<domain>/<local-part>,
+// each a Maildir with tmp, new and cur subdirectories. A mailbox exists when its
+// directory does; mail for other addresses is rejected, so creating the directory
+// is how a user is provisioned.
+type Maildir struct {
+	Root string
+}
+
+// Deliver implements Transport.
+func (m Maildir) Deliver(domain string, txs []delivery.Transaction) []delivery.Result {
+	results := make([]delivery.Result, len(txs))
+	for i, tx := range txs {
+		results[i] = make(delivery.Result, len(tx.To))
+		for j, rcpt := range tx.To {
+			if err := m.deliverOne(tx.From, rcpt, tx.Data); err != nil {
+				audit.Log("transport maildir delivery to %s failed: %v", rcpt, err)
+				results[i][j] = err
+				continue
+			}
+			audit.Log("transport maildir delivered message from %s to %s", tx.From, rcpt)
+		}
+	}
+	return results
+}
+
+func (m Maildir) deliverOne(from, rcpt string, data []byte) error {
+	dir, err := m.Mailbox(rcpt)
+	if err != nil {
+		return permFailure(StageMaildir, "", "5.1.3", err.Error(), err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			err := fmt.Errorf("no mailbox for %s", rcpt)
+			return permFailure(StageMaildir, "", "5.1.1", err.Error(), err)
+		}
+		return tempFailure(StageMaildir, "", "mailbox unavailable", err)
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return tempFailure(StageMaildir, "", "mailbox unavailable", err)
+		}
+	}
+
+	name, err := uniqueName()
+	if err != nil {
+		return tempFailure(StageMaildir, "", "mailbox unavailable", err)
+	}
+	// Maildir files use the local LF line ending, as mail readers expect.
+	message := append([]byte(fmt.Sprintf("Return-Path: <%s>\nDelivered-To: %s\n", from, rcpt)), bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))...)
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := writeSynced(tmp, message); err != nil {
+		_ = os.Remove(tmp)
+		return tempFailure(StageMaildir, "", "mailbox unavailable", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+		_ = os.Remove(tmp)
+		return tempFailure(StageMaildir, "", "mailbox unavailable", err)
+	}
+	return nil
+}
+
+// Mailbox returns the Maildir path for rcpt. Addresses whose parts could escape
+// Root are rejected.
+func (m Maildir) Mailbox(rcpt string) (string, error) {
+	at := strings.LastIndex(rcpt, "@")
+	if at <= 0 || at == len(rcpt)-1 {
+		return "", fmt.Errorf("invalid local address %q", rcpt)
+	}
+	local, domain := strings.ToLower(rcpt[:at]), strings.ToLower(rcpt[at+1:])
+	for _, part := range []string{local, domain} {
+		if part == "." || part == ".." || strings.ContainsAny(part, "/\\\x00") {
+			return "", fmt.Errorf("invalid local address %q", rcpt)
+		}
+	}
+	return filepath.Join(m.Root, domain, local), nil
+}
+
+// Exists reports whether rcpt has a mailbox.
+func (m Maildir) Exists(rcpt string) (bool, error) {
+	dir, err := m.Mailbox(rcpt)
+	if err != nil {
+		return false, nil
+	}
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// uniqueName returns a Maildir file name: time, randomness and our hostname.
+func uniqueName() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	host := strings.NewReplacer("/", "\\057", ":", "\\072").Replace(config.Hostname())
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dR%s.%s", now.Unix(), now.Nanosecond()/1000, hex.EncodeToString(b[:]), host), nil
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	return errors.Join(err, f.Close())
+}
@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopherpost/delivery"
+)
+
+func TestMaildirDeliver(t *testing.T) {
+	t.Setenv("SMTP_HOSTNAME", "mx.test")
+	root := t.TempDir()
+	m := Maildir{Root: root}
+	if err := os.MkdirAll(filepath.Join(root, "example.com", "alice"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	results := m.Deliver("example.com", []delivery.Transaction{
+		{From: "sender@example.org", To: []string{"Alice@Example.com", "../evil@example.com", "nobody@example.com"}, Data: []byte("Subject: hi\r\nX-Mixed: yes\n\r\nbody\r\nend\n")},
+	})
+	if results[0][0] != nil {
+		t.Fatalf("delivery failed: %v", results[0][0])
+	}
+	if !delivery.IsPermanent(results[0][1]) {
+		t.Fatalf("expected an unsafe local part to be rejected permanently, got %v", results[0][1])
+	}
+	var derr *delivery.Error
+	if !errors.As(results[0][2], &derr) || derr.EnhancedCode != "5.1.1" {
+		t.Fatalf("expected 5.1.1 for a missing mailbox, got %v", results[0][2])
+	}
+	if _, err := os.Stat(filepath.Join(root, "example.com", "nobody")); !os.IsNotExist(err) {
+		t.Fatalf("expected no mailbox to be created for an unknown user, got %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(root, "example.com", "alice", "new"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one message in new/, got %v, %v", entries, err)
+	}
+	if !strings.HasSuffix(entries[0].Name(), ".mx.test") {
+		t.Fatalf("unexpected file name %s", entries[0].Name())
+	}
+	data, err := os.ReadFile(filepath.Join(root, "example.com", "alice", "new", entries[0].Name()))
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	if want := "Return-Path: <sender@example.org>\nDelivered-To: Alice@Example.com\nSubject: hi\nX-Mixed: yes\n\nbody\nend\n"; string(data) != want {
+		t.Fatalf("unexpected message %q", data)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(root, "example.com", "alice", "tmp")); len(tmp) != 0 {
+		t.Fatalf("expected tmp/ to be empty, got %v", tmp)
+	}
+}
+
+func TestMaildirUnavailableIsTemporary(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(root, nil, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	results := Maildir{Root: root}.Deliver("example.com", []delivery.Transaction{{From: "a@example.org", To: []string{"bob@example.com"}}})
+	if results[0][0] == nil || delivery.IsPermanent(results[0][0]) {
+		t.Fatalf("expected a temporary failure, got %v", results[0][0])
+	}
+}
+
+func TestMaildirExists(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "example.com", "alice"), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	m := Maildir{Root: root}
+	for rcpt, want := range map[string]bool{
+		"ALICE@example.com":    true,
+		"bob@example.com":      false,
+		"alice@example.org":    false,
+		"../alice@example.com": false,
+	} {
+		got, err := m.Exists(rcpt)
+		if err != nil || got != want {
+			t.Errorf("Exists(%q) = %v, %v; want %v", rcpt, got, err, want)
+		}
+	}
+}
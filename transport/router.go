@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"strings"
+
+	"gopherpost/delivery"
+	"gopherpost/internal/config"
+)
+
+// Rule sends the recipients matching Pattern to Transport. Patterns are
+// addresses, exact domains, "*.example.com" for any subdomain of example.com, or
+// "*" for every recipient. ARCSeal asks for mail on the rule to be ARC sealed
+// before it is queued.
+type Rule struct {
+	Pattern   string
+	Transport Transport
+	ARCSeal   bool
+}
+
+// Router is a Transport that picks another Transport for each recipient. The most
+// specific rule wins: an address over a domain, a domain over wildcards, and a
+// longer wildcard over a shorter one. Recipients no rule matches go to the
+// fallback.
+type Router struct {
+	rules    []Rule
+	fallback Transport
+}
+
+// NewRouter returns a router over rules that sends unmatched recipients to
+// fallback.
+func NewRouter(fallback Transport, rules ...Rule) *Router {
+	r := &Router{fallback: fallback}
+	for _, rule := range rules {
+		rule.Pattern = strings.ToLower(strings.TrimSuffix(rule.Pattern, "."))
+		r.rules = append(r.rules, rule)
+	}
+	return r
+}
+
+// FromConfig builds the router described by the outbound routing configuration.
+// Local domains go to their Maildirs ahead of any route for the same domain.
+// Unmatched recipients use the smarthost when one is configured and their MX
+// hosts otherwise.
+func FromConfig(routing config.Routing) *Router {
+	var fallback Transport = MX{}
+	if routing.Smarthost != nil {
+		fallback = Smarthost{Relay: routing.Smarthost}
+	}
+	var rules []Rule
+	for _, domain := range routing.LocalDomains {
+		rules = append(rules, Rule{Pattern: domain, Transport: Maildir{Root: config.MaildirRoot()}})
+	}
+	for _, route := range routing.Routes {
+		var t Transport
+		switch route.Transport {
+		case config.TransportRelay:
+			t = Smarthost{Relay: route.Relay}
+		case config.TransportLocal:
+			t = Maildir{Root: config.MaildirRoot()}
+		case config.TransportWebhook:
+			t = NewWebhook(route.Webhook.URL, route.Webhook.Secret)
+		case config.TransportDiscard:
+			t = Discard{}
+		default:
+			t = MX{}
+		}
+		rules = append(rules, Rule{Pattern: route.Pattern, Transport: t, ARCSeal: route.ARCSeal})
+	}
+	return NewRouter(fallback, rules...)
+}
+
+// Lookup returns the transport for the recipient address rcpt.
+func (r *Router) Lookup(rcpt string) Transport {
+	if i := r.match(rcpt); i >= 0 {
+		return r.rules[i].Transport
+	}
+	return r.fallback
+}
+
+// ARCSeal reports whether the rule for the recipient address rcpt asks for ARC
+// sealing. The fallback never does.
+func (r *Router) ARCSeal(rcpt string) bool {
+	i := r.match(rcpt)
+	return i >= 0 && r.rules[i].ARCSeal
+}
+
+// match returns the index of the rule for rcpt, or -1 for the fallback. Among
+// equally specific rules the first wins.
+func (r *Router) match(rcpt string) int {
+	rcpt = strings.ToLower(rcpt)
+	domain := rcpt
+	if at := strings.LastIndex(rcpt, "@"); at >= 0 {
+		domain = rcpt[at+1:]
+	}
+	best, bestScore := -1, -1
+	for i, rule := range r.rules {
+		score := -1
+		switch suffix, wildcard := strings.CutPrefix(rule.Pattern, "*."); {
+		case rule.Pattern == rcpt:
+			return i
+		case rule.Pattern == domain:
+			score = len(domain) + 1
+		case rule.Pattern == "*":
+			score = 0
+		case wildcard && strings.HasSuffix(domain, "."+suffix):
+			score = len(suffix)
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// Deliver implements Transport. Each transaction is split by transport, so
+// recipients of one message may be delivered by several transports.
+func (r *Router) Deliver(domain string, txs []delivery.Transaction) []delivery.Result {
+	type slot struct{ tx, rcpt int }
+	type part struct {
+		transport Transport
+		txs       []delivery.Transaction
+		slots     [][]slot
+	}
+
+	results := make([]delivery.Result, len(txs))
+	parts := make(map[int]*part)
+	var order []int
+	for i, tx := range txs {
+		results[i] = make(delivery.Result, len(tx.To))
+		split := make(map[int]int) // rule index -> position in part.txs
+		for j, rcpt := range tx.To {
+			key := r.match(rcpt)
+			p, ok := parts[key]
+			if !ok {
+				p = &part{transport: r.fallback}
+				if key >= 0 {
+					p.transport = r.rules[key].Transport
+				}
+				parts[key] = p
+				order = append(order, key)
+			}
+			pos, ok := split[key]
+			if !ok {
+				pos = len(p.txs)
+				split[key] = pos
+				p.txs = append(p.txs, delivery.Transaction{From: tx.From, Data: tx.Data})
+				p.slots = append(p.slots, nil)
+			}
+			p.txs[pos].To = append(p.txs[pos].To, rcpt)
+			p.slots[pos] = append(p.slots[pos], slot{tx: i, rcpt: j})
+		}
+	}
+
+	for _, key := range order {
+		p := parts[key]
+		partResults := p.transport.Deliver(domain, p.txs)
+		for pos, slots := range p.slots {
+			for k, s := range slots {
+				results[s.tx][s.rcpt] = partResults[pos][k]
+			}
+		}
+	}
+	return results
+}
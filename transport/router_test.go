@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"errors"
+	"testing"
+
+	"gopherpost/delivery"
+	"gopherpost/internal/config"
+)
+
+// recorder is a Transport that accepts everything and remembers what it saw.
+type recorder struct {
+	name string
+	seen *[]string
+}
+
+func (r recorder) Deliver(domain string, txs []delivery.Transaction) []delivery.Result {
+	results := make([]delivery.Result, len(txs))
+	for i, tx := range txs {
+		results[i] = make(delivery.Result, len(tx.To))
+		for j, rcpt := range tx.To {
+			*r.seen = append(*r.seen, r.name+":"+rcpt)
+			if rcpt == "reject@example.com" {
+				results[i][j] = errors.New("rejected")
+			}
+		}
+	}
+	return results
+}
+
+func TestRouterLookup(t *testing.T) {
+	var seen []string
+	mx, local, hook, other := recorder{"mx", &seen}, recorder{"local", &seen}, recorder{"hook", &seen}, recorder{"other", &seen}
+	router := NewRouter(mx,
+		Rule{Pattern: "*", Transport: other},
+		Rule{Pattern: "example.com", Transport: local},
+		Rule{Pattern: "*.example.com", Transport: hook},
+		Rule{Pattern: "Ops@Example.com", Transport: hook},
+	)
+	for rcpt, want := range map[string]string{
+		"user@example.com":    "local",
+		"ops@example.com":     "hook",
+		"user@eu.example.com": "hook",
+		"user@elsewhere.test": "other",
+		"user@notexample.com": "other",
+	} {
+		if got := router.Lookup(rcpt).(recorder).name; got != want {
+			t.Errorf("Lookup(%q) = %s, want %s", rcpt, got, want)
+		}
+	}
+
+	if got := NewRouter(mx).Lookup("user@example.com").(recorder).name; got != "mx" {
+		t.Fatalf("expected the fallback without rules, got %s", got)
+	}
+}
+
+func TestRouterDeliverSplitsRecipients(t *testing.T) {
+	var seen []string
+	router := NewRouter(recorder{"mx", &seen}, Rule{Pattern: "ops@example.com", Transport: recorder{"hook", &seen}})
+
+	results := router.Deliver("example.com", []delivery.Transaction{
+		{From: "a@example.org", To: []string{"one@example.com", "ops@example.com", "reject@example.com"}, Data: []byte("x")},
+		{From: "b@example.org", To: []string{"ops@example.com"}, Data: []byte("y")},
+	})
+	want := []string{"mx:one@example.com", "mx:reject@example.com", "hook:ops@example.com", "hook:ops@example.com"}
+	if len(seen) != len(want) {
+		t.Fatalf("unexpected deliveries %v", seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Fatalf("unexpected deliveries %v", seen)
+		}
+	}
+	if results[0][0] != nil || results[0][1] != nil || results[0][2] == nil || results[1][0] != nil {
+		t.Fatalf("results not mapped back to their recipients: %v", results)
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	relay := &config.Relay{Name: "esp", Host: "smtp.esp.example", Port: "587"}
+	router := FromConfig(config.Routing{
+		Smarthost:    relay,
+		LocalDomains: []string{"mail.example"},
+		Routes: []config.Route{
+			{Pattern: "mail.example", Transport: config.TransportDirect},
+			{Pattern: "partner.example", Transport: config.TransportDirect, ARCSeal: true},
+			{Pattern: "local.example", Transport: config.TransportLocal},
+			{Pattern: "hooks.example", Transport: config.TransportWebhook, Webhook: &config.Webhook{URL: "https://hooks.example/in"}},
+			{Pattern: "null.example", Transport: config.TransportDiscard},
+		},
+	})
+	checks := map[string]func(Transport) bool{
+		"a@partner.example": func(t Transport) bool { _, ok := t.(MX); return ok },
+		"a@local.example":   func(t Transport) bool { _, ok := t.(Maildir); return ok },
+		"a@mail.example":    func(t Transport) bool { _, ok := t.(Maildir); return ok },
+		"a@hooks.example":   func(t Transport) bool { w, ok := t.(*Webhook); return ok && w.URL == "https://hooks.example/in" },
+		"a@null.example":    func(t Transport) bool { _, ok := t.(Discard); return ok },
+		"a@other.example":   func(t Transport) bool { s, ok := t.(Smarthost); return ok && s.Relay == relay },
+	}
+	for rcpt, check := range checks {
+		if got := router.Lookup(rcpt); !check(got) {
+			t.Errorf("Lookup(%q) = %#v", rcpt, got)
+		}
+	}
+	if !router.ARCSeal("a@partner.example") || router.ARCSeal("a@local.example") || router.ARCSeal("a@other.example") {
+		t.Errorf("expected only the partner.example route to ARC seal")
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	results := Discard{}.Deliver("example.com", []delivery.Transaction{{From: "a@example.org", To: []string{"x@example.com", "y@example.com"}}})
+	if len(results) != 1 || len(results[0]) != 2 || results[0][0] != nil || results[0][1] != nil {
+		t.Fatalf("expected every recipient to be accepted, got %v", results)
+	}
+}
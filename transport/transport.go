@@ -0,0 +1,69 @@
+// Package transport decides how queued mail leaves the server. A Router picks a
+// Transport for each recipient: direct MX delivery, a smarthost, a local Maildir,
+// an HTTP webhook, or discard.
+package transport
+
+import (
+	"gopherpost/delivery"
+	audit "gopherpost/internal/audit"
+	"gopherpost/internal/config"
+)
+
+// Transport delivers transactions whose recipients all belong to domain. The
+// result for each transaction holds one entry per recipient, nil when it was
+// accepted. Errors should be *delivery.Error values so the queue can tell
+// permanent failures from temporary ones and record the reason.
+type Transport interface {
+	Deliver(domain string, txs []delivery.Transaction) []delivery.Result
+}
+
+// Func adapts an ordinary function to the Transport interface.
+type Func func(domain string, txs []delivery.Transaction) []delivery.Result
+
+// Deliver calls f.
+func (f Func) Deliver(domain string, txs []delivery.Transaction) []delivery.Result {
+	return f(domain, txs)
+}
+
+// MX delivers directly to the domain's MX hosts.
+type MX struct{}
+
+// Deliver implements Transport.
+func (MX) Deliver(domain string, txs []delivery.Transaction) []delivery.Result {
+	return delivery.DeliverTransactions(domain, txs)
+}
+
+// Smarthost hands everything to a relay.
+type Smarthost struct {
+	Relay *config.Relay
+}
+
+// Deliver implements Transport.
+func (s Smarthost) Deliver(domain string, txs []delivery.Transaction) []delivery.Result {
+	return delivery.DeliverRelay(s.Relay, domain, txs)
+}
+
+// Discard accepts every recipient and drops the message.
+type Discard struct{}
+
+// Deliver implements Transport.
+func (Discard) Deliver(domain string, txs []delivery.Transaction) []delivery.Result {
+	results := make([]delivery.Result, len(txs))
+	for i, tx := range txs {
+		for _, rcpt := range tx.To {
+			audit.Log("transport discard: dropped message from %s to %s", tx.From, rcpt)
+		}
+		results[i] = make(delivery.Result, len(tx.To))
+	}
+	return results
+}
+
+// tempFailure and permFailure build the *delivery.Error reported by transports
+// that do not speak SMTP, using the reply codes an MTA would have sent.
+func tempFailure(stage delivery.Stage, host, message string, err error) *delivery.Error {
+	return &delivery.Error{Stage: stage, Host: host, Code: 451, EnhancedCode: "4.3.0", Message: "4.3.0 " + message, Err: err}
+}
+
+func permFailure(stage delivery.Stage, host, enhanced, message string, err error) *delivery.Error {
+	return &delivery.Error{Stage: stage, Host: host, Code: 550, EnhancedCode: enhanced, Message: enhanced + " " + message, Err: err}
+}
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopherpost/delivery"
+	audit "gopherpost/internal/audit"
+)
+
+// StageWebhook identifies failures of webhook delivery.
+const StageWebhook delivery.Stage = "webhook"
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, prefixed with
+// "sha256=", when the webhook has a secret.
+const SignatureHeader = "X-GopherPost-Signature"
+
+// WebhookPayload is the JSON body posted for each message. Message holds the
+// raw bytes, base64 encoded, since mail need not be valid UTF-8.
+type WebhookPayload struct {
+	Domain  string   `json:"domain"`
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Message []byte   `json:"message"`
+}
+
+// Webhook posts each message to an HTTP endpoint. A 2xx response accepts it; 4xx
+// responses other than 408 and 429 reject it permanently; anything else, including
+// network errors, defers it.
+type Webhook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// NewWebhook returns a webhook transport posting to url.
+func NewWebhook(url, secret string) *Webhook {
+	return &Webhook{URL: url, Secret: secret, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Deliver implements Transport.
+func (w *Webhook) Deliver(domain string, txs []delivery.Transaction) []delivery.Result {
+	results := make([]delivery.Result, len(txs))
+	for i, tx := range txs {
+		err := w.post(domain, tx)
+		if err != nil {
+			audit.Log("transport webhook delivery to %v failed: %v", tx.To, err)
+		} else {
+			audit.Log("transport webhook delivered message from %s to %v", tx.From, tx.To)
+		}
+		results[i] = make(delivery.Result, len(tx.To))
+		for j := range results[i] {
+			results[i][j] = err
+		}
+	}
+	return results
+}
+
+func (w *Webhook) post(domain string, tx delivery.Transaction) error {
+	host := w.URL
+	if u, err := url.Parse(w.URL); err == nil {
+		host = u.Host
+	}
+	body, err := json.Marshal(WebhookPayload{Domain: domain, From: tx.From, To: tx.To, Message: tx.Data})
+	if err != nil {
+		return permFailure(StageWebhook, host, "5.6.0", "message cannot be encoded", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return tempFailure(StageWebhook, host, "webhook unavailable", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return tempFailure(StageWebhook, host, "webhook unavailable", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	status := fmt.Errorf("webhook returned %s", resp.Status)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return permFailure(StageWebhook, host, "5.0.0", status.Error(), status)
+	default:
+		return tempFailure(StageWebhook, host, status.Error(), status)
+	}
+}
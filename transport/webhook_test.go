@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopherpost/delivery"
+)
+
+func TestWebhookDeliver(t *testing.T) {
+	var got WebhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if r.Header.Get(SignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	// A Latin-1 body is not valid UTF-8 and must arrive byte for byte.
+	data := []byte("Subject: hi\r\nContent-Type: text/plain; charset=iso-8859-1\r\n\r\nGr\xfc\xdfe \xff\r\n")
+	results := NewWebhook(srv.URL, "s3cret").Deliver("example.com", []delivery.Transaction{
+		{From: "a@example.org", To: []string{"x@example.com", "y@example.com"}, Data: data},
+	})
+	if results[0][0] != nil || results[0][1] != nil {
+		t.Fatalf("delivery failed: %v", results[0])
+	}
+	if got.Domain != "example.com" || got.From != "a@example.org" || len(got.To) != 2 || !bytes.Equal(got.Message, data) {
+		t.Fatalf("unexpected payload %+v", got)
+	}
+}
+
+func TestWebhookStatusClassification(t *testing.T) {
+	for status, permanent := range map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusNotFound:            true,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+		http.StatusServiceUnavailable:  false,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		results := NewWebhook(srv.URL, "").Deliver("example.com", []delivery.Transaction{{From: "a@example.org", To: []string{"x@example.com"}}})
+		srv.Close()
+		err := results[0][0]
+		if err == nil || delivery.IsPermanent(err) != permanent {
+			t.Errorf("status %d: expected permanent=%v, got %v", status, permanent, err)
+		}
+	}
+
+	results := NewWebhook("http://127.0.0.1:1/unreachable", "").Deliver("example.com", []delivery.Transaction{{From: "a@example.org", To: []string{"x@example.com"}}})
+	if results[0][0] == nil || delivery.IsPermanent(results[0][0]) {
+		t.Fatalf("expected a network error to be temporary, got %v", results[0][0])
+	}
+}